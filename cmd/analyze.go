@@ -0,0 +1,206 @@
+/*
+Copyright © 2024 Thearas thearas850@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/Thearas/dodo/src"
+)
+
+var AnalyzeConfig = Analyze{}
+
+type Analyze struct {
+	Files      []string
+	Format     string
+	Top        int
+	Interval   time.Duration
+	OutputFile string
+}
+
+// analyzeCmd represents the analyze command
+var analyzeCmd = &cobra.Command{
+	Use:   "analyze",
+	Short: "Profile the workload of dumped sqls without a cluster",
+	Long: `Profile the workload of dumped sqls without a cluster.
+
+Report the top referenced tables, join conditions, the most common predicates per column,
+function usage, statement types per user and QPS over time.`,
+	Example: `dodo analyze -f output/sql/*.sql
+dodo analyze -f output/sql --format markdown --output-file workload.md`,
+	SilenceUsage: true,
+	PersistentPreRunE: func(cmd *cobra.Command, _ []string) error {
+		return initConfig(cmd)
+	},
+	RunE: func(_ *cobra.Command, args []string) error {
+		if err := completeAnalyzeConfig(args); err != nil {
+			return err
+		}
+		return analyze()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(analyzeCmd)
+	analyzeCmd.PersistentFlags().SortFlags = false
+	analyzeCmd.Flags().SortFlags = false
+
+	flags := analyzeCmd.Flags()
+	flags.StringSliceVarP(&AnalyzeConfig.Files, "file", "f", nil, "The dump sql files or dirs, support glob")
+	flags.StringVar(&AnalyzeConfig.Format, "format", "table", "Analysis format, one of: "+strings.Join(reportFormats, ", "))
+	flags.IntVar(&AnalyzeConfig.Top, "top", 20, "Only show the top N tables, joins, predicates and functions, 0 means all")
+	flags.DurationVar(&AnalyzeConfig.Interval, "interval", time.Minute, "The time interval of QPS over time, at least 1s")
+	flags.StringVar(&AnalyzeConfig.OutputFile, "output-file", "", "Write analysis to the file instead of stdout")
+}
+
+func completeAnalyzeConfig(args []string) error {
+	// also accept the files as args, so that 'dodo analyze -f output/sql/*.sql' works after shell expansion
+	AnalyzeConfig.Files = append(AnalyzeConfig.Files, args...)
+	if len(AnalyzeConfig.Files) == 0 {
+		return errors.New("analyze requires -f flag")
+	}
+	if !slices.Contains(reportFormats, AnalyzeConfig.Format) {
+		return fmt.Errorf("invalid analysis format: %s", AnalyzeConfig.Format)
+	}
+	if AnalyzeConfig.Interval < time.Second {
+		return fmt.Errorf("invalid --interval %s, should be at least 1s", AnalyzeConfig.Interval)
+	}
+	return nil
+}
+
+func analyze() error {
+	files, err := expandDumpFiles(AnalyzeConfig.Files)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return errors.New("no dump file found")
+	}
+
+	a := src.NewWorkloadAnalyzer(AnalyzeConfig.Interval)
+	for _, path := range files {
+		if err := scanFile(path, a.Collect); err != nil {
+			return err
+		}
+	}
+	r := a.Result(AnalyzeConfig.Top)
+	logrus.Infof("Analyzed %d query(s) of %d fingerprint(s) in %d file(s)", r.Queries, r.Fingerprints, len(files))
+	if r.ParseErrors > 0 {
+		logrus.Warnf("%d fingerprint(s) can not be parsed, only their statement types are counted", r.ParseErrors)
+	}
+
+	w := io.Writer(os.Stdout)
+	if AnalyzeConfig.OutputFile != "" {
+		f, err := os.Create(AnalyzeConfig.OutputFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	switch AnalyzeConfig.Format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	case "markdown":
+		return writeAnalysis(w, r, writeAnalysisMarkdown)
+	default:
+		return writeAnalysis(w, r, writeAnalysisTable)
+	}
+}
+
+// writeAnalysis writes each section of the analysis by the table writer.
+func writeAnalysis(w io.Writer, r *src.WorkloadAnalysis, writeTable func(w io.Writer, title string, header []string, rows [][]string) error) error {
+	counts := func(cs []src.WorkloadCount) [][]string {
+		return lo.Map(cs, func(c src.WorkloadCount, _ int) []string { return []string{c.Name, fmt.Sprint(c.Count)} })
+	}
+
+	predicates := lo.Map(r.Predicates, func(p src.WorkloadPredicates, _ int) []string {
+		ops := lo.Map(p.Operators, func(c src.WorkloadCount, _ int) string { return fmt.Sprintf("%s(%d)", c.Name, c.Count) })
+		return []string{p.Column, fmt.Sprint(p.Count), strings.Join(ops, ", ")}
+	})
+	stmtTypes := lo.Map(r.StmtTypes, func(s src.WorkloadStmtType, _ int) []string {
+		return []string{s.User, s.Type, fmt.Sprint(s.Count)}
+	})
+	qps := lo.Map(r.QPS, func(q src.WorkloadQPS, _ int) []string {
+		return []string{q.Time, fmt.Sprint(q.Count), fmt.Sprintf("%.2f", q.QPS)}
+	})
+
+	sections := []struct {
+		title  string
+		header []string
+		rows   [][]string
+	}{
+		{"Summary", []string{"QUERIES", "FINGERPRINTS", "PARSE ERRORS"}, [][]string{{fmt.Sprint(r.Queries), fmt.Sprint(r.Fingerprints), fmt.Sprint(r.ParseErrors)}}},
+		{"Top Tables", []string{"TABLE", "COUNT"}, counts(r.Tables)},
+		{"Top Joins", []string{"JOIN", "COUNT"}, counts(r.Joins)},
+		{"Top Predicates", []string{"COLUMN", "COUNT", "OPERATORS"}, predicates},
+		{"Top Functions", []string{"FUNCTION", "COUNT"}, counts(r.Functions)},
+		{"Statement Types", []string{"USER", "TYPE", "COUNT"}, stmtTypes},
+		{"QPS", []string{"TIME", "COUNT", "QPS"}, qps},
+	}
+	for i, s := range sections {
+		if i > 0 {
+			if _, err := fmt.Fprintln(w); err != nil {
+				return err
+			}
+		}
+		if err := writeTable(w, s.title, s.header, s.rows); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeAnalysisTable(w io.Writer, title string, header []string, rows [][]string) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "# "+title)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+func writeAnalysisMarkdown(w io.Writer, title string, header []string, rows [][]string) error {
+	lines := []string{
+		"## " + title,
+		"",
+		"| " + strings.Join(header, " | ") + " |",
+		"|" + strings.Repeat(" --- |", len(header)),
+	}
+	for _, row := range rows {
+		row = lo.Map(row, func(s string, _ int) string { return strings.ReplaceAll(s, "|", `\|`) })
+		lines = append(lines, "| "+strings.Join(row, " | ")+" |")
+	}
+
+	_, err := fmt.Fprintln(w, strings.Join(lines, "\n"))
+	return err
+}
@@ -111,6 +111,8 @@ func AnonymizeStats(s []*src.TableStats) []*src.TableStats {
 		t.Name = src.Anonymize(AnonymizeConfig.Method, t.Name)
 		for _, c := range t.Columns {
 			c.Name = src.Anonymize(AnonymizeConfig.Method, c.Name)
+			// the histogram bounds and top-n are column values, which can not be anonymized
+			c.Histogram, c.TopN = nil, nil
 		}
 	}
 
@@ -16,6 +16,7 @@ limitations under the License.
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -23,6 +24,7 @@ import (
 	"strings"
 
 	"github.com/emirpasic/gods/queues/circularbuffer"
+	"github.com/jmoiron/sqlx"
 	"github.com/samber/lo"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -31,9 +33,13 @@ import (
 )
 
 var (
-	createTableDDLs = []string{}
-	createOtherDDLs = []string{} // like views and other unknown ddls
-	createConnDB    string
+	createTableDDLs  = []string{}
+	createOtherDDLs  = []string{}                    // like views and other unknown ddls
+	createObjectDDLs = map[src.SchemaType][]string{} // schemas other than tables and views, like functions and rollups
+	createConnDB     string
+
+	// createBeforeTables are the types of schemas created before tables in order, tables and views may depend on them.
+	createBeforeTables = []src.SchemaType{src.SchemaTypeResource, src.SchemaTypeWorkloadGroup, src.SchemaTypeCatalog, src.SchemaTypeFunction}
 )
 
 // createCmd represents the create command
@@ -42,6 +48,9 @@ var createCmd = &cobra.Command{
 	Short: "Create tables and views",
 	Long: `Create tables and views.
 
+Other dumped schemas are created in dependency order:
+resources, workload groups, catalogs and functions -> tables -> rollups -> views -> row policies.
+
 Example:
   dodo create --dbs db1,db2
   dodo create --dbs db1 --tables table1,table2
@@ -59,52 +68,46 @@ Example:
 		}
 		GlobalConfig.Parallel = min(GlobalConfig.Parallel, len(createTableDDLs))
 
-		logrus.Infof("Create %d table(s) and %d view(s), parallel: %d", len(createTableDDLs), len(createOtherDDLs), GlobalConfig.Parallel)
+		logrus.Infof("Create %d table(s), %d view(s) and %d other schema(s), parallel: %d",
+			len(createTableDDLs), len(createOtherDDLs), lo.Sum(lo.Map(lo.Values(createObjectDDLs), func(ddls []string, _ int) int { return len(ddls) })), GlobalConfig.Parallel)
 
 		db, err := connectDBWithoutDBName()
 		if err != nil {
 			return err
 		}
+		// 1. Set resource tags, before counting the backends for replicas.
+		if err := src.CreateResourceTags(ctx, db, createObjectDDLs[src.SchemaTypeResourceTag], GlobalConfig.DryRun); err != nil {
+			return err
+		}
 		beCount, err := src.ShowBackendCount(ctx, db)
 		if err != nil {
 			return err
 		}
 
-		// 1. Create tables first.
-		g := src.ParallelGroup(GlobalConfig.Parallel)
-		for _, t := range createTableDDLs {
-			g.Go(func() error {
-				dbname, _, _ := dbtableFromFileName(t)
-				if createConnDB != "" {
-					dbname = createConnDB
-				}
-				logrus.Debugf("create ddl file %s in db '%s'", t, dbname)
-				if _, err := src.RunCreateSQL(ctx, db, dbname, t, beCount, GlobalConfig.DryRun); err != nil {
-					return err
-				}
-				return nil
-			})
+		// 2. Create schemas depended by tables and views, one type by one.
+		for _, t := range createBeforeTables {
+			if err := createSchemas(ctx, db, createObjectDDLs[t], beCount); err != nil {
+				return err
+			}
 		}
-		if err := g.Wait(); err != nil {
+
+		// 3. Create tables, then their rollups.
+		if err := createSchemas(ctx, db, createTableDDLs, beCount); err != nil {
 			return err
 		}
-
-		// 2. Create views in queue.
-		if len(createOtherDDLs) == 0 {
-			return nil
+		if err := createSchemas(ctx, db, createObjectDDLs[src.SchemaTypeRollup], beCount); err != nil {
+			return err
 		}
-		queue := circularbuffer.New(len(createOtherDDLs))
+
+		// 4. Create views in queue.
+		queue := circularbuffer.New(max(len(createOtherDDLs), 1))
 		lo.ForEach(createOtherDDLs, func(v string, _ int) { queue.Enqueue(lo.Tuple2[string, int]{A: v, B: 1}) })
 		for i := 0; !queue.Empty(); i++ {
 			v_, _ := queue.Dequeue()
 			v, count := v_.(lo.Tuple2[string, int]).Unpack()
 
 			logrus.Debugln("create ddl file", v, ", round:", count)
-			dbname, _, _ := dbtableFromFileName(v)
-			if createConnDB != "" {
-				dbname = createConnDB
-			}
-			needDeps, err := src.RunCreateSQL(ctx, db, dbname, v, beCount, GlobalConfig.DryRun)
+			needDeps, err := src.RunCreateSQL(ctx, db, createDBOfFile(v), v, beCount, GlobalConfig.DryRun)
 			if err != nil {
 				return err
 			}
@@ -119,7 +122,8 @@ Example:
 			}
 		}
 
-		return nil
+		// 5. Create row policies on tables.
+		return createSchemas(ctx, db, createObjectDDLs[src.SchemaTypeRowPolicy], beCount)
 	},
 }
 
@@ -149,17 +153,8 @@ func completeCreateConfig() (err error) {
 		if err != nil {
 			return err
 		}
-		var tableDDLs []string
-		for _, ddl := range createDDLs_ {
-			db, _, isTable := dbtableFromFileName(ddl)
-			isDumpTable := db != ""
-			if isDumpTable && isTable {
-				tableDDLs = append(tableDDLs, ddl)
-			} else {
-				createOtherDDLs = append(createOtherDDLs, ddl)
-			}
-		}
-		createTableDDLs = tableDDLs
+		createTableDDLs = nil
+		addCreateDDLs(createDDLs_...)
 		return nil
 	}
 
@@ -169,54 +164,126 @@ func completeCreateConfig() (err error) {
 
 	// auto find ddl
 	createTableDDLs = []string{}
+	globalMatches := lo.Map(src.GlobalSchemaTypes, func(t src.SchemaType, _ int) string {
+		return filepath.Join(ddldir, fmt.Sprintf("*.%s.sql", t.Lower()))
+	})
+	fmatches := []string{}
 	if len(GlobalConfig.Tables) == 0 {
 		for _, db := range GlobalConfig.DBs {
-			fmatch := filepath.Join(ddldir, fmt.Sprintf("%s.*.table.sql", db))
-			tableddls, err := src.FileGlob([]string{fmatch})
-			if err != nil {
-				logrus.Errorf("Get db '%s' ddls in '%s' failed", db, fmatch)
-				return err
-			}
-			createTableDDLs = append(createTableDDLs, tableddls...)
-
-			fmatch = filepath.Join(ddldir, fmt.Sprintf("%s.*view.sql", db))
-			viewddls, err := src.FileGlob([]string{fmatch})
-			if err != nil {
-				logrus.Errorf("Get db '%s' ddls in '%s' failed", db, fmatch)
-				return err
-			}
-			createOtherDDLs = append(createOtherDDLs, viewddls...)
+			fmatches = append(fmatches, filepath.Join(ddldir, fmt.Sprintf("%s.*.sql", db)))
 		}
 	} else {
 		for _, table := range GlobalConfig.Tables {
 			tableddl := filepath.Join(ddldir, fmt.Sprintf("%s.table.sql", table))
 			if _, err := os.Stat(tableddl); err != nil {
 				// maybe a view
-				fmatch := filepath.Join(ddldir, fmt.Sprintf("%s.*view.sql", table))
-				if viewddls, err := src.FileGlob([]string{fmatch}); err == nil && len(viewddls) > 0 {
-					createOtherDDLs = append(createOtherDDLs, viewddls...)
-				}
+				fmatches = append(fmatches, filepath.Join(ddldir, fmt.Sprintf("%s.*view.sql", table)))
 				continue
 			}
-			createTableDDLs = append(createTableDDLs, tableddl)
+			fmatches = append(fmatches, tableddl, filepath.Join(ddldir, fmt.Sprintf("%s.rollup.sql", table)))
+		}
+	}
+	var ddls []string
+	for i, fmatch := range append(globalMatches, fmatches...) {
+		ddls_, err := src.FileGlob([]string{fmatch})
+		if err != nil {
+			logrus.Errorf("Get ddls in '%s' failed", fmatch)
+			return err
 		}
+		isGlobalMatch := i < len(globalMatches)
+		// only the dumped ddls, the global function glob also matches the ones in other dbs, like '{db}.{name}.function.sql'
+		ddls = append(ddls, lo.Filter(ddls_, func(ddl string, _ int) bool {
+			t, global := ddlFileSchemaType(ddl)
+			return t != "" && (global || !isGlobalMatch)
+		})...)
 	}
+	addCreateDDLs(lo.Uniq(ddls)...)
 
 	slices.Sort(createTableDDLs)
 	slices.Sort(createOtherDDLs)
+	for _, ddls := range createObjectDDLs {
+		slices.Sort(ddls)
+	}
 
 	return nil
 }
 
-func dbtableFromFileName(file string) (string, string, bool) {
-	// table ddl file has 4 parts: {db}.{table}.{table|view|materialized_view|...}.sql
-	dumpsuffixs := lo.Map(src.AllSchemaTypes, func(t src.SchemaType, _ int) string { return t.Lower() })
+// addCreateDDLs classifies the ddl files by the schema type in file name, unknown ones are created along with views.
+func addCreateDDLs(ddls ...string) {
+	for _, ddl := range ddls {
+		switch t, _ := ddlFileSchemaType(ddl); t {
+		case src.SchemaTypeTable:
+			createTableDDLs = append(createTableDDLs, ddl)
+		case "", src.SchemaTypeView, src.SchemaTypeMaterializedView:
+			createOtherDDLs = append(createOtherDDLs, ddl)
+		default:
+			createObjectDDLs[t] = append(createObjectDDLs[t], ddl)
+		}
+	}
+}
+
+// createSchemas runs the ddl files in parallel, the ones depending on each other should be created in different calls.
+func createSchemas(ctx context.Context, db *sqlx.DB, ddls []string, beCount int) error {
+	g := src.ParallelGroup(GlobalConfig.Parallel)
+	for _, ddl := range ddls {
+		g.Go(func() error {
+			dbname := createDBOfFile(ddl)
+			logrus.Debugf("create ddl file %s in db '%s'", ddl, dbname)
+			needDeps, err := src.RunCreateSQL(ctx, db, dbname, ddl, beCount, GlobalConfig.DryRun)
+			if err != nil {
+				return err
+			}
+			if needDeps != "" {
+				return fmt.Errorf("ddl need depends, message: %s", needDeps)
+			}
+			return nil
+		})
+	}
+	return g.Wait()
+}
 
+// createDBOfFile returns the database to create the schema of ddl file in, empty for the schemas not in any database.
+func createDBOfFile(ddl string) string {
+	if t, global := ddlFileSchemaType(ddl); global {
+		return ""
+	} else if createConnDB != "" || t == "" {
+		return createConnDB
+	}
+	dbname, _, _ := dbtableFromFileName(ddl)
+	return dbname
+}
+
+// ddlFileSchemaType returns the schema type of dumped ddl file, empty if it is not dumped by dodo.
+// The global is true if the schema is not in any database.
+func ddlFileSchemaType(file string) (t src.SchemaType, global bool) {
 	parts := strings.Split(filepath.Base(file), ".")
-	isDumpTable := len(parts) == 4 && (lo.ContainsBy(dumpsuffixs, func(s string) bool { return parts[2] == s && parts[3] == "sql" }))
-	if !isDumpTable {
+	if len(parts) < 3 || parts[len(parts)-1] != "sql" {
+		return "", false
+	}
+	suffix := parts[len(parts)-2]
+
+	// dumped as {db}.{name}.{type}.sql
+	if len(parts) == 4 {
+		if t, ok := lo.Find(src.AllSchemaTypes, func(t src.SchemaType) bool { return t.Lower() == suffix }); ok {
+			return t, false
+		}
+	}
+	// dumped as {name}.{type}.sql
+	if len(parts) == 3 {
+		if t, ok := lo.Find(src.GlobalSchemaTypes, func(t src.SchemaType) bool { return t.Lower() == suffix }); ok {
+			return t, true
+		}
+	}
+	return "", false
+}
+
+func dbtableFromFileName(file string) (string, string, bool) {
+	// table ddl file has 4 parts: {db}.{table}.{table|view|materialized_view|...}.sql
+	t, global := ddlFileSchemaType(file)
+	if t == "" || global {
 		return "", "", false
 	}
 
-	return parts[0], parts[1], parts[2] == "table"
+	parts := strings.Split(filepath.Base(file), ".")
+	return parts[0], parts[1], t == src.SchemaTypeTable
 }
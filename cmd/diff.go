@@ -38,6 +38,13 @@ var (
 	noColor          bool
 	minDurationDiff  time.Duration
 	originalDumpSQLs []string
+	floatTolerance   float64
+	ignoreOrder      bool
+)
+
+const (
+	maxPrintDiffRows      = 10
+	maxPrintPlanChangeIds = 5
 )
 
 // diffCmd represents the diff command
@@ -77,6 +84,8 @@ func init() {
 	flags.BoolVar(&noColor, "no-color", false, "Disable color output")
 	flags.DurationVar(&minDurationDiff, "min-duration-diff", 100*time.Millisecond, "Print diff if duration difference is greater than this value")
 	flags.StringSliceVar(&originalDumpSQLs, "original-sqls", nil, "Diff with original dump sql instead of another replay result")
+	flags.Float64Var(&floatTolerance, "float-tolerance", 1e-6, "Relative tolerance when comparing float/decimal values of saved rows")
+	flags.BoolVar(&ignoreOrder, "ignore-order", false, "Ignore the order of saved rows even if the query has 'ORDER BY'")
 }
 
 func guessClientCount(replay string) (int, error) {
@@ -108,10 +117,19 @@ func diffDumpSQL(replay string) error {
 		return err
 	}
 
-	client2sqls, err := readOriginalDumpSQLs(clientCount)
+	// split the original sqls per client on disk, only sqls of one client are loaded in memory at a time
+	paths, err := expandDumpFiles(originalDumpSQLs)
 	if err != nil {
 		return err
 	}
+	splitDir, clientSqls, _, _, err := splitReplaySqls(paths, nil, nil, 0, 0, clientCount)
+	if splitDir != "" {
+		defer os.RemoveAll(splitDir)
+	}
+	if err != nil {
+		return err
+	}
+	client2sqls := lo.SliceToMap(clientSqls, func(cs src.ClientSqls) (string, src.ClientSqls) { return cs.Client, cs })
 
 	return filepath.WalkDir(replay, func(path2 string, d os.DirEntry, err error) error {
 		if err != nil {
@@ -122,11 +140,17 @@ func diffDumpSQL(replay string) error {
 		}
 
 		client := strings.TrimSuffix(filepath.Base(path2), src.ReplayResultFileExt)
-		clientsqls, ok := client2sqls[client]
+		cs, ok := client2sqls[client]
 		if !ok {
 			logrus.Errorf("client %s not found in original dump sql, skipping", client)
 			return nil
 		}
+		r, err := cs.Open()
+		if err != nil {
+			return err
+		}
+		clientsqls := r.ReadAll()
+		r.Close()
 
 		f2, err := os.Open(path2)
 		if err != nil {
@@ -134,50 +158,35 @@ func diffDumpSQL(replay string) error {
 		}
 		defer f2.Close()
 		scan2 := bufio.NewScanner(f2)
+		scan2.Buffer(make([]byte, 0, 1024*1024), 10*1024*1024)
 
 		logrus.Debugf("diffing %s:", path2)
 
 		id2sqls := lo.SliceToMap(clientsqls, func(s *src.ReplaySql) (string, *src.ReplaySql) { return s.QueryId, s })
-		if err := diff(&diffReader{id2sqls: id2sqls}, &diffReader{scan: scan2}); err != nil {
+		if err := diff(&diffReader{id2sqls: id2sqls}, &diffReader{scan: scan2, dir: filepath.Dir(path2)}); err != nil {
 			logrus.Errorf("diff %s failed, err: %v", path2, err)
 		}
 		return nil
 	})
 }
 
-func readOriginalDumpSQLs(clientCount int) (map[string][]*src.ReplaySql, error) {
-	sqls, err := src.FileGlob(originalDumpSQLs)
+// readOriginalDumpSQLs splits the original sqls per client on disk to be read lazily, call cleanup to remove the split files.
+func readOriginalDumpSQLs(paths []string, clientCount int) (originals *src.OriginalSqls, cleanup func(), err error) {
+	paths, err = expandDumpFiles(paths)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-
-	client2sqls := make(map[string][]*src.ReplaySql, 10240)
-	for _, originalDumpSQL := range sqls {
-		f, err := os.Open(originalDumpSQL)
-		if err != nil {
-			return nil, err
-		}
-		//nolint:revive
-		defer f.Close()
-
-		client2sqls_, _, _, err := src.DecodeReplaySqls(
-			bufio.NewScanner(f),
-			make(map[string]struct{}),
-			make(map[string]struct{}),
-			0, 0,
-			clientCount,
-		)
-		if err != nil {
-			return nil, err
-		}
-
-		for client, sqls := range client2sqls_ {
-			client2sqls[client] = append(client2sqls[client], sqls...)
+	splitDir, clientSqls, _, _, err := splitReplaySqls(paths, nil, nil, 0, 0, clientCount)
+	cleanup = func() {
+		if splitDir != "" {
+			_ = os.RemoveAll(splitDir)
 		}
 	}
-
-	return client2sqls, nil
-
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return src.NewOriginalSqls(clientSqls), cleanup, nil
 }
 
 func diffTwoReplays(replay1, replay2 string) error {
@@ -210,16 +219,31 @@ func diffTwoReplays(replay1, replay2 string) error {
 		}
 		defer f1.Close()
 		scan1 := bufio.NewScanner(f1)
+		scan1.Buffer(make([]byte, 0, 1024*1024), 10*1024*1024)
 		f2, err := os.Open(path2)
 		if err != nil {
 			return err
 		}
 		defer f2.Close()
 		scan2 := bufio.NewScanner(f2)
+		scan2.Buffer(make([]byte, 0, 1024*1024), 10*1024*1024)
 
 		logrus.Debugf("diffing %s and %s", path1, path2)
 
-		if err := diff(&diffReader{scan: scan1}, &diffReader{scan: scan2}); err != nil {
+		// saved rows of replay, if any
+		rows1, err := src.ReadReplayRows(replayRowsPath(path1))
+		if err != nil {
+			return err
+		}
+		rows2, err := src.ReadReplayRows(replayRowsPath(path2))
+		if err != nil {
+			return err
+		}
+
+		if err := diff(
+			&diffReader{scan: scan1, id2rows: rows1, dir: filepath.Dir(path1)},
+			&diffReader{scan: scan2, id2rows: rows2, dir: filepath.Dir(path2)},
+		); err != nil {
 			logrus.Errorf("diff %s and %s failed, err: %v", path1, path2, err)
 		}
 		return nil
@@ -227,11 +251,18 @@ func diffTwoReplays(replay1, replay2 string) error {
 }
 
 func diff(scan1, scan2 *diffReader) error {
-	id2diff := make(map[string]string)
-	for r2 := scan2.get(""); r2 != nil; r2 = scan1.get("") {
+	var (
+		id2diff     = make(map[string]string)
+		planChanges = []*planChange{}
+	)
+	for r2 := scan2.get(""); r2 != nil; r2 = scan2.get("") {
 		d := diff2{
-			r1: scan1.get(r2.QueryId),
-			r2: r2,
+			r1:    scan1.get(r2.QueryId),
+			r2:    r2,
+			rows1: scan1.id2rows[r2.QueryId],
+			rows2: scan2.id2rows[r2.QueryId],
+			dir1:  scan1.dir,
+			dir2:  scan2.dir,
 		}
 		if d.r1 == nil {
 			id2diff[d.r2.QueryId] = "query id not found in original dump sql or replay1"
@@ -241,9 +272,16 @@ func diff(scan1, scan2 *diffReader) error {
 			id2diff[d.r2.QueryId] = fmt.Sprintf("query id not match, %s != %s", d.r1.QueryId, d.r2.QueryId)
 			continue
 		}
+		if d.r1.Skipped != "" || d.r2.Skipped != "" {
+			// not executed, nothing to compare
+			continue
+		}
 		if diffmsg := d.result(); diffmsg != "" {
 			id2diff[d.r2.QueryId] = diffmsg
 		}
+		if d.r1.PlanDigest != "" && d.r2.PlanDigest != "" && d.r1.PlanDigest != d.r2.PlanDigest {
+			planChanges = addPlanChange(planChanges, d.r1.PlanDigest, d.r2.PlanDigest, d.r2.QueryId)
+		}
 	}
 
 	// print diff result
@@ -257,15 +295,69 @@ func diff(scan1, scan2 *diffReader) error {
 		fmt.Println()
 		fmt.Println()
 	}
+	printPlanChanges(planChanges, scan1.plans, scan2.plans)
 	fmt.Println()
 	fmt.Println()
 
 	return nil
 }
 
+// planChange is the queries whose plan changed from digest1 to digest2.
+type planChange struct {
+	digest1, digest2 string
+	queryIds         []string
+}
+
+func addPlanChange(changes []*planChange, digest1, digest2, queryId string) []*planChange {
+	for _, c := range changes {
+		if c.digest1 == digest1 && c.digest2 == digest2 {
+			c.queryIds = append(c.queryIds, queryId)
+			return changes
+		}
+	}
+	return append(changes, &planChange{digest1: digest1, digest2: digest2, queryIds: []string{queryId}})
+}
+
+func printPlanChanges(changes []*planChange, plans1, plans2 map[string]string) {
+	for _, c := range changes {
+		ids := lo.Map(lo.Slice(c.queryIds, 0, maxPrintPlanChangeIds), func(id string, _ int) string { return color.CyanString(id) })
+		if len(c.queryIds) > maxPrintPlanChangeIds {
+			ids = append(ids, fmt.Sprintf("... and %d more", len(c.queryIds)-maxPrintPlanChangeIds))
+		}
+		fmt.Printf("Plan changed in %d queries, QueryId: %s\n", len(c.queryIds), strings.Join(ids, ", "))
+
+		plan1, ok1 := plans1[c.digest1]
+		plan2, ok2 := plans2[c.digest2]
+		if !ok1 || !ok2 {
+			fmt.Printf("plan digest: %s vs %s (plan text not found)\n\n", color.GreenString(c.digest1), color.RedString(c.digest2))
+			continue
+		}
+		for _, line := range strings.Split(src.DiffPlans(plan1, plan2, "replay1", "replay2"), "\n") {
+			switch {
+			case strings.HasPrefix(line, "-"):
+				line = color.GreenString(line)
+			case strings.HasPrefix(line, "+"):
+				line = color.RedString(line)
+			}
+			fmt.Println(line)
+		}
+	}
+}
+
 type diffReader struct {
 	scan    *bufio.Scanner // or
 	id2sqls map[string]*src.ReplaySql
+
+	id2rows map[string]*src.ReplayRows
+
+	// plans is the plan text of each digest read so far
+	plans map[string]string
+	// dir is the replay result dir, profiles are relative to it
+	dir string
+}
+
+func replayRowsPath(resultPath string) string {
+	return strings.TrimSuffix(resultPath, src.ReplayResultFileExt) + src.ReplayRowsFileExt
 }
 
 func (r *diffReader) get(queryId string) *src.ReplayResult {
@@ -282,6 +374,12 @@ func (r *diffReader) get(queryId string) *src.ReplayResult {
 			logrus.Errorf("unmarshal %s failed, err: %v", r.scan.Text(), err)
 			return nil
 		}
+		if result.Plan != "" {
+			if r.plans == nil {
+				r.plans = map[string]string{}
+			}
+			r.plans[result.PlanDigest] = result.Plan
+		}
 		return result
 	}
 
@@ -297,7 +395,9 @@ func (r *diffReader) get(queryId string) *src.ReplayResult {
 }
 
 type diff2 struct {
-	r1, r2 *src.ReplayResult
+	r1, r2       *src.ReplayResult
+	rows1, rows2 *src.ReplayRows
+	dir1, dir2   string
 }
 
 func (d *diff2) result() string {
@@ -326,7 +426,13 @@ func (d *diff2) result() string {
 				color.GreenString(strconv.Itoa(d.r1.ReturnRows)),
 				color.RedString(strconv.Itoa(d.r2.ReturnRows))))
 		}
-		if d.r1.ReturnRowsHash != d.r2.ReturnRowsHash {
+		if d.rows1 != nil && d.rows2 != nil && !d.rows1.Partial() && !d.rows2.Partial() {
+			// compare the saved rows, they may be equal even if hash not match (e.g. float precision, rows order),
+			// unless they are arbitrary subsets of unordered rows
+			if rd := src.DiffReplayRows(d.rows1, d.rows2, floatTolerance, ignoreOrder); !rd.Empty() {
+				result = append(result, formatRowsDiff(rd))
+			}
+		} else if d.r1.ReturnRowsHash != d.r2.ReturnRowsHash {
 			result = append(result, color.RedString("rows hash not match (count: %d)", d.r1.ReturnRows))
 		}
 	}
@@ -335,6 +441,71 @@ func (d *diff2) result() string {
 		result = append(result, fmt.Sprintf("duration too long: %s vs %s",
 			color.GreenString("%dms", d.r1.DurationMs),
 			color.RedString("%dms", d.r2.DurationMs)))
+		if d.r1.Profile != "" || d.r2.Profile != "" {
+			result = append(result, fmt.Sprintf("profiles: %s vs %s", d.profile(d.dir1, d.r1), d.profile(d.dir2, d.r2)))
+		}
 	}
 	return strings.Join(result, "\n")
 }
+
+func (*diff2) profile(dir string, r *src.ReplayResult) string {
+	if r.Profile == "" {
+		return "<none>"
+	}
+	return filepath.Join(dir, r.Profile)
+}
+
+func formatRowsDiff(rd *src.RowsDiff) string {
+	column := func(i int) string {
+		if i < len(rd.Columns) {
+			return rd.Columns[i]
+		}
+		return fmt.Sprintf("#%d", i+1)
+	}
+	value := func(row []*string, i int) string {
+		if i >= len(row) {
+			return "<none>"
+		}
+		if row[i] == nil {
+			return "NULL"
+		}
+		return *row[i]
+	}
+	formatRow := func(row []*string) string {
+		values := make([]string, len(row))
+		for i := range row {
+			values[i] = value(row, i)
+		}
+		return "(" + strings.Join(values, ", ") + ")"
+	}
+
+	lines := []string{"rows not match:"}
+	for i, m := range rd.Mismatches {
+		if i >= maxPrintDiffRows {
+			lines = append(lines, fmt.Sprintf("  ... and %d more mismatched rows", len(rd.Mismatches)-i))
+			break
+		}
+		cols := make([]string, 0, len(m.Cols))
+		for _, c := range m.Cols {
+			cols = append(cols, fmt.Sprintf("`%s` %s != %s", column(c), color.GreenString(value(m.Row1, c)), color.RedString(value(m.Row2, c))))
+		}
+		lines = append(lines, fmt.Sprintf("  row %d: %s", m.Idx+1, strings.Join(cols, ", ")))
+	}
+	for _, rows := range []struct {
+		sign string
+		rows [][]*string
+		c    func(string, ...any) string
+	}{
+		{"-", rd.Missing, color.GreenString},
+		{"+", rd.Extra, color.RedString},
+	} {
+		for i, row := range rows.rows {
+			if i >= maxPrintDiffRows {
+				lines = append(lines, fmt.Sprintf("  %s ... and %d more rows", rows.sign, len(rows.rows)-i))
+				break
+			}
+			lines = append(lines, rows.c("  %s %s", rows.sign, formatRow(row)))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -20,12 +20,18 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/jmoiron/sqlx"
@@ -47,22 +53,39 @@ type Dump struct {
 	OutputQueryDir        string
 	LocalAuditLogCacheDir string
 	AuditLogEncoding      string
+	AuditLogFormat        string
 
 	SSHAddress    string
 	SSHPassword   string
 	SSHPrivateKey string
+	SSHStream     bool
+	AllFEs        bool
 
 	DumpSchema         bool
+	SchemaFromQueries  bool
 	DumpStats          bool
+	DumpTopN           int
 	DumpQuery          bool
 	QueryMinDuration_  time.Duration
 	QueryMinDurationMs int64
 	QueryStates        []string
 	OnlySelect         bool
+	SessionStmts       bool
 	Strict             bool
 	From, To           string
 	Analyze            bool
 
+	Follow         bool
+	FollowInterval time.Duration
+	FollowRotate   time.Duration
+	FollowDelay    time.Duration
+
+	Compress string
+
+	SampleMaxPerFingerprint int
+	SampleTopSlowest        int
+	SamplePercent           float64
+
 	Clean bool
 }
 
@@ -99,6 +122,11 @@ or environment variables with prefix 'DORIS_', e.g.
 			if err := cleanFile(DumpConfig.OutputQueryDir, true); err != nil {
 				return err
 			}
+			if DumpConfig.Follow {
+				if err := cleanFile(filepath.Join(GlobalConfig.DodoDataDir, src.DumpCheckpointFile), true); err != nil {
+					return err
+				}
+			}
 		}
 
 		if AnonymizeConfig.Enabled {
@@ -106,15 +134,8 @@ or environment variables with prefix 'DORIS_', e.g.
 		}
 
 		// dump schemas
-		if DumpConfig.DumpSchema {
-			schemas, err := dumpSchemas(ctx)
-			if err != nil {
-				return err
-			}
-
-			logrus.Infof("Found %d schema(s)", lo.SumBy(schemas, func(s *src.DBSchema) int { return len(s.Schemas) }))
-
-			if err := outputSchemas(schemas); err != nil {
+		if DumpConfig.DumpSchema && !DumpConfig.SchemaFromQueries {
+			if err := dumpAndOutputSchemas(ctx); err != nil {
 				return err
 			}
 		}
@@ -129,6 +150,16 @@ or environment variables with prefix 'DORIS_', e.g.
 			logrus.Infof("Found %d query(s)", count)
 		}
 
+		// dump schemas of the tables referenced by queries
+		if DumpConfig.SchemaFromQueries {
+			if err := resolveQueryTables(ctx); err != nil {
+				return err
+			}
+			if err := dumpAndOutputSchemas(ctx); err != nil {
+				return err
+			}
+		}
+
 		// store anonymize hash dict
 		if AnonymizeConfig.Enabled {
 			src.StoreMiniHashDict(AnonymizeConfig.Method, AnonymizeConfig.HashDictPath)
@@ -145,21 +176,35 @@ func init() {
 
 	pFlags := dumpCmd.PersistentFlags()
 	pFlags.BoolVar(&DumpConfig.DumpSchema, "dump-schema", false, "Dump schema")
+	pFlags.BoolVar(&DumpConfig.SchemaFromQueries, "schema-from-queries", false, "Dump schemas of the tables referenced by dumped queries (and the base tables of views), instead of '--dbs' and '--tables'")
 	pFlags.BoolVar(&DumpConfig.DumpStats, "dump-stats", true, "Dump schema stats, only take effect when '--dump-schema=true'")
+	pFlags.IntVar(&DumpConfig.DumpTopN, "dump-topn", 0, "Also dump the top N frequent values of each column sampled from table into stats, 0 means not dump")
 	pFlags.BoolVar(&DumpConfig.DumpQuery, "dump-query", false, "Dump query from audit log")
 	pFlags.DurationVar(&DumpConfig.QueryMinDuration_, "query-min-duration", 0, "Dump queries which execution duration is greater than or equal to")
 	pFlags.StringSliceVar(&DumpConfig.QueryStates, "query-states", []string{}, "Dump queries with states, like 'ok', 'eof' and 'err'")
 	pFlags.BoolVar(&DumpConfig.OnlySelect, "only-select", true, "Only dump SELECT queries")
+	pFlags.BoolVar(&DumpConfig.SessionStmts, "session-stmts", false, "Also dump session statements like 'SET' and 'USE', so that replay can restore the session state")
 	pFlags.BoolVarP(&DumpConfig.Strict, "strict", "s", false, "Filter out sqls that can't be parsed")
 	pFlags.StringVar(&DumpConfig.From, "from", "", "Dump queries from this time, like '2006-01-02 15:04:05'")
 	pFlags.StringVar(&DumpConfig.To, "to", "", "Dump queries to this time, like '2006-01-02 16:04:05'")
+	pFlags.IntVar(&DumpConfig.SampleMaxPerFingerprint, "sample-max-per-fingerprint", 0, "Keep at most N queries of each fingerprint (the normalized statement), <= 0 means unlimited")
+	pFlags.IntVar(&DumpConfig.SampleTopSlowest, "sample-top-slowest", 0, "Keep the K slowest queries of each fingerprint, <= 0 means not")
+	pFlags.BoolVar(&DumpConfig.Follow, "follow", false, "Keep dumping new queries from audit log until interrupted, resume from the checkpoint in '--dodo-data-dir'")
+	pFlags.DurationVar(&DumpConfig.FollowInterval, "follow-interval", 5*time.Second, "Poll interval of '--follow'")
+	pFlags.DurationVar(&DumpConfig.FollowRotate, "follow-rotate", time.Hour, "Rotate the output sql file of '--follow' by this interval")
+	pFlags.DurationVar(&DumpConfig.FollowDelay, "follow-delay", time.Minute, "Only dump the queries older than this delay when following audit log table, since audit logs are loaded into table in batches")
+	pFlags.Float64Var(&DumpConfig.SamplePercent, "sample-percent", 100, "Keep a random percent of queries, the time distribution is preserved, like 10")
+	pFlags.StringVar(&DumpConfig.Compress, "compress", "", "Compress the output sql files, one of: "+strings.Join(src.CompressionNames(), ", "))
 	pFlags.StringSliceVar(&DumpConfig.AuditLogPaths, "audit-logs", nil, "Scan query from audit log files, either local path or 'ssh://xxx'")
 	pFlags.StringVar(&DumpConfig.AuditLogTable, "audit-log-table", "", "Scan query from audit log table, like 'audit_db.audit_tbl'")
 	pFlags.StringVar(&DumpConfig.AuditLogEncoding, "audit-log-encoding", "auto", "Audit log encoding, like utf8, gbk, ...")
+	pFlags.StringVar(&DumpConfig.AuditLogFormat, "audit-log-format", src.AuditLogFormatAuto, fmt.Sprintf("Audit log format, one of: %s, %s", src.AuditLogFormatAuto, strings.Join(src.AuditLogFormatNames(), ", ")))
 	pFlags.BoolVar(&DumpConfig.Analyze, "analyze", false, "Run 'ANALYZE TABLE' before dump stats, only take effect when '--dump-stats=true'")
 	pFlags.StringVar(&DumpConfig.SSHAddress, "ssh-address", "", "SSH address for downloading audit log, default is 'root@{db_host}:22'")
 	pFlags.StringVar(&DumpConfig.SSHPassword, "ssh-password", "", "SSH password for '--ssh-address'")
 	pFlags.StringVar(&DumpConfig.SSHPrivateKey, "ssh-private-key", "~/.ssh/id_rsa", "File path of SSH private key for '--ssh-address'")
+	pFlags.BoolVar(&DumpConfig.SSHStream, "ssh-stream", false, "Read remote audit logs over SSH directly instead of downloading them to '--dodo-data-dir'")
+	pFlags.BoolVar(&DumpConfig.AllFEs, "all-fes", false, "Dump the audit logs of all FEs in 'SHOW FRONTENDS' over SSH, only the ones overlapping '--from' and '--to'")
 	addAnonymizeBaseFlags(pFlags, false)
 
 	dumpCmd.RegisterFlagCompletionFunc("query-states", func(_ *cobra.Command, _ []string, _ string) ([]string, cobra.ShellCompDirective) {
@@ -179,9 +224,30 @@ func completeDumpConfig() error {
 	DumpConfig.OutputQueryDir = filepath.Join(GlobalConfig.OutputDir, "sql")
 	DumpConfig.LocalAuditLogCacheDir = filepath.Join(GlobalConfig.DodoDataDir, "auditlog")
 
+	if DumpConfig.SchemaFromQueries && (!DumpConfig.DumpSchema || !DumpConfig.DumpQuery) {
+		return errors.New("--schema-from-queries requires both --dump-schema and --dump-query")
+	}
+
+	if DumpConfig.AllFEs && (len(DumpConfig.AuditLogPaths) > 0 || DumpConfig.AuditLogTable != "") {
+		return errors.New("--all-fes conflicts with --audit-logs and --audit-log-table")
+	}
 	if DumpConfig.AuditLogTable != "" && !strings.Contains(DumpConfig.AuditLogTable, ".") {
 		return errors.New("need to specific database in '--audit-log-table', like 'audit_db.audit_tbl'")
 	}
+	if DumpConfig.DumpTopN < 0 {
+		return fmt.Errorf("invalid --dump-topn %d, should be at least 0", DumpConfig.DumpTopN)
+	}
+	if DumpConfig.DumpTopN > 0 && AnonymizeConfig.Enabled {
+		return errors.New("--dump-topn conflicts with --anonymize, the column values can not be anonymized")
+	}
+	if DumpConfig.Compress != "" && src.CompressionExt(DumpConfig.Compress) == "" {
+		return fmt.Errorf("invalid --compress %s, should be one of: %s", DumpConfig.Compress, strings.Join(src.CompressionNames(), ", "))
+	}
+	if DumpConfig.AuditLogFormat != src.AuditLogFormatAuto {
+		if _, err := src.GetAuditLogFormat(DumpConfig.AuditLogFormat); err != nil {
+			return err
+		}
+	}
 
 	if DumpConfig.QueryMinDuration_ > 0 {
 		DumpConfig.QueryMinDurationMs = DumpConfig.QueryMinDuration_.Milliseconds()
@@ -200,7 +266,9 @@ func completeDumpConfig() error {
 
 	GlobalConfig.DBs, GlobalConfig.Tables = lo.Uniq(GlobalConfig.DBs), lo.Uniq(GlobalConfig.Tables)
 	dbs, tables := GlobalConfig.DBs, GlobalConfig.Tables
-	if DumpConfig.DumpSchema && len(dbs) == 0 {
+	if DumpConfig.SchemaFromQueries && len(tables) > 0 {
+		return errors.New("--tables conflicts with --schema-from-queries")
+	} else if DumpConfig.DumpSchema && !DumpConfig.SchemaFromQueries && len(dbs) == 0 {
 		return errors.New("expected at least one database, please use --dbs flag")
 	} else if len(dbs) == 1 {
 		// prepend default database if only one database specified
@@ -218,6 +286,26 @@ func completeDumpConfig() error {
 		}
 	}
 
+	if DumpConfig.SampleMaxPerFingerprint > 0 && DumpConfig.SampleTopSlowest > 0 {
+		return errors.New("--sample-max-per-fingerprint conflicts with --sample-top-slowest")
+	}
+	if DumpConfig.SamplePercent <= 0 || DumpConfig.SamplePercent > 100 {
+		return errors.New("--sample-percent must be in (0, 100]")
+	}
+
+	if DumpConfig.Follow {
+		switch {
+		case !DumpConfig.DumpQuery:
+			return errors.New("--follow requires --dump-query")
+		case DumpConfig.To != "":
+			return errors.New("--follow conflicts with --to")
+		case DumpConfig.SampleTopSlowest > 0:
+			return errors.New("--follow conflicts with --sample-top-slowest")
+		case DumpConfig.FollowInterval <= 0 || DumpConfig.FollowRotate <= 0:
+			return errors.New("--follow-interval and --follow-rotate must be positive")
+		}
+	}
+
 	DumpConfig.QueryStates = lo.Map(DumpConfig.QueryStates, func(s string, _ int) string {
 		return strings.ToUpper(s)
 	})
@@ -233,11 +321,22 @@ func completeDumpConfig() error {
 	return nil
 }
 
+func dumpAndOutputSchemas(ctx context.Context) error {
+	schemas, err := dumpSchemas(ctx)
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("Found %d schema(s)", lo.SumBy(schemas, func(s *src.DBSchema) int { return len(s.Schemas) }))
+
+	return outputSchemas(schemas)
+}
+
 func dumpSchemas(ctx context.Context) ([]*src.DBSchema, error) {
 	dbs, tables := GlobalConfig.DBs, GlobalConfig.Tables
 	g := src.ParallelGroup(GlobalConfig.Parallel)
 
-	schemas := make([]*src.DBSchema, len(dbs))
+	schemas, globalSchemas := make([]*src.DBSchema, len(dbs)), &src.DBSchema{}
 	for i, db := range dbs {
 		g.Go(func() error {
 			logrus.Infof("Dumping schemas from %s...", db)
@@ -252,32 +351,43 @@ func dumpSchemas(ctx context.Context) ([]*src.DBSchema, error) {
 			if err != nil {
 				return err
 			}
+			schemas[i] = &src.DBSchema{
+				Name:    db,
+				Schemas: append(createTables, src.ShowCreateDBSchemas(ctx, conn, db, createTables)...),
+			}
 
 			// dump stats
 			if !DumpConfig.DumpStats {
 				return nil
 			}
 			tbls := lo.Map(createTables, func(s *src.Schema, _ int) string { return s.Name })
-			stats, err := src.GetTablesStats(ctx, conn, DumpConfig.Analyze, db, tbls...)
+			stats, err := src.GetTablesStats(ctx, conn, DumpConfig.Analyze, DumpConfig.DumpTopN, db, tbls...)
 			if err != nil {
 				return err
 			}
-
-			schemas[i] = &src.DBSchema{
-				Name:    db,
-				Schemas: createTables,
-				Stats:   stats,
-			}
+			schemas[i].Stats = stats
 
 			return nil
 		})
 	}
 
+	// dump schemas not in any database, like catalogs and resources
+	g.Go(func() error {
+		conn, err := connectDBWithoutDBName()
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		globalSchemas = &src.DBSchema{Schemas: src.ShowCreateGlobalSchemas(ctx, conn)}
+		return nil
+	})
+
 	if err := g.Wait(); err != nil {
 		return nil, err
 	}
 
-	return schemas, nil
+	return append(schemas, globalSchemas), nil
 }
 
 func outputSchemas(schemas []*src.DBSchema) error {
@@ -297,13 +407,15 @@ func outputSchemas(schemas []*src.DBSchema) error {
 		g.Go(func() error {
 			// 1. write each schema into split file
 			for _, s := range s.Schemas {
-				var filename string
 				if AnonymizeConfig.Enabled {
-					s.DB = src.Anonymize(AnonymizeConfig.Method, s.DB)
+					if s.DB != "" {
+						s.DB = src.Anonymize(AnonymizeConfig.Method, s.DB)
+					}
 					s.Name = src.Anonymize(AnonymizeConfig.Method, s.Name)
 				}
 
-				filename = fmt.Sprintf("%s.%s.%s.sql", s.DB, s.Name, s.Type.Lower())
+				// the schemas not in any database have no db part
+				filename := fmt.Sprintf("%s.%s.sql", s, s.Type.Lower())
 				if AnonymizeConfig.Enabled {
 					s.CreateStmt = AnonymizeSQL(filename, s.CreateStmt)
 				}
@@ -358,17 +470,187 @@ func dumpQueries(ctx context.Context) (int, error) {
 		QueryMinDurationMs: DumpConfig.QueryMinDurationMs,
 		QueryStates:        DumpConfig.QueryStates,
 		OnlySelect:         DumpConfig.OnlySelect,
+		SessionStmts:       DumpConfig.SessionStmts,
 		Strict:             DumpConfig.Strict,
 		From:               DumpConfig.From,
 		To:                 DumpConfig.To,
 	}
 
+	if DumpConfig.Follow {
+		return followQueries(ctx, opts)
+	}
 	if DumpConfig.AuditLogTable != "" {
 		return dumpQueriesFromTable(ctx, opts)
 	}
 	return dumpQueriesFromFile(ctx, opts)
 }
 
+// auditLogFollower is the follower of an audit log file or table.
+type auditLogFollower interface {
+	Poll(ctx context.Context, w src.SqlWriter) (int, error)
+	Close() error
+}
+
+// followQueries keeps dumping new queries until interrupted, the checkpoint is saved after each poll.
+func followQueries(ctx context.Context, opts src.AuditLogScanOpts) (int, error) {
+	cp, err := src.ReadDumpCheckpoint(GlobalConfig.DodoDataDir)
+	if err != nil {
+		return 0, err
+	}
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer stop()
+
+	var (
+		followers []auditLogFollower
+		names     []string
+		commits   []func()
+	)
+	defer func() {
+		for _, f := range followers {
+			f.Close()
+		}
+	}()
+
+	if DumpConfig.AuditLogTable != "" {
+		dbTable := strings.SplitN(DumpConfig.AuditLogTable, ".", 2)
+		db, err := connectDB(dbTable[0])
+		if err != nil {
+			return 0, err
+		}
+		defer db.Close()
+
+		key := DumpConfig.AuditLogTable
+		f, err := src.NewAuditLogTableFollower(ctx, db, dbTable[0], dbTable[1], opts, DumpConfig.FollowDelay, cp.Table(key))
+		if err != nil {
+			return 0, err
+		}
+		followers, names = append(followers, f), append(names, key)
+		commits = append(commits, func() { cp.SetTable(key, f.Checkpoint()) })
+	} else {
+		paths, fes, err := followAuditLogPaths(ctx)
+		if err != nil {
+			return 0, err
+		}
+		for i, path := range paths {
+			key := src.AuditLogCheckpointKey(path)
+			feOpts := opts
+			feOpts.Fe = fes[i]
+			f, err := src.NewAuditLogFollower(ctx, path, DumpConfig.SSHPrivateKey, DumpConfig.AuditLogEncoding, DumpConfig.AuditLogFormat, feOpts, cp.File(key), DumpConfig.From != "")
+			if err != nil {
+				return 0, fmt.Errorf("follow audit log %s failed: %w", key, err)
+			}
+			followers, names = append(followers, f), append(names, key)
+			commits = append(commits, func() { cp.SetFile(key, f.Checkpoint()) })
+		}
+	}
+
+	rotators := make([]*rotatingQueryWriter, len(followers))
+	writers := make([]src.SqlWriter, len(followers))
+	for i := range followers {
+		rotators[i] = &rotatingQueryWriter{idx: i, rotate: DumpConfig.FollowRotate}
+		writers[i] = rotators[i]
+		//nolint:revive
+		defer writers[i].Close()
+	}
+	sampler, writers := newQuerySampler(collectQueryTables(writers))
+
+	logrus.Infof("Following audit logs %v, press Ctrl+C to stop...", names)
+
+	var (
+		g       = src.ParallelGroup(len(followers))
+		counter = &atomic.Int64{}
+	)
+	for i, f := range followers {
+		g.Go(func() error {
+			for polled := false; ; polled = true {
+				count, err := f.Poll(ctx, writers[i])
+				if err != nil && ctx.Err() == nil {
+					if !polled {
+						return fmt.Errorf("follow audit log %s failed: %w", names[i], err)
+					}
+					logrus.Warnf("follow audit log %s failed, will retry, err: %v", names[i], err)
+				}
+				if count > 0 {
+					logrus.Debugf("dumped %d new query(s) from %s", count, names[i])
+					counter.Add(int64(count))
+				}
+
+				// the checkpoint is saved after the queries before it are flushed
+				if err := rotators[i].Flush(); err != nil {
+					return err
+				}
+				commits[i]()
+				if !GlobalConfig.DryRun {
+					if err := cp.Write(GlobalConfig.DodoDataDir); err != nil {
+						return err
+					}
+				}
+
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-time.After(DumpConfig.FollowInterval):
+				}
+			}
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return int(counter.Load()), err
+	}
+
+	logrus.Infoln("Stopped following audit logs")
+	return int(counter.Load()), finishQuerySampler(sampler)
+}
+
+// followAuditLogPaths returns the audit logs to follow and their FEs (empty if unknown),
+// the current FE audit log on remote server by default.
+func followAuditLogPaths(ctx context.Context) (paths, fes []string, err error) {
+	if DumpConfig.AllFEs {
+		frontends, err := showAliveFrontends(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, fe := range frontends {
+			dirUrl, err := frontendAuditLogDir(fe)
+			if err != nil {
+				return nil, nil, err
+			}
+			paths, fes = append(paths, dirUrl+"fe.audit.log"), append(fes, fe.Host)
+		}
+		return paths, fes, nil
+	}
+
+	if len(DumpConfig.AuditLogPaths) == 0 {
+		dirUrl, err := remoteAuditLogDir(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("please specific audit log files by '--audit-logs' or table by '--audit-log-table', err: %v", err)
+		}
+		return []string{dirUrl + "fe.audit.log"}, []string{""}, nil
+	}
+
+	for _, auditLog := range DumpConfig.AuditLogPaths {
+		if strings.HasPrefix(auditLog, "ssh://") {
+			sshUrl, err := expandSSHPath(auditLog)
+			if err != nil {
+				return nil, nil, err
+			}
+			paths = append(paths, sshUrl)
+			continue
+		}
+
+		localPath := strings.TrimPrefix(auditLog, "file://")
+		localPaths, err := filepath.Glob(localPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid audit log path: %s, err: %v", localPath, err)
+		}
+		if len(localPaths) == 0 {
+			return nil, nil, fmt.Errorf("audit log not found: %s", localPath)
+		}
+		paths = append(paths, localPaths...)
+	}
+	return paths, make([]string, len(paths)), nil
+}
+
 func dumpQueriesFromTable(ctx context.Context, opts src.AuditLogScanOpts) (int, error) {
 	if opts.From == "" || opts.To == "" {
 		return 0, errors.New("must specific both '--from' and '--to' when dumping from audit log table")
@@ -386,17 +668,26 @@ func dumpQueriesFromTable(ctx context.Context, opts src.AuditLogScanOpts) (int,
 
 	w := NewQueryWriter(1, 0)
 	defer w.Close()
+	sampler, writers := newQuerySampler(collectQueryTables([]src.SqlWriter{w}))
 
-	count, err := src.GetDBAuditLogs(ctx, w, db, dbname, table, opts, GlobalConfig.Parallel)
+	count, err := src.GetDBAuditLogs(ctx, writers[0], db, dbname, table, opts, GlobalConfig.Parallel)
 	if err != nil {
 		logrus.Errorf("Extract queries from audit logs table failed, %v", err)
 		return 0, err
 	}
 
-	return count, nil
+	return count, finishQuerySampler(sampler)
 }
 
 func dumpQueriesFromFile(ctx context.Context, opts src.AuditLogScanOpts) (int, error) {
+	// stop reading the audit logs (and the remote 'cat' over ssh) on interrupt
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer stop()
+
+	if DumpConfig.AllFEs {
+		return dumpQueriesFromAllFEs(ctx, opts)
+	}
+
 	auditLogs := DumpConfig.AuditLogPaths
 	if len(auditLogs) == 0 {
 		sshUrl, err := chooseRemoteAuditLog(ctx)
@@ -410,21 +701,22 @@ func dumpQueriesFromFile(ctx context.Context, opts src.AuditLogScanOpts) (int, e
 
 	auditLogFiles := []string{}
 	for _, auditLog := range auditLogs {
-		var localPath string
-
-		// 1. Remote audit log. scp remote path to local path
+		// 1. Remote audit log. Read over ssh directly, or scp remote path to local path
 		if strings.HasPrefix(auditLog, "ssh://") {
-			localPath = filepath.Join(DumpConfig.LocalAuditLogCacheDir, path.Base(auditLog))
-			if err := copyAuditLog(ctx, auditLog, localPath); err != nil {
-				logrus.Errorln("Copy remote audit log failed:", err)
+			remotePaths, err := listRemoteAuditLogs(ctx, auditLog)
+			if err != nil {
+				return 0, err
+			}
+			paths, err := fetchRemoteAuditLogs(ctx, remotePaths, DumpConfig.LocalAuditLogCacheDir)
+			if err != nil {
 				return 0, err
 			}
-			auditLogFiles = append(auditLogFiles, localPath)
+			auditLogFiles = append(auditLogFiles, paths...)
 			continue
 		}
 
 		// 2. Local audit log.
-		localPath = strings.TrimPrefix(auditLog, "file://")
+		localPath := strings.TrimPrefix(auditLog, "file://")
 		localPaths, err := filepath.Glob(localPath)
 		if err != nil {
 			return 0, fmt.Errorf("invalid audit log path: %s, err: %v", localPath, err)
@@ -442,11 +734,15 @@ func dumpQueriesFromFile(ctx context.Context, opts src.AuditLogScanOpts) (int, e
 		//nolint:revive
 		defer writers[i].Close()
 	}
+	sampler, writers := newQuerySampler(collectQueryTables(writers))
 
 	count, err := src.ExtractQueriesFromAuditLogs(
+		ctx,
 		writers,
 		auditLogFiles,
 		DumpConfig.AuditLogEncoding,
+		DumpConfig.AuditLogFormat,
+		DumpConfig.SSHPrivateKey,
 		opts,
 		GlobalConfig.Parallel,
 	)
@@ -455,12 +751,263 @@ func dumpQueriesFromFile(ctx context.Context, opts src.AuditLogScanOpts) (int, e
 		return 0, err
 	}
 
-	return count, nil
+	return count, finishQuerySampler(sampler)
+}
+
+// dumpQueriesFromAllFEs dumps the audit logs of all FEs, the queries are recorded with the FE they are sent to.
+func dumpQueriesFromAllFEs(ctx context.Context, opts src.AuditLogScanOpts) (int, error) {
+	fes, err := showAliveFrontends(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	// 1. List and fetch the audit logs of each FE.
+	feAuditLogs := make([][]string, len(fes))
+	total := 0
+	for i, fe := range fes {
+		dirUrl, err := frontendAuditLogDir(fe)
+		if err != nil {
+			return 0, err
+		}
+		remotePaths, err := listRemoteAuditLogs(ctx, dirUrl+"fe.audit.log*")
+		if err != nil {
+			return 0, fmt.Errorf("list audit logs of FE %s failed: %v", fe.Host, err)
+		}
+		logrus.Infof("Found %d audit log(s) on FE %s", len(remotePaths), fe.Host)
+
+		feAuditLogs[i], err = fetchRemoteAuditLogs(ctx, remotePaths, filepath.Join(DumpConfig.LocalAuditLogCacheDir, fe.Host))
+		if err != nil {
+			return 0, err
+		}
+		total += len(feAuditLogs[i])
+	}
+	if total == 0 {
+		return 0, errors.New("no audit log of FEs found between '--from' and '--to'")
+	}
+
+	// 2. Start dumping, one output file per audit log.
+	logrus.Infoln("Dumping queries from audit log files of all FEs...")
+
+	writers := make([]src.SqlWriter, total)
+	for i := range writers {
+		writers[i] = NewQueryWriter(total, i)
+		//nolint:revive
+		defer writers[i].Close()
+	}
+	sampler, writers := newQuerySampler(collectQueryTables(writers))
+
+	count := 0
+	for i, fe := range fes {
+		feOpts := opts
+		feOpts.Fe = fe.Host
+		n, err := src.ExtractQueriesFromAuditLogs(
+			ctx,
+			writers[:len(feAuditLogs[i])],
+			feAuditLogs[i],
+			DumpConfig.AuditLogEncoding,
+			DumpConfig.AuditLogFormat,
+			DumpConfig.SSHPrivateKey,
+			feOpts,
+			GlobalConfig.Parallel,
+		)
+		if err != nil {
+			logrus.Errorf("Extract queries from audit logs of FE %s failed, %v", fe.Host, err)
+			return 0, err
+		}
+		count += n
+		writers = writers[len(feAuditLogs[i]):]
+	}
+
+	return count, finishQuerySampler(sampler)
+}
+
+// showAliveFrontends returns the alive FEs of cluster, the dead ones are skipped with warning.
+func showAliveFrontends(ctx context.Context) ([]*src.Frontend, error) {
+	conn, err := connectDB("information_schema")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	fes, err := src.ShowFrontends(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	fes = lo.Filter(fes, func(fe *src.Frontend, _ int) bool {
+		if !fe.Alive {
+			logrus.Warnf("skip FE %s which is not alive, the queries sent to it may be missed", fe.Host)
+		}
+		return fe.Alive
+	})
+	if len(fes) == 0 {
+		return nil, errors.New("no alive FE found")
+	}
+	return fes, nil
+}
+
+// frontendAuditLogDir returns the ssh url of audit log directory on FE, ends with '/'.
+// The user, password and port are the same as '--ssh-address'.
+func frontendAuditLogDir(fe *src.Frontend) (string, error) {
+	if fe.AuditLogDir == "" {
+		return "", fmt.Errorf("audit log directory of FE %s not found", fe.Host)
+	}
+	u, err := url.Parse(DumpConfig.SSHAddress)
+	if err != nil {
+		return "", err
+	}
+	u.Host = net.JoinHostPort(fe.Host, lo.CoalesceOrEmpty(u.Port(), "22"))
+	u.Path = strings.TrimSuffix(fe.AuditLogDir, "/") + "/"
+	return expandSSHPath(u.String())
+}
+
+// fetchRemoteAuditLogs returns the remote audit logs as is if '--ssh-stream', otherwise downloads them to cacheDir.
+func fetchRemoteAuditLogs(ctx context.Context, remotePaths []string, cacheDir string) ([]string, error) {
+	if DumpConfig.SSHStream {
+		return remotePaths, nil
+	}
+
+	localPaths := make([]string, 0, len(remotePaths))
+	for _, remotePath := range remotePaths {
+		localPath := filepath.Join(cacheDir, remoteAuditLogName(remotePath))
+		if err := copyAuditLog(ctx, remotePath, localPath); err != nil {
+			logrus.Errorln("Copy remote audit log failed:", err)
+			return nil, err
+		}
+		localPaths = append(localPaths, localPath)
+	}
+	return localPaths, nil
+}
+
+// queryTables collects the tables referenced by dumped queries, only when '--schema-from-queries'.
+var queryTables *src.QueryTableCollector
+
+// collectQueryTables collects the tables of the queries written, after sampled and before anonymized.
+func collectQueryTables(writers []src.SqlWriter) []src.SqlWriter {
+	if !DumpConfig.SchemaFromQueries {
+		return writers
+	}
+	queryTables, writers = src.NewQueryTableCollector(writers)
+	return writers
+}
+
+// resolveQueryTables resolves the tables referenced by dumped queries to the existing tables and views,
+// and the base tables of views recursively, then sets them to the dbs and tables to dump.
+func resolveQueryTables(ctx context.Context) error {
+	var (
+		pending   []string
+		resolved  = map[string]struct{}{}
+		db2tables = map[string][]*src.Schema{}
+		conns     = map[string]*sqlx.DB{}
+	)
+	defer func() {
+		for _, conn := range conns {
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}()
+
+	if queryTables != nil {
+		pending = queryTables.Tables()
+	}
+	others := []string{}
+	for len(pending) > 0 {
+		name := pending[0]
+		pending = pending[1:]
+
+		db, table, ok := src.SplitQueryTable(name, GlobalConfig.Catalog)
+		if !ok {
+			others = append(others, name)
+			continue
+		}
+		if _, ok := resolved[db+"."+table]; ok {
+			continue
+		}
+
+		conn, ok := conns[db]
+		if !ok {
+			var err error
+			if conn, err = connectDB(db); err != nil {
+				logrus.Warnf("skip tables in database '%s' referenced by queries, err: %v", db, err)
+				conns[db] = nil
+				continue
+			}
+			conns[db] = conn
+		}
+		if conn == nil {
+			continue
+		}
+		tables, ok := db2tables[db]
+		if !ok {
+			var err error
+			if tables, err = src.ShowTables(ctx, conn, db); err != nil {
+				return err
+			}
+			db2tables[db] = tables
+		}
+
+		s, ok := src.FindSchema(tables, table)
+		if !ok {
+			logrus.Warnf("table '%s.%s' referenced by queries not found, skipping", db, table)
+			continue
+		}
+		resolved[s.String()] = struct{}{}
+
+		if s.Type == src.SchemaTypeView {
+			base, err := src.ShowViewBaseTables(ctx, conn, s.DB, s.Name)
+			if err != nil {
+				logrus.Warnf("can not get the base tables of view '%s', err: %v", s, err)
+				continue
+			}
+			logrus.Debugf("view '%s' references tables: %v", s, base)
+			pending = append(pending, base...)
+		}
+	}
+	if len(others) > 0 {
+		logrus.Warnf("skip %d table(s) referenced by queries in other catalogs, dump them with '--catalog': %v", len(others), lo.Uniq(others))
+	}
+
+	GlobalConfig.Tables = lo.Keys(resolved)
+	slices.Sort(GlobalConfig.Tables)
+	GlobalConfig.DBs = lo.Uniq(lo.Map(GlobalConfig.Tables, func(t string, _ int) string { return strings.SplitN(t, ".", 2)[0] }))
+	logrus.Infof("Found %d table(s) referenced by queries", len(GlobalConfig.Tables))
+	return nil
+}
+
+func newQuerySampler(writers []src.SqlWriter) (*src.QuerySampler, []src.SqlWriter) {
+	return src.NewQuerySampler(src.QuerySampleOpts{
+		MaxPerFingerprint:        DumpConfig.SampleMaxPerFingerprint,
+		TopSlowestPerFingerprint: DumpConfig.SampleTopSlowest,
+		Percent:                  DumpConfig.SamplePercent,
+	}, writers)
+}
+
+// finishQuerySampler writes the sampled queries and the fingerprint summary.
+func finishQuerySampler(sampler *src.QuerySampler) error {
+	if err := sampler.Flush(); err != nil {
+		return err
+	}
+
+	summary := sampler.Summary()
+	logrus.Infof("Sampled %d query(s) of %d fingerprint(s)",
+		lo.SumBy(summary, func(f *src.FingerprintSummary) int { return f.Sampled }),
+		len(summary),
+	)
+	if GlobalConfig.DryRun {
+		return nil
+	}
+	if AnonymizeConfig.Enabled {
+		for _, f := range summary {
+			f.Fingerprint = AnonymizeSQL("fingerprint#"+f.Id, f.Fingerprint)
+		}
+	}
+	return src.WriteFingerprintSummary(filepath.Join(GlobalConfig.OutputDir, src.DumpFingerprintsFile), summary)
 }
 
 type queryWriter struct {
 	filename string
 	f        *os.File
+	c        io.WriteCloser // compressor, nil if not compressed
 	w        *bufio.Writer
 	count    int
 }
@@ -468,23 +1015,33 @@ type queryWriter struct {
 func NewQueryWriter(filecount, fileidx int) src.SqlWriter {
 	format := outputQueryFileNameFormat(filecount)
 	name := fmt.Sprintf(format, fileidx)
-	path := filepath.Join(DumpConfig.OutputQueryDir, name)
+	return newQueryWriter(name, os.O_TRUNC)
+}
+
+// newQueryWriter opens the output sql file with the flag, like os.O_TRUNC or os.O_APPEND.
+// The file is compressed by '--compress', the appended content is written as a new compressed frame.
+func newQueryWriter(name string, flag int) *queryWriter {
+	path := filepath.Join(DumpConfig.OutputQueryDir, name+src.CompressionExt(DumpConfig.Compress))
 
 	w := &queryWriter{filename: name}
 	if GlobalConfig.DryRun {
 		return w
 	}
 
-	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|flag, 0600)
 	if err != nil {
 		logrus.Fatalln("Can not open output sql file:", path, ", err:", err)
 	}
+	w.f, w.w = f, bufio.NewWriterSize(f, 256*1024)
 
-	return &queryWriter{
-		filename: name,
-		f:        f,
-		w:        bufio.NewWriterSize(f, 256*1024),
+	if DumpConfig.Compress != "" {
+		w.c, err = src.NewCompressWriter(f, DumpConfig.Compress)
+		if err != nil {
+			logrus.Fatalln("Can not compress output sql file:", path, ", err:", err)
+		}
+		w.w = bufio.NewWriterSize(w.c, 256*1024)
 	}
+	return w
 }
 
 func (w *queryWriter) WriteSql(s string) error {
@@ -513,9 +1070,26 @@ func (w *queryWriter) WriteSql(s string) error {
 	return err
 }
 
+func (w *queryWriter) Flush() error {
+	if w.w == nil {
+		return nil
+	}
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+	// make the flushed sqls readable in compressed file, for the checkpoint of '--follow'
+	if f, ok := w.c.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
 func (w *queryWriter) Close() error {
-	if w.w != nil {
-		if err := w.w.Flush(); err != nil {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if w.c != nil {
+		if err := w.c.Close(); err != nil {
 			return err
 		}
 	}
@@ -525,6 +1099,42 @@ func (w *queryWriter) Close() error {
 	return nil
 }
 
+// rotatingQueryWriter appends queries to the output sql files rotated by time, like 'q0-20241114170000.sql'.
+type rotatingQueryWriter struct {
+	idx    int
+	rotate time.Duration
+
+	opened time.Time
+	w      *queryWriter
+}
+
+func (w *rotatingQueryWriter) WriteSql(s string) error {
+	if w.w == nil || time.Since(w.opened) >= w.rotate {
+		if err := w.Close(); err != nil {
+			return err
+		}
+		w.opened = time.Now()
+		w.w = newQueryWriter(fmt.Sprintf("q%d-%s.sql", w.idx, w.opened.Format("20060102150405")), os.O_APPEND)
+	}
+	return w.w.WriteSql(s)
+}
+
+func (w *rotatingQueryWriter) Flush() error {
+	if w.w == nil {
+		return nil
+	}
+	return w.w.Flush()
+}
+
+func (w *rotatingQueryWriter) Close() error {
+	if w.w == nil {
+		return nil
+	}
+	err := w.w.Close()
+	w.w = nil
+	return err
+}
+
 func outputQueryFileNameFormat(total int) string {
 	count := 0
 	for total != 0 {
@@ -536,6 +1146,33 @@ func outputQueryFileNameFormat(total int) string {
 }
 
 func chooseRemoteAuditLog(ctx context.Context) (string, error) {
+	sshUrl, err := remoteAuditLogDir(ctx)
+	if err != nil {
+		return "", err
+	}
+	sshUrl += "fe.audit.log*"
+
+	auditLogs, err := src.SshLs(ctx, DumpConfig.SSHPrivateKey, sshUrl)
+	if err != nil {
+		return "", fmt.Errorf("SSH list remote audit log failed: %v", err)
+	}
+	auditLogs = lo.Filter(auditLogs, func(name string, _ int) bool {
+		return name != "" && src.AuditLogFileInTimeRange(name, DumpConfig.From, DumpConfig.To)
+	})
+	if len(auditLogs) == 0 {
+		return "", errors.New("no audit log found on remote server")
+	}
+
+	choosed, err := src.Choose("Choose audit log on remote server to dump", auditLogs)
+	if err != nil {
+		return "", err
+	}
+
+	return expandSSHPath(fmt.Sprintf("%s%s", DumpConfig.SSHAddress, choosed))
+}
+
+// remoteAuditLogDir returns the ssh url of FE audit log directory, ends with '/'.
+func remoteAuditLogDir(ctx context.Context) (string, error) {
 	conn, err := connectDB("information_schema")
 	if err != nil {
 		return "", err
@@ -554,22 +1191,46 @@ func chooseRemoteAuditLog(ctx context.Context) (string, error) {
 	if !strings.HasPrefix(sshUrl, "/") {
 		sshUrl += "/"
 	}
-	sshUrl += "fe.audit.log*"
+	return sshUrl, nil
+}
 
-	auditLogs, err := src.SshLs(ctx, DumpConfig.SSHPrivateKey, sshUrl)
+// listRemoteAuditLogs expands the glob in remote audit log path,
+// and skips the rotated audit logs out of '--from' and '--to' by the date in their names.
+func listRemoteAuditLogs(ctx context.Context, remotePath string) ([]string, error) {
+	remotePath, err := expandSSHPath(remotePath)
 	if err != nil {
-		return "", fmt.Errorf("SSH list remote audit log failed: %v", err)
-	}
-	if len(auditLogs) == 0 {
-		return "", errors.New("no audit log found on remote server")
+		return nil, err
 	}
 
-	choosed, err := src.Choose("Choose audit log on remote server to dump", auditLogs)
+	u, err := url.Parse(remotePath)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	return expandSSHPath(fmt.Sprintf("%s%s", DumpConfig.SSHAddress, choosed))
+	remotePaths := []string{remotePath}
+	if strings.ContainsAny(path.Base(u.Path), "*?[") {
+		remotePaths, err = src.SshGlob(ctx, DumpConfig.SSHPrivateKey, remotePath)
+		if err != nil {
+			return nil, fmt.Errorf("SSH list remote audit log failed: %v", err)
+		}
+	}
+
+	return lo.Filter(remotePaths, func(p string, _ int) bool {
+		name := remoteAuditLogName(p)
+		if src.AuditLogFileInTimeRange(name, DumpConfig.From, DumpConfig.To) {
+			return true
+		}
+		logrus.Debugf("skip remote audit log %s out of time range", name)
+		return false
+	}), nil
+}
+
+// remoteAuditLogName returns the file name of remote audit log url.
+func remoteAuditLogName(remotePath string) string {
+	if u, err := url.Parse(remotePath); err == nil {
+		return path.Base(u.Path)
+	}
+	return path.Base(remotePath)
 }
 
 func copyAuditLog(ctx context.Context, remotePath, localPath string) error {
@@ -0,0 +1,185 @@
+/*
+Copyright © 2024 Thearas thearas850@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cast"
+	"github.com/spf13/cobra"
+
+	"github.com/Thearas/dodo/src"
+)
+
+var ExportResultConfig = ExportResult{}
+
+type ExportResult struct {
+	OriginalSQLs []string
+	Format       string
+	OutputFile   string
+	Run          string
+	LoadTable    string
+}
+
+var exportResultFormats = []string{src.ResultExportParquet, src.ResultExportCSV}
+
+// exportResultCmd represents the export-result command
+var exportResultCmd = &cobra.Command{
+	Use:   "export-result",
+	Short: "Export replay results to Parquet or CSV file, or stream load them into Doris table",
+	Long: `Export replay results to Parquet or CSV file, or stream load them into Doris table.
+
+Each result directory is exported as a run, the run name is the directory name by default.`,
+	Example: `dodo export-result --original-sqls dump.sql replay1/ replay2/ --output-file results.parquet
+dodo export-result --original-sqls dump.sql replay1/ --format csv --output-file results.csv
+dodo export-result --original-sqls dump.sql replay1/ --load-table dodo.replay_results`,
+	SilenceUsage: true,
+	PersistentPreRunE: func(cmd *cobra.Command, _ []string) error {
+		return initConfig(cmd)
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, _ := signal.NotifyContext(cmd.Context(), syscall.SIGABRT, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+		if err := completeExportResultConfig(args); err != nil {
+			return err
+		}
+		return exportResult(ctx, args)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(exportResultCmd)
+	exportResultCmd.PersistentFlags().SortFlags = false
+	exportResultCmd.Flags().SortFlags = false
+
+	flags := exportResultCmd.Flags()
+	flags.StringSliceVar(&ExportResultConfig.OriginalSQLs, "original-sqls", nil, "The original dump sql, used to get the fingerprint, user and db of replay results")
+	flags.StringVar(&ExportResultConfig.Format, "format", src.ResultExportParquet, "Export file format, one of: "+strings.Join(exportResultFormats, ", "))
+	flags.StringVar(&ExportResultConfig.OutputFile, "output-file", "", "Write replay results to the file")
+	flags.StringVar(&ExportResultConfig.Run, "run", "", "The run name of replay results, default is the result directory name, only for one result directory")
+	flags.StringVar(&ExportResultConfig.LoadTable, "load-table", "", "Stream load replay results into the Doris table, in format 'db.table'")
+}
+
+func completeExportResultConfig(args []string) error {
+	if len(args) == 0 {
+		return errors.New("export-result requires at least one replay result dir")
+	}
+	if ExportResultConfig.Run != "" && len(args) > 1 {
+		return errors.New("--run is only allowed with one replay result dir")
+	}
+	if ExportResultConfig.OutputFile == "" && ExportResultConfig.LoadTable == "" {
+		return errors.New("export-result requires --output-file or --load-table flag")
+	}
+	if !slices.Contains(exportResultFormats, ExportResultConfig.Format) {
+		return fmt.Errorf("invalid export format: %s", ExportResultConfig.Format)
+	}
+	if t := ExportResultConfig.LoadTable; t != "" && len(strings.Split(t, ".")) != 2 {
+		return fmt.Errorf("invalid --load-table '%s', should be in format 'db.table'", t)
+	}
+	return nil
+}
+
+func exportResult(ctx context.Context, args []string) error {
+	// the original sqls are split the same as each replay, so that they can be read client by client
+	count2originals := map[int]*src.OriginalSqls{}
+	records := []src.ReplayResultRecord{}
+	for _, dir := range args {
+		var originals *src.OriginalSqls
+		if len(ExportResultConfig.OriginalSQLs) > 0 {
+			clientCount, err := guessClientCount(dir)
+			if err != nil {
+				return err
+			}
+			var ok bool
+			if originals, ok = count2originals[clientCount]; !ok {
+				var cleanup func()
+				originals, cleanup, err = readOriginalDumpSQLs(ExportResultConfig.OriginalSQLs, clientCount)
+				if err != nil {
+					return err
+				}
+				defer cleanup()
+				count2originals[clientCount] = originals
+			}
+		}
+
+		run := ExportResultConfig.Run
+		if run == "" {
+			run = filepath.Base(filepath.Clean(dir))
+		}
+		rs, err := src.ReadReplayResultRecords(dir, run, originals)
+		if err != nil {
+			return err
+		}
+		logrus.Debugf("read %d replay result(s) of run '%s' in %s", len(rs), run, dir)
+		records = append(records, rs...)
+	}
+	logrus.Infof("Export %d replay result(s) of %d run(s)", len(records), len(args))
+
+	if ExportResultConfig.OutputFile != "" {
+		if err := writeExportResultFile(records); err != nil {
+			return err
+		}
+	}
+	if ExportResultConfig.LoadTable != "" {
+		return loadExportResult(ctx, records)
+	}
+	return nil
+}
+
+func writeExportResultFile(records []src.ReplayResultRecord) error {
+	f, err := os.Create(ExportResultConfig.OutputFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := src.WriteReplayResultRecords(f, ExportResultConfig.Format, records); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func loadExportResult(ctx context.Context, records []src.ReplayResultRecord) error {
+	dir, err := os.MkdirTemp("", "dodo-export-result-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "results.csv")
+	if err := src.WriteReplayResultLoadFile(file, records); err != nil {
+		return err
+	}
+
+	dbtable := strings.SplitN(ExportResultConfig.LoadTable, ".", 2)
+	return src.StreamLoad(
+		ctx,
+		GlobalConfig.DBHost, cast.ToString(GlobalConfig.HTTPPort),
+		GlobalConfig.DBUser, GlobalConfig.DBPassword,
+		dbtable[0], dbtable[1], file,
+		"1/1",
+		GlobalConfig.DryRun,
+	)
+}
@@ -21,7 +21,9 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 	"time"
 
 	"github.com/samber/lo"
@@ -35,18 +37,54 @@ var ReplayConfig = Replay{}
 
 type Replay struct {
 	Cluster         string
-	ReplayFile      string
+	ReplayFiles_    []string
 	ReplayResultDir string
 	Users_          []string
 	From_, To_      string
 	ClientCount     int
 	Speed           float32
 	MaxHashRows     int
+	MaxSaveRows     int
 	MaxConnIdleTime time.Duration
+	OpenLoop        bool
+	QPS             float64
+	QPSRamp         time.Duration
+	PoolSize        int
+	Stream          bool
 
-	DBs      map[string]struct{}
-	Users    map[string]struct{}
-	From, To int64
+	ShadowHost         string
+	ShadowPort         uint16
+	ShadowUser         string
+	ShadowPassword     string
+	ShadowCatalog      string
+	ShadowCluster      string
+	ShadowLatencyRatio float64
+	// ShadowPasswordSet is whether --shadow-password is set, so that an empty shadow password is allowed
+	ShadowPasswordSet bool
+
+	ProgressInterval time.Duration
+	MetricsAddr      string
+	Resume           bool
+
+	WriteMode          string
+	SandboxDB          string
+	SandboxTableSuffix string
+
+	CapturePlan      string
+	ProfileThreshold time.Duration
+
+	TimeWarp_ string
+	TimeWarp  *src.ReplayTimeWarp
+
+	UserMapFile           string
+	MaxConcurrencyPerUser int
+	MaxConcurrencyPerDB   int
+
+	UserMap     *src.ReplayUserMap
+	ReplayFiles []string
+	DBs         map[string]struct{}
+	Users       map[string]struct{}
+	From, To    int64
 
 	Clean bool
 }
@@ -56,12 +94,17 @@ var replayCmd = &cobra.Command{
 	Use:     "replay",
 	Short:   "Replay queries from dump file",
 	Aliases: []string{"r"},
-	Example: "dodo replay -f /path/to/dump.sql",
+	Example: `dodo replay -f /path/to/dump.sql
+dodo replay -f 'output/sql/*.sql'`,
 	PersistentPreRunE: func(cmd *cobra.Command, _ []string) error {
 		return initConfig(cmd)
 	},
 	SilenceUsage: true,
 	RunE: func(cmd *cobra.Command, _ []string) error {
+		ctx, stop := signal.NotifyContext(cmd.Context(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+		defer stop()
+
+		ReplayConfig.ShadowPasswordSet = cmd.Flags().Changed("shadow-password")
 		if err := completeReplayConfig(); err != nil {
 			return err
 		}
@@ -71,7 +114,7 @@ var replayCmd = &cobra.Command{
 			}
 		}
 
-		return replay(cmd.Context())
+		return replay(ctx)
 	},
 }
 
@@ -81,7 +124,7 @@ func init() {
 	replayCmd.Flags().SortFlags = false
 
 	pFlags := replayCmd.PersistentFlags()
-	pFlags.StringVarP(&ReplayConfig.ReplayFile, "file", "f", "", "Replay queries from dump file")
+	pFlags.StringSliceVarP(&ReplayConfig.ReplayFiles_, "file", "f", nil, "Replay queries from dump files, globs and directories are supported, sqls of all files are merged into one timeline")
 	pFlags.StringVarP(&ReplayConfig.Cluster, "cluster", "c", "", "Replay queries on the cluster")
 	pFlags.StringVar(&ReplayConfig.ReplayResultDir, "result-dir", "", "Replay result directory, default is '<output-dir>/replay'")
 	pFlags.StringSliceVar(&ReplayConfig.Users_, "users", []string{}, "Replay queries from these users")
@@ -90,21 +133,55 @@ func init() {
 	pFlags.IntVar(&ReplayConfig.ClientCount, "client-count", 0, "Set replay client count")
 	pFlags.Float32Var(&ReplayConfig.Speed, "speed", 1.0, "Replay speed, like 0.5, 2, 4, ...")
 	pFlags.IntVar(&ReplayConfig.MaxHashRows, "max-hash-rows", 0, "Number of query return rows to hash, useful when diff replay result")
+	pFlags.IntVar(&ReplayConfig.MaxSaveRows, "max-save-rows", 0, "Number of query return rows to save in '<client>.rows.gz', useful when diff replay result rows")
 	pFlags.DurationVar(
 		&ReplayConfig.MaxConnIdleTime,
 		"max-conn-idle-time",
 		5*time.Second,
 		"Max idle duration of a replay client connection, <= 0 means unlimited",
 	)
+	pFlags.BoolVar(&ReplayConfig.OpenLoop, "open-loop", false, "Fire each query at its scheduled time, no matter how long the previous query took")
+	pFlags.Float64Var(&ReplayConfig.QPS, "qps", 0, "Target QPS of open-loop replay, 0 means following the original query time, implies --open-loop")
+	pFlags.DurationVar(&ReplayConfig.QPSRamp, "qps-ramp", 0, "Ramp up QPS linearly from 0 to --qps in this duration, like '1m'")
+	pFlags.IntVar(&ReplayConfig.PoolSize, "pool-size", 16, "Max connections of open-loop replay")
+	pFlags.BoolVar(&ReplayConfig.Stream, "stream", false, "Split the replay file per client on disk and read sqls lazily, useful when the file is larger than memory")
+
+	pFlags.StringVar(&ReplayConfig.ShadowHost, "shadow-host", "", "Also replay every query on the shadow target at the same moment and diff the results inline")
+	pFlags.Uint16Var(&ReplayConfig.ShadowPort, "shadow-port", 0, "Shadow target port, default is the same as --port")
+	pFlags.StringVar(&ReplayConfig.ShadowUser, "shadow-user", "", "Shadow target user, default is the same as --user")
+	pFlags.StringVar(&ReplayConfig.ShadowPassword, "shadow-password", "", "Shadow target password, default is the same as --password")
+	pFlags.StringVar(&ReplayConfig.ShadowCatalog, "shadow-catalog", "", "Shadow target catalog, default is the same as --catalog")
+	pFlags.StringVar(&ReplayConfig.ShadowCluster, "shadow-cluster", "", "Shadow target cluster, default is the same as --cluster")
+	pFlags.DurationVar(&ReplayConfig.ProgressInterval, "progress-interval", 10*time.Second, "Interval of logging replay progress, <= 0 means never")
+	pFlags.StringVar(&ReplayConfig.MetricsAddr, "metrics-addr", "", "Serve Prometheus metrics at 'http://<addr>/metrics' during replay, like ':9090'")
+	pFlags.BoolVar(&ReplayConfig.Resume, "resume", false, "Resume the interrupted replay from the checkpoint in '--result-dir'")
+	pFlags.Float64Var(&ReplayConfig.ShadowLatencyRatio, "shadow-latency-ratio", 2, "Report latency diff when the latency ratio of shadow and primary target is out of [1/ratio, ratio], <= 0 means never")
+	pFlags.StringVar(&ReplayConfig.WriteMode, "write-mode", src.ReplayWriteDirect, "How to replay write statements (INSERT/UPDATE/DELETE/TRUNCATE): direct, sandbox (rewrite the target tables by --sandbox-*) or explain (send 'EXPLAIN <stmt>' instead)")
+	pFlags.StringVar(&ReplayConfig.SandboxDB, "sandbox-db", "", "Redirect the target tables of write statements to this database, requires --write-mode=sandbox")
+	pFlags.StringVar(&ReplayConfig.SandboxTableSuffix, "sandbox-table-suffix", "", "Append the suffix to the target tables of write statements, like '_shadow', requires --write-mode=sandbox")
+	pFlags.StringVar(&ReplayConfig.CapturePlan, "capture-plan", "", "Capture the plan of each distinct query fingerprint by 'EXPLAIN' (explain) or 'EXPLAIN SHAPE PLAN' (shape), so that 'dodo diff' can report plan changes")
+	pFlags.Lookup("capture-plan").NoOptDefVal = src.ReplayPlanExplain
+	pFlags.DurationVar(&ReplayConfig.ProfileThreshold, "profile-threshold", 0, "Enable profile and save the profiles of queries slower than this value (fetched from --http-port) in '<result-dir>/profile', <= 0 means never")
+	pFlags.StringVar(&ReplayConfig.TimeWarp_, "time-warp", "", "Shift the date/datetime literals of queries by an offset like '720h', '-90d', or by the duration between replay time and original query time if 'now'")
+	pFlags.StringVar(&ReplayConfig.UserMapFile, "user-map", "", "YAML file that maps the original users to replay user/password and workload group, and sets per user/db max concurrency")
+	pFlags.IntVar(&ReplayConfig.MaxConcurrencyPerUser, "max-concurrency-per-user", 0, "Max concurrent queries of each original user, <= 0 means unlimited")
+	pFlags.IntVar(&ReplayConfig.MaxConcurrencyPerDB, "max-concurrency-per-db", 0, "Max concurrent queries of each original database, <= 0 means unlimited")
 
 	flags := replayCmd.Flags()
 	flags.BoolVar(&ReplayConfig.Clean, "clean", false, "Clean previous replay result")
 }
 
 func completeReplayConfig() (err error) {
-	if ReplayConfig.ReplayFile == "" {
+	if len(ReplayConfig.ReplayFiles_) == 0 {
 		return errors.New("replay file is required, please use --file flag")
 	}
+	ReplayConfig.ReplayFiles, err = expandDumpFiles(ReplayConfig.ReplayFiles_)
+	if err != nil {
+		return err
+	}
+	if len(ReplayConfig.ReplayFiles) == 0 {
+		return fmt.Errorf("no replay file found: %v", ReplayConfig.ReplayFiles_)
+	}
 	if ReplayConfig.ReplayResultDir == "" {
 		ReplayConfig.ReplayResultDir = filepath.Join(GlobalConfig.OutputDir, "replay")
 	}
@@ -128,6 +205,50 @@ func completeReplayConfig() (err error) {
 	if ReplayConfig.Speed <= 0 {
 		return errors.New("replay speed must be > 0")
 	}
+	if ReplayConfig.QPS < 0 {
+		return errors.New("replay qps must be >= 0")
+	}
+	if ReplayConfig.QPS > 0 {
+		ReplayConfig.OpenLoop = true
+	}
+	if ReplayConfig.QPSRamp > 0 && ReplayConfig.QPS == 0 {
+		return errors.New("--qps-ramp requires --qps")
+	}
+	if ReplayConfig.OpenLoop && ReplayConfig.PoolSize <= 0 {
+		return errors.New("replay pool size must be > 0")
+	}
+	if ReplayConfig.Resume && ReplayConfig.Clean {
+		return errors.New("--resume conflicts with --clean")
+	}
+	if ReplayConfig.ShadowHost == "" && (ReplayConfig.ShadowPort != 0 || ReplayConfig.ShadowUser != "" || ReplayConfig.ShadowPasswordSet || ReplayConfig.ShadowCatalog != "" || ReplayConfig.ShadowCluster != "") {
+		return errors.New("--shadow-* flags require --shadow-host")
+	}
+	switch ReplayConfig.WriteMode {
+	case src.ReplayWriteSandbox:
+		if ReplayConfig.SandboxDB == "" && ReplayConfig.SandboxTableSuffix == "" {
+			return errors.New("--write-mode=sandbox requires --sandbox-db or --sandbox-table-suffix")
+		}
+	case src.ReplayWriteDirect, src.ReplayWriteExplain:
+		if ReplayConfig.SandboxDB != "" || ReplayConfig.SandboxTableSuffix != "" {
+			return errors.New("--sandbox-* flags require --write-mode=sandbox")
+		}
+	default:
+		return fmt.Errorf("unknown write mode '%s', should be one of: %s, %s, %s", ReplayConfig.WriteMode, src.ReplayWriteDirect, src.ReplayWriteSandbox, src.ReplayWriteExplain)
+	}
+	if ReplayConfig.CapturePlan != "" && ReplayConfig.CapturePlan != src.ReplayPlanExplain && ReplayConfig.CapturePlan != src.ReplayPlanShape {
+		return fmt.Errorf("unknown capture plan mode '%s', should be one of: %s, %s", ReplayConfig.CapturePlan, src.ReplayPlanExplain, src.ReplayPlanShape)
+	}
+
+	if ReplayConfig.TimeWarp_ != "" {
+		if ReplayConfig.TimeWarp, err = src.ParseReplayTimeWarp(ReplayConfig.TimeWarp_); err != nil {
+			return err
+		}
+	}
+	if ReplayConfig.UserMapFile != "" {
+		if ReplayConfig.UserMap, err = src.ReadReplayUserMap(ReplayConfig.UserMapFile); err != nil {
+			return err
+		}
+	}
 
 	ReplayConfig.DBs = lo.SliceToMap(GlobalConfig.DBs, func(s string) (string, struct{}) { return s, struct{}{} })
 	ReplayConfig.Users = lo.SliceToMap(ReplayConfig.Users_, func(s string) (string, struct{}) { return s, struct{}{} })
@@ -136,38 +257,40 @@ func completeReplayConfig() (err error) {
 }
 
 func replay(ctx context.Context) error {
-	f, err := os.Open(ReplayConfig.ReplayFile)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	buf := bufio.NewScanner(f)
-	buf.Buffer(make([]byte, 0, 10*1024*1024), 10*1024*1024)
-
-	logrus.Debugf("replay file %s with filter, db: %v, user: %v, from: %s, to: %s",
-		ReplayConfig.ReplayFile,
+	logrus.Debugf("replay files %v with filter, db: %v, user: %v, from: %s, to: %s",
+		ReplayConfig.ReplayFiles,
 		ReplayConfig.DBs,
 		ReplayConfig.Users,
 		ReplayConfig.From_, ReplayConfig.To_,
 	)
 
-	// TODO: better to use connection -> sqls, but no connection id in audit log yet
-	client2Sqls, minTs, count, err := src.DecodeReplaySqls(
-		buf,
-		ReplayConfig.DBs,
-		ReplayConfig.Users,
-		ReplayConfig.From,
-		ReplayConfig.To,
-		ReplayConfig.ClientCount,
+	var (
+		clientSqls []src.ClientSqls
+		minTs      int64
+		count      int
+		err        error
 	)
+	if ReplayConfig.Stream {
+		var splitDir string
+		splitDir, clientSqls, minTs, count, err = splitReplaySqls(
+			ReplayConfig.ReplayFiles,
+			ReplayConfig.DBs,
+			ReplayConfig.Users,
+			ReplayConfig.From,
+			ReplayConfig.To,
+			ReplayConfig.ClientCount,
+		)
+		if splitDir != "" {
+			defer os.RemoveAll(splitDir)
+		}
+	} else {
+		clientSqls, minTs, count, err = decodeReplaySqls()
+	}
 	if err != nil {
 		return err
 	}
-	clientSqls := lo.MapToSlice(client2Sqls, func(k string, v []*src.ReplaySql) src.ClientSqls {
-		return src.ClientSqls{Client: k, Sqls: v}
-	})
 	if len(clientSqls) == 0 {
-		return fmt.Errorf("no SQLs found in replay file: %s", ReplayConfig.ReplayFile)
+		return fmt.Errorf("no SQLs found in replay files: %v", ReplayConfig.ReplayFiles)
 	}
 	logrus.Infoln("Found", count, "replay sql(s)")
 
@@ -179,10 +302,143 @@ func replay(ctx context.Context) error {
 		return err
 	}
 
-	return src.ReplaySqls(
-		ctx,
-		GlobalConfig.DBHost, GlobalConfig.DBPort, GlobalConfig.DBUser, GlobalConfig.DBPassword, GlobalConfig.Catalog, ReplayConfig.Cluster,
-		ReplayConfig.ReplayResultDir, clientSqls, ReplayConfig.Speed, ReplayConfig.MaxHashRows, ReplayConfig.MaxConnIdleTime,
-		minTs, GlobalConfig.Parallel,
+	opts := src.ReplayOpts{
+		Host:     GlobalConfig.DBHost,
+		Port:     GlobalConfig.DBPort,
+		User:     GlobalConfig.DBUser,
+		Password: GlobalConfig.DBPassword,
+		Catalog:  GlobalConfig.Catalog,
+		Cluster:  ReplayConfig.Cluster,
+
+		ResultDir:       ReplayConfig.ReplayResultDir,
+		Speed:           ReplayConfig.Speed,
+		MaxHashRows:     ReplayConfig.MaxHashRows,
+		MaxSaveRows:     ReplayConfig.MaxSaveRows,
+		MaxConnIdleTime: ReplayConfig.MaxConnIdleTime,
+		Parallel:        GlobalConfig.Parallel,
+
+		OpenLoop: ReplayConfig.OpenLoop,
+		QPS:      ReplayConfig.QPS,
+		QPSRamp:  ReplayConfig.QPSRamp,
+		PoolSize: ReplayConfig.PoolSize,
+
+		ProgressInterval: ReplayConfig.ProgressInterval,
+		MetricsAddr:      ReplayConfig.MetricsAddr,
+		Resume:           ReplayConfig.Resume,
+
+		CapturePlan:      ReplayConfig.CapturePlan,
+		ProfileThreshold: ReplayConfig.ProfileThreshold,
+		HTTPPort:         GlobalConfig.HTTPPort,
+
+		TimeWarp: ReplayConfig.TimeWarp,
+
+		UserMap:               ReplayConfig.UserMap,
+		MaxConcurrencyPerUser: ReplayConfig.MaxConcurrencyPerUser,
+		MaxConcurrencyPerDB:   ReplayConfig.MaxConcurrencyPerDB,
+	}
+	if ReplayConfig.ShadowHost != "" {
+		opts.Shadow = &src.ReplayShadow{
+			Host:     ReplayConfig.ShadowHost,
+			Port:     lo.CoalesceOrEmpty(ReplayConfig.ShadowPort, opts.Port),
+			User:     lo.CoalesceOrEmpty(ReplayConfig.ShadowUser, opts.User),
+			Password: lo.Ternary(ReplayConfig.ShadowPasswordSet, ReplayConfig.ShadowPassword, opts.Password),
+			Catalog:  lo.CoalesceOrEmpty(ReplayConfig.ShadowCatalog, opts.Catalog),
+			Cluster:  lo.CoalesceOrEmpty(ReplayConfig.ShadowCluster, opts.Cluster),
+
+			LatencyRatio: ReplayConfig.ShadowLatencyRatio,
+		}
+	}
+	if ReplayConfig.WriteMode != src.ReplayWriteDirect {
+		opts.Sandbox = &src.ReplaySandbox{
+			Mode:        ReplayConfig.WriteMode,
+			DB:          ReplayConfig.SandboxDB,
+			TableSuffix: ReplayConfig.SandboxTableSuffix,
+		}
+	}
+
+	return src.ReplaySqls(ctx, opts, clientSqls, minTs, count)
+}
+
+func decodeReplaySqls() ([]src.ClientSqls, int64, int, error) {
+	// group sqls by session (connection), fallback to client if the dump sql has no session
+	collector := src.NewReplaySqlCollector(
+		ReplayConfig.DBs,
+		ReplayConfig.Users,
+		ReplayConfig.From,
+		ReplayConfig.To,
+		ReplayConfig.ClientCount,
 	)
+	for _, path := range ReplayConfig.ReplayFiles {
+		if err := scanFile(path, collector.Collect); err != nil {
+			return nil, 0, 0, err
+		}
+	}
+
+	client2Sqls, minTs, count := collector.Close()
+	clientSqls := lo.MapToSlice(client2Sqls, func(k string, v []*src.ReplaySql) src.ClientSqls {
+		return src.ClientSqls{Client: k, Sqls: v}
+	})
+	return clientSqls, minTs, count, nil
+}
+
+// splitReplaySqls splits sqls in the dump files into one file per client under a temp dir,
+// each file is sorted by time, so that sqls can be read lazily. The returned dir should be removed by caller.
+func splitReplaySqls(
+	paths []string,
+	dbs, users map[string]struct{},
+	from, to int64,
+	clientCount int,
+) (string, []src.ClientSqls, int64, int, error) {
+	if err := os.MkdirAll(GlobalConfig.DodoDataDir, 0755); err != nil {
+		return "", nil, 0, 0, err
+	}
+	splitDir, err := os.MkdirTemp(GlobalConfig.DodoDataDir, "split-")
+	if err != nil {
+		return "", nil, 0, 0, err
+	}
+	logrus.Debugf("splitting sqls of %v into %s", paths, splitDir)
+
+	splitter := src.NewReplaySqlSplitter(splitDir, dbs, users, from, to, clientCount)
+	for _, path := range paths {
+		if err := scanFile(path, splitter.Split); err != nil {
+			_, _, _, _ = splitter.Close()
+			return splitDir, nil, 0, 0, err
+		}
+	}
+
+	clientSqls, minTs, count, err := splitter.Close()
+	return splitDir, clientSqls, minTs, count, err
+}
+
+func scanFile(path string, fn func(*bufio.Scanner) error) error {
+	f, err := src.OpenDecompressed(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	buf := bufio.NewScanner(f)
+	buf.Buffer(make([]byte, 0, 10*1024*1024), 10*1024*1024)
+
+	logrus.Debugln("reading dump file", path)
+	return fn(buf)
+}
+
+// expandDumpFiles expands globs and directories (to the '*.sql' files in it, and the compressed ones like '*.sql.gz') to dump files.
+func expandDumpFiles(paths []string) ([]string, error) {
+	files := []string{}
+	for _, p := range paths {
+		globs := []string{p}
+		if stat, err := os.Stat(p); err == nil && stat.IsDir() {
+			globs = []string{filepath.Join(p, "*.sql")}
+			for _, ext := range src.CompressionExts() {
+				globs = append(globs, filepath.Join(p, "*.sql"+ext))
+			}
+		}
+		matches, err := src.FileGlob(globs)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	return lo.Uniq(files), nil
 }
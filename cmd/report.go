@@ -0,0 +1,216 @@
+/*
+Copyright © 2024 Thearas thearas850@gmail.com
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/goccy/go-json"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/Thearas/dodo/src"
+)
+
+var ReportConfig = Report{}
+
+type Report struct {
+	OriginalSQLs []string
+	Format       string
+	SortBy       string
+	Top          int
+	OutputFile   string
+}
+
+var (
+	reportFormats = []string{"table", "json", "markdown"}
+	reportSortBys = []string{"count", "p50", "p90", "p99", "max", "err-rate", "rows-mismatch"}
+)
+
+// reportCmd represents the report command
+var reportCmd = &cobra.Command{
+	Use:   "report",
+	Short: "Report replay latency percentiles, error rate and rows mismatches per sql fingerprint",
+	Example: `dodo report --original-sqls dump.sql replay1/
+dodo report --original-sqls dump.sql replay1/ replay2/ --format markdown`,
+	SilenceUsage: true,
+	PersistentPreRunE: func(cmd *cobra.Command, _ []string) error {
+		return initConfig(cmd)
+	},
+	RunE: func(_ *cobra.Command, args []string) error {
+		if err := completeReportConfig(args); err != nil {
+			return err
+		}
+		return report(args)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(reportCmd)
+	reportCmd.PersistentFlags().SortFlags = false
+	reportCmd.Flags().SortFlags = false
+
+	flags := reportCmd.Flags()
+	flags.StringSliceVar(&ReportConfig.OriginalSQLs, "original-sqls", nil, "The original dump sql, used to get the statement of replay results")
+	flags.StringVar(&ReportConfig.Format, "format", "table", "Report format, one of: "+strings.Join(reportFormats, ", "))
+	flags.StringVar(&ReportConfig.SortBy, "sort-by", "p99", "Sort fingerprints in descending order by, one of: "+strings.Join(reportSortBys, ", "))
+	flags.IntVar(&ReportConfig.Top, "top", 0, "Only report the top N fingerprints, 0 means all")
+	flags.StringVar(&ReportConfig.OutputFile, "output-file", "", "Write report to the file instead of stdout")
+}
+
+func completeReportConfig(args []string) error {
+	if len(ReportConfig.OriginalSQLs) == 0 {
+		return errors.New("report requires --original-sqls flag")
+	}
+	if len(args) != 1 && len(args) != 2 {
+		return errors.New("report requires one replay result dir, or two to compare")
+	}
+	if !slices.Contains(reportFormats, ReportConfig.Format) {
+		return fmt.Errorf("invalid report format: %s", ReportConfig.Format)
+	}
+	if !slices.Contains(reportSortBys, ReportConfig.SortBy) {
+		return fmt.Errorf("invalid report sort by: %s", ReportConfig.SortBy)
+	}
+	return nil
+}
+
+func report(args []string) error {
+	// split the original sqls the same as the target replay, so that they can be read client by client
+	clientCount, err := guessClientCount(args[len(args)-1])
+	if err != nil {
+		return err
+	}
+	originals, cleanup, err := readOriginalDumpSQLs(ReportConfig.OriginalSQLs, clientCount)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	// the last replay is the target, the first one (if any) is the baseline
+	results, err := src.ReadReplayResults(args[len(args)-1])
+	if err != nil {
+		return err
+	}
+	var baseResults map[string]*src.ReplayResult
+	if len(args) == 2 {
+		baseResults, err = src.ReadReplayResults(args[0])
+		if err != nil {
+			return err
+		}
+	}
+	logrus.Debugf("report %d replay result(s)", len(results))
+
+	r := src.NewReplayReport(originals, results, baseResults)
+	src.SortReportItems(r.Items, ReportConfig.SortBy)
+	if ReportConfig.Top > 0 && len(r.Items) > ReportConfig.Top {
+		r.Items = r.Items[:ReportConfig.Top]
+	}
+
+	w := io.Writer(os.Stdout)
+	if ReportConfig.OutputFile != "" {
+		f, err := os.Create(ReportConfig.OutputFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	switch ReportConfig.Format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	case "markdown":
+		return writeReportMarkdown(w, r, len(args) == 2)
+	default:
+		return writeReportTable(w, r, len(args) == 2)
+	}
+}
+
+func reportHeader(compareReplay bool) []string {
+	header := []string{"ID", "COUNT", "ERR%", "P50", "P90", "P99", "MAX", "BASE P50", "BASE P99", "P99 DIFF"}
+	if compareReplay {
+		header = append(header, "ERR MISMATCH", "ROWS MISMATCH")
+	}
+	return append(header, "FINGERPRINT")
+}
+
+func reportRow(item *src.ReportItem, compareReplay bool, maxFingerprintLen int) []string {
+	row := []string{
+		item.Id,
+		fmt.Sprint(item.Count),
+		fmt.Sprintf("%.2f", item.ErrRate*100),
+		fmt.Sprintf("%dms", item.P50Ms),
+		fmt.Sprintf("%dms", item.P90Ms),
+		fmt.Sprintf("%dms", item.P99Ms),
+		fmt.Sprintf("%dms", item.MaxMs),
+	}
+	if item.Base != nil {
+		diff := "-"
+		if item.Base.P99Ms > 0 {
+			diff = fmt.Sprintf("%+.1f%%", float64(item.P99Ms-item.Base.P99Ms)*100/float64(item.Base.P99Ms))
+		}
+		row = append(row, fmt.Sprintf("%dms", item.Base.P50Ms), fmt.Sprintf("%dms", item.Base.P99Ms), diff)
+	} else {
+		row = append(row, "-", "-", "-")
+	}
+	if compareReplay {
+		row = append(row, fmt.Sprint(item.ErrMismatches), fmt.Sprint(item.RowsMismatches))
+	}
+
+	fp := item.Fingerprint
+	if runes := []rune(fp); maxFingerprintLen > 0 && len(runes) > maxFingerprintLen {
+		fp = string(runes[:maxFingerprintLen]) + "..."
+	}
+	return append(row, fp)
+}
+
+func writeReportTable(w io.Writer, r *src.ReplayReport, compareReplay bool) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(reportHeader(compareReplay), "\t"))
+	fmt.Fprintln(tw, strings.Join(reportRow(r.Total, compareReplay, 0), "\t"))
+	for _, item := range r.Items {
+		fmt.Fprintln(tw, strings.Join(reportRow(item, compareReplay, 100), "\t"))
+	}
+	return tw.Flush()
+}
+
+func writeReportMarkdown(w io.Writer, r *src.ReplayReport, compareReplay bool) error {
+	header := reportHeader(compareReplay)
+	lines := []string{
+		"| " + strings.Join(header, " | ") + " |",
+		"|" + strings.Repeat(" --- |", len(header)),
+	}
+
+	for _, item := range append([]*src.ReportItem{r.Total}, r.Items...) {
+		row := reportRow(item, compareReplay, 0)
+		fp := &row[len(row)-1]
+		if item != r.Total {
+			*fp = "`" + strings.ReplaceAll(*fp, "|", `\|`) + "`"
+		}
+		lines = append(lines, "| "+strings.Join(row, " | ")+" |")
+	}
+
+	_, err := fmt.Fprintln(w, strings.Join(lines, "\n"))
+	return err
+}
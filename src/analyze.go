@@ -0,0 +1,208 @@
+package src
+
+import (
+	"bufio"
+	"cmp"
+	"slices"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+
+	"github.com/Thearas/dodo/src/parser"
+)
+
+// WorkloadAnalysis is the workload profile of dumped sqls.
+type WorkloadAnalysis struct {
+	Queries      int `json:"queries"`
+	Fingerprints int `json:"fingerprints"`
+	ParseErrors  int `json:"parseErrors"`
+
+	Tables     []WorkloadCount      `json:"tables"`
+	Joins      []WorkloadCount      `json:"joins"`
+	Predicates []WorkloadPredicates `json:"predicates"`
+	Functions  []WorkloadCount      `json:"functions"`
+	StmtTypes  []WorkloadStmtType   `json:"stmtTypes"`
+	QPS        []WorkloadQPS        `json:"qps"`
+}
+
+// WorkloadCount is the count of queries referencing the name, like a table, a join or a function.
+type WorkloadCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// WorkloadPredicates is the most common predicate operators of a column.
+type WorkloadPredicates struct {
+	Column    string          `json:"column"`
+	Count     int             `json:"count"`
+	Operators []WorkloadCount `json:"operators"`
+}
+
+// WorkloadStmtType is the count of statement type executed by user.
+type WorkloadStmtType struct {
+	User  string `json:"user"`
+	Type  string `json:"type"`
+	Count int    `json:"count"`
+}
+
+// WorkloadQPS is the query count in a time interval.
+type WorkloadQPS struct {
+	Time  string  `json:"time"`
+	Count int     `json:"count"`
+	QPS   float64 `json:"qps"`
+}
+
+// WorkloadAnalyzer analyzes the dumped sqls without a cluster, each fingerprint is parsed only once per db.
+type WorkloadAnalyzer struct {
+	interval time.Duration
+
+	queries      int
+	parseErrors  int
+	fingerprints map[string]struct{}
+	analyses     map[string]*parser.QueryAnalysis // db + '\x00' + fingerprint -> analysis, nil if parse failed
+
+	tables     map[string]int
+	joins      map[string]int
+	predicates map[string]map[string]int // column -> operator -> count
+	functions  map[string]int
+	stmtTypes  map[[2]string]int // [user, type] -> count
+	buckets    map[int64]int     // interval start (ms) -> count
+}
+
+// NewWorkloadAnalyzer returns the analyzer, the QPS is counted in every interval.
+func NewWorkloadAnalyzer(interval time.Duration) *WorkloadAnalyzer {
+	return &WorkloadAnalyzer{
+		interval:     max(interval, time.Second),
+		fingerprints: map[string]struct{}{},
+		analyses:     map[string]*parser.QueryAnalysis{},
+		tables:       map[string]int{},
+		joins:        map[string]int{},
+		predicates:   map[string]map[string]int{},
+		functions:    map[string]int{},
+		stmtTypes:    map[[2]string]int{},
+		buckets:      map[int64]int{},
+	}
+}
+
+// Collect analyzes the sqls from dump file, can be called multiple times with different dump files.
+func (a *WorkloadAnalyzer) Collect(s *bufio.Scanner) error {
+	d, err := newReplaySqlDecoder(s)
+	if err != nil || d == nil {
+		return err
+	}
+
+	for sql := d.next(); sql != nil; sql = d.next() {
+		a.add(sql)
+	}
+	return s.Err()
+}
+
+func (a *WorkloadAnalyzer) add(s *ReplaySql) {
+	a.queries++
+	if ts, err := s.Timestamp(); err == nil {
+		a.buckets[ts-ts%a.interval.Milliseconds()]++
+	}
+
+	// the tables are qualified by the db of sql, the same fingerprint may reference different tables in other dbs
+	fp := parser.Fingerprint(s.Stmt)
+	a.fingerprints[fp] = struct{}{}
+	key := s.Db + "\x00" + fp
+	qa, ok := a.analyses[key]
+	if !ok {
+		var err error
+		qa, err = parser.AnalyzeQuery(s.QueryId, s.Stmt, s.Db)
+		if err != nil {
+			logrus.Debugf("skip analyzing sql can not be parsed at query_id: %s, err: %v", s.QueryId, err)
+			a.parseErrors++
+		}
+		a.analyses[key] = qa
+	}
+	if qa == nil {
+		a.stmtTypes[[2]string{s.User, "UNKNOWN"}]++
+		return
+	}
+	a.stmtTypes[[2]string{s.User, qa.StmtType}]++
+
+	// count each table, join and function once per query
+	for _, t := range lo.Uniq(qa.Tables) {
+		a.tables[t]++
+	}
+	for _, j := range lo.Uniq(lo.Map(qa.Joins, func(j parser.QueryJoin, _ int) string { return j.Condition })) {
+		a.joins[j]++
+	}
+	for _, p := range qa.Predicates {
+		ops, ok := a.predicates[p.Column]
+		if !ok {
+			ops = map[string]int{}
+			a.predicates[p.Column] = ops
+		}
+		ops[p.Operator]++
+	}
+	for _, f := range lo.Uniq(qa.Functions) {
+		a.functions[f]++
+	}
+}
+
+// Result returns the analysis, only the top N of tables, joins, predicates and functions are kept, <= 0 means all.
+func (a *WorkloadAnalyzer) Result(top int) *WorkloadAnalysis {
+	r := &WorkloadAnalysis{
+		Queries:      a.queries,
+		Fingerprints: len(a.fingerprints),
+		ParseErrors:  a.parseErrors,
+		Tables:       topWorkloadCounts(a.tables, top),
+		Joins:        topWorkloadCounts(a.joins, top),
+		Functions:    topWorkloadCounts(a.functions, top),
+	}
+
+	for col, ops := range a.predicates {
+		p := WorkloadPredicates{Column: col, Operators: topWorkloadCounts(ops, 0)}
+		for _, op := range p.Operators {
+			p.Count += op.Count
+		}
+		r.Predicates = append(r.Predicates, p)
+	}
+	slices.SortFunc(r.Predicates, func(a, b WorkloadPredicates) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), cmp.Compare(a.Column, b.Column))
+	})
+	if top > 0 && len(r.Predicates) > top {
+		r.Predicates = r.Predicates[:top]
+	}
+
+	for k, n := range a.stmtTypes {
+		r.StmtTypes = append(r.StmtTypes, WorkloadStmtType{User: k[0], Type: k[1], Count: n})
+	}
+	slices.SortFunc(r.StmtTypes, func(a, b WorkloadStmtType) int {
+		return cmp.Or(cmp.Compare(a.User, b.User), cmp.Compare(b.Count, a.Count), cmp.Compare(a.Type, b.Type))
+	})
+
+	// fill the idle intervals, so that the QPS over time is continuous
+	if len(a.buckets) > 0 {
+		step := a.interval.Milliseconds()
+		first, last := lo.Min(lo.Keys(a.buckets)), lo.Max(lo.Keys(a.buckets))
+		for ts := first; ts <= last; ts += step {
+			n := a.buckets[ts]
+			r.QPS = append(r.QPS, WorkloadQPS{
+				Time:  time.UnixMilli(ts).UTC().Format("2006-01-02 15:04:05"),
+				Count: n,
+				QPS:   float64(n) / a.interval.Seconds(),
+			})
+		}
+	}
+	return r
+}
+
+// topWorkloadCounts returns the top N counts in descending order, <= 0 means all.
+func topWorkloadCounts(m map[string]int, top int) []WorkloadCount {
+	counts := make([]WorkloadCount, 0, len(m))
+	for name, n := range m {
+		counts = append(counts, WorkloadCount{Name: name, Count: n})
+	}
+	slices.SortFunc(counts, func(a, b WorkloadCount) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), cmp.Compare(a.Name, b.Name))
+	})
+	if top > 0 && len(counts) > top {
+		counts = counts[:top]
+	}
+	return counts
+}
@@ -0,0 +1,51 @@
+package src
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWorkloadAnalyzer(t *testing.T) {
+	sqls := []string{
+		encodeReplaySql(ReplaySqlMeta{Ts_: "2024-09-20 00:00:01.000", QueryId: "1", User: "u1", Db: "db1"}, "select * from t1 join t2 on t1.id = t2.id where t1.a = 1"),
+		encodeReplaySql(ReplaySqlMeta{Ts_: "2024-09-20 00:00:30.000", QueryId: "2", User: "u1", Db: "db1"}, "select * from t1 join t2 on t1.id = t2.id where t1.a = 2"),
+		encodeReplaySql(ReplaySqlMeta{Ts_: "2024-09-20 00:02:00.000", QueryId: "3", User: "u2", Db: "db1"}, "select count(*) from t1 where a > 1"),
+		encodeReplaySql(ReplaySqlMeta{Ts_: "2024-09-20 00:02:01.000", QueryId: "4", User: "u2", Db: "db1"}, "set a = 1"),
+		encodeReplaySql(ReplaySqlMeta{Ts_: "2024-09-20 00:02:02.000", QueryId: "5", User: "u2", Db: "db1"}, "select from where"),
+		encodeReplaySql(ReplaySqlMeta{Ts_: "2024-09-20 00:02:03.000", QueryId: "6", User: "u2", Db: "db2"}, "select count(*) from t1 where a > 2"),
+	}
+	s := bufio.NewScanner(strings.NewReader(strings.Join(sqls, "\n")))
+
+	a := NewWorkloadAnalyzer(time.Minute)
+	require.NoError(t, a.Collect(s))
+	r := a.Result(0)
+	assert.Equal(t, 6, r.Queries)
+	assert.Equal(t, 4, r.Fingerprints)
+	assert.Equal(t, 1, r.ParseErrors)
+	assert.Equal(t, []WorkloadCount{{"db1.t1", 3}, {"db1.t2", 2}, {"db2.t1", 1}}, r.Tables)
+	assert.Equal(t, []WorkloadCount{{"db1.t1.id = db1.t2.id", 2}}, r.Joins)
+	assert.Equal(t, []WorkloadPredicates{
+		{Column: "db1.t1.a", Count: 3, Operators: []WorkloadCount{{"=", 2}, {">", 1}}},
+		{Column: "db2.t1.a", Count: 1, Operators: []WorkloadCount{{">", 1}}},
+	}, r.Predicates)
+	assert.Equal(t, []WorkloadCount{{"count", 2}}, r.Functions)
+	assert.Equal(t, []WorkloadStmtType{
+		{User: "u1", Type: "SELECT", Count: 2},
+		{User: "u2", Type: "SELECT", Count: 2},
+		{User: "u2", Type: "SET", Count: 1},
+		{User: "u2", Type: "UNKNOWN", Count: 1},
+	}, r.StmtTypes)
+	assert.Equal(t, []WorkloadQPS{
+		{Time: "2024-09-20 00:00:00", Count: 2, QPS: 2.0 / 60},
+		{Time: "2024-09-20 00:01:00", Count: 0, QPS: 0},
+		{Time: "2024-09-20 00:02:00", Count: 4, QPS: 4.0 / 60},
+	}, r.QPS)
+
+	r = a.Result(1)
+	assert.Equal(t, []WorkloadCount{{"db1.t1", 3}}, r.Tables)
+}
@@ -0,0 +1,185 @@
+package src
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zeebo/blake3"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/transform"
+)
+
+const (
+	AuditLogFormatAuto = "auto"
+	AuditLogFormatFE   = "fe"
+
+	// auditLogDetectLines is the max count of non-empty lines used to detect the audit log format.
+	auditLogDetectLines = 20
+	// auditLogDetectSize is the max size of log head used to detect the audit log encoding and format.
+	auditLogDetectSize = 1024 * 1024
+)
+
+var (
+	feAuditLogLineRe = regexp.MustCompile(`^\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2},\d`)
+
+	// isQueryStmtRe matches the statements that Doris regards as query (IsQuery=true).
+	isQueryStmtRe = regexp.MustCompile(`(?i)^[\s(]*(SELECT|WITH)\b`)
+
+	auditLogTimeFormats = []string{
+		"2006-01-02 15:04:05,000",
+		"2006-01-02 15:04:05.999999999",
+		time.RFC3339Nano,
+		"2006-01-02T15:04:05.999999999",
+		"060102 15:04:05",
+	}
+
+	auditLogFormats = []*AuditLogFormat{}
+)
+
+// AuditLogFormat is an input format of audit logs, every format emits the same replay sqls.
+type AuditLogFormat struct {
+	Name string
+	// Detect reports whether the first non-empty lines of a log are in this format.
+	Detect func(lines []string) bool
+	// IsRecordStart reports whether the line starts a new record,
+	// a line not starts a record is considered belonging to the previous line.
+	IsRecordStart func(line []byte) bool
+	// NewScanner creates a scanner of the format, source is the base name of the log file.
+	NewScanner func(opts AuditLogScanOpts, source string) AuditLogScanner
+}
+
+// auditLogFlusher is implemented by scanners buffering the incomplete record until the end of log.
+type auditLogFlusher interface {
+	Flush()
+}
+
+// RegisterAuditLogFormat registers an audit log format, formats are detected in the order of registration.
+func RegisterAuditLogFormat(f *AuditLogFormat) {
+	auditLogFormats = append(auditLogFormats, f)
+}
+
+// AuditLogFormatNames returns the names of all registered audit log formats.
+func AuditLogFormatNames() []string {
+	names := make([]string, 0, len(auditLogFormats))
+	for _, f := range auditLogFormats {
+		names = append(names, f.Name)
+	}
+	return names
+}
+
+// GetAuditLogFormat returns the registered audit log format by name.
+func GetAuditLogFormat(name string) (*AuditLogFormat, error) {
+	for _, f := range auditLogFormats {
+		if f.Name == name {
+			return f, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown audit log format '%s', should be one of: %s, %s", name, AuditLogFormatAuto, strings.Join(AuditLogFormatNames(), ", "))
+}
+
+// DetectAuditLogFormat detects the audit log format from the first non-empty lines.
+func DetectAuditLogFormat(lines []string) (*AuditLogFormat, error) {
+	for _, f := range auditLogFormats {
+		if f.Detect(lines) {
+			return f, nil
+		}
+	}
+	return nil, errors.New("unknown audit log format")
+}
+
+func detectAuditLogFormat(format string, r *bufio.Reader, enc encoding.Encoding, name string) (*AuditLogFormat, error) {
+	if format != AuditLogFormatAuto && format != "" {
+		return GetAuditLogFormat(format)
+	}
+
+	// peek the head of log without consuming it, only the complete lines
+	head, err := r.Peek(auditLogDetectSize)
+	if len(head) == 0 && err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("cannot read audit log %s: %v", name, err)
+	}
+	if len(head) == auditLogDetectSize {
+		head = head[:bytes.LastIndexByte(head, '\n')+1]
+	}
+	lines, err := auditLogDetectLinesOf(transform.NewReader(bytes.NewReader(head), enc.NewDecoder()))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read audit log %s: %v", name, err)
+	}
+
+	logFormat, err := DetectAuditLogFormat(lines)
+	if err != nil {
+		return nil, fmt.Errorf("cannot detect format of audit log %s, please specify by '--audit-log-format'", name)
+	}
+	return logFormat, nil
+}
+
+// auditLogDetectLinesOf returns the first non-empty lines of log to detect its format.
+func auditLogDetectLinesOf(r io.Reader) ([]string, error) {
+	lines := make([]string, 0, auditLogDetectLines)
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 0, 10*1024*1024), 10*1024*1024)
+	for len(lines) < auditLogDetectLines && s.Scan() {
+		if line := strings.TrimSpace(s.Text()); line != "" {
+			lines = append(lines, s.Text())
+		}
+	}
+	return lines, s.Err()
+}
+
+// normalizeAuditLogTime converts the time in audit logs to the format of replay sql meta, like '2006-01-02 15:04:05.000'.
+//
+// Unix timestamps in seconds or milliseconds are also supported.
+func normalizeAuditLogTime(s string) (string, bool) {
+	s = strings.Join(strings.Fields(s), " ")
+	for _, layout := range auditLogTimeFormats {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC().Format(replayTsFormat), true
+		}
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n <= 0 {
+		return "", false
+	}
+	if n < 1e11 {
+		// seconds
+		n *= 1000
+	}
+	return time.UnixMilli(int64(n)).UTC().Format(replayTsFormat), true
+}
+
+// auditLogQueryId generates a query id for the logs without query id.
+func auditLogQueryId(h *blake3.Hasher, parts ...string) string {
+	b := hashstr(h, strings.Join(parts, "\x00"))
+	return fmt.Sprintf("%x-%x-%x-%x", b[:4], b[4:6], b[6:8], b[8:16])
+}
+
+var feAuditLogFormat = &AuditLogFormat{
+	Name: AuditLogFormatFE,
+	Detect: func(lines []string) bool {
+		return len(lines) > 0 && feAuditLogLineRe.MatchString(lines[0])
+	},
+	IsRecordStart: func(line []byte) bool {
+		const minLenToMatch = len("yyyy-mm-dd HH:MM:SS,S")
+		return len(line) >= minLenToMatch && feAuditLogLineRe.Match(line[:minLenToMatch])
+	},
+	NewScanner: func(opts AuditLogScanOpts, _ string) AuditLogScanner {
+		return NewAuditLogScanner(opts)
+	},
+}
+
+func init() {
+	// the order matters when detecting, plain sql is the fallback
+	RegisterAuditLogFormat(feAuditLogFormat)
+	RegisterAuditLogFormat(jsonAuditLogFormat)
+	RegisterAuditLogFormat(mysqlGeneralLogFormat)
+	RegisterAuditLogFormat(mysqlSlowLogFormat)
+	RegisterAuditLogFormat(sqlLinesFormat)
+	RegisterAuditLogFormat(sqlFileFormat)
+}
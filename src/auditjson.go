@@ -0,0 +1,114 @@
+package src
+
+import (
+	"bytes"
+	"strings"
+	"unicode"
+
+	"github.com/goccy/go-json"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cast"
+	"github.com/zeebo/blake3"
+)
+
+const AuditLogFormatJSON = "json"
+
+// jsonAuditLogKeys are the candidate keys (normalized by normalizeJSONAuditLogKey) of each field in json audit log,
+// both the column names of audit log table and the keys of fe audit log are supported.
+var jsonAuditLogKeys = map[string][]string{
+	"time":     {"timestamp", "time", "eventtime"},
+	"client":   {"clientip", "client"},
+	"user":     {"user"},
+	"db":       {"db", "database"},
+	"state":    {"state"},
+	"duration": {"querytime", "timems", "durationms"},
+	"queryId":  {"queryid"},
+	"isQuery":  {"isquery"},
+	"feIp":     {"frontendip", "feip"},
+	"stmt":     {"stmt", "statement"},
+}
+
+var jsonAuditLogFormat = &AuditLogFormat{
+	Name: AuditLogFormatJSON,
+	Detect: func(lines []string) bool {
+		return len(lines) > 0 && strings.HasPrefix(strings.TrimSpace(lines[0]), "{") && json.Valid([]byte(lines[0]))
+	},
+	IsRecordStart: func([]byte) bool { return true },
+	NewScanner: func(opts AuditLogScanOpts, _ string) AuditLogScanner {
+		return &JSONAuditLogScanner{SimpleAuditLogScanner: *NewSimpleAuditLogScanner(opts), hash: blake3.New()}
+	},
+}
+
+// JSONAuditLogScanner scans audit logs with one json object per line.
+type JSONAuditLogScanner struct {
+	SimpleAuditLogScanner
+
+	hash *blake3.Hasher
+}
+
+func (*JSONAuditLogScanner) Init() {}
+
+func (s *JSONAuditLogScanner) ScanOne(oneLog []byte) error {
+	oneLog = bytes.TrimSpace(oneLog)
+	if len(oneLog) == 0 {
+		return nil
+	}
+
+	obj := map[string]any{}
+	if err := json.Unmarshal(oneLog, &obj); err != nil {
+		logrus.Warnf("ignore invalid json audit log: %s, err: %v", oneLog, err)
+		return nil
+	}
+	fields := make(map[string]any, len(obj))
+	for k, v := range obj {
+		fields[normalizeJSONAuditLogKey(k)] = v
+	}
+	get := func(field string) any {
+		for _, k := range jsonAuditLogKeys[field] {
+			if v, ok := fields[k]; ok && v != nil {
+				return v
+			}
+		}
+		return nil
+	}
+
+	time, ok := normalizeAuditLogTime(cast.ToString(get("time")))
+	if !ok {
+		logrus.Warnf("ignore json audit log with invalid time: %s", oneLog)
+		return nil
+	}
+	r := &auditLogRecord{
+		Time:       time,
+		Client:     cast.ToString(get("client")),
+		User:       cast.ToString(get("user")),
+		Db:         cast.ToString(get("db")),
+		QueryId:    cast.ToString(get("queryId")),
+		State:      cast.ToString(get("state")),
+		Stmt:       strings.TrimSpace(cast.ToString(get("stmt"))),
+		DurationMs: cast.ToInt64(get("duration")),
+	}
+	r.Fe = cast.ToString(get("feIp"))
+	r.Session = auditLogSession(r.Client, r.Fe)
+	if isQuery := get("isQuery"); isQuery != nil {
+		r.IsQuery = cast.ToBool(isQuery)
+	} else {
+		r.IsQuery = isQueryStmtRe.MatchString(r.Stmt)
+	}
+	if r.QueryId == "" {
+		r.QueryId = auditLogQueryId(s.hash, r.Time, r.Client, r.Stmt)
+	}
+
+	// the stmt is already unescaped by json
+	s.addRecord(r, false, false)
+	return nil
+}
+
+// normalizeJSONAuditLogKey keeps only the lowercase letters and digits of key, like 'Time(ms)' -> 'timems'.
+func normalizeJSONAuditLogKey(k string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, k)
+}
@@ -3,12 +3,16 @@ package src
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
 	"sync/atomic"
+	"time"
 
 	"github.com/dlclark/regexp2"
 	"github.com/samber/lo"
@@ -26,10 +30,16 @@ var (
 	// NOTE: A bit hacky, but it works for now.
 	//
 	// Tested on v2.0.14+, v2.1.x and v3.0.x. Not sure if it also works on others Doris version.
-	stmtMatchFmt = `^(\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2},\d*) \[[^\]]+\] \|Client=([^|]+)\|User=([^|]+)(?:\|Ctl=[^|]+)?\|Db=(%s)(?:\|CommandType=[^|]+)?\|State=%s\|(?:.+?)\|Time(?:\(ms\))?=(\d*)\|(?:.+?)\|QueryId=([a-z0-9-]+)\|IsQuery=%s\|(?:.+?)\|Stmt=(.+?)\|CpuTimeMS=` //nolint:all
+	stmtMatchFmt = `^(\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2},\d*) \[[^\]]+\] \|Client=([^|]+)\|User=([^|]+)(?:\|Ctl=[^|]+)?\|Db=(%s)(?:\|CommandType=[^|]+)?\|State=%s\|(?:.+?)\|Time(?:\(ms\))?=(\d*)\|(?:.+?)\|QueryId=([a-z0-9-]+)\|IsQuery=(%s)\|(?:.*?\|feIp=([^|]*))?.*?\|Stmt=(.+?)\|CpuTimeMS=` //nolint:all
 
 	// filterStmtRe filters out some statements from the audit log.
 	filterStmtRe = regexp.MustCompile("(?i)^(EXPLAIN|SHOW|USE)")
+
+	// sessionStmtRe matches the statements that change the state of a session, like session variables, user variables and current database.
+	sessionStmtRe = regexp.MustCompile(`(?i)^\s*(SET|USE)\s`)
+
+	// sessionVarAssignRe matches one variable assignment of SET, like 'SESSION a = 1', '@@global.a = 1' or '@a := 1'.
+	sessionVarAssignRe = regexp.MustCompile("(?is)^(?:(GLOBAL|SESSION|LOCAL)\\s+)?(@@(?:(GLOBAL|SESSION|LOCAL)\\.)?|@)?`?(\\w+)`?\\s*:?=")
 )
 
 // Not thread safe.
@@ -48,9 +58,13 @@ type AuditLogScanOpts struct {
 	QueryMinDurationMs int64
 	QueryStates        []string
 	OnlySelect         bool
+	SessionStmts       bool // also keep session statements (SET/USE) when OnlySelect
 	From, To           string
 
 	Strict bool
+
+	// Fe is the FE which the audit logs are from, recorded in the sqls whose FE is not in logs.
+	Fe string
 }
 
 // push down filter to db
@@ -66,8 +80,11 @@ func (opts *AuditLogScanOpts) sqlConditions() string {
 	if len(opts.QueryStates) > 0 {
 		conditions += fmt.Sprintf(" AND `state` IN ('%s')", strings.Join(opts.QueryStates, `', '`))
 	}
-	if opts.OnlySelect {
-		conditions += ` AND is_query = 1`
+	if opts.OnlySelect && opts.SessionStmts {
+		conditions += " AND (is_query = 1 OR stmt REGEXP '(?i)^[[:space:]]*(set|use|prepare|execute|deallocate)[[:space:]]')"
+	} else if opts.OnlySelect {
+		// keep prepared statements and the user variables they use
+		conditions += " AND (is_query = 1 OR stmt REGEXP '(?i)^[[:space:]]*(prepare|execute|deallocate|set[[:space:]]+@)')"
 	}
 
 	if opts.From != "" {
@@ -85,41 +102,59 @@ type SqlWriter interface {
 }
 
 // ExtractQueriesFromAuditLog extracts the query from an audit log.
+//
+// The audit logs may be local paths or 'ssh://xxx' urls, the remote ones are read over ssh directly.
+// The reading stops when ctx is done.
 func ExtractQueriesFromAuditLogs(
+	ctx context.Context,
 	writers []SqlWriter,
 	auditlogPaths []string,
 	encoding string,
+	format string,
+	privKey string,
 	opts AuditLogScanOpts,
 	parallel int,
 ) (int, error) {
-	logrus.Infof("Extracting queries of database %v, audit logs: %v", opts.DBs, auditlogPaths)
+	logrus.Infof("Extracting queries of database %v, audit logs: %v", opts.DBs, lo.Map(auditlogPaths, func(p string, _ int) string { return AuditLogCheckpointKey(p) }))
 
 	g := ParallelGroup(parallel)
 
 	counter := &atomic.Int32{}
 	for i, auditlogPath := range auditlogPaths {
 		g.Go(func() error {
-			f, err := os.Open(auditlogPath)
+			name := AuditLogCheckpointKey(auditlogPath)
+			f, err := openAuditLog(ctx, auditlogPath, privKey)
 			if err != nil {
-				logrus.Errorln("Unable to open audit log file:", auditlogPath)
+				logrus.Errorln("Unable to open audit log file:", name)
 				return err
 			}
 			defer f.Close()
+			r := bufio.NewReaderSize(f, auditLogDetectSize)
 
 			// detect encoding
-			enc, err := detectAuditLogEncoding(encoding, f)
+			enc, err := detectAuditLogEncoding(encoding, r, name)
+			if err != nil {
+				return err
+			}
+
+			// detect format
+			logFormat, err := detectAuditLogFormat(format, r, enc, name)
 			if err != nil {
 				return err
 			}
 
-			buf := bufio.NewScanner(transform.NewReader(f, enc.NewDecoder()))
+			buf := bufio.NewScanner(transform.NewReader(r, enc.NewDecoder()))
 			buf.Buffer(make([]byte, 0, 10*1024*1024), 10*1024*1024)
 
-			logrus.Debugln("Extracting queries from audit log:", auditlogPath, "with encoding:", enc)
+			logrus.Debugln("Extracting queries from audit log:", name, "with encoding:", enc, "and format:", logFormat.Name)
 
 			// read log file line by line
-			s := NewAuditLogScanner(opts)
-			count, err := extractQueriesFromAuditLog(writers[i], s, buf)
+			s := logFormat.NewScanner(opts, auditLogSourceName(name))
+			count, err := extractQueriesFromAuditLog(writers[i], s, logFormat, buf)
+			if ctx.Err() != nil {
+				// the reading is interrupted, the queries are incomplete
+				return ctx.Err()
+			}
 			if err != nil {
 				return err
 			}
@@ -137,31 +172,97 @@ func ExtractQueriesFromAuditLogs(
 	return int(counter.Load()), nil
 }
 
+// openAuditLog opens the local or remote ('ssh://xxx') audit log, the compressed one is decompressed on the fly.
+// The audit log is closed when ctx is done, so that reading it stops.
+func openAuditLog(ctx context.Context, auditlogPath, privKey string) (io.ReadCloser, error) {
+	var (
+		f   io.ReadCloser
+		err error
+	)
+	if strings.HasPrefix(auditlogPath, "ssh://") {
+		f, err = SshCat(ctx, privKey, auditlogPath)
+	} else {
+		var file *os.File
+		if file, err = os.Open(auditlogPath); err == nil {
+			stop := context.AfterFunc(ctx, func() { file.Close() })
+			f = readCloser{file, closerFunc(func() error { stop(); return file.Close() })}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := Decompress(f)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decompress audit log %s: %v", AuditLogCheckpointKey(auditlogPath), err)
+	}
+	return r, nil
+}
+
+// auditLogFileDateRe matches the date in the name of rotated audit logs,
+// like 'fe.audit.log.20240806-1' (rotated daily) and 'fe.audit.log.2024080623-1.gz' (rotated hourly).
+var auditLogFileDateRe = regexp.MustCompile(`\.(\d{8}|\d{10})(?:-\d+)?(?:\.gz|\.zst|\.lz4)?$`)
+
+// AuditLogFileInTimeRange reports whether the audit log may have logs between from and to by the date in its name,
+// the one without date (like the current 'fe.audit.log') is always in range.
+func AuditLogFileInTimeRange(name, from, to string) bool {
+	m := auditLogFileDateRe.FindStringSubmatch(filepath.Base(name))
+	if m == nil {
+		return true
+	}
+	layout, period := "20060102", 24*time.Hour
+	if len(m[1]) == len("2006010215") {
+		layout, period = "2006010215", time.Hour
+	}
+	start, err := time.Parse(layout, m[1])
+	if err != nil {
+		return true
+	}
+
+	if from != "" && start.Add(period).Format(time.DateTime) <= from {
+		return false
+	}
+	if to != "" && start.Format(time.DateTime) > to {
+		return false
+	}
+	return true
+}
+
 func extractQueriesFromAuditLog(
 	w SqlWriter,
 	s AuditLogScanner,
+	format *AuditLogFormat,
 	auditlog *bufio.Scanner,
 ) (int, error) {
 	s.Init()
 	defer s.Close()
 
+	return scanAuditLogRecords(w, s, format, auditlog)
+}
+
+// scanAuditLogRecords scans the records of audit log, the scanner must be initialized.
+func scanAuditLogRecords(
+	w SqlWriter,
+	s AuditLogScanner,
+	format *AuditLogFormat,
+	auditlog *bufio.Scanner,
+) (int, error) {
 	// read log file line by line
 	if !auditlog.Scan() {
 		logrus.Warningln("Failed to scan audit log file, maybe empty?")
 		return 0, nil
 	}
 	var (
-		line   = auditlog.Bytes()
-		lineRe = regexp.MustCompile(`^\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2},\d`)
-		eof    = false
-		count  = 0
+		line  = auditlog.Bytes()
+		eof   = false
+		count = 0
 	)
 
 	for !eof {
 		oneLog := bytes.Clone(line)
 
 		// one log may have multiple lines
-		// a line not starts with 'yyyy-mm-dd HH:MM:SS,S' is considered belonging to the previous line
+		// a line not starts a record is considered belonging to the previous line
 		for {
 			if !auditlog.Scan() {
 				eof = true
@@ -169,8 +270,7 @@ func extractQueriesFromAuditLog(
 			}
 			line = auditlog.Bytes()
 
-			const minLenToMatch = len("yyyy-mm-dd HH:MM:SS,S")
-			if len(line) >= minLenToMatch && lineRe.Match(line[:minLenToMatch+1]) {
+			if format.IsRecordStart(line) {
 				break
 			}
 
@@ -193,6 +293,17 @@ func extractQueriesFromAuditLog(
 		count += count_
 	}
 
+	// some scanners buffer the incomplete record until the end of log
+	if f, ok := s.(auditLogFlusher); ok {
+		f.Flush()
+		count_, err := s.Consume(w)
+		if err != nil {
+			logrus.Errorln("Failed to output audit log")
+			return 0, err
+		}
+		count += count_
+	}
+
 	return count, nil
 }
 
@@ -204,6 +315,9 @@ type SimpleAuditLogScanner struct {
 	distinctQueryTs  string
 
 	re *regexp2.Regexp
+
+	// created on the first record
+	prepared *preparedStmts
 }
 
 func NewSimpleAuditLogScanner(opts AuditLogScanOpts) *SimpleAuditLogScanner {
@@ -216,7 +330,7 @@ func NewSimpleAuditLogScanner(opts AuditLogScanOpts) *SimpleAuditLogScanner {
 
 func (s *SimpleAuditLogScanner) Init() {
 	s.re = regexp2.MustCompile(
-		auditlogQueryRe(s.DBs, s.QueryStates, s.OnlySelect),
+		auditlogQueryRe(s.DBs, s.QueryStates),
 		regexp2.Multiline|regexp2.Singleline|regexp2.Unicode|regexp2.Compiled,
 	)
 }
@@ -256,7 +370,7 @@ func (s *SimpleAuditLogScanner) Consume(w SqlWriter) (int, error) {
 func (*SimpleAuditLogScanner) Close() {}
 
 func (s *SimpleAuditLogScanner) onMatch(caps []string, skipOptsFilter bool) {
-	time, client, user, db, durationMs, queryId, stmt := caps[0], caps[1], caps[2], caps[3], cast.ToInt64(caps[4]), caps[5], caps[6]
+	time, client, user, db, durationMs, queryId, isQuery, feIp, stmt := caps[0], caps[1], caps[2], caps[3], cast.ToInt64(caps[4]), caps[5], cast.ToBool(caps[6]), caps[7], caps[8]
 	time = strings.Replace(time, ",", ".", 1) // 2006-01-02 15:04:05,000 -> 2006-01-02 15:04:05.000
 	stmt = strings.TrimSpace(stmt)
 
@@ -273,27 +387,90 @@ func (s *SimpleAuditLogScanner) onMatch(caps []string, skipOptsFilter bool) {
 		s.distinctQueryTs = time
 	}
 
-	ok := s.filterStmtFromMatch(time, queryId, stmt, durationMs, skipOptsFilter)
-	if !ok {
+	// TODO: May incorrectly unescaped SQLs that originally contain multiline string.
+	s.addRecord(&auditLogRecord{
+		Time:       time,
+		Client:     client,
+		Session:    auditLogSession(client, feIp),
+		Fe:         feIp,
+		User:       user,
+		Db:         db,
+		QueryId:    queryId,
+		Stmt:       stmt,
+		DurationMs: durationMs,
+		IsQuery:    isQuery,
+	}, skipOptsFilter, true)
+}
+
+// auditLogRecord is a query record parsed from audit logs of any format.
+type auditLogRecord struct {
+	Time                 string // like '2006-01-02 15:04:05.000'
+	Client, Session, Fe  string
+	User, Db             string
+	QueryId, State, Stmt string
+	DurationMs           int64
+	IsQuery              bool
+}
+
+// addRecord filters the record and encodes it as replay sql.
+func (s *SimpleAuditLogScanner) addRecord(r *auditLogRecord, skipOptsFilter, unescape bool) {
+	if !skipOptsFilter {
+		// the fe format has been filtered by regex, others are filtered here
+		if len(s.DBs) > 0 && !slices.Contains(s.DBs, r.Db) {
+			return
+		}
+		if len(s.QueryStates) > 0 && r.State != "" && !slices.Contains(s.QueryStates, r.State) {
+			return
+		}
+	}
+
+	stmt := r.Stmt
+	if unescape {
+		stmt = s.unescapeStmt(stmt)
+	}
+
+	// replace the execution of prepared statement by its template
+	if s.prepared == nil {
+		s.prepared = newPreparedStmts()
+	}
+	template, params, prepared, emit := s.prepared.resolve(lo.CoalesceOrEmpty(r.Session, r.Client), stmt)
+	if !emit {
 		return
 	}
+	isQuery := r.IsQuery
+	if prepared {
+		stmt, isQuery = template, isQueryStmtRe.MatchString(template)
+	}
 
-	// TODO: May incorrectly unescaped SQLs that originally contain multiline string.
-	stmt = s.unescapeStmt(stmt)
+	ok := s.filterStmtFromMatch(r.Time, r.QueryId, stmt, r.DurationMs, isQuery, skipOptsFilter)
+	if !ok {
+		return
+	}
 
-	if s.Strict && s.validateSQL(queryId, stmt) != nil {
+	if s.Strict && !prepared && s.validateSQL(r.QueryId, stmt) != nil {
 		return
 	}
 
 	// add leading meta comment
-	outputStmt := EncodeReplaySql(time, client, user, db, queryId, stmt, durationMs)
+	outputStmt := encodeReplaySql(ReplaySqlMeta{
+		Ts_:        r.Time,
+		Client:     r.Client,
+		Session:    r.Session,
+		User:       r.User,
+		Db:         r.Db,
+		QueryId:    r.QueryId,
+		DurationMs: r.DurationMs,
+		Fe:         lo.CoalesceOrEmpty(r.Fe, s.Fe),
+		Prepared:   prepared,
+		Params:     params,
+	}, stmt)
 
 	s.sqls = append(s.sqls, outputStmt)
 }
 
 //nolint:revive
 func (s *SimpleAuditLogScanner) filterStmtFromMatch(
-	time, queryId, stmt string, durationMs int64,
+	time, queryId, stmt string, durationMs int64, isQuery bool,
 	skipOptsFilter bool,
 ) bool {
 	// remove empty stmt
@@ -311,8 +488,15 @@ func (s *SimpleAuditLogScanner) filterStmtFromMatch(
 		return false
 	}
 
+	isSessionStmt := s.SessionStmts && sessionStmtRe.MatchString(stmt)
+
+	// remove non-query statements except session statements
+	if s.OnlySelect && !isQuery && !isSessionStmt {
+		return false
+	}
+
 	// remove explain, show and use statements
-	if !s.OnlySelect && filterStmtRe.MatchString(stmt) {
+	if !s.OnlySelect && !isSessionStmt && filterStmtRe.MatchString(stmt) {
 		return false
 	}
 
@@ -329,7 +513,8 @@ func (s *SimpleAuditLogScanner) filterStmtFromMatch(
 		return false
 	}
 
-	if s.QueryMinDurationMs > 0 {
+	// session statements are always fast, keep them to restore the session state
+	if s.QueryMinDurationMs > 0 && !isSessionStmt {
 		if durationMs < s.QueryMinDurationMs {
 			return false
 		}
@@ -395,6 +580,17 @@ func (*SimpleAuditLogScanner) validateSQL(queryId, stmt string) error {
 	return err
 }
 
+// auditLogSession returns the identity of the connection that executed the query.
+//
+// Doris does not log the connection id, but a client address is unique
+// among the alive connections of one FE, so 'client@fe' is used instead.
+func auditLogSession(client, feIp string) string {
+	if feIp == "" {
+		return ""
+	}
+	return client + "@" + feIp
+}
+
 // Which length is larger than audit_plugin_max_sql_length.
 func logStmtTruncated(queryId, stmt string) bool {
 	var truncated bool
@@ -409,8 +605,10 @@ func logStmtTruncated(queryId, stmt string) bool {
 	return truncated
 }
 
-//nolint:revive
-func auditlogQueryRe(dbs, states []string, onlySelect bool) string {
+// auditlogQueryRe returns the regex of fe audit log.
+//
+// IsQuery is not filtered by regex, since the non-query statements like 'PREPARE' are required by prepared statements.
+func auditlogQueryRe(dbs, states []string) string {
 	var dbFilter string
 	if len(dbs) > 0 {
 		allowDBs := lo.Map(dbs, func(s string, _ int) string { return regexp.QuoteMeta(s) })
@@ -427,25 +625,17 @@ func auditlogQueryRe(dbs, states []string, onlySelect bool) string {
 		stateFilter = "[^|]*"
 	}
 
-	isQuery := "[^|]+"
-	if onlySelect {
-		isQuery = "true"
-	}
-
-	return fmt.Sprintf(stmtMatchFmt, dbFilter, stateFilter, isQuery)
+	return fmt.Sprintf(stmtMatchFmt, dbFilter, stateFilter, "[^|]+")
 }
 
-func detectAuditLogEncoding(encoding string, f *os.File) (encoding.Encoding, error) {
+func detectAuditLogEncoding(encoding string, r *bufio.Reader, name string) (encoding.Encoding, error) {
 	// detect encoding
 	var err error
 	if encoding == "auto" || encoding == "" {
 		// detect encoding
-		encoding, err = DetectCharset(bufio.NewReader(f))
+		encoding, err = DetectCharset(r)
 		if err != nil {
-			return nil, fmt.Errorf("cannot detect charset of audit log %s: %v", f.Name(), err)
-		}
-		if _, err = f.Seek(0, 0); err != nil {
-			return nil, fmt.Errorf("cannot seek audit log %s: %v", f.Name(), err)
+			return nil, fmt.Errorf("cannot detect charset of audit log %s: %v", name, err)
 		}
 	}
 	enc, err := GetEncoding(encoding)
@@ -0,0 +1,164 @@
+package src
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+	CompressionLz4  = "lz4"
+)
+
+// compressions are the supported compressions, detected by the magic number at the head of file.
+var compressions = []struct {
+	name  string
+	ext   string
+	magic []byte
+}{
+	{CompressionGzip, ".gz", []byte{0x1f, 0x8b}},
+	{CompressionZstd, ".zst", []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{CompressionLz4, ".lz4", []byte{0x04, 0x22, 0x4d, 0x18}},
+}
+
+// CompressionNames returns the names of supported compressions.
+func CompressionNames() []string {
+	names := make([]string, 0, len(compressions))
+	for _, c := range compressions {
+		names = append(names, c.name)
+	}
+	return names
+}
+
+// CompressionExts returns the file extensions of supported compressions, like '.gz'.
+func CompressionExts() []string {
+	exts := make([]string, 0, len(compressions))
+	for _, c := range compressions {
+		exts = append(exts, c.ext)
+	}
+	return exts
+}
+
+// CompressionExt returns the file extension of compression, empty if not compressed.
+func CompressionExt(compression string) string {
+	for _, c := range compressions {
+		if c.name == compression {
+			return c.ext
+		}
+	}
+	return ""
+}
+
+// DetectCompression returns the compression of stream by its magic number without consuming it, empty if not compressed.
+func DetectCompression(r *bufio.Reader) string {
+	for _, c := range compressions {
+		if magic, _ := r.Peek(len(c.magic)); bytes.Equal(magic, c.magic) {
+			return c.name
+		}
+	}
+	return ""
+}
+
+// OpenDecompressed opens the file, the compressed one is decompressed on the fly.
+func OpenDecompressed(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := Decompress(f)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decompress %s: %v", path, err)
+	}
+	return r, nil
+}
+
+// Decompress detects the compression of stream and decompresses it on the fly, the stream is closed along with the returned reader.
+func Decompress(rc io.ReadCloser) (io.ReadCloser, error) {
+	r := bufio.NewReader(rc)
+
+	var (
+		dr  io.Reader
+		err error
+	)
+	switch DetectCompression(r) {
+	case CompressionGzip:
+		dr, err = gzip.NewReader(r)
+	case CompressionZstd:
+		var zr *zstd.Decoder
+		if zr, err = zstd.NewReader(r); err == nil {
+			return readCloser{zr, closerFunc(func() error { zr.Close(); return rc.Close() })}, nil
+		}
+	case CompressionLz4:
+		dr = &lz4FramesReader{r: r, zr: lz4.NewReader(r)}
+	default:
+		dr = r
+	}
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return readCloser{dr, rc}, nil
+}
+
+// NewCompressWriter returns the writer which compresses to w, closing it flushes the compressor but not closes w.
+// The writer writes as is if compression is empty.
+func NewCompressWriter(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case "":
+		return nopWriteCloser{w}, nil
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		return zstd.NewWriter(w)
+	case CompressionLz4:
+		return lz4.NewWriter(w), nil
+	}
+	return nil, fmt.Errorf("unknown compression '%s', should be one of: %s", compression, strings.Join(CompressionNames(), ", "))
+}
+
+// lz4FramesReader reads the concatenated lz4 frames, unlike lz4.Reader which stops at the end of first frame.
+type lz4FramesReader struct {
+	r  *bufio.Reader
+	zr *lz4.Reader
+}
+
+func (l *lz4FramesReader) Read(p []byte) (int, error) {
+	n, err := l.zr.Read(p)
+	if !errors.Is(err, io.EOF) {
+		return n, err
+	}
+	if _, err := l.r.Peek(1); err != nil {
+		return n, io.EOF
+	}
+	// next frame
+	l.zr.Reset(l.r)
+	if n > 0 {
+		return n, nil
+	}
+	return l.Read(p)
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error { return f() }
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,42 @@
+package src
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompress(t *testing.T) {
+	dir := t.TempDir()
+	for _, compression := range append([]string{""}, CompressionNames()...) {
+		t.Run("compression_"+compression, func(t *testing.T) {
+			// appended content is written as a new compressed frame
+			buf := &bytes.Buffer{}
+			for _, s := range []string{"select 1;\n", "select 2;\n"} {
+				w, err := NewCompressWriter(buf, compression)
+				require.NoError(t, err)
+				_, err = w.Write([]byte(s))
+				require.NoError(t, err)
+				require.NoError(t, w.Close())
+			}
+
+			path := filepath.Join(dir, "q0.sql"+CompressionExt(compression))
+			require.NoError(t, os.WriteFile(path, buf.Bytes(), 0600))
+
+			r, err := OpenDecompressed(path)
+			require.NoError(t, err)
+			defer r.Close()
+			b, err := io.ReadAll(r)
+			require.NoError(t, err)
+			assert.Equal(t, "select 1;\nselect 2;\n", string(b))
+		})
+	}
+
+	_, err := NewCompressWriter(io.Discard, "bz2")
+	assert.Error(t, err)
+}
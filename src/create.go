@@ -10,6 +10,7 @@ import (
 
 	"github.com/antlr4-go/antlr/v4"
 	"github.com/jmoiron/sqlx"
+	"github.com/samber/lo"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cast"
 
@@ -30,54 +31,24 @@ func RunCreateSQL(ctx context.Context, conn *sqlx.DB, db string, sqlFile string,
 	}
 
 	for _, s_ := range multiStmts.AllStatement() {
-		// only run create table/view sql
+		// only run the sql creating dumped schemas
 		s, ok := s_.(*parser.StatementBaseAliasContext)
 		if !ok {
 			continue
 		}
 
-		var (
-			name       string
-			schemaType SchemaType
-		)
-		if create, ok := s.StatementBase().(*parser.SupportedCreateStatementAliasContext); ok {
-			// 1. table or view
-			var (
-				createTable *parser.CreateTableContext
-				createView  *parser.CreateViewContext
-			)
-			createTable, ok = create.SupportedCreateStatement().(*parser.CreateTableContext)
-			if !ok {
-				createView, ok = create.SupportedCreateStatement().(*parser.CreateViewContext)
-				if !ok {
-					continue
-				}
-			}
-			if createTable != nil {
-				name = strings.ReplaceAll(createTable.GetName().GetText(), "`", "")
-				schemaType = SchemaTypeTable
-			} else {
-				name = strings.ReplaceAll(createView.GetName().GetText(), "`", "")
-				schemaType = SchemaTypeView
-			}
-		} else if create, ok := s.StatementBase().(*parser.MaterializedViewStatementAliasContext); ok {
-			// 2. materialized view
-			createMTMV, ok := create.MaterializedViewStatement().(*parser.CreateMTMVContext)
-			if !ok {
-				continue
-			}
-			name = strings.ReplaceAll(createMTMV.GetMvName().GetText(), "`", "")
-			schemaType = SchemaTypeMaterializedView
-		} else {
+		name, schemaType, ok := createdSchema(s.StatementBase())
+		if !ok {
 			continue
 		}
+		schema := &Schema{Name: name, Type: schemaType, DB: db}
 
 		interval := antlr.NewInterval(s.GetStart().GetTokenIndex(), s.GetStop().GetTokenIndex())
 		stmt := p.GetTokenStream().GetTextFromInterval(interval)
 
 		logrus.Tracef("creating schema in db %s, sql: %s", db, stmt)
 		if dryrun {
-			return "", nil
+			continue
 		}
 		c, err := conn.Connx(ctx)
 		if err != nil {
@@ -97,7 +68,7 @@ func RunCreateSQL(ctx context.Context, conn *sqlx.DB, db string, sqlFile string,
 
 		if err != nil {
 			if strings.Contains(err.Error(), " already exists") {
-				logrus.Infof("skip creating %s '%s.%s', already exists", schemaType.Lower(), db, name)
+				logrus.Infof("skip creating %s '%s', already exists", schemaType.Lower(), schema)
 				continue
 			} else if strings.Contains(err.Error(), " does not exist") {
 				// may deppends on other table/view
@@ -106,12 +77,199 @@ func RunCreateSQL(ctx context.Context, conn *sqlx.DB, db string, sqlFile string,
 			return "", err
 		}
 
-		logrus.Infof("%s '%s.%s' created, cost %.2fs", schemaType.Lower(), db, name, duration.Seconds())
+		if schemaType == SchemaTypeRollup && db != "" {
+			if err := waitRollupJobs(ctx, conn, db); err != nil {
+				return "", err
+			}
+			duration = time.Since(startedAt)
+		}
+
+		logrus.Infof("%s '%s' created, cost %.2fs", schemaType.Lower(), schema, duration.Seconds())
 	}
 
 	return "", nil
 }
 
+// createdSchema returns the name and type of schema created by the statement, ok is false if it creates none of the dumped schemas.
+func createdSchema(stmt parser.IStatementBaseContext) (name string, schemaType SchemaType, ok bool) {
+	unquote := func(s string) string { return strings.Trim(strings.ReplaceAll(s, "`", ""), `'"`) }
+
+	switch s := stmt.(type) {
+	case *parser.SupportedCreateStatementAliasContext:
+		switch c := s.SupportedCreateStatement().(type) {
+		case *parser.CreateTableContext:
+			return unquote(c.GetName().GetText()), SchemaTypeTable, true
+		case *parser.CreateViewContext:
+			return unquote(c.GetName().GetText()), SchemaTypeView, true
+		case *parser.CreateUserDefineFunctionContext:
+			return unquote(c.FunctionIdentifier().GetText()), SchemaTypeFunction, true
+		case *parser.CreateAliasFunctionContext:
+			return unquote(c.FunctionIdentifier().GetText()), SchemaTypeFunction, true
+		case *parser.CreateRowPolicyContext:
+			return unquote(c.GetName().GetText()), SchemaTypeRowPolicy, true
+		case *parser.CreateWorkloadGroupContext:
+			return unquote(c.GetName().GetText()), SchemaTypeWorkloadGroup, true
+		case *parser.CreateResourceContext:
+			return unquote(c.GetName().GetText()), SchemaTypeResource, true
+		case *parser.CreateCatalogContext:
+			return unquote(c.GetCatalogName().GetText()), SchemaTypeCatalog, true
+		}
+	case *parser.SupportedAlterStatementAliasContext:
+		switch c := s.SupportedAlterStatement().(type) {
+		case *parser.AlterTableAddRollupContext:
+			return unquote(c.GetTableName().GetText()), SchemaTypeRollup, true
+		case *parser.AlterSystemContext:
+			if m, ok := c.AlterSystemClause().(*parser.ModifyBackendClauseContext); ok && hasProperty(m.PropertyItemList(), "tag.location") {
+				hosts := lo.Map(m.GetHostPorts(), func(t antlr.Token, _ int) string { return unquote(t.GetText()) })
+				return strings.Join(hosts, ","), SchemaTypeResourceTag, true
+			}
+		}
+	case *parser.SupportedSetStatementAliasContext:
+		if c, ok := s.SupportedSetStatement().(*parser.SetUserPropertiesContext); ok && c.GetUser() != nil &&
+			hasProperty(c.PropertyItemList(), "resource_tags.location") {
+			return unquote(c.GetUser().GetText()), SchemaTypeResourceTag, true
+		}
+	case *parser.MaterializedViewStatementAliasContext:
+		if c, ok := s.MaterializedViewStatement().(*parser.CreateMTMVContext); ok {
+			if isSyncMaterializedView(c) {
+				return unquote(c.GetMvName().GetText()), SchemaTypeRollup, true
+			}
+			return unquote(c.GetMvName().GetText()), SchemaTypeMaterializedView, true
+		}
+	}
+	return "", "", false
+}
+
+// propertyValue returns the unquoted value of property key in the list, ok is false if not found.
+func propertyValue(list parser.IPropertyItemListContext, key string) (value string, ok bool) {
+	if list == nil {
+		return "", false
+	}
+	unquote := func(s string) string { return strings.Trim(s, `'"`) }
+	for _, item := range list.AllPropertyItem() {
+		if strings.EqualFold(unquote(item.GetKey().GetText()), key) {
+			return unquote(item.PropertyValue().GetText()), true
+		}
+	}
+	return "", false
+}
+
+func hasProperty(list parser.IPropertyItemListContext, key string) bool {
+	_, ok := propertyValue(list, key)
+	return ok
+}
+
+// CreateResourceTags sets the dumped resource tags of backends and users.
+//
+// The dumped backends are mapped to the backends of the same address, otherwise to the ones in default location in order,
+// at least one backend is kept in default location for the tables without resource tag, the others are skipped with warning.
+// The users are not dumped, setting the tags of the ones not exist is skipped with warning.
+func CreateResourceTags(ctx context.Context, conn *sqlx.DB, ddls []string, dryrun bool) error {
+	var (
+		backends  []lo.Tuple2[string, string] // dumped address and location
+		userStmts []lo.Tuple2[string, string] // user and statement
+	)
+	for _, ddl := range ddls {
+		b, err := os.ReadFile(ddl)
+		if err != nil {
+			return fmt.Errorf("failed to read SQL file '%s': %v", ddl, err)
+		}
+		p := parser.NewParser(ddl, string(b))
+		multiStmts, err := p.Parse()
+		if err != nil {
+			return err
+		}
+		for _, s_ := range multiStmts.AllStatement() {
+			s, ok := s_.(*parser.StatementBaseAliasContext)
+			if !ok {
+				continue
+			}
+			name, schemaType, ok := createdSchema(s.StatementBase())
+			if !ok || schemaType != SchemaTypeResourceTag {
+				continue
+			}
+			if a, ok := s.StatementBase().(*parser.SupportedAlterStatementAliasContext); ok {
+				m := a.SupportedAlterStatement().(*parser.AlterSystemContext).AlterSystemClause().(*parser.ModifyBackendClauseContext)
+				location, _ := propertyValue(m.PropertyItemList(), "tag.location")
+				for _, addr := range strings.Split(name, ",") {
+					backends = append(backends, lo.T2(addr, location))
+				}
+				continue
+			}
+			interval := antlr.NewInterval(s.GetStart().GetTokenIndex(), s.GetStop().GetTokenIndex())
+			userStmts = append(userStmts, lo.T2(name, p.GetTokenStream().GetTextFromInterval(interval)))
+		}
+	}
+	if len(backends)+len(userStmts) == 0 {
+		return nil
+	}
+
+	rows, err := showRows(ctx, conn, "SHOW BACKENDS")
+	if err != nil {
+		return err
+	}
+	stmts := lo.Map(mapBackendTags(backends, rows), func(t lo.Tuple2[string, string], _ int) lo.Tuple2[string, string] {
+		return lo.T2(t.A, backendTagStmt(t.A, t.B))
+	})
+	for i, t := range append(stmts, userStmts...) {
+		name, stmt := t.Unpack()
+		logrus.Tracef("setting resource tag, sql: %s", stmt)
+		if dryrun {
+			continue
+		}
+		if _, err := conn.ExecContext(ctx, InternalSqlComment+stmt); err != nil {
+			if i < len(stmts) {
+				return fmt.Errorf("tag backend %s failed: %v", name, err)
+			}
+			logrus.Warnf("skip setting resource tags of user '%s', err: %v", name, err)
+			continue
+		}
+		logrus.Infof("resource tag of '%s' set", name)
+	}
+	return nil
+}
+
+// mapBackendTags maps the dumped backend tags (address and location) to the target backends (rows of 'SHOW BACKENDS'),
+// see CreateResourceTags.
+func mapBackendTags(dumped []lo.Tuple2[string, string], rows []map[string]string) []lo.Tuple2[string, string] {
+	var (
+		exists = map[string]bool{}
+		free   []string // the target backends in default location
+	)
+	for _, row := range rows {
+		addr := backendAddr(row)
+		exists[addr] = true
+		if location, err := backendTagLocation(row); err == nil && location == ResourceTagDefault {
+			free = append(free, addr)
+		}
+	}
+	// the backends of the same address are kept, e.g. creating in the dumped cluster
+	free = lo.Filter(free, func(addr string, _ int) bool {
+		return !lo.ContainsBy(dumped, func(t lo.Tuple2[string, string]) bool { return t.A == addr })
+	})
+
+	mapped := make([]lo.Tuple2[string, string], 0, len(dumped))
+	for _, t := range dumped {
+		addr, location := t.Unpack()
+		if !exists[addr] {
+			if len(free) <= 1 {
+				logrus.Warnf("skip tagging backend %s with location '%s', no more backend in default location", addr, location)
+				continue
+			}
+			logrus.Debugf("tag backend %s in place of dumped backend %s", free[0], addr)
+			addr, free = free[0], free[1:]
+		}
+		mapped = append(mapped, lo.T2(addr, location))
+	}
+	return mapped
+}
+
+// isSyncMaterializedView tells whether it creates a sync materialized view, which has none of the async one's clauses, same as Doris.
+func isSyncMaterializedView(c *parser.CreateMTMVContext) bool {
+	return c.BuildMode() == nil && c.REFRESH() == nil && c.GetCols() == nil && c.GetKeys() == nil &&
+		c.HASH() == nil && c.RANDOM() == nil && c.BUCKETS() == nil && c.PARTITION() == nil && c.PropertyClause() == nil
+}
+
 type CreateParserListener struct {
 	*parser.BaseDorisParserListener
 
@@ -3,6 +3,7 @@ package src
 import (
 	"bytes"
 	"context"
+	"database/sql"
 	"fmt"
 	"net"
 	"strconv"
@@ -12,6 +13,7 @@ import (
 	"time"
 
 	"github.com/go-sql-driver/mysql"
+	"github.com/goccy/go-json"
 	"github.com/jmoiron/sqlx"
 	"github.com/samber/lo"
 	"github.com/sirupsen/logrus"
@@ -20,6 +22,7 @@ import (
 
 var (
 	InternalSqlComment = "/*dodo*/"
+	TopNSampleRows     = 100000 // the rows sampled from table to find top-n frequent values of column
 
 	sqlLikeReplacer = strings.NewReplacer(
 		`"`, `\"`,
@@ -27,10 +30,23 @@ var (
 		`%`, `\%`,
 	)
 
+	// AllSchemaTypes are the types of schemas in database, dumped as '{db}.{name}.{type}.sql'.
 	AllSchemaTypes = []SchemaType{
 		SchemaTypeTable,
 		SchemaTypeView,
 		SchemaTypeMaterializedView,
+		SchemaTypeFunction,
+		SchemaTypeRowPolicy,
+		SchemaTypeRollup,
+	}
+
+	// GlobalSchemaTypes are the types of schemas not in any database, dumped as '{name}.{type}.sql'.
+	GlobalSchemaTypes = []SchemaType{
+		SchemaTypeResourceTag,
+		SchemaTypeResource,
+		SchemaTypeWorkloadGroup,
+		SchemaTypeCatalog,
+		SchemaTypeFunction,
 	}
 )
 
@@ -40,6 +56,13 @@ var (
 	SchemaTypeTable            SchemaType = "TABLE"
 	SchemaTypeView             SchemaType = "VIEW"
 	SchemaTypeMaterializedView SchemaType = "MATERIALIZED_VIEW"
+	SchemaTypeFunction         SchemaType = "FUNCTION"
+	SchemaTypeRowPolicy        SchemaType = "ROW_POLICY"
+	SchemaTypeRollup           SchemaType = "ROLLUP" // rollups and sync materialized views of table
+	SchemaTypeResource         SchemaType = "RESOURCE"
+	SchemaTypeWorkloadGroup    SchemaType = "WORKLOAD_GROUP"
+	SchemaTypeCatalog          SchemaType = "CATALOG"
+	SchemaTypeResourceTag      SchemaType = "RESOURCE_TAG" // tag locations of backends and users
 )
 
 func (s SchemaType) sanitize() SchemaType {
@@ -72,6 +95,9 @@ type Schema struct {
 }
 
 func (s *Schema) String() string {
+	if s.DB == "" {
+		return s.Name
+	}
 	return fmt.Sprintf("%s.%s", s.DB, s.Name)
 }
 
@@ -91,6 +117,23 @@ type ColumnStats struct {
 	Min         string `yaml:"min"`
 	Max         string `yaml:"max"`
 	Method      string `yaml:"method"`
+
+	Histogram []*HistogramBucket `yaml:"histogram,omitempty"`
+	TopN      []*TopNValue       `yaml:"topn,omitempty"`
+}
+
+// HistogramBucket is a bucket of 'SHOW COLUMN HISTOGRAM', Count is the number of values in [Lower, Upper].
+type HistogramBucket struct {
+	Lower string `yaml:"lower"`
+	Upper string `yaml:"upper"`
+	Ndv   int64  `yaml:"ndv"`
+	Count int64  `yaml:"count"`
+}
+
+// TopNValue is a frequent value of column, Frequency is its proportion in the sampled non-null values.
+type TopNValue struct {
+	Value     string  `yaml:"value"`
+	Frequency float64 `yaml:"frequency"`
 }
 
 func NewDB(host string, port uint16, user, password, catalog, db string) (*sqlx.DB, error) {
@@ -252,22 +295,23 @@ func ShowTables(ctx context.Context, conn *sqlx.DB, dbname string, tablenamePref
 	return
 }
 
+// ShowBackendCount returns the count of backends in the default tag location, where the replicas of 'replication_num' are,
+// or the count of all backends if none is in the default location.
 func ShowBackendCount(ctx context.Context, conn *sqlx.DB) (count int, err error) {
-	r, err := conn.QueryxContext(ctx, InternalSqlComment+"SHOW BACKENDS")
+	rows, err := showRows(ctx, conn, "SHOW BACKENDS")
 	if err != nil {
 		return 0, err
 	}
-	defer r.Close()
 
-	for r.Next() {
-		_, err := r.SliceScan()
-		if err != nil {
-			return 0, err
+	for _, row := range rows {
+		if location, err := backendTagLocation(row); err != nil || location == ResourceTagDefault {
+			count++
 		}
-		count++
 	}
-
-	return count, r.Err()
+	if count == 0 {
+		return len(rows), nil
+	}
+	return count, nil
 }
 
 func ShowFronendsDisksDir(ctx context.Context, conn *sqlx.DB, diskType string) (dir string, err error) {
@@ -300,6 +344,71 @@ func ShowFronendsDisksDir(ctx context.Context, conn *sqlx.DB, diskType string) (
 	return dir, r.Err()
 }
 
+// Frontend is a FE of cluster.
+type Frontend struct {
+	Host        string
+	Alive       bool
+	AuditLogDir string
+}
+
+// ShowFrontends returns the FEs of cluster and their audit log directories.
+func ShowFrontends(ctx context.Context, conn *sqlx.DB) ([]*Frontend, error) {
+	rows, err := showRows(ctx, conn, "SHOW FRONTENDS")
+	if err != nil {
+		return nil, err
+	}
+	fes := make([]*Frontend, 0, len(rows))
+	for _, row := range rows {
+		fes = append(fes, &Frontend{
+			// 'IP' before Doris 2.0
+			Host:  lo.CoalesceOrEmpty(row["Host"], row["IP"]),
+			Alive: strings.EqualFold(row["Alive"], "true"),
+		})
+	}
+
+	disks, err := showRows(ctx, conn, "SHOW FRONTENDS DISKS")
+	if err != nil {
+		return nil, err
+	}
+	for _, disk := range disks {
+		if disk["DirType"] != "audit-log" {
+			continue
+		}
+		if fe, ok := lo.Find(fes, func(fe *Frontend) bool { return fe.Host == disk["Host"] }); ok {
+			fe.AuditLogDir = disk["Dir"]
+		}
+	}
+	return fes, nil
+}
+
+// showRows returns the rows of 'SHOW xxx' statement as column -> value.
+func showRows(ctx context.Context, conn *sqlx.DB, stmt string) ([]map[string]string, error) {
+	r, err := conn.QueryxContext(ctx, InternalSqlComment+stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	cols, err := r.Columns()
+	if err != nil {
+		return nil, err
+	}
+	vals := lo.ToAnySlice(lo.ToSlicePtr(make([]sql.NullString, len(cols))))
+
+	rows := []map[string]string{}
+	for r.Next() {
+		if err := r.Scan(vals...); err != nil {
+			return nil, err
+		}
+		row := make(map[string]string, len(cols))
+		for i, col := range cols {
+			row[col] = vals[i].(*sql.NullString).String
+		}
+		rows = append(rows, row)
+	}
+	return rows, r.Err()
+}
+
 func exportTable(ctx context.Context, conn *sqlx.DB, dbname, table, target, toURL string, with, props map[string]string) error {
 	strKV := func(k string, v string) string {
 		if !strings.HasPrefix(k, `"`) && !strings.HasSuffix(k, `'`) {
@@ -352,8 +461,11 @@ func cancelExportTable(ctx context.Context, conn *sqlx.DB, dbname string, label
 	return err
 }
 
+// GetTablesStats returns the column stats of tables, with histograms if collected,
+// and the top-N frequent values sampled from table if topN > 0.
+//
 //nolint:revive
-func GetTablesStats(ctx context.Context, conn *sqlx.DB, analyze bool, dbname string, tables ...string) ([]*TableStats, error) {
+func GetTablesStats(ctx context.Context, conn *sqlx.DB, analyze bool, topN int, dbname string, tables ...string) ([]*TableStats, error) {
 	if len(tables) == 0 {
 		return []*TableStats{}, nil
 	}
@@ -364,7 +476,7 @@ func GetTablesStats(ctx context.Context, conn *sqlx.DB, analyze bool, dbname str
 			analyzeTableSync(ctx, conn, dbname, table)
 		}
 
-		s, err := getTableStats(ctx, conn, dbname, table)
+		s, err := getTableStats(ctx, conn, dbname, table, topN)
 		if err != nil {
 			logrus.Errorf("get table stats failed: db: %s, table: %s, err: %v", dbname, table, err)
 			return nil, err
@@ -388,7 +500,7 @@ func analyzeTableSync(ctx context.Context, conn *sqlx.DB, dbname, table string)
 	defer r.Close()
 }
 
-func getTableStats(ctx context.Context, conn *sqlx.DB, dbname, table string) (*TableStats, error) {
+func getTableStats(ctx context.Context, conn *sqlx.DB, dbname, table string, topN int) (*TableStats, error) {
 	logrus.Debugln("get table stats:", table)
 
 	// show all column stats of table.
@@ -436,6 +548,22 @@ func getTableStats(ctx context.Context, conn *sqlx.DB, dbname, table string) (*T
 		return nil, nil
 	}
 
+	// histograms are only there if collected by 'ANALYZE TABLE ... UPDATE HISTOGRAM'
+	histograms, err := getColumnHistograms(ctx, conn, dbname, table)
+	if err != nil {
+		logrus.Debugf("skip column histograms of %s.%s, err: %v", dbname, table, err)
+	}
+	for _, c := range cols {
+		c.Histogram = histograms[c.Name]
+		if topN <= 0 {
+			continue
+		}
+		if c.TopN, err = getColumnTopN(ctx, conn, dbname, table, c.Name, topN); err != nil {
+			// columns like bitmap and array can not be grouped by
+			logrus.Debugf("skip top-n values of column %s.%s.%s, err: %v", dbname, table, c.Name, err)
+		}
+	}
+
 	tbl := &TableStats{
 		Name:     table,
 		RowCount: cols[0].Count,
@@ -444,6 +572,71 @@ func getTableStats(ctx context.Context, conn *sqlx.DB, dbname, table string) (*T
 	return tbl, nil
 }
 
+func getColumnHistograms(ctx context.Context, conn *sqlx.DB, dbname, table string) (map[string][]*HistogramBucket, error) {
+	rows, err := showRows(ctx, conn, fmt.Sprintf("SHOW COLUMN HISTOGRAM `%s`.`%s`", dbname, table))
+	if err != nil {
+		return nil, err
+	}
+
+	histograms := make(map[string][]*HistogramBucket, len(rows))
+	for _, row := range rows {
+		buckets, err := parseHistogramBuckets(row["buckets"])
+		if err != nil {
+			return nil, fmt.Errorf("invalid histogram of column '%s': %v", row["column_name"], err)
+		}
+		if len(buckets) > 0 {
+			histograms[row["column_name"]] = buckets
+		}
+	}
+	return histograms, nil
+}
+
+// parseHistogramBuckets parses the buckets json of 'SHOW COLUMN HISTOGRAM',
+// either an array of buckets or an object with 'buckets' field.
+func parseHistogramBuckets(s string) ([]*HistogramBucket, error) {
+	type bucket struct {
+		Lower string  `json:"lower"`
+		Upper string  `json:"upper"`
+		Ndv   float64 `json:"ndv"`
+		Count float64 `json:"count"`
+	}
+	var (
+		buckets []bucket
+		err     error
+	)
+	if s = strings.TrimSpace(s); strings.HasPrefix(s, "{") {
+		h := struct {
+			Buckets []bucket `json:"buckets"`
+		}{}
+		err = json.Unmarshal([]byte(s), &h)
+		buckets = h.Buckets
+	} else if s != "" {
+		err = json.Unmarshal([]byte(s), &buckets)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return lo.FilterMap(buckets, func(b bucket, _ int) (*HistogramBucket, bool) {
+		return &HistogramBucket{Lower: b.Lower, Upper: b.Upper, Ndv: int64(b.Ndv), Count: int64(b.Count)}, b.Count > 0
+	}), nil
+}
+
+// getColumnTopN returns the top n frequent non-null values of column sampled from table.
+func getColumnTopN(ctx context.Context, conn *sqlx.DB, dbname, table, column string, n int) ([]*TopNValue, error) {
+	rows, err := showRows(ctx, conn, fmt.Sprintf(
+		"SELECT `%[3]s` AS v, count(*) AS cnt, sum(count(*)) OVER () AS total FROM `%[1]s`.`%[2]s` TABLESAMPLE(%[4]d ROWS) WHERE `%[3]s` IS NOT NULL GROUP BY `%[3]s` ORDER BY cnt DESC LIMIT %[5]d",
+		dbname, table, column, TopNSampleRows, n,
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	return lo.Map(rows, func(row map[string]string, _ int) *TopNValue {
+		return &TopNValue{Value: row["v"], Frequency: cast.ToFloat64(row["cnt"]) / cast.ToFloat64(row["total"])}
+	}), nil
+}
+
 func CountAuditlogs(
 	ctx context.Context,
 	db *sqlx.DB,
@@ -579,7 +772,7 @@ func getDBAuditLogsWithConds(
 ) (lastTime string, lastQueryId string, err error) {
 	const maxRetry = 5
 	for retry := range maxRetry {
-		stmt := fmt.Sprintf("SELECT `time`, client_ip, user, db, query_time, query_id, stmt FROM `%s`.`%s` WHERE %s ORDER BY `time`, query_id LIMIT %d OFFSET %d",
+		stmt := fmt.Sprintf("SELECT `time`, client_ip, user, db, query_time, query_id, is_query, frontend_ip, stmt FROM `%s`.`%s` WHERE %s ORDER BY `time`, query_id LIMIT %d OFFSET %d",
 			dbname,
 			table,
 			conditions,
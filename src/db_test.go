@@ -0,0 +1,32 @@
+package src
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseHistogramBuckets(t *testing.T) {
+	want := []*HistogramBucket{
+		{Lower: "1", Upper: "10", Ndv: 10, Count: 100},
+		{Lower: "11", Upper: "20", Ndv: 5, Count: 50},
+	}
+
+	// array of buckets
+	buckets, err := parseHistogramBuckets(`[{"lower":"1","upper":"10","ndv":10.0,"count":100.0,"pre_sum":0.0},{"lower":"11","upper":"20","ndv":5.0,"count":50.0,"pre_sum":100.0}]`)
+	require.NoError(t, err)
+	assert.Equal(t, want, buckets)
+
+	// object with buckets, the empty bucket is dropped
+	buckets, err = parseHistogramBuckets(`{"data_type":"INT","num_buckets":3,"buckets":[{"lower":"1","upper":"10","ndv":10,"count":100},{"lower":"11","upper":"20","ndv":5,"count":50},{"lower":"21","upper":"30","ndv":0,"count":0}]}`)
+	require.NoError(t, err)
+	assert.Equal(t, want, buckets)
+
+	buckets, err = parseHistogramBuckets("")
+	require.NoError(t, err)
+	assert.Empty(t, buckets)
+
+	_, err = parseHistogramBuckets("[{")
+	assert.Error(t, err)
+}
@@ -0,0 +1,489 @@
+package src
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
+	"github.com/zeebo/blake3"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/transform"
+)
+
+const (
+	DumpCheckpointFile = "dump.checkpoint"
+
+	// followChunkSize is the max bytes of audit log read at a time.
+	followChunkSize = 64 * 1024 * 1024
+	// followTableLimit is the max rows of audit log table read at a time.
+	followTableLimit = 1000
+)
+
+// DumpCheckpoint records the progress of following audit logs, so that repeated dumps only capture new queries.
+type DumpCheckpoint struct {
+	// Files is the progress of each audit log file, keyed by its path.
+	Files map[string]*AuditLogFileCheckpoint `json:"files"`
+	// Tables is the progress of each audit log table, keyed by 'db.table'.
+	Tables map[string]*AuditLogTableCheckpoint `json:"tables"`
+
+	mu sync.Mutex
+}
+
+// AuditLogFileCheckpoint is the read offset of an audit log file.
+type AuditLogFileCheckpoint struct {
+	Offset int64 `json:"offset"`
+	// Head is the hash of the first line, the log is regarded as rotated if it changes.
+	Head string `json:"head"`
+}
+
+// AuditLogTableCheckpoint is the last read record of an audit log table.
+type AuditLogTableCheckpoint struct {
+	Time    string `json:"time"`
+	QueryId string `json:"queryId"`
+}
+
+// ReadDumpCheckpoint reads the checkpoint in the dir, returns an empty one if not exists.
+func ReadDumpCheckpoint(dir string) (*DumpCheckpoint, error) {
+	cp := &DumpCheckpoint{}
+	b, err := os.ReadFile(filepath.Join(dir, DumpCheckpointFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	} else if err == nil {
+		if err := json.Unmarshal(b, cp); err != nil {
+			return nil, fmt.Errorf("invalid dump checkpoint: %w", err)
+		}
+	}
+	if cp.Files == nil {
+		cp.Files = map[string]*AuditLogFileCheckpoint{}
+	}
+	if cp.Tables == nil {
+		cp.Tables = map[string]*AuditLogTableCheckpoint{}
+	}
+	return cp, nil
+}
+
+// File returns the checkpoint of audit log file, empty if not exists.
+func (cp *DumpCheckpoint) File(key string) AuditLogFileCheckpoint {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if f, ok := cp.Files[key]; ok {
+		return *f
+	}
+	return AuditLogFileCheckpoint{}
+}
+
+// SetFile sets the checkpoint of audit log file.
+func (cp *DumpCheckpoint) SetFile(key string, f AuditLogFileCheckpoint) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.Files[key] = &f
+}
+
+// Table returns the checkpoint of audit log table, empty if not exists.
+func (cp *DumpCheckpoint) Table(dbtable string) AuditLogTableCheckpoint {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if t, ok := cp.Tables[dbtable]; ok {
+		return *t
+	}
+	return AuditLogTableCheckpoint{}
+}
+
+// SetTable sets the checkpoint of audit log table.
+func (cp *DumpCheckpoint) SetTable(dbtable string, t AuditLogTableCheckpoint) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.Tables[dbtable] = &t
+}
+
+// Write writes the checkpoint to the dir, the queries before it must have been flushed.
+func (cp *DumpCheckpoint) Write(dir string) error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	b, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	// write to a temp file first, so that the checkpoint is never half written
+	path := filepath.Join(dir, DumpCheckpointFile)
+	if err := os.WriteFile(path+".tmp", b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// AuditLogCheckpointKey returns the checkpoint key of audit log path, the password in ssh url is removed.
+func AuditLogCheckpointKey(path string) string {
+	u, err := url.Parse(path)
+	if err != nil || u.Scheme != "ssh" || u.User == nil {
+		return path
+	}
+	u.User = url.User(u.User.Username())
+	return u.String()
+}
+
+// auditLogSource is a growing audit log file, local or remote over ssh.
+type auditLogSource interface {
+	// stat returns the size and the first line of file.
+	stat(ctx context.Context) (size int64, head []byte, err error)
+	// read reads at most n bytes at offset.
+	read(ctx context.Context, offset, n int64) ([]byte, error)
+	Close() error
+}
+
+type localAuditLogSource struct {
+	path string
+}
+
+func (s *localAuditLogSource) stat(context.Context) (int64, []byte, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, nil, err
+	}
+	head, err := bufio.NewReaderSize(f, 4096).ReadSlice('\n')
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, bufio.ErrBufferFull) {
+		return 0, nil, err
+	}
+	return stat.Size(), bytes.Clone(head), nil
+}
+
+func (s *localAuditLogSource) read(_ context.Context, offset, n int64) ([]byte, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b := make([]byte, n)
+	read, err := f.ReadAt(b, offset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return b[:read], nil
+}
+
+func (*localAuditLogSource) Close() error { return nil }
+
+// sshAuditLogSource reads the remote audit log by shell commands over one ssh connection.
+type sshAuditLogSource struct {
+	path   string
+	client *ssh.Client
+}
+
+func newSSHAuditLogSource(privKey, remoteUrl string) (*sshAuditLogSource, error) {
+	client, remotePath, err := sshDial(remoteUrl, privKey)
+	if err != nil {
+		return nil, err
+	}
+	return &sshAuditLogSource{path: remotePath, client: client}, nil
+}
+
+func (s *sshAuditLogSource) output(cmd string) ([]byte, error) {
+	session, err := s.client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	return session.Output(cmd)
+}
+
+func (s *sshAuditLogSource) stat(context.Context) (int64, []byte, error) {
+	path := shellQuote(s.path)
+	out, err := s.output(fmt.Sprintf("stat -L -c %%s %s && head -c 4096 %s | head -n 1", path, path))
+	if err != nil {
+		return 0, nil, fmt.Errorf("stat remote audit log %s failed: %w", s.path, err)
+	}
+	sizeStr, head, _ := bytes.Cut(out, []byte("\n"))
+	size, err := strconv.ParseInt(string(sizeStr), 10, 64)
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid size of remote audit log %s: %s", s.path, sizeStr)
+	}
+	return size, head, nil
+}
+
+func (s *sshAuditLogSource) read(_ context.Context, offset, n int64) ([]byte, error) {
+	out, err := s.output(fmt.Sprintf("tail -c +%d %s | head -c %d", offset+1, shellQuote(s.path), n))
+	if err != nil {
+		return nil, fmt.Errorf("read remote audit log %s failed: %w", s.path, err)
+	}
+	return out, nil
+}
+
+func (s *sshAuditLogSource) Close() error {
+	return s.client.Close()
+}
+
+// AuditLogFollower tails an audit log file (local or 'ssh://xxx') and extracts the new queries after the checkpoint.
+type AuditLogFollower struct {
+	path     string
+	source   auditLogSource
+	encoding string
+	format   string
+	opts     AuditLogScanOpts
+	cp       AuditLogFileCheckpoint
+
+	// detected on the first non-empty read
+	enc       encoding.Encoding
+	logFormat *AuditLogFormat
+	scanner   AuditLogScanner
+
+	// lastSize is the file size of last poll, the last record is regarded as complete if the file stops growing
+	lastSize int64
+}
+
+// NewAuditLogFollower returns the follower of audit log, it starts from the checkpoint,
+// or the end of log if the checkpoint is empty and fromStart is false.
+func NewAuditLogFollower(
+	ctx context.Context,
+	path, privKey, encoding, format string,
+	opts AuditLogScanOpts,
+	cp AuditLogFileCheckpoint,
+	fromStart bool,
+) (*AuditLogFollower, error) {
+	var source auditLogSource = &localAuditLogSource{path: path}
+	if strings.HasPrefix(path, "ssh://") {
+		var err error
+		if source, err = newSSHAuditLogSource(privKey, path); err != nil {
+			return nil, err
+		}
+	}
+
+	f := &AuditLogFollower{path: path, source: source, encoding: encoding, format: format, opts: opts, cp: cp}
+	if cp.Offset == 0 && cp.Head == "" && !fromStart {
+		size, head, err := source.stat(ctx)
+		if err != nil {
+			source.Close()
+			return nil, err
+		}
+		f.cp.Offset, f.cp.Head = size, hashAuditLogHead(head)
+	}
+	return f, nil
+}
+
+// Checkpoint returns the progress of follower, all the extracted queries are before it.
+func (f *AuditLogFollower) Checkpoint() AuditLogFileCheckpoint {
+	return f.cp
+}
+
+// Poll extracts the queries appended since last poll.
+func (f *AuditLogFollower) Poll(ctx context.Context, w SqlWriter) (int, error) {
+	size, head, err := f.source.stat(ctx)
+	if err != nil {
+		return 0, err
+	}
+	headHash := hashAuditLogHead(head)
+	if size < f.cp.Offset || (headHash != "" && f.cp.Head != "" && headHash != f.cp.Head) {
+		logrus.Warnf("audit log %s is rotated, follow from the beginning of the new one", AuditLogCheckpointKey(f.path))
+		f.cp.Offset, f.lastSize = 0, 0
+	}
+	if headHash != "" {
+		f.cp.Head = headHash
+	}
+	idle := size == f.lastSize
+	f.lastSize = size
+
+	count := 0
+	for f.cp.Offset < size && ctx.Err() == nil {
+		b, err := f.source.read(ctx, f.cp.Offset, min(size-f.cp.Offset, followChunkSize))
+		if err != nil {
+			return count, err
+		}
+		if len(b) == 0 {
+			break
+		}
+		if err := f.init(b); err != nil {
+			return count, err
+		}
+
+		// the last record may have more lines to come, unless the file stops growing
+		end := f.completeRecordsEnd(b, idle && f.cp.Offset+int64(len(b)) >= size)
+		if end == 0 {
+			break
+		}
+
+		s := bufio.NewScanner(transform.NewReader(bytes.NewReader(b[:end]), f.enc.NewDecoder()))
+		s.Buffer(make([]byte, 0, 10*1024*1024), 10*1024*1024)
+		n, err := scanAuditLogRecords(w, f.scanner, f.logFormat, s)
+		if err != nil {
+			return count, err
+		}
+		count += n
+		f.cp.Offset += int64(end)
+	}
+	return count, nil
+}
+
+// completeRecordsEnd returns the end of complete records in b, only whole lines are returned.
+func (f *AuditLogFollower) completeRecordsEnd(b []byte, lastComplete bool) int {
+	end := bytes.LastIndexByte(b, '\n') + 1
+	if end == 0 || lastComplete {
+		return end
+	}
+	// cut before the start of last record
+	for start := bytes.LastIndexByte(b[:end-1], '\n') + 1; start > 0; start = bytes.LastIndexByte(b[:start-1], '\n') + 1 {
+		if f.logFormat.IsRecordStart(b[start:]) {
+			return start
+		}
+	}
+	if len(b) < followChunkSize {
+		return 0
+	}
+	// the record is larger than a chunk, give up waiting for it
+	return end
+}
+
+func (f *AuditLogFollower) init(b []byte) error {
+	if f.scanner != nil {
+		return nil
+	}
+
+	encName := f.encoding
+	if encName == "auto" || encName == "" {
+		var err error
+		if encName, err = DetectCharset(bufio.NewReader(bytes.NewReader(b))); err != nil {
+			return fmt.Errorf("cannot detect charset of audit log %s: %v", AuditLogCheckpointKey(f.path), err)
+		}
+	}
+	enc, err := GetEncoding(encName)
+	if err != nil {
+		return err
+	}
+
+	logFormat, err := GetAuditLogFormat(f.format)
+	if f.format == AuditLogFormatAuto || f.format == "" {
+		var lines []string
+		if lines, err = auditLogDetectLinesOf(transform.NewReader(bytes.NewReader(b), enc.NewDecoder())); err == nil {
+			logFormat, err = DetectAuditLogFormat(lines)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("cannot detect format of audit log %s, please specify by '--audit-log-format'", AuditLogCheckpointKey(f.path))
+	}
+	if logFormat.Name == AuditLogFormatSQL {
+		return fmt.Errorf("audit log %s in format '%s' can not be followed", AuditLogCheckpointKey(f.path), logFormat.Name)
+	}
+	logrus.Debugln("Following audit log:", AuditLogCheckpointKey(f.path), "with encoding:", enc, "and format:", logFormat.Name)
+
+	f.enc, f.logFormat = enc, logFormat
+	f.scanner = logFormat.NewScanner(f.opts, auditLogSourceName(AuditLogCheckpointKey(f.path)))
+	f.scanner.Init()
+	return nil
+}
+
+func (f *AuditLogFollower) Close() error {
+	if f.scanner != nil {
+		f.scanner.Close()
+	}
+	return f.source.Close()
+}
+
+func hashAuditLogHead(head []byte) string {
+	// the first line is not complete yet
+	if !bytes.HasSuffix(head, []byte("\n")) {
+		return ""
+	}
+	return anonymizeHashStr(blake3.New(), string(head))
+}
+
+// AuditLogTableFollower polls the audit log table and extracts the new queries after the checkpoint.
+type AuditLogTableFollower struct {
+	db            *sqlx.DB
+	dbname, table string
+	opts          AuditLogScanOpts
+	delay         time.Duration
+	cp            AuditLogTableCheckpoint
+	scanner       *SimpleAuditLogScanner
+}
+
+// NewAuditLogTableFollower returns the follower of audit log table, it starts from the checkpoint,
+// or opts.From, or now if both are empty.
+//
+// Only the records older than delay are read, since the audit logs are loaded into table in batches.
+func NewAuditLogTableFollower(
+	ctx context.Context,
+	db *sqlx.DB,
+	dbname, table string,
+	opts AuditLogScanOpts,
+	delay time.Duration,
+	cp AuditLogTableCheckpoint,
+) (*AuditLogTableFollower, error) {
+	if cp.Time == "" && opts.From == "" {
+		if err := db.GetContext(ctx, &cp.Time, InternalSqlComment+"SELECT CAST(NOW() AS STRING)"); err != nil {
+			return nil, err
+		}
+	}
+
+	s := NewSimpleAuditLogScanner(opts)
+	s.Init()
+	return &AuditLogTableFollower{db: db, dbname: dbname, table: table, opts: opts, delay: delay, cp: cp, scanner: s}, nil
+}
+
+// Checkpoint returns the progress of follower, all the extracted queries are before it.
+func (f *AuditLogTableFollower) Checkpoint() AuditLogTableCheckpoint {
+	return f.cp
+}
+
+// Poll extracts the queries loaded since last poll.
+func (f *AuditLogTableFollower) Poll(ctx context.Context, w SqlWriter) (int, error) {
+	conditions := f.opts.sqlConditions()
+	if f.delay > 0 {
+		conditions += fmt.Sprintf(" AND `time` <= DATE_SUB(NOW(), INTERVAL %d SECOND)", int(f.delay.Seconds()))
+	}
+
+	count := 0
+	for ctx.Err() == nil {
+		conds := conditions
+		if f.cp.QueryId != "" {
+			conds += fmt.Sprintf(" AND (`time` > '%s' OR (`time` = '%s' AND query_id > '%s'))", f.cp.Time, f.cp.Time, f.cp.QueryId)
+		} else if f.cp.Time != "" {
+			conds += fmt.Sprintf(" AND `time` >= '%s'", f.cp.Time)
+		}
+
+		lastTime, lastQueryId, err := getDBAuditLogsWithConds(ctx, f.scanner, f.db, f.dbname, f.table, conds, followTableLimit, 0)
+		if err != nil {
+			// drop the partially read records, they will be read again from the checkpoint
+			f.scanner.sqls = f.scanner.sqls[:0]
+			clear(f.scanner.distinctQueryIds)
+			return count, err
+		}
+		n, err := f.scanner.Consume(w)
+		if err != nil {
+			return count, err
+		}
+		count += n
+		if lastQueryId == "" {
+			break
+		}
+		f.cp.Time, f.cp.QueryId = lastTime, lastQueryId
+	}
+	return count, nil
+}
+
+func (f *AuditLogTableFollower) Close() error {
+	f.scanner.Close()
+	return nil
+}
@@ -144,6 +144,11 @@ func newColGenRule(
 				genRule["max"] = colstats.Max
 			}
 		}
+
+		// the values are weighted by top-n values and histogram to resemble the skew of data
+		if g := newStatsDistributionGenRule(colstats, colBaseType, genRule); g != nil {
+			genRule["gen"] = g
+		}
 	}
 
 	// 2. Merge rules in global custom rules
@@ -151,6 +156,10 @@ func newColGenRule(
 	if !ok || len(customRule) == 0 {
 		return genRule
 	}
+	if lo.SomeBy([]string{"min", "max", "length"}, func(k string) bool { _, ok := customRule[k]; return ok }) {
+		// the custom range overrides the distribution in stats
+		delete(genRule, "gen")
+	}
 	gen.MergeGenRules(genRule, customRule, true)
 
 	notnull := col.NOT() != nil && col.GetNullable() != nil
@@ -161,6 +170,60 @@ func newColGenRule(
 	return genRule
 }
 
+// newStatsDistributionGenRule returns the weighted enum generator rule from top-n values and histogram in stats, nil if there is neither.
+// The top-n values are generated as is, the others are generated in buckets of histogram or the range of rule.
+func newStatsDistributionGenRule(colstats *ColumnStats, colBaseType string, rule GenRule) GenRule {
+	switch colBaseType {
+	case "ARRAY", "MAP", "STRUCT", "JSON", "JSONB", "VARIANT", "BITMAP", "HLL", "QUANTILE_STATE", "AGG_STATE":
+		return nil
+	}
+	// histogram of string is in lexicographical order, can not be generated by range
+	histogram := colstats.Histogram
+	if IsStringType(colBaseType) {
+		histogram = nil
+	}
+	if len(colstats.TopN) == 0 && len(histogram) == 0 {
+		return nil
+	}
+
+	var (
+		enum    []any
+		weights []float64
+	)
+	for _, v := range colstats.TopN {
+		enum = append(enum, v.Value)
+		weights = append(weights, v.Frequency)
+	}
+
+	// the frequency of values not in top-n
+	restFreq := 1 - lo.Sum(weights)
+	if colstats.Ndv > 0 && int64(len(colstats.TopN)) >= colstats.Ndv {
+		restFreq = 0
+	}
+	if restFreq > 1e-6 {
+		// null is generated by the column rule, not the enum
+		restRule := lo.PickByKeys(rule, []string{"min", "max", "length"})
+		restRule["null_frequency"] = 0
+
+		if total := lo.SumBy(histogram, func(b *HistogramBucket) int64 { return b.Count }); total > 0 {
+			for _, b := range histogram {
+				enum = append(enum, lo.Assign(restRule, GenRule{"min": b.Lower, "max": b.Upper}))
+				weights = append(weights, restFreq*float64(b.Count)/float64(total))
+			}
+		} else {
+			enum = append(enum, restRule)
+			weights = append(weights, restFreq)
+		}
+	}
+
+	// normalize, the sampled frequencies may not sum to 1
+	sum := lo.Sum(weights)
+	return GenRule{
+		"enum":    enum,
+		"weights": lo.Map(weights, func(w float64, _ int) any { return w / sum }),
+	}
+}
+
 func buildStreamLoadMapping(visitor *gen.TypeVisitor, loadColName, colBaseType string) (string, bool) {
 	var (
 		mapping     string
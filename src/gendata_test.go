@@ -114,3 +114,59 @@ PROPERTIES (
 	assert.Len(t, resultCSV, 1+tg.Rows) // first line is columns info
 	assert.True(t, strings.HasPrefix(resultCSV[0], GenDataFileFirstLinePrefix))
 }
+
+func TestGendataWithStatsDistribution(t *testing.T) {
+	sql := `CREATE TABLE t (
+    t_int int NOT NULL,
+    t_varchar varchar(255) NOT NULL,
+    t_hist int NOT NULL
+) DUPLICATE KEY(t_int) DISTRIBUTED BY HASH(t_int) BUCKETS 1`
+	stats := &TableStats{
+		Name:     "t",
+		RowCount: 1000,
+		Columns: []*ColumnStats{
+			{
+				Name: "t_int", Ndv: 2, Min: "1", Max: "2",
+				TopN: []*TopNValue{{Value: "1", Frequency: 0.8}, {Value: "2", Frequency: 0.2}},
+			},
+			{
+				Name: "t_varchar", Ndv: 100, AvgSizeByte: 8, Min: "aaaaaaaa", Max: "zzzzzzzz",
+				TopN: []*TopNValue{{Value: "foo", Frequency: 0.5}},
+			},
+			{
+				Name: "t_hist", Ndv: 100, Min: "0", Max: "99",
+				Histogram: []*HistogramBucket{{Lower: "0", Upper: "9", Count: 900}, {Lower: "10", Upper: "99", Count: 100}},
+			},
+		},
+	}
+
+	rows := 10000
+	tg, err := NewTableGen("create-table.sql", sql, stats, rows, nil)
+	assert.NoError(t, err)
+
+	b := &bytes.Buffer{}
+	w := bufio.NewWriter(b)
+	assert.NoError(t, tg.GenCSV(w, tg.Rows))
+	assert.NoError(t, w.Flush())
+
+	var ints, foos, lowHists int
+	for _, line := range strings.Split(b.String(), "\n") {
+		cols := strings.Split(line, string(ColumnSeparator))
+		assert.Len(t, cols, 3)
+		assert.Contains(t, []string{"1", "2"}, cols[0])
+		if cols[0] == "1" {
+			ints++
+		}
+		if cols[1] == "foo" {
+			foos++
+		} else {
+			assert.Len(t, cols[1], 8)
+		}
+		if len(cols[2]) == 1 {
+			lowHists++
+		}
+	}
+	assert.InDelta(t, 0.8, float64(ints)/float64(rows), 0.03)
+	assert.InDelta(t, 0.5, float64(foos)/float64(rows), 0.03)
+	assert.InDelta(t, 0.9, float64(lowHists)/float64(rows), 0.03)
+}
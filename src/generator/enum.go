@@ -3,6 +3,7 @@ package generator
 import (
 	"errors"
 	"fmt"
+	"math"
 	"math/rand/v2"
 	"sort"
 
@@ -75,7 +76,8 @@ func NewEnumGenerator(visitor *TypeVisitor, dataType parser.IDataTypeContext, r
 	if len(weights) != len(enum) {
 		return nil, errors.New("enum length not equals to weights length")
 	}
-	if lo.Sum(weights) != 1 {
+	// tolerate the float error of computed weights, like the ones from column stats
+	if math.Abs(float64(lo.Sum(weights))-1) > 1e-4 {
 		return nil, errors.New("sum of weights should be 1")
 	}
 
@@ -435,7 +435,7 @@ func (v *TypeVisitor) GetLength() (minVal, maxVal int) {
 	}
 
 	switch l := l.(type) {
-	case int, float32, float64:
+	case int, int64, float32, float64:
 		length := cast.ToInt(l)
 		minVal, maxVal = length, length
 	case GenRule:
@@ -27,7 +27,7 @@ type HyperAuditLogScanner struct {
 }
 
 func (s *HyperAuditLogScanner) Init() {
-	s.database, s.scratch = hs_alloc(s.DBs, s.QueryStates, s.OnlySelect)
+	s.database, s.scratch = hs_alloc(s.DBs, s.QueryStates)
 }
 
 func (s *HyperAuditLogScanner) ScanOne(oneLog []byte) error {
@@ -69,18 +69,18 @@ var (
 	hslock  sync.Mutex
 )
 
-func hs_alloc(dbs, states []string, onlySelect bool) (chimera.BlockDatabase, *chimera.Scratch) {
+func hs_alloc(dbs, states []string) (chimera.BlockDatabase, *chimera.Scratch) {
 	hslock.Lock()
 	defer hslock.Unlock()
 
 	if hsAlloc == nil {
-		hsAlloc = hs_makeAuditLogQueryRegex(dbs, states, onlySelect)
+		hsAlloc = hs_makeAuditLogQueryRegex(dbs, states)
 	}
 	return hsAlloc()
 }
 
-func hs_makeAuditLogQueryRegex(dbs, states []string, onlySelect bool) hyperscanAlloc {
-	re := auditlogQueryRe(dbs, states, onlySelect)
+func hs_makeAuditLogQueryRegex(dbs, states []string) hyperscanAlloc {
+	re := auditlogQueryRe(dbs, states)
 
 	pattern := chimera.NewPattern(re, chimera.MultiLine|chimera.DotAll|chimera.SingleMatch|chimera.Utf8Mode|chimera.UnicodeProperty)
 	database, err := chimera.NewManagedBlockDatabase(pattern)
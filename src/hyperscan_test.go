@@ -10,5 +10,5 @@ import (
 )
 
 func Test_hs_makeAuditLogQueryRegex(t *testing.T) {
-	assert.NotPanics(t, func() { hs_makeAuditLogQueryRegex([]string{"db1", "db2"}, nil, true) })
+	assert.NotPanics(t, func() { hs_makeAuditLogQueryRegex([]string{"db1", "db2"}, nil) })
 }
@@ -5,6 +5,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"strings"
@@ -24,10 +25,18 @@ func StreamLoad(ctx context.Context, host, httpPort, user, password, db, table,
 		logrus.Errorf("Open data file '%s' failed", file)
 		return err
 	}
-	r := bufio.NewReader(f)
+	compression := DetectCompression(bufio.NewReader(f))
+	_ = f.Close()
+
+	rc, err := OpenDecompressed(file)
+	if err != nil {
+		logrus.Errorf("Open data file '%s' failed", file)
+		return err
+	}
+	r := bufio.NewReader(rc)
 	columns, err := r.ReadString('\n')
 	if err != nil || len(columns) == 0 {
-		_ = f.Close()
+		_ = rc.Close()
 		return fmt.Errorf("data file '%s' is unreadable or empty", file)
 	}
 
@@ -36,7 +45,7 @@ func StreamLoad(ctx context.Context, host, httpPort, user, password, db, table,
 		skipLines = 0
 		columns = ""
 	}
-	_ = f.Close()
+	_ = rc.Close()
 
 	// use curl to perform stream load
 	userpass := fmt.Sprintf("%s:%s", user, password)
@@ -44,7 +53,12 @@ func StreamLoad(ctx context.Context, host, httpPort, user, password, db, table,
 	if columns != "" {
 		curl += fmt.Sprintf(" -H '%s'", columns)
 	}
-	curl += fmt.Sprintf(" -T '%s'", file)
+	if compression == "" {
+		curl += fmt.Sprintf(" -T '%s'", file)
+	} else {
+		// the compressed file is decompressed and sent by stdin in chunks
+		curl += " -T -"
+	}
 
 	sanitizedCurl := strings.Replace(curl, userpass, fmt.Sprintf("%s:****", user), 1)
 	logrus.Infof("Stream load %s.%s (%s)", db, table, fileProgress)
@@ -57,7 +71,17 @@ func StreamLoad(ctx context.Context, host, httpPort, user, password, db, table,
 	var stdout []byte
 	for range StreamLoadMaxRetries {
 		cmd := exec.CommandContext(ctx, "sh", "-ec", curl)
+		var data io.ReadCloser
+		if compression != "" {
+			if data, err = OpenDecompressed(file); err != nil {
+				return err
+			}
+			cmd.Stdin = data
+		}
 		stdout, err = cmd.Output()
+		if data != nil {
+			_ = data.Close()
+		}
 		if err == nil {
 			break
 		}
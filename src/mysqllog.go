@@ -0,0 +1,245 @@
+package src
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/samber/lo"
+	"github.com/zeebo/blake3"
+)
+
+const (
+	AuditLogFormatMySQLGeneral = "mysql-general"
+	AuditLogFormatMySQLSlow    = "mysql-slow"
+)
+
+var (
+	// mysqlLogHeaderRe matches the header lines written when mysqld starts, like:
+	//
+	//	/usr/sbin/mysqld, Version: 8.0.36 (MySQL Community Server - GPL). started with:
+	//	Tcp port: 3306  Unix socket: /var/run/mysqld/mysqld.sock
+	//	Time                 Id Command    Argument
+	mysqlLogHeaderRe = regexp.MustCompile(`^(\S+, Version: .* started with:|Tcp port: \d+|Time\s+Id\s+Command\s+Argument)`)
+
+	// mysqlGeneralLogLineRe matches a record of general log, the time may be omitted in MySQL 5.6 and earlier, like:
+	//
+	//	2024-08-06T23:44:11.123456Z	   10 Query	SELECT 1
+	//	240806 23:44:11	   10 Query	SELECT 1
+	//			   10 Query	SELECT 2
+	mysqlGeneralLogLineRe = regexp.MustCompile(`(?s)^(\d{4}-\d{2}-\d{2}T\S+|\d{6}\s+\d{1,2}:\d{2}:\d{2})?\s+(\d+) ([A-Z][a-zA-Z ]*?)(?:\t(.*))?$`)
+
+	// mysqlGeneralLogConnectRe matches the argument of 'Connect' command, like 'root@localhost on mydb using TCP/IP'.
+	mysqlGeneralLogConnectRe = regexp.MustCompile(`^(\S*)@(\S*) on (\S*)`)
+
+	mysqlSlowLogTimeRe     = regexp.MustCompile(`^# Time: (.+)$`)
+	mysqlSlowLogUserHostRe = regexp.MustCompile(`^# User@Host: ([^\[\s]*)\[[^\]]*\] @ (\S*) \[([^\]]*)\](?:\s+Id:\s*(\d+))?`)
+	mysqlSlowLogQueryTime  = regexp.MustCompile(`^# Query_time: ([\d.]+)`)
+	mysqlSlowLogTimestamp  = regexp.MustCompile(`(?i)^SET timestamp=(\d+);$`)
+	mysqlUseStmtRe         = regexp.MustCompile("(?i)^use\\s+`?([^`;\\s]+)`?\\s*;?$")
+)
+
+var mysqlGeneralLogFormat = &AuditLogFormat{
+	Name: AuditLogFormatMySQLGeneral,
+	Detect: func(lines []string) bool {
+		// the first line except headers
+		for _, line := range lines {
+			if !mysqlLogHeaderRe.MatchString(line) {
+				return mysqlGeneralLogLineRe.MatchString(line)
+			}
+		}
+		return false
+	},
+	IsRecordStart: func(line []byte) bool {
+		return mysqlLogHeaderRe.Match(line) || mysqlGeneralLogLineRe.Match(line)
+	},
+	NewScanner: func(opts AuditLogScanOpts, _ string) AuditLogScanner {
+		return &MySQLGeneralLogScanner{
+			SimpleAuditLogScanner: *NewSimpleAuditLogScanner(opts),
+			conns:                 map[string]*mysqlConn{},
+			hash:                  blake3.New(),
+		}
+	},
+}
+
+var mysqlSlowLogFormat = &AuditLogFormat{
+	Name: AuditLogFormatMySQLSlow,
+	Detect: func(lines []string) bool {
+		// the first line except headers
+		for _, line := range lines {
+			if !mysqlLogHeaderRe.MatchString(line) {
+				return strings.HasPrefix(line, "# Time: ") || strings.HasPrefix(line, "# User@Host: ")
+			}
+		}
+		return false
+	},
+	IsRecordStart: func(line []byte) bool {
+		// the time line is omitted if it is the same as the previous record
+		s := string(line)
+		return strings.HasPrefix(s, "# Time: ") || strings.HasPrefix(s, "# User@Host: ") || mysqlLogHeaderRe.MatchString(s)
+	},
+	NewScanner: func(opts AuditLogScanOpts, _ string) AuditLogScanner {
+		return &MySQLSlowLogScanner{
+			SimpleAuditLogScanner: *NewSimpleAuditLogScanner(opts),
+			conns:                 map[string]*mysqlConn{},
+			hash:                  blake3.New(),
+		}
+	},
+}
+
+// mysqlConn is the state of a connection in MySQL logs.
+type mysqlConn struct {
+	user, host, db string
+}
+
+func (c *mysqlConn) client(id string) string {
+	return c.host + ":" + id
+}
+
+// MySQLGeneralLogScanner scans MySQL general query log.
+//
+// General log has no query id and duration, query id is generated by hash and duration is always 0.
+type MySQLGeneralLogScanner struct {
+	SimpleAuditLogScanner
+
+	lastTime string
+	conns    map[string]*mysqlConn
+	hash     *blake3.Hasher
+}
+
+func (*MySQLGeneralLogScanner) Init() {}
+
+func (s *MySQLGeneralLogScanner) ScanOne(oneLog []byte) error {
+	caps := mysqlGeneralLogLineRe.FindStringSubmatch(string(oneLog))
+	if caps == nil {
+		return nil
+	}
+	time, id, command, arg := caps[1], caps[2], strings.TrimSpace(caps[3]), strings.TrimSpace(caps[4])
+	if time != "" {
+		var ok bool
+		if time, ok = normalizeAuditLogTime(time); !ok {
+			return nil
+		}
+		s.lastTime = time
+	}
+	time = s.lastTime
+
+	conn, ok := s.conns[id]
+	if !ok {
+		// connected before the log starts
+		conn = &mysqlConn{}
+		s.conns[id] = conn
+	}
+
+	switch command {
+	case "Connect":
+		if m := mysqlGeneralLogConnectRe.FindStringSubmatch(arg); m != nil {
+			conn.user, conn.host, conn.db = m[1], m[2], m[3]
+		}
+	case "Init DB":
+		conn.db = arg
+	case "Quit":
+		if s.prepared != nil {
+			s.prepared.end(conn.client(id))
+		}
+		delete(s.conns, id)
+	case "Query", "Execute":
+		if time == "" || arg == "" {
+			return nil
+		}
+		if m := mysqlUseStmtRe.FindStringSubmatch(arg); m != nil {
+			conn.db = m[1]
+		}
+		client := conn.client(id)
+		s.addRecord(&auditLogRecord{
+			Time:    time,
+			Client:  client,
+			User:    conn.user,
+			Db:      conn.db,
+			QueryId: auditLogQueryId(s.hash, time, client, arg),
+			Stmt:    arg,
+			IsQuery: isQueryStmtRe.MatchString(arg),
+		}, false, false)
+	}
+	return nil
+}
+
+// MySQLSlowLogScanner scans MySQL slow query log.
+type MySQLSlowLogScanner struct {
+	SimpleAuditLogScanner
+
+	// pendingTime is the time of the previous '# Time' line, which is split from its record
+	lastTime, pendingTime string
+
+	conns map[string]*mysqlConn
+	hash  *blake3.Hasher
+}
+
+func (*MySQLSlowLogScanner) Init() {}
+
+func (s *MySQLSlowLogScanner) ScanOne(oneLog []byte) error {
+	var (
+		conn       = &mysqlConn{}
+		id         string
+		time       string
+		timestamp  string
+		hasUser    bool
+		durationMs int64
+		stmt       []string
+	)
+	for _, line := range strings.Split(string(oneLog), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if m := mysqlSlowLogTimeRe.FindStringSubmatch(line); m != nil {
+			time, _ = normalizeAuditLogTime(m[1])
+		} else if m := mysqlSlowLogUserHostRe.FindStringSubmatch(line); m != nil {
+			hasUser = true
+			id = m[4]
+			if c, ok := s.conns[id]; ok && id != "" {
+				conn = c
+			} else if id != "" {
+				s.conns[id] = conn
+			}
+			conn.user, conn.host = m[1], m[2]
+			if m[3] != "" {
+				conn.host = m[3]
+			}
+		} else if m := mysqlSlowLogQueryTime.FindStringSubmatch(line); m != nil {
+			seconds, _ := strconv.ParseFloat(m[1], 64)
+			durationMs = int64(seconds * 1000)
+		} else if strings.HasPrefix(line, "#") || mysqlLogHeaderRe.MatchString(line) {
+			continue
+		} else if m := mysqlSlowLogTimestamp.FindStringSubmatch(line); m != nil {
+			timestamp, _ = normalizeAuditLogTime(m[1])
+		} else if m := mysqlUseStmtRe.FindStringSubmatch(strings.TrimSpace(line)); m != nil && len(stmt) == 0 {
+			conn.db = m[1]
+		} else if len(stmt) > 0 || strings.TrimSpace(line) != "" {
+			stmt = append(stmt, line)
+		}
+	}
+
+	if !hasUser {
+		s.pendingTime = time
+		return nil
+	}
+
+	// the time line is omitted if it is the same as the previous record
+	time = lo.CoalesceOrEmpty(time, s.pendingTime, timestamp, s.lastTime)
+	s.lastTime, s.pendingTime = time, ""
+
+	query := strings.TrimSpace(strings.Join(stmt, "\n"))
+	if time == "" || query == "" {
+		return nil
+	}
+	client := conn.client(id)
+	s.addRecord(&auditLogRecord{
+		Time:       time,
+		Client:     client,
+		User:       conn.user,
+		Db:         conn.db,
+		QueryId:    auditLogQueryId(s.hash, time, client, query),
+		Stmt:       query,
+		DurationMs: durationMs,
+		IsQuery:    isQueryStmtRe.MatchString(query),
+	}, false, false)
+	return nil
+}
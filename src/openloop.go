@@ -0,0 +1,403 @@
+package src
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/goccy/go-json"
+	"github.com/sirupsen/logrus"
+)
+
+// openLoopSchedule computes the scheduled start time of each sql in open-loop replay.
+type openLoopSchedule struct {
+	minTs int64
+	speed float32
+	qps   float64
+	ramp  time.Duration
+}
+
+// at returns the scheduled offset (from replay start) of the i-th sql.
+//
+// Without qps, sqls are fired at their original timestamps scaled by speed.
+// With qps, sqls are fired at a fixed rate, after a linear ramp from 0 to qps.
+func (s *openLoopSchedule) at(i int, sql *ReplaySql) time.Duration {
+	if s.qps <= 0 {
+		return time.Duration(float64(sql.Ts-s.minTs)/float64(s.speed)) * time.Millisecond
+	}
+
+	// during ramp the rate is qps*t/ramp, so the count of sqls fired at t is qps*t^2/(2*ramp)
+	var (
+		n         = float64(i)
+		rampSec   = s.ramp.Seconds()
+		rampCount = s.qps * rampSec / 2
+		sec       float64
+	)
+	if n < rampCount {
+		sec = math.Sqrt(2 * n * rampSec / s.qps)
+	} else {
+		sec = rampSec + (n-rampCount)/s.qps
+	}
+	return time.Duration(sec * float64(time.Second))
+}
+
+type openLoopTask struct {
+	client      string
+	seq         int
+	sql         *ReplaySql
+	scheduledAt time.Time
+}
+
+// openLoopMerger merges sqls of all clients into one timeline,
+// only the head sql of each client is kept in memory, and at most clientFileMaxOpen client files are opened.
+type openLoopMerger struct {
+	clients []string
+	readers []*ReplaySqlReader
+	pool    *clientReaderPool
+	seqs    []int
+	heads   openLoopHeap
+
+	// skipped is the count of executed sqls skipped by resuming
+	skipped int
+}
+
+type openLoopHead struct {
+	idx int
+	sql *ReplaySql
+}
+
+type openLoopHeap []openLoopHead
+
+func (h openLoopHeap) Len() int { return len(h) }
+func (h openLoopHeap) Less(i, j int) bool {
+	if h[i].sql.Ts != h[j].sql.Ts {
+		return h[i].sql.Ts < h[j].sql.Ts
+	}
+	return h[i].idx < h[j].idx
+}
+func (h openLoopHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *openLoopHeap) Push(x any)   { *h = append(*h, x.(openLoopHead)) }
+func (h *openLoopHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+func newOpenLoopMerger(clientSqls []ClientSqls, resume *ReplayCheckpoint) (*openLoopMerger, error) {
+	m := &openLoopMerger{seqs: make([]int, len(clientSqls)), pool: newClientReaderPool(clientFileMaxOpen)}
+	for i := range clientSqls {
+		var resumeAfter string
+		if resume != nil {
+			resumeAfter = resume.Clients[clientSqls[i].Client]
+		}
+		r, skipped, err := openClientSqls(&clientSqls[i], resumeAfter, m.pool)
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+		m.skipped += skipped
+		m.clients = append(m.clients, clientSqls[i].Client)
+		m.readers = append(m.readers, r)
+		if s := r.Next(); s != nil {
+			m.heads = append(m.heads, openLoopHead{idx: i, sql: s})
+		}
+	}
+	heap.Init(&m.heads)
+	return m, nil
+}
+
+// next returns the earliest sql of all clients, or nil if there is no more.
+func (m *openLoopMerger) next() *openLoopTask {
+	if len(m.heads) == 0 {
+		return nil
+	}
+
+	head := m.heads[0]
+	if s := m.readers[head.idx].Next(); s != nil {
+		m.heads[0].sql = s
+		heap.Fix(&m.heads, 0)
+	} else {
+		heap.Pop(&m.heads)
+	}
+	seq := m.seqs[head.idx]
+	m.seqs[head.idx]++
+	return &openLoopTask{client: m.clients[head.idx], seq: seq, sql: head.sql}
+}
+
+func (m *openLoopMerger) Close() {
+	for _, r := range m.readers {
+		r.Close()
+	}
+}
+
+// replayResultWriter writes results of open-loop replay to '<client>.result' (and rows to '<client>.rows.gz'),
+// so that they can be diffed the same as closed-loop replay.
+type replayResultWriter struct {
+	mu      sync.Mutex
+	results *clientFileWriter
+	rows    *clientFileWriter
+}
+
+func newReplayResultWriter(dir string, appendOnly bool) *replayResultWriter {
+	w := &replayResultWriter{
+		results: newClientFileWriter(dir, ReplayResultFileExt),
+		rows:    newClientFileWriter(dir, ReplayRowsFileExt),
+	}
+	w.results.appendOnly, w.rows.appendOnly = appendOnly, appendOnly
+	return w
+}
+
+func (w *replayResultWriter) write(client string, result *ReplayResult, rows *ReplayRows) error {
+	b, err := json.Marshal(result)
+	if err != nil {
+		logrus.Errorln("failed to marshal result:", err)
+		return nil
+	}
+	var rowsb []byte
+	if rows != nil {
+		if rowsb, err = json.Marshal(rows); err != nil {
+			logrus.Errorln("failed to marshal rows:", err)
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(rowsb) > 0 {
+		if err := w.rows.write(client, rowsb); err != nil {
+			logrus.Errorln("client", client, "failed to write rows:", err)
+			return err
+		}
+	}
+	if err := w.results.write(client, b); err != nil {
+		logrus.Errorln("client", client, "failed to write result:", err)
+		return err
+	}
+	return nil
+}
+
+func (w *replayResultWriter) Close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.results.Close(); err != nil {
+		logrus.Errorln("failed to close result files:", err)
+	}
+	if err := w.rows.Close(); err != nil {
+		logrus.Errorln("failed to close rows files:", err)
+	}
+}
+
+// replayLagStats collects the lag of open-loop replay.
+type replayLagStats struct {
+	mu           sync.Mutex
+	count        int64
+	sumMs, maxMs int64
+}
+
+func (s *replayLagStats) add(lagMs int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.count++
+	s.sumMs += lagMs
+	s.maxMs = max(s.maxMs, lagMs)
+}
+
+// openLoopQueue is an unbounded task queue of a pool worker,
+// so that dispatching never waits for a busy worker.
+type openLoopQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	tasks  []*openLoopTask
+	closed bool
+}
+
+func newOpenLoopQueue() *openLoopQueue {
+	q := &openLoopQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *openLoopQueue) push(t *openLoopTask) {
+	q.mu.Lock()
+	q.tasks = append(q.tasks, t)
+	q.mu.Unlock()
+	q.cond.Signal()
+}
+
+// pop returns the next task, it blocks until there is a task or the queue is closed.
+func (q *openLoopQueue) pop() (*openLoopTask, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.tasks) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if len(q.tasks) == 0 {
+		return nil, false
+	}
+	t := q.tasks[0]
+	q.tasks[0] = nil
+	q.tasks = q.tasks[1:]
+	return t, true
+}
+
+func (q *openLoopQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+// openLoopWorker returns the worker index of the session in a pool,
+// all sqls of a session go to the same worker to keep the session state.
+func openLoopWorker(session string, poolSize int) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(session))
+	return int(h.Sum32() % uint32(poolSize)) //nolint:gosec
+}
+
+// openLoopPool is the task queues of the bounded connection pool, one queue per worker.
+// A session is pinned to one worker no matter which user and db its sqls are of,
+// the worker switches the user and db of connection before executing.
+type openLoopPool []*openLoopQueue
+
+func newOpenLoopPool(size int) openLoopPool {
+	p := make(openLoopPool, size)
+	for i := range p {
+		p[i] = newOpenLoopQueue()
+	}
+	return p
+}
+
+// dispatch pushes the task to the worker of its session, returns the worker index.
+func (p openLoopPool) dispatch(t *openLoopTask) int {
+	i := openLoopWorker(t.client, len(p))
+	p[i].push(t)
+	return i
+}
+
+func (p openLoopPool) close() {
+	for _, q := range p {
+		q.close()
+	}
+}
+
+// switchSession switches the connection to another session that shares it in open-loop replay.
+// The connection is re-established when either session has session state,
+// and the state of the new session is restored, so no session state leaks to other sessions.
+func (c *ReplayClient) switchSession(session string) {
+	if session == c.session {
+		return
+	}
+	if c.shadow != nil {
+		c.shadow.switchSession(session)
+	}
+	if c.sessionStates == nil {
+		c.sessionStates = map[string][]string{}
+	}
+
+	stmts := c.sessionStates[session]
+	delete(c.sessionStates, session)
+	if len(c.sessionStmts) > 0 {
+		c.sessionStates[c.session] = c.sessionStmts
+	}
+	if len(c.sessionStmts) > 0 || len(stmts) > 0 {
+		c.Close(false)
+	}
+	c.session, c.sessionStmts = session, stmts
+}
+
+// replayOpenLoop fires each sql at its scheduled time, no matter how long the previous sql took.
+// Sqls are executed by a bounded connection pool, each session is pinned to one connection of the pool.
+// When the connection is busy, the lag between scheduled and actual start time grows.
+func replayOpenLoop(ctx context.Context, opts *ReplayOpts, dbcfg *mysql.Config, clientSqls []ClientSqls, minTs int64) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	tasks, err := newOpenLoopMerger(clientSqls, opts.resume)
+	if err != nil {
+		return err
+	}
+	defer tasks.Close()
+	opts.monitor.skip(tasks.skipped)
+
+	schedule := &openLoopSchedule{minTs: minTs, speed: opts.Speed, qps: opts.QPS, ramp: opts.QPSRamp}
+	poolSize := max(opts.PoolSize, 1)
+
+	logrus.Infof("Open-loop replay with %d client, pool size %d, qps %.2f, ramp %v, started at %v, speed %f",
+		len(clientSqls),
+		poolSize,
+		opts.QPS,
+		opts.QPSRamp,
+		time.UnixMilli(minTs).UTC().Format("2006-01-02 15:04:05"),
+		opts.Speed,
+	)
+
+	var (
+		results = newReplayResultWriter(opts.ResultDir, opts.resume != nil)
+		lags    = &replayLagStats{}
+		pool    = newOpenLoopPool(poolSize)
+		g       = ParallelGroup(0)
+	)
+	defer results.Close()
+
+	for i, q := range pool {
+		cli := opts.newClient(dbcfg, fmt.Sprintf("pool#%d", i), nil, minTs)
+		g.Go(func() error {
+			defer cli.Close(true)
+			for t, ok := q.pop(); ok; t, ok = q.pop() {
+				if ctx.Err() != nil {
+					// interrupted, drain the queue
+					continue
+				}
+				lag := time.Since(t.scheduledAt)
+				cli.switchSession(t.client)
+				result, rows := cli.executeWithShadow(ctx, t.sql)
+				if ctx.Err() != nil {
+					// the sql will be replayed again when resuming
+					continue
+				}
+				result.LagMs = lag.Milliseconds()
+				lags.add(result.LagMs)
+				if err := results.write(t.client, result, rows); err != nil {
+					cancel()
+					return err
+				}
+				opts.monitor.done(t.client, t.seq, t.sql, result)
+			}
+			return nil
+		})
+	}
+
+	start := time.Now()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+dispatch:
+	for i, t := 0, tasks.next(); t != nil; i, t = i+1, tasks.next() {
+		t.scheduledAt = start.Add(schedule.at(i, t.sql))
+		if d := time.Until(t.scheduledAt); d > time.Millisecond {
+			timer.Reset(d)
+			select {
+			case <-ctx.Done():
+				break dispatch
+			case <-timer.C:
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		pool.dispatch(t)
+	}
+	pool.close()
+
+	err = g.Wait()
+
+	if lags.count > 0 {
+		logrus.Infof("Open-loop replay done, avg lag %dms, max lag %dms", lags.sumMs/lags.count, lags.maxMs)
+	}
+	return err
+}
@@ -0,0 +1,279 @@
+package parser
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/antlr4-go/antlr/v4"
+	"github.com/samber/lo"
+)
+
+// QueryAnalysis is the statement type, referenced tables, joins, predicates and functions of a sql.
+type QueryAnalysis struct {
+	// StmtType is the type of statement, like 'SELECT', 'INSERT' and 'SET'.
+	StmtType string
+	// Tables are the referenced tables, qualified by the default database, like 'db.t'. CTEs are not included.
+	Tables []string
+	// Joins are the equi-join conditions between two tables, like 'db.t1.a = db.t2.b'.
+	Joins []QueryJoin
+	// Predicates are the column predicates against non-column values, like 'db.t.a' '='.
+	Predicates []QueryPredicate
+	// Functions are the called functions in lower case, like 'count'.
+	Functions []string
+}
+
+// QueryJoin is an equi-join condition, the left table is always less than the right one.
+type QueryJoin struct {
+	Left, Right string
+	Condition   string
+}
+
+// QueryPredicate is a predicate on a column, Column is qualified by table if it can be resolved.
+type QueryPredicate struct {
+	Column   string
+	Operator string
+}
+
+// mirroredOperators are the comparison operators when the two sides are swapped.
+var mirroredOperators = map[string]string{"<": ">", ">": "<", "<=": ">=", ">=": "<="}
+
+// AnalyzeQuery parses the sql and returns its analysis, the tables without database are qualified by defaultDb.
+func AnalyzeQuery(sqlId, sql, defaultDb string) (*QueryAnalysis, error) {
+	stmtType := firstKeyword(sql)
+	if stmtType == "SET" || stmtType == "USE" {
+		return &QueryAnalysis{StmtType: stmtType}, nil
+	}
+
+	p := NewParser(sqlId, sql)
+	ms, err := p.Parse()
+	if err != nil {
+		return nil, err
+	}
+
+	l := &analyzeListener{defaultDb: defaultDb, aliases: map[string]string{}, ctes: map[string]struct{}{}}
+	antlr.ParseTreeWalkerDefault.Walk(l, ms)
+
+	a := &QueryAnalysis{StmtType: lo.CoalesceOrEmpty(l.writeKind, stmtType), Functions: l.functions}
+	if a.StmtType == "WITH" {
+		a.StmtType = "SELECT"
+	}
+	for _, t := range l.tables {
+		if _, ok := l.ctes[t]; !ok {
+			a.Tables = append(a.Tables, t)
+		}
+	}
+	for _, c := range l.comparisons {
+		left, right := l.resolveColumn(c.left), l.resolveColumn(c.right)
+		switch {
+		case left.col != "" && right.col != "":
+			if (c.op != "=" && c.op != "<=>") || left.table == "" || right.table == "" || left.table == right.table {
+				continue
+			}
+			if left.table > right.table {
+				left, right = right, left
+			}
+			a.Joins = append(a.Joins, QueryJoin{Left: left.table, Right: right.table, Condition: left.String() + " " + c.op + " " + right.String()})
+		case left.col != "":
+			a.Predicates = append(a.Predicates, QueryPredicate{Column: left.String(), Operator: c.op})
+		case right.col != "":
+			a.Predicates = append(a.Predicates, QueryPredicate{Column: right.String(), Operator: lo.CoalesceOrEmpty(mirroredOperators[c.op], c.op)})
+		}
+	}
+	return a, nil
+}
+
+// firstKeyword returns the first keyword of sql in upper case.
+func firstKeyword(sql string) string {
+	lexer := NewDorisLexer(antlr.NewInputStream(sql))
+	lexer.RemoveErrorListeners()
+
+	for t := lexer.NextToken(); t.GetTokenType() != antlr.TokenEOF; t = lexer.NextToken() {
+		if t.GetChannel() != antlr.TokenDefaultChannel || t.GetTokenType() == DorisLexerLEFT_PAREN {
+			continue
+		}
+		return strings.ToUpper(t.GetText())
+	}
+	return ""
+}
+
+// analyzeListener collects the tables, comparisons and functions of a sql,
+// the columns are resolved after walking since the select list is walked before the from clause.
+type analyzeListener struct {
+	*BaseDorisParserListener
+
+	defaultDb string
+	writeKind string
+
+	tables      []string
+	aliases     map[string]string
+	ctes        map[string]struct{}
+	comparisons []analyzeComparison
+	functions   []string
+}
+
+// analyzeComparison is a comparison between two sides, a side is nil if it is not a column.
+type analyzeComparison struct {
+	left, right []string
+	op          string
+}
+
+type analyzeColumn struct {
+	table, col string
+}
+
+func (c analyzeColumn) String() string {
+	if c.table == "" {
+		return c.col
+	}
+	return c.table + "." + c.col
+}
+
+func (l *analyzeListener) ExitInsertTable(ctx *InsertTableContext) {
+	if ctx.Explain() == nil {
+		l.writeKind = WriteStmtInsert
+	}
+	l.addTable(ctx.GetTableName(), "")
+}
+
+func (l *analyzeListener) ExitUpdate(ctx *UpdateContext) {
+	if ctx.Explain() == nil {
+		l.writeKind = WriteStmtUpdate
+	}
+	l.addTable(ctx.GetTableName(), "")
+}
+
+func (l *analyzeListener) ExitDelete(ctx *DeleteContext) {
+	if ctx.Explain() == nil {
+		l.writeKind = WriteStmtDelete
+	}
+	l.addTable(ctx.GetTableName(), "")
+}
+
+func (l *analyzeListener) ExitAliasQuery(ctx *AliasQueryContext) {
+	l.ctes[unquoteIdentifier(ctx.Identifier().GetText())] = struct{}{}
+}
+
+func (l *analyzeListener) ExitTableName(ctx *TableNameContext) {
+	var alias string
+	if a := ctx.TableAlias(); a != nil && a.StrictIdentifier() != nil {
+		alias = unquoteIdentifier(a.StrictIdentifier().GetText())
+	}
+	l.addTable(ctx.MultipartIdentifier(), alias)
+}
+
+// addTable records the table and its alias, the alias is the table name if empty.
+func (l *analyzeListener) addTable(id IMultipartIdentifierContext, alias string) {
+	if id == nil {
+		return
+	}
+	parts := lo.Map(id.GetParts(), func(p IErrorCapturingIdentifierContext, _ int) string {
+		return unquoteIdentifier(p.GetText())
+	})
+	if len(parts) == 0 {
+		return
+	}
+
+	table := l.qualifyTable(parts)
+	if _, ok := l.ctes[parts[0]]; ok && len(parts) == 1 {
+		table = parts[0]
+	}
+	l.tables = append(l.tables, table)
+	l.aliases[lo.CoalesceOrEmpty(alias, parts[len(parts)-1])] = table
+}
+
+func (l *analyzeListener) qualifyTable(parts []string) string {
+	if len(parts) == 1 && l.defaultDb != "" {
+		parts = []string{l.defaultDb, parts[0]}
+	}
+	return strings.Join(parts, ".")
+}
+
+func (l *analyzeListener) ExitComparison(ctx *ComparisonContext) {
+	l.comparisons = append(l.comparisons, analyzeComparison{
+		left:  columnParts(ctx.GetLeft()),
+		right: columnParts(ctx.GetRight()),
+		op:    strings.ToUpper(ctx.ComparisonOperator().GetText()),
+	})
+}
+
+func (l *analyzeListener) ExitPredicated(ctx *PredicatedContext) {
+	p, ok := ctx.Predicate().(*PredicateContext)
+	if !ok || p.GetKind() == nil {
+		return
+	}
+	col := columnParts(ctx.ValueExpression())
+	if col == nil {
+		return
+	}
+
+	op := strings.ToUpper(p.GetKind().GetText())
+	switch {
+	case p.IS() != nil && p.NOT() != nil:
+		op = "IS NOT " + op
+	case p.IS() != nil:
+		op = "IS " + op
+	case p.NOT() != nil:
+		op = "NOT " + op
+	}
+	if p.Query() != nil {
+		op += " (subquery)"
+	}
+	l.comparisons = append(l.comparisons, analyzeComparison{left: col, op: op})
+}
+
+func (l *analyzeListener) ExitFunctionCallExpression(ctx *FunctionCallExpressionContext) {
+	fi := ctx.FunctionIdentifier()
+	name := strings.ToLower(unquoteIdentifier(fi.FunctionNameIdentifier().GetText()))
+	if db := fi.GetDbName(); db != nil {
+		name = unquoteIdentifier(db.GetText()) + "." + name
+	}
+	l.functions = append(l.functions, name)
+}
+
+// resolveColumn resolves the table of column by the table aliases,
+// the unqualified column belongs to the only table of sql, or unknown if there are many.
+func (l *analyzeListener) resolveColumn(parts []string) analyzeColumn {
+	switch len(parts) {
+	case 0:
+		return analyzeColumn{}
+	case 1:
+		tables := lo.Uniq(l.tables)
+		if len(tables) == 1 {
+			return analyzeColumn{table: tables[0], col: parts[0]}
+		}
+		return analyzeColumn{col: parts[0]}
+	case 2:
+		if t, ok := l.aliases[parts[0]]; ok {
+			return analyzeColumn{table: t, col: parts[1]}
+		}
+	}
+	last := len(parts) - 1
+	return analyzeColumn{table: l.qualifyTable(slices.Clone(parts[:last])), col: parts[last]}
+}
+
+// columnParts returns the name parts of column like ['t', 'a'], or nil if the expression is not a column.
+func columnParts(ctx IValueExpressionContext) []string {
+	v, ok := ctx.(*ValueExpressionDefaultContext)
+	if !ok {
+		return nil
+	}
+	return primaryColumnParts(v.PrimaryExpression())
+}
+
+func primaryColumnParts(ctx IPrimaryExpressionContext) []string {
+	switch p := ctx.(type) {
+	case *ColumnReferenceContext:
+		return []string{unquoteIdentifier(p.Identifier().GetText())}
+	case *DereferenceContext:
+		base := primaryColumnParts(p.GetBase())
+		if base == nil {
+			return nil
+		}
+		return append(base, unquoteIdentifier(p.GetFieldName().GetText()))
+	}
+	return nil
+}
+
+func unquoteIdentifier(s string) string {
+	return strings.Trim(s, "`")
+}
@@ -3,6 +3,7 @@ package parser
 import (
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -81,3 +82,228 @@ func TestParser(t *testing.T) {
 		assert.Equal(t, sql, s)
 	}
 }
+
+func TestFingerprint(t *testing.T) {
+	tests := []struct {
+		sql  string
+		want string
+	}{
+		{
+			sql:  "SELECT a, count(*) FROM t1 WHERE b = 'x' AND c > -1.5 -- comment\n GROUP BY a;",
+			want: "select a, count(*) from t1 where b = ? and c > ? group by a",
+		},
+		{
+			sql:  "select /* comment */ * from `db`.t where id in (1, 2,3) and x - 1 > 0 limit 10",
+			want: "select * from `db`.t where id in (?+) and x - ? > ? limit ?",
+		},
+		{
+			sql:  `insert into t values (1, "a"), (2, 'b'), (3, 'c')`,
+			want: "insert into t values (?+)",
+		},
+		{
+			sql:  "select * from t where (a, b) in ((1, 2), (3, 4)) and dt = date '2024-01-01'",
+			want: "select * from t where (a, b) in ((?+)) and dt = date ?",
+		},
+		{
+			sql:  "select * from t where a = true and b in (1, null) and c is not null and d is false and e = NULL",
+			want: "select * from t where a = ? and b in (?+) and c is not null and d is false and e = ?",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sql, func(t *testing.T) {
+			assert.Equal(t, tt.want, Fingerprint(tt.sql))
+		})
+	}
+}
+
+func TestHasOrderBy(t *testing.T) {
+	assert.True(t, HasOrderBy("select a from t order by a limit 10"))
+	assert.True(t, HasOrderBy("(select a from t1) union all (select a from t2) ORDER BY a"))
+	assert.False(t, HasOrderBy("select a, row_number() over (partition by b order by c) from t"))
+	assert.False(t, HasOrderBy("select * from (select a from t order by a limit 10) t2"))
+	assert.False(t, HasOrderBy("select 'order by' from t"))
+}
+
+func TestRewriteWriteStmt(t *testing.T) {
+	sandbox := func(parts []string) []string {
+		if len(parts) == 1 {
+			parts = append([]string{"sandbox"}, parts...)
+		}
+		parts[len(parts)-2] = "sandbox"
+		parts[len(parts)-1] += "_shadow"
+		return parts
+	}
+	tests := []struct {
+		sql      string
+		want     string
+		wantKind string
+	}{
+		{
+			sql:      "insert into db1.t1 (a, b) select a, b from db1.t2 where a > 1",
+			want:     "insert into `sandbox`.`t1_shadow` (a, b) select a, b from db1.t2 where a > 1",
+			wantKind: WriteStmtInsert,
+		},
+		{
+			sql:      "WITH c AS (SELECT 1 AS a) INSERT INTO `t1` SELECT a FROM c",
+			want:     "WITH c AS (SELECT 1 AS a) INSERT INTO `sandbox`.`t1_shadow` SELECT a FROM c",
+			wantKind: WriteStmtInsert,
+		},
+		{
+			sql:      "update internal.db1.t1 set a = 1 where b in (select b from t2)",
+			want:     "update `internal`.`sandbox`.`t1_shadow` set a = 1 where b in (select b from t2)",
+			wantKind: WriteStmtUpdate,
+		},
+		{
+			sql:      "/* c */ delete from t1 where a = 1",
+			want:     "/* c */ delete from `sandbox`.`t1_shadow` where a = 1",
+			wantKind: WriteStmtDelete,
+		},
+		{
+			sql:      "UPDATE t1 SET t1.a = 1 WHERE t1.b = 2",
+			want:     "UPDATE `sandbox`.`t1_shadow` `t1` SET t1.a = 1 WHERE t1.b = 2",
+			wantKind: WriteStmtUpdate,
+		},
+		{
+			sql:      "update db1.t1 set db1.t1.a = 1 where `db1`.`t1`.b = 2 and c = (select max(c) from db1.t2 where db1.t2.d = db1.t1.d)",
+			want:     "update `sandbox`.`t1_shadow` `t1` set `t1`.a = 1 where `t1`.b = 2 and c = (select max(c) from db1.t2 where db1.t2.d = `t1`.d)",
+			wantKind: WriteStmtUpdate,
+		},
+		{
+			sql:      "update t1 x set x.a = 1 where x.b = 2",
+			want:     "update `sandbox`.`t1_shadow` x set x.a = 1 where x.b = 2",
+			wantKind: WriteStmtUpdate,
+		},
+		{
+			sql:      "DELETE FROM db1.t1 PARTITION (p1) WHERE t1.id IN (SELECT id FROM t2 WHERE t2.a = db1.t1.a)",
+			want:     "DELETE FROM `sandbox`.`t1_shadow` PARTITION (p1) `t1` WHERE t1.id IN (SELECT id FROM t2 WHERE t2.a = `t1`.a)",
+			wantKind: WriteStmtDelete,
+		},
+		{
+			sql:      "truncate table db1.t1",
+			want:     "truncate table `sandbox`.`t1_shadow`",
+			wantKind: WriteStmtTruncate,
+		},
+		{
+			sql:  "explain insert into t1 values (1)",
+			want: "explain insert into t1 values (1)",
+		},
+		{
+			sql:  "with c as (select 1) select * from c",
+			want: "with c as (select 1) select * from c",
+		},
+		{
+			sql:  "select * from t1",
+			want: "select * from t1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sql, func(t *testing.T) {
+			got, kind, err := RewriteWriteStmt("1", tt.sql, sandbox)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.wantKind, kind)
+		})
+	}
+}
+
+func TestRewriteWriteStmt_unsafe(t *testing.T) {
+	for _, sql := range []string{
+		"drop table t1",
+		"alter table t1 add column c int",
+		"create table t2 as select * from t1",
+		"LOAD LABEL db1.l1 (DATA INFILE('s3://b/f') INTO TABLE t1) WITH S3 ()",
+		"set global exec_mem_limit = 1",
+		"SET @@GLOBAL.exec_mem_limit = 1",
+		"set password for 'u' = password('p')",
+		"execute s1 using 1",
+	} {
+		t.Run(sql, func(t *testing.T) {
+			_, _, err := RewriteWriteStmt("1", sql, nil)
+			assert.ErrorIs(t, err, ErrUnsafeStmt)
+		})
+	}
+
+	for _, sql := range []string{"(select 1)", "show tables", "set exec_mem_limit = 1", "set @a = 'global'", "use db1", ""} {
+		got, kind, err := RewriteWriteStmt("1", sql, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, sql, got)
+		assert.Empty(t, kind)
+	}
+}
+
+func TestWarpTimeLiterals(t *testing.T) {
+	warp := func(t time.Time, dateOnly bool) time.Time {
+		if dateOnly {
+			return t.AddDate(0, 0, 10)
+		}
+		return t.Add(36 * time.Hour)
+	}
+	tests := []struct {
+		sql  string
+		want string
+	}{
+		{
+			sql:  "select * from t where dt = '2024-09-20' and ts >= \"2024-09-20 23:00:00\"",
+			want: "select * from t where dt = '2024-09-30' and ts >= \"2024-09-22 11:00:00\"",
+		},
+		{
+			sql:  "/* '2024-09-20' */ select `2024-09-20`, date '2024-09-20', timestamp '2024-09-20T10:00:00.123' from t",
+			want: "/* '2024-09-20' */ select `2024-09-20`, date '2024-09-30', timestamp '2024-09-21T22:00:00.123' from t",
+		},
+		{
+			sql:  "select * from t where dt between '2024-12-25' and date_add('2024-12-31', interval 1 day) and s = '2024-13-01'",
+			want: "select * from t where dt between '2025-01-04' and date_add('2025-01-10', interval 1 day) and s = '2024-13-01'",
+		},
+		{
+			sql:  "select * from t where s = 'a 2024-09-20' and b = binary '2024-09-20'",
+			want: "select * from t where s = 'a 2024-09-20' and b = binary '2024-09-20'",
+		},
+	}
+	for _, tt := range tests {
+		got, err := WarpTimeLiterals("1", tt.sql, warp)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.want, got)
+	}
+
+	got, ok := WarpTimeLiteral("'2024-02-28'", warp)
+	assert.True(t, ok)
+	assert.Equal(t, "'2024-03-09'", got)
+	_, ok = WarpTimeLiteral("'abc'", warp)
+	assert.False(t, ok)
+
+	_, err := WarpTimeLiterals("1", "select * from where dt = '2024-09-20'", warp)
+	assert.Error(t, err)
+}
+
+func TestAnalyzeQuery(t *testing.T) {
+	sql := "WITH c AS (SELECT id FROM t3) SELECT count(*), `T1`.b FROM t1 AS `T1` JOIN db2.t2 x ON T1.id = x.id AND x.c > 1 " +
+		"WHERE 10 <= T1.a AND x.d IN (SELECT id FROM c) AND T1.e NOT LIKE 'a%' AND T1.f IS NOT NULL AND upper(T1.g) = 'A'"
+	a, err := AnalyzeQuery("1", sql, "db1")
+	assert.NoError(t, err)
+	assert.Equal(t, "SELECT", a.StmtType)
+	assert.Equal(t, []string{"db1.t3", "db1.t1", "db2.t2"}, a.Tables)
+	assert.Equal(t, []QueryJoin{{Left: "db1.t1", Right: "db2.t2", Condition: "db1.t1.id = db2.t2.id"}}, a.Joins)
+	assert.Equal(t, []QueryPredicate{
+		{Column: "db2.t2.c", Operator: ">"},
+		{Column: "db1.t1.a", Operator: ">="},
+		{Column: "db2.t2.d", Operator: "IN (subquery)"},
+		{Column: "db1.t1.e", Operator: "NOT LIKE"},
+		{Column: "db1.t1.f", Operator: "IS NOT NULL"},
+	}, a.Predicates)
+	assert.Equal(t, []string{"count", "upper"}, a.Functions)
+
+	a, err = AnalyzeQuery("2", "insert into t1 select * from t2 where a between 1 and 2", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "INSERT", a.StmtType)
+	assert.Equal(t, []string{"t2", "t1"}, a.Tables)
+	assert.Equal(t, []QueryPredicate{{Column: "a", Operator: "BETWEEN"}}, a.Predicates)
+
+	a, err = AnalyzeQuery("3", "CREATE VIEW `v` COMMENT 'x' AS SELECT `internal`.`db2`.`t1`.`a` FROM `internal`.`db2`.`t1` JOIN t2 USING (a)", "db1")
+	assert.NoError(t, err)
+	assert.Equal(t, "CREATE", a.StmtType)
+	assert.Equal(t, []string{"internal.db2.t1", "db1.t2"}, a.Tables)
+
+	a, err = AnalyzeQuery("4", "SET a = 1", "")
+	assert.NoError(t, err)
+	assert.Equal(t, &QueryAnalysis{StmtType: "SET"}, a)
+}
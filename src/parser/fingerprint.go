@@ -0,0 +1,175 @@
+package parser
+
+import (
+	"strings"
+
+	"github.com/antlr4-go/antlr/v4"
+)
+
+const (
+	FingerprintPlaceholder     = "?"
+	FingerprintListPlaceholder = "(?+)"
+)
+
+// tokenLiteralList is a pseudo token type of collapsed literal list.
+const tokenLiteralList = -100
+
+// keywords followed by a space before '('
+var fingerprintSpacedKeywords = map[int]bool{
+	DorisLexerAND:    true,
+	DorisLexerAS:     true,
+	DorisLexerBY:     true,
+	DorisLexerELSE:   true,
+	DorisLexerEXISTS: true,
+	DorisLexerFROM:   true,
+	DorisLexerIN:     true,
+	DorisLexerJOIN:   true,
+	DorisLexerNOT:    true,
+	DorisLexerON:     true,
+	DorisLexerOR:     true,
+	DorisLexerSELECT: true,
+	DorisLexerTHEN:   true,
+	DorisLexerUSING:  true,
+	DorisLexerVALUES: true,
+	DorisLexerWHEN:   true,
+	DorisLexerWHERE:  true,
+	DorisLexerWITH:   true,
+}
+
+type fingerprintToken struct {
+	text string
+	typ  int
+}
+
+// Fingerprint normalizes the sql, all literals (including NULL, TRUE and FALSE) are replaced by '?',
+// comments and whitespaces are removed, keywords are lowercased,
+// and lists of literals like 'IN (1, 2, 3)' are collapsed to 'IN (?+)'.
+func Fingerprint(sql string) string {
+	lexer := NewDorisLexer(antlr.NewInputStream(sql))
+	lexer.RemoveErrorListeners()
+
+	tokens := []fingerprintToken{}
+	for t := lexer.NextToken(); t.GetTokenType() != antlr.TokenEOF; t = lexer.NextToken() {
+		if t.GetChannel() != antlr.TokenDefaultChannel {
+			continue
+		}
+
+		switch typ := t.GetTokenType(); typ {
+		case DorisLexerSEMICOLON:
+			continue
+		case DorisLexerSTRING_LITERAL,
+			DorisLexerBIGINT_LITERAL,
+			DorisLexerSMALLINT_LITERAL,
+			DorisLexerTINYINT_LITERAL,
+			DorisLexerINTEGER_VALUE,
+			DorisLexerEXPONENT_VALUE,
+			DorisLexerDECIMAL_VALUE,
+			DorisLexerBIGDECIMAL_LITERAL:
+			// negative number, e.g. 'a = -1'
+			if n := len(tokens); n > 0 && tokens[n-1].typ == DorisLexerSUBTRACT && (n == 1 || !isOperand(tokens[n-2].typ)) {
+				tokens = tokens[:n-1]
+			}
+			tokens = append(tokens, fingerprintToken{FingerprintPlaceholder, DorisLexerSTRING_LITERAL})
+		case DorisLexerNULL, DorisLexerTRUE, DorisLexerFALSE:
+			// keep the predicate 'IS [NOT] NULL/TRUE/FALSE'
+			if n := len(tokens); n > 0 && (tokens[n-1].typ == DorisLexerIS || tokens[n-1].typ == DorisLexerNOT && n > 1 && tokens[n-2].typ == DorisLexerIS) {
+				tokens = append(tokens, fingerprintToken{strings.ToLower(t.GetText()), typ})
+				break
+			}
+			tokens = append(tokens, fingerprintToken{FingerprintPlaceholder, DorisLexerSTRING_LITERAL})
+		case DorisLexerIDENTIFIER, DorisLexerBACKQUOTED_IDENTIFIER:
+			tokens = append(tokens, fingerprintToken{t.GetText(), typ})
+		default:
+			tokens = append(tokens, fingerprintToken{strings.ToLower(t.GetText()), typ})
+		}
+		tokens = collapseLiteralList(tokens)
+	}
+
+	return joinFingerprintTokens(tokens)
+}
+
+// isOperand reports whether the token can be the left operand of a binary '-'.
+func isOperand(typ int) bool {
+	switch typ {
+	case DorisLexerIDENTIFIER, DorisLexerBACKQUOTED_IDENTIFIER, DorisLexerSTRING_LITERAL, DorisLexerRIGHT_PAREN, tokenLiteralList:
+		return true
+	}
+	return false
+}
+
+// collapseLiteralList collapses the tail of tokens:
+//
+//	( ? , ? , ? )      => (?+)
+//	(?+) , (?+)        => (?+)
+func collapseLiteralList(tokens []fingerprintToken) []fingerprintToken {
+	n := len(tokens)
+	if n == 0 {
+		return tokens
+	}
+
+	switch tokens[n-1].typ {
+	case DorisLexerRIGHT_PAREN:
+		for i := n - 2; i >= 1 && tokens[i].text == FingerprintPlaceholder; i -= 2 {
+			if tokens[i-1].typ == DorisLexerLEFT_PAREN {
+				tokens = append(tokens[:i-1], fingerprintToken{FingerprintListPlaceholder, tokenLiteralList})
+				return collapseLiteralList(tokens)
+			}
+			if tokens[i-1].typ != DorisLexerCOMMA {
+				break
+			}
+		}
+	case tokenLiteralList:
+		if n >= 3 && tokens[n-2].typ == DorisLexerCOMMA && tokens[n-3].typ == tokenLiteralList {
+			return tokens[:n-2]
+		}
+	}
+	return tokens
+}
+
+func isWord(t fingerprintToken) bool {
+	c := t.text[0]
+	return c == '`' || c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func joinFingerprintTokens(tokens []fingerprintToken) string {
+	sb := strings.Builder{}
+	for i, t := range tokens {
+		if i > 0 {
+			prev := tokens[i-1]
+			noSpace := t.typ == DorisLexerRIGHT_PAREN || t.typ == DorisLexerCOMMA || t.typ == DorisLexerDOT ||
+				prev.typ == DorisLexerLEFT_PAREN || prev.typ == DorisLexerDOT ||
+				// function call, e.g. 'count(*)'
+				(t.typ == DorisLexerLEFT_PAREN && isWord(prev) && !fingerprintSpacedKeywords[prev.typ])
+			if !noSpace {
+				sb.WriteByte(' ')
+			}
+		}
+		sb.WriteString(t.text)
+	}
+	return sb.String()
+}
+
+// HasOrderBy reports whether the result order of the sql is determined by a top-level 'ORDER BY'.
+func HasOrderBy(sql string) bool {
+	lexer := NewDorisLexer(antlr.NewInputStream(sql))
+	lexer.RemoveErrorListeners()
+
+	depth, prev := 0, antlr.TokenInvalidType
+	for t := lexer.NextToken(); t.GetTokenType() != antlr.TokenEOF; t = lexer.NextToken() {
+		if t.GetChannel() != antlr.TokenDefaultChannel {
+			continue
+		}
+		switch typ := t.GetTokenType(); typ {
+		case DorisLexerLEFT_PAREN:
+			depth++
+		case DorisLexerRIGHT_PAREN:
+			depth--
+		case DorisLexerBY:
+			if depth == 0 && prev == DorisLexerORDER {
+				return true
+			}
+		}
+		prev = t.GetTokenType()
+	}
+	return false
+}
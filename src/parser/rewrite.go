@@ -0,0 +1,266 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/antlr4-go/antlr/v4"
+	"github.com/samber/lo"
+)
+
+const (
+	WriteStmtInsert   = "INSERT"
+	WriteStmtUpdate   = "UPDATE"
+	WriteStmtDelete   = "DELETE"
+	WriteStmtTruncate = "TRUNCATE"
+)
+
+// ErrUnsafeStmt is returned for the statements which are neither queries nor rewritable writes,
+// like DROP, ALTER, CREATE TABLE AS SELECT, LOAD and SET GLOBAL.
+var ErrUnsafeStmt = errors.New("not a query or INSERT, UPDATE, DELETE, TRUNCATE statement")
+
+// RewriteWriteStmt rewrites the target table of write statement (INSERT, UPDATE, DELETE and TRUNCATE),
+// the tables read by the statement are not changed.
+//
+// rename returns the new name parts of the target table, like ['db', 't'] -> ['sandbox', 't'],
+// nil rename only detects the kind of write statement.
+//
+// Returns the kind of write statement like 'INSERT', or empty if the sql is read only (query or session statement).
+// Other statements return ErrUnsafeStmt.
+func RewriteWriteStmt(sqlId, sql string, rename func(parts []string) []string) (newSQL, kind string, err error) {
+	if ok, err := maybeWriteStmt(sql); err != nil {
+		return "", "", err
+	} else if !ok {
+		return sql, "", nil
+	}
+
+	p := NewParser(sqlId, sql)
+	ms, err := p.Parse()
+	if err != nil {
+		return "", "", err
+	}
+
+	l := &writeTargetListener{rename: rename}
+	antlr.ParseTreeWalkerDefault.Walk(l, ms)
+	if l.err != nil {
+		return "", "", l.err
+	}
+	if l.kind == "" || rename == nil {
+		return sql, l.kind, nil
+	}
+
+	slices.SortFunc(l.replaces, func(a, b textReplace) int { return a.start - b.start })
+	return replaceText(sql, l.replaces), l.kind, nil
+}
+
+// maybeWriteStmt checks the first keyword of sql to avoid parsing the queries,
+// returns ErrUnsafeStmt if the sql is neither read only nor a rewritable write.
+func maybeWriteStmt(sql string) (bool, error) {
+	lexer := NewDorisLexer(antlr.NewInputStream(sql))
+	lexer.RemoveErrorListeners()
+
+	var (
+		first antlr.Token
+		n     int
+	)
+	for t := lexer.NextToken(); t.GetTokenType() != antlr.TokenEOF; t = lexer.NextToken() {
+		if t.GetChannel() != antlr.TokenDefaultChannel || (n == 0 && t.GetTokenType() == DorisLexerLEFT_PAREN) {
+			continue
+		}
+		if n++; n == 1 {
+			if first = t; t.GetTokenType() != DorisLexerSET {
+				break
+			}
+			continue
+		}
+
+		// SET is safe only for session variables
+		switch t.GetTokenType() {
+		case DorisLexerGLOBAL, DorisLexerPASSWORD, DorisLexerPROPERTY, DorisLexerLDAP_ADMIN_PASSWORD:
+			return false, fmt.Errorf("%w: SET %s", ErrUnsafeStmt, strings.ToUpper(t.GetText()))
+		case DorisLexerDEFAULT:
+			if n == 2 {
+				return false, fmt.Errorf("%w: SET DEFAULT", ErrUnsafeStmt)
+			}
+		}
+	}
+	if first == nil {
+		return false, nil
+	}
+
+	switch first.GetTokenType() {
+	case DorisLexerINSERT, DorisLexerUPDATE, DorisLexerDELETE, DorisLexerTRUNCATE, DorisLexerWITH:
+		return true, nil
+	case DorisLexerSELECT, DorisLexerVALUES, DorisLexerEXPLAIN, DorisLexerSHOW, DorisLexerDESC, DorisLexerDESCRIBE, DorisLexerUSE, DorisLexerSET:
+		return false, nil
+	}
+	return false, fmt.Errorf("%w: %s", ErrUnsafeStmt, strings.ToUpper(first.GetText()))
+}
+
+// writeTargetListener renames the target tables of write statements, explained statements are ignored.
+type writeTargetListener struct {
+	*BaseDorisParserListener
+
+	rename func(parts []string) []string
+
+	kind     string
+	err      error
+	replaces []textReplace
+	// columns are the qualified column references walked, like 't.a' and 'db.t.a'
+	columns []qualifiedColumn
+}
+
+// qualifiedColumn is a column reference with qualifier, start and stop are the runes of qualifier in sql.
+type qualifiedColumn struct {
+	qualifier   []string
+	start, stop int
+}
+
+// textReplace replaces the runes in [start, stop] of sql by text.
+type textReplace struct {
+	start, stop int
+	text        string
+}
+
+// replaceText replaces in the original sql to keep the comments, which are skipped by lexer,
+// replaces must be in order and not overlapped.
+func replaceText(sql string, replaces []textReplace) string {
+	runes := []rune(sql)
+	for i := len(replaces) - 1; i >= 0; i-- {
+		r := replaces[i]
+		runes = slices.Concat(runes[:r.start], []rune(r.text), runes[r.stop+1:])
+	}
+	return string(runes)
+}
+
+func (l *writeTargetListener) ExitInsertTable(ctx *InsertTableContext) {
+	if ctx.Explain() != nil {
+		return
+	}
+	if ctx.GetTableName() == nil {
+		// INSERT INTO DORIS_INTERNAL_TABLE_ID(id)
+		l.kind, l.err = WriteStmtInsert, fmt.Errorf("can not rewrite the insert target by table id: %s", ctx.GetText())
+		return
+	}
+	l.renameTable(WriteStmtInsert, ctx.GetTableName())
+}
+
+func (l *writeTargetListener) ExitUpdate(ctx *UpdateContext) {
+	if ctx.Explain() != nil {
+		return
+	}
+	l.renameTable(WriteStmtUpdate, ctx.GetTableName())
+	if id := ctx.GetTableName(); id != nil {
+		parts := id.GetParts()
+		l.aliasTable(ctx, id, ctx.TableAlias(), parts[len(parts)-1].GetStart().GetStop()+1)
+	}
+}
+
+func (l *writeTargetListener) ExitDelete(ctx *DeleteContext) {
+	if ctx.Explain() != nil {
+		return
+	}
+	l.renameTable(WriteStmtDelete, ctx.GetTableName())
+	if id := ctx.GetTableName(); id != nil {
+		parts := id.GetParts()
+		aliasAt := parts[len(parts)-1].GetStart().GetStop() + 1
+		if ctx.PartitionSpec() != nil {
+			aliasAt = ctx.PartitionSpec().GetStop().GetStop() + 1
+		}
+		l.aliasTable(ctx, id, ctx.TableAlias(), aliasAt)
+	}
+}
+
+func (l *writeTargetListener) ExitTruncateTable(ctx *TruncateTableContext) {
+	l.renameTable(WriteStmtTruncate, ctx.MultipartIdentifier())
+}
+
+func (l *writeTargetListener) renameTable(kind string, id IMultipartIdentifierContext) {
+	l.kind = kind
+	if l.rename == nil || id == nil {
+		return
+	}
+
+	ids := id.GetParts()
+	parts := identifierParts(id)
+
+	// every part is one token, the stop of identifier is not used since it may be wrong at the end of sql
+	l.replaces = append(l.replaces, textReplace{
+		start: ids[0].GetStart().GetStart(),
+		stop:  ids[len(ids)-1].GetStart().GetStop(),
+		text:  "`" + strings.Join(l.rename(parts), "`.`") + "`",
+	})
+}
+
+func (l *writeTargetListener) ExitDereference(ctx *DereferenceContext) {
+	// only the whole reference, like 'db.t.a' but not its base 'db.t'
+	if _, ok := ctx.GetParent().(*DereferenceContext); ok {
+		return
+	}
+	parts := primaryColumnParts(ctx)
+	if parts == nil {
+		return
+	}
+	base := ctx.GetBase()
+	l.columns = append(l.columns, qualifiedColumn{
+		qualifier: parts[:len(parts)-1],
+		start:     base.GetStart().GetStart(),
+		stop:      base.GetStop().GetStop(),
+	})
+}
+
+func (l *writeTargetListener) ExitUpdateAssignment(ctx *UpdateAssignmentContext) {
+	ids := ctx.GetCol().GetParts()
+	if len(ids) < 2 {
+		return
+	}
+	l.columns = append(l.columns, qualifiedColumn{
+		qualifier: identifierParts(ctx.GetCol())[:len(ids)-1],
+		start:     ids[0].GetStart().GetStart(),
+		stop:      ids[len(ids)-2].GetStart().GetStop(),
+	})
+}
+
+// aliasTable keeps the columns qualified by the renamed target table of UPDATE and DELETE resolvable.
+// The target without alias is aliased by its original name at aliasAt, like 'UPDATE sandbox.t_shadow t SET t.a = 1',
+// and the qualifiers with db are replaced by the alias, like 'db.t.a' -> 't.a'.
+func (l *writeTargetListener) aliasTable(stmt antlr.ParserRuleContext, id IMultipartIdentifierContext, alias ITableAliasContext, aliasAt int) {
+	if l.rename == nil || (alias != nil && alias.StrictIdentifier() != nil) {
+		return
+	}
+
+	var (
+		target = identifierParts(id)
+		name   = "`" + target[len(target)-1] + "`"
+		found  bool
+	)
+	for _, c := range l.columns {
+		// the columns walked before this statement belong to the previous statements
+		if c.start < stmt.GetStart().GetStart() || !sameTable(c.qualifier, target) {
+			continue
+		}
+		found = true
+		if len(c.qualifier) > 1 {
+			l.replaces = append(l.replaces, textReplace{start: c.start, stop: c.stop, text: name})
+		}
+	}
+	if found {
+		l.replaces = append(l.replaces, textReplace{start: aliasAt, stop: aliasAt - 1, text: " " + name})
+	}
+}
+
+// sameTable reports whether the table names refer to the same table, the missing catalog and db are ignored.
+func sameTable(a, b []string) bool {
+	for i := 1; i <= min(len(a), len(b)); i++ {
+		if a[len(a)-i] != b[len(b)-i] {
+			return false
+		}
+	}
+	return len(a) > 0 && len(b) > 0
+}
+
+func identifierParts(id IMultipartIdentifierContext) []string {
+	return lo.Map(id.GetParts(), func(p IErrorCapturingIdentifierContext, _ int) string { return unquoteIdentifier(p.GetText()) })
+}
@@ -0,0 +1,107 @@
+package parser
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/antlr4-go/antlr/v4"
+)
+
+// timeLiteralRe matches the date or datetime in string literal, like '2024-09-20', '2024-09-20 10:00:00.123'.
+var timeLiteralRe = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}(?:([ T])\d{2}:\d{2}:\d{2}(?:\.(\d{1,6}))?)?$`)
+
+// WarpTimeLiterals shifts the date and datetime literals in sql by warp, like '2024-09-20' -> '2024-09-21'.
+// Only the string constants and typed constants (like DATE '2024-09-20') are touched,
+// the strings in comments and quoted identifiers are not.
+func WarpTimeLiterals(sqlId, sql string, warp func(t time.Time, dateOnly bool) time.Time) (string, error) {
+	if !hasTimeLiteral(sql) {
+		return sql, nil
+	}
+
+	p := NewParser(sqlId, sql)
+	ms, err := p.Parse()
+	if err != nil {
+		return "", err
+	}
+
+	l := &timeLiteralListener{warp: warp}
+	antlr.ParseTreeWalkerDefault.Walk(l, ms)
+	if len(l.replaces) == 0 {
+		return sql, nil
+	}
+	return replaceText(sql, l.replaces), nil
+}
+
+// WarpTimeLiteral shifts the date or datetime in the quoted string literal by warp,
+// returns false if it is not a time literal.
+func WarpTimeLiteral(literal string, warp func(t time.Time, dateOnly bool) time.Time) (string, bool) {
+	q := strings.IndexAny(literal, `'"`)
+	if q < 0 || len(literal) < q+2 || literal[len(literal)-1] != literal[q] {
+		return literal, false
+	}
+	s := literal[q+1 : len(literal)-1]
+	m := timeLiteralRe.FindStringSubmatch(s)
+	if m == nil {
+		return literal, false
+	}
+
+	layout, dateOnly := time.DateOnly, m[1] == ""
+	if !dateOnly {
+		layout += m[1] + time.TimeOnly
+		if m[2] != "" {
+			layout += "." + strings.Repeat("0", len(m[2]))
+		}
+	}
+	t, err := time.Parse(layout, s)
+	if err != nil {
+		// like '2024-13-01'
+		return literal, false
+	}
+	return literal[:q+1] + warp(t, dateOnly).Format(layout) + literal[len(literal)-1:], true
+}
+
+// hasTimeLiteral checks the string literals of sql to avoid parsing the sqls without time literal.
+func hasTimeLiteral(sql string) bool {
+	lexer := NewDorisLexer(antlr.NewInputStream(sql))
+	lexer.RemoveErrorListeners()
+
+	for t := lexer.NextToken(); t.GetTokenType() != antlr.TokenEOF; t = lexer.NextToken() {
+		if t.GetTokenType() != DorisLexerSTRING_LITERAL {
+			continue
+		}
+		if _, ok := WarpTimeLiteral(t.GetText(), func(t time.Time, _ bool) time.Time { return t }); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// timeLiteralListener collects the time literals to shift.
+type timeLiteralListener struct {
+	*BaseDorisParserListener
+
+	warp     func(t time.Time, dateOnly bool) time.Time
+	replaces []textReplace
+}
+
+func (l *timeLiteralListener) ExitStringLiteral(ctx *StringLiteralContext) {
+	if ctx.BINARY() != nil {
+		return
+	}
+	l.warpLiteral(ctx.STRING_LITERAL())
+}
+
+func (l *timeLiteralListener) ExitTypeConstructor(ctx *TypeConstructorContext) {
+	l.warpLiteral(ctx.STRING_LITERAL())
+}
+
+func (l *timeLiteralListener) warpLiteral(node antlr.TerminalNode) {
+	if node == nil {
+		return
+	}
+	t := node.GetSymbol()
+	if text, ok := WarpTimeLiteral(t.GetText(), l.warp); ok {
+		l.replaces = append(l.replaces, textReplace{start: t.GetStart(), stop: t.GetStop(), text: text})
+	}
+}
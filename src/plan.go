@@ -0,0 +1,175 @@
+package src
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/sirupsen/logrus"
+	"github.com/zeebo/blake3"
+
+	"github.com/Thearas/dodo/src/parser"
+)
+
+const (
+	// ReplayPlanExplain captures the plan by 'EXPLAIN <stmt>'.
+	ReplayPlanExplain = "explain"
+	// ReplayPlanShape captures the plan by 'EXPLAIN SHAPE PLAN <stmt>', which only contains the plan shape.
+	ReplayPlanShape = "shape"
+)
+
+// planNumberRe matches the standalone numbers in plan, like ids, cardinality and costs,
+// they change between runs even if the plan shape is the same.
+var planNumberRe = regexp.MustCompile(`\b\d+(\.\d+)?\b`)
+
+// planCapturer captures the plan of each distinct statement fingerprint, shared by all clients of a target.
+type planCapturer struct {
+	explain string
+
+	mu sync.Mutex
+	// plans is the captured plan of each fingerprint
+	plans map[string]*capturedPlan
+	// recorded is the plan digests whose text has been recorded in the result file of a client
+	recorded map[string]struct{}
+}
+
+type capturedPlan struct {
+	done chan struct{}
+	// digest is empty if the plan can not be captured
+	digest, plan string
+}
+
+func newPlanCapturer(mode string) *planCapturer {
+	explain := "EXPLAIN"
+	if mode == ReplayPlanShape {
+		explain = "EXPLAIN SHAPE PLAN"
+	}
+	return &planCapturer{explain: explain, plans: map[string]*capturedPlan{}, recorded: map[string]struct{}{}}
+}
+
+// capturePlan starts to capture the plan of the sql if its fingerprint has not been captured by any client.
+//
+// The EXPLAIN runs on its own connection in parallel with the sql, so that the sql is not delayed.
+// Returns nil if the sql can not be explained.
+func (c *ReplayClient) capturePlan(ctx context.Context, s *ReplaySql) *capturedPlan {
+	// prepared statement can not be explained with placeholders
+	if s.Prepared || !isQueryStmtRe.MatchString(s.Stmt) {
+		return nil
+	}
+
+	fp := parser.Fingerprint(s.Stmt)
+	c.plans.mu.Lock()
+	p, ok := c.plans.plans[fp]
+	if !ok {
+		p = &capturedPlan{done: make(chan struct{})}
+		c.plans.plans[fp] = p
+	}
+	c.plans.mu.Unlock()
+	if ok {
+		return p
+	}
+
+	// explain with the same credential and session state of the client
+	explainer := &ReplayClient{
+		dbcfg:         c.dbcfg.Clone(),
+		catalog:       c.catalog,
+		cluster:       c.cluster,
+		client:        c.client + "(explain)",
+		plans:         c.plans,
+		workloadGroup: c.workloadGroup,
+		sessionStmts:  slices.Clone(c.sessionStmts),
+	}
+	go func() {
+		defer close(p.done)
+		defer explainer.Close(false)
+
+		plan, err := explainer.explain(ctx, s)
+		if err != nil {
+			logrus.Debugf("client %s capture plan failed at query_id: %s, err: %v", c.client, s.QueryId, err)
+			return
+		}
+		h := blake3.Sum256([]byte(plan))
+		p.digest, p.plan = fmt.Sprintf("%x", h[:8]), plan
+	}()
+	return p
+}
+
+// recordPlan waits for the captured plan and records its digest in result,
+// the plan text is only recorded at the first time of each digest in the result file of client.
+func (c *ReplayClient) recordPlan(p *capturedPlan, result *ReplayResult) {
+	<-p.done
+	if p.digest == "" {
+		return
+	}
+	result.PlanDigest = p.digest
+
+	// the result file is named by the session in open-loop replay
+	client := c.client
+	if c.session != "" {
+		client = c.session
+	}
+	key := client + "\x00" + p.digest
+	c.plans.mu.Lock()
+	defer c.plans.mu.Unlock()
+	if _, ok := c.plans.recorded[key]; !ok {
+		c.plans.recorded[key] = struct{}{}
+		result.Plan = p.plan
+	}
+}
+
+func (c *ReplayClient) explain(ctx context.Context, s *ReplaySql) (string, error) {
+	conn, err := c.conn(ctx, s.Db)
+	if err != nil {
+		return "", err
+	}
+	r, err := conn.QueryContext(ctx, c.plans.explain+" "+strings.TrimSuffix(strings.TrimSpace(s.Stmt), ";"))
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	lines := []string{}
+	for r.Next() {
+		var line string
+		if err := r.Scan(&line); err != nil {
+			return "", err
+		}
+		lines = append(lines, line)
+	}
+	if err := r.Err(); err != nil {
+		return "", err
+	}
+	return normalizePlan(strings.Join(lines, "\n")), nil
+}
+
+// normalizePlan removes the numbers and blank lines of plan, so that only the plan shape is compared.
+func normalizePlan(plan string) string {
+	lines := []string{}
+	for _, line := range strings.Split(plan, "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		lines = append(lines, planNumberRe.ReplaceAllString(line, "?"))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// DiffPlans returns the unified diff of two plans.
+func DiffPlans(plan1, plan2, name1, name2 string) string {
+	d, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(plan1 + "\n"),
+		B:        difflib.SplitLines(plan2 + "\n"),
+		FromFile: name1,
+		ToFile:   name2,
+		Context:  3,
+	})
+	if err != nil {
+		return err.Error()
+	}
+	return d
+}
@@ -0,0 +1,230 @@
+package src
+
+import (
+	"container/list"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// prepareStmtRe matches the server-side prepared statement, like:
+	//
+	//	PREPARE stmt1 FROM 'SELECT * FROM t WHERE id = ?'
+	//	PREPARE `1` FROM SELECT * FROM t WHERE id = ?
+	prepareStmtRe = regexp.MustCompile("(?is)^\\s*PREPARE\\s+`?([\\w-]+)`?\\s+FROM\\s+(.+?)\\s*;?\\s*$")
+
+	// executeStmtRe matches the execution of prepared statement, like 'EXECUTE stmt1 USING 1, 'a', @b'.
+	executeStmtRe = regexp.MustCompile("(?is)^\\s*EXECUTE\\s+`?([\\w-]+)`?(?:\\s+USING\\s+(.+?))?\\s*;?\\s*$")
+
+	// deallocateStmtRe matches the deallocation of prepared statement, like 'DEALLOCATE PREPARE stmt1'.
+	deallocateStmtRe = regexp.MustCompile("(?is)^\\s*(?:DEALLOCATE|DROP)\\s+PREPARE\\s+`?([\\w-]+)`?\\s*;?\\s*$")
+
+	// setUserVarRe matches the assignment of user variables, like 'SET @a = 1, @b = 'x''.
+	setUserVarRe = regexp.MustCompile(`(?is)^\s*SET\s+(@.+?)\s*;?\s*$`)
+
+	// userVarAssignRe matches one assignment of setUserVarRe, like '@a = 1'.
+	userVarAssignRe = regexp.MustCompile(`(?s)^@(\w+)\s*:?=\s*(.+)$`)
+)
+
+// preparedMaxSessions is the max sessions tracked by preparedStmts, audit logs have no end of session.
+const preparedMaxSessions = 10000
+
+// preparedStmts tracks the prepared statements and user variables of each session in audit logs,
+// so that the execution of a prepared statement can be dumped as its template with bound parameters.
+//
+// At most preparedMaxSessions sessions are tracked, the least recently used one is dropped.
+type preparedStmts struct {
+	sessions map[string]*list.Element // session -> element of *preparedSession in lru
+	lru      *list.List               // the most recently used session is at the front
+}
+
+type preparedSession struct {
+	session   string
+	templates map[string]string // name -> template
+	vars      map[string]string // user variable -> value
+}
+
+func newPreparedStmts() *preparedStmts {
+	return &preparedStmts{
+		sessions: map[string]*list.Element{},
+		lru:      list.New(),
+	}
+}
+
+// get returns the tracked session, or creates it if create is true, otherwise an empty untracked one is returned.
+func (p *preparedStmts) get(session string, create bool) *preparedSession {
+	if e, ok := p.sessions[session]; ok {
+		p.lru.MoveToFront(e)
+		return e.Value.(*preparedSession)
+	}
+	if !create {
+		return &preparedSession{}
+	}
+
+	ps := &preparedSession{session: session, templates: map[string]string{}, vars: map[string]string{}}
+	p.sessions[session] = p.lru.PushFront(ps)
+	if p.lru.Len() > preparedMaxSessions {
+		oldest := p.lru.Remove(p.lru.Back()).(*preparedSession)
+		delete(p.sessions, oldest.session)
+	}
+	return ps
+}
+
+// end drops the prepared statements and user variables of the session.
+func (p *preparedStmts) end(session string) {
+	if e, ok := p.sessions[session]; ok {
+		p.lru.Remove(e)
+		delete(p.sessions, session)
+	}
+}
+
+// resolve tracks the statement executed by the session.
+//
+// Returns the template and parameters if the statement executes a prepared statement,
+// emit is false if the statement should not be dumped, like 'PREPARE' or execution of unknown prepared statement.
+func (p *preparedStmts) resolve(session, stmt string) (template string, params []string, prepared, emit bool) {
+	if m := prepareStmtRe.FindStringSubmatch(stmt); m != nil {
+		template = m[2]
+		if strings.HasPrefix(template, "'") || strings.HasPrefix(template, `"`) {
+			template = unquoteSQLString(template)
+		}
+		p.get(session, true).templates[m[1]] = template
+		return "", nil, false, false
+	}
+	if m := deallocateStmtRe.FindStringSubmatch(stmt); m != nil {
+		delete(p.get(session, false).templates, m[1])
+		return "", nil, false, false
+	}
+	if m := setUserVarRe.FindStringSubmatch(stmt); m != nil {
+		for _, assign := range splitSQLParams(m[1]) {
+			if am := userVarAssignRe.FindStringSubmatch(assign); am != nil {
+				p.get(session, true).vars[strings.ToLower(am[1])] = am[2]
+			}
+		}
+		return "", nil, false, true
+	}
+
+	m := executeStmtRe.FindStringSubmatch(stmt)
+	if m == nil {
+		return "", nil, false, true
+	}
+	ps := p.get(session, false)
+	template, ok := ps.templates[m[1]]
+	if !ok {
+		logrus.Debugf("ignore executing unknown prepared statement '%s' in session %s", m[1], session)
+		return "", nil, false, false
+	}
+	params = splitSQLParams(m[2])
+	for i, param := range params {
+		if !strings.HasPrefix(param, "@") {
+			continue
+		}
+		v, ok := ps.vars[strings.ToLower(param[1:])]
+		if !ok {
+			logrus.Debugf("ignore executing prepared statement '%s' with unknown user variable %s in session %s", m[1], param, session)
+			return "", nil, false, false
+		}
+		params[i] = v
+	}
+	return template, params, true, true
+}
+
+// splitSQLParams splits the comma separated expressions, commas in quotes and parentheses are ignored.
+func splitSQLParams(s string) []string {
+	var (
+		params = []string{}
+		quote  byte
+		depth  int
+		start  int
+	)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			params = append(params, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	if last := strings.TrimSpace(s[start:]); last != "" {
+		params = append(params, last)
+	}
+	return params
+}
+
+// unquoteSQLString unquotes the sql string literal, both the doubled quote and backslash escapes are supported.
+func unquoteSQLString(s string) string {
+	if len(s) < 2 || s[0] != s[len(s)-1] {
+		return s
+	}
+	quote := s[0]
+	s = s[1 : len(s)-1]
+
+	var w strings.Builder
+	w.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '\\' && i+1 < len(s) {
+			i++
+			switch s[i] {
+			case 'n':
+				w.WriteByte('\n')
+			case 't':
+				w.WriteByte('\t')
+			case 'r':
+				w.WriteByte('\r')
+			case '0':
+				w.WriteByte(0)
+			default:
+				w.WriteByte(s[i])
+			}
+			continue
+		}
+		if c == quote && i+1 < len(s) && s[i+1] == quote {
+			i++
+		}
+		w.WriteByte(c)
+	}
+	return w.String()
+}
+
+// preparedParamValues converts the sql literals to the values bound to prepared statement.
+//
+// Integers are bound as int64, other numbers as float64, quoted strings as string, NULL as nil,
+// and others (like expressions) as their sql text.
+func preparedParamValues(params []string) []any {
+	values := make([]any, len(params))
+	for i, p := range params {
+		switch {
+		case strings.EqualFold(p, "NULL"):
+			values[i] = nil
+		case strings.EqualFold(p, "TRUE"), strings.EqualFold(p, "FALSE"):
+			values[i] = strings.EqualFold(p, "TRUE")
+		case strings.HasPrefix(p, "'") || strings.HasPrefix(p, `"`):
+			values[i] = unquoteSQLString(p)
+		default:
+			if n, err := strconv.ParseInt(p, 10, 64); err == nil {
+				values[i] = n
+			} else if f, err := strconv.ParseFloat(p, 64); err == nil {
+				values[i] = f
+			} else {
+				values[i] = p
+			}
+		}
+	}
+	return values
+}
@@ -0,0 +1,149 @@
+package src
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// ReplayProfileDir is the dir of query profiles in replay result dir.
+	ReplayProfileDir = "profile"
+
+	// the profile is reported to FE asynchronously, it may not be ready right after the query finished
+	replayProfileRetries       = 5
+	replayProfileRetryInterval = time.Second
+	replayProfileParallel      = 4
+)
+
+// ReplayProfileFile returns the path of query profile relative to the replay result dir.
+func ReplayProfileFile(queryId string) string {
+	return filepath.Join(ReplayProfileDir, queryId+".profile")
+}
+
+// replayProfiler fetches the profiles of slow queries from FE HTTP API in background.
+type replayProfiler struct {
+	threshold time.Duration
+	baseURL   string
+	dir       string
+
+	client *http.Client
+	sem    chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newReplayProfiler(o *ReplayOpts) (*replayProfiler, error) {
+	dir := filepath.Join(o.ResultDir, ReplayProfileDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &replayProfiler{
+		threshold: o.ProfileThreshold,
+		baseURL:   "http://" + net.JoinHostPort(o.Host, strconv.Itoa(int(o.HTTPPort))),
+		dir:       dir,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		sem:       make(chan struct{}, replayProfileParallel),
+	}, nil
+}
+
+// collectProfile fetches the profile of the sql if it is slower than threshold, the profile path is recorded in result.
+func (c *ReplayClient) collectProfile(ctx context.Context, s *ReplaySql, result *ReplayResult) {
+	if time.Duration(result.DurationMs)*time.Millisecond < c.profiler.threshold || ctx.Err() != nil {
+		return
+	}
+
+	conn, err := c.conn(ctx, s.Db)
+	if err != nil {
+		return
+	}
+	var serverQueryId string
+	if err := conn.QueryRowxContext(ctx, "SELECT last_query_id()").Scan(&serverQueryId); err != nil || serverQueryId == "" {
+		logrus.Debugf("client %s get last query id failed at query_id: %s, err: %v", c.client, s.QueryId, err)
+		return
+	}
+
+	result.Profile = ReplayProfileFile(s.QueryId)
+	// the profile is only visible to the user that executed the query, which may be mapped by '--user-map'
+	c.profiler.fetch(s.QueryId, serverQueryId, c.dbcfg.User, c.dbcfg.Passwd)
+}
+
+// fetch saves the profile of server query id as the profile of query id, with the credential of the user executed it.
+func (p *replayProfiler) fetch(queryId, serverQueryId, user, password string) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.sem <- struct{}{}
+		defer func() { <-p.sem }()
+
+		var (
+			profile []byte
+			err     error
+		)
+		for i := 0; i < replayProfileRetries; i++ {
+			if i > 0 {
+				time.Sleep(replayProfileRetryInterval)
+			}
+			if profile, err = p.get(serverQueryId, user, password); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			logrus.Warnf("fetch profile of query_id: %s (server query id: %s) failed, err: %v", queryId, serverQueryId, err)
+			return
+		}
+		if err := os.WriteFile(filepath.Join(p.dir, filepath.Base(ReplayProfileFile(queryId))), profile, 0600); err != nil {
+			logrus.Errorf("write profile of query_id: %s failed, err: %v", queryId, err)
+		}
+	}()
+}
+
+func (p *replayProfiler) get(serverQueryId, user, password string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, p.baseURL+"/api/profile/text?query_id="+url.QueryEscape(serverQueryId), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(user, password)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK || len(b) == 0 {
+		return nil, fmt.Errorf("status: %s, body: %s", resp.Status, b)
+	}
+
+	// FE responds the error in json with status 200, like profile not found
+	if bytes.HasPrefix(b, []byte("{")) {
+		r := struct {
+			Code int    `json:"code"`
+			Msg  string `json:"msg"`
+		}{}
+		if json.Unmarshal(b, &r) == nil && r.Code != 0 {
+			return nil, fmt.Errorf("code: %d, msg: %s", r.Code, r.Msg)
+		}
+	}
+	return b, nil
+}
+
+// wait waits for the fetching profiles.
+func (p *replayProfiler) wait() {
+	p.wg.Wait()
+}
@@ -0,0 +1,130 @@
+package src
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+
+	"github.com/Thearas/dodo/src/parser"
+)
+
+// QueryTableCollector collects the tables referenced by the dumped queries, so that exactly their schemas are dumped.
+// The tables are like 'db.table', or 'catalog.db.table' if the catalog is specified in queries.
+type QueryTableCollector struct {
+	mu     sync.Mutex
+	parsed map[string]struct{} // db + fingerprint
+	tables map[string]struct{}
+}
+
+// NewQueryTableCollector returns the collector and the writers to write queries through it.
+func NewQueryTableCollector(writers []SqlWriter) (*QueryTableCollector, []SqlWriter) {
+	c := &QueryTableCollector{
+		parsed: map[string]struct{}{},
+		tables: map[string]struct{}{},
+	}
+	collected := make([]SqlWriter, len(writers))
+	for i, w := range writers {
+		collected[i] = &tableCollectedSqlWriter{collector: c, w: w}
+	}
+	return c, collected
+}
+
+type tableCollectedSqlWriter struct {
+	collector *QueryTableCollector
+	w         SqlWriter
+}
+
+func (w *tableCollectedSqlWriter) WriteSql(s string) error {
+	w.collector.collect(s)
+	return w.w.WriteSql(s)
+}
+
+func (w *tableCollectedSqlWriter) Close() error {
+	return w.w.Close()
+}
+
+func (c *QueryTableCollector) collect(sql string) {
+	q := decodeReplaySql([]byte(sql))
+	if q == nil || sessionStmtRe.MatchString(q.Stmt) {
+		return
+	}
+
+	// queries of the same fingerprint reference the same tables
+	key := q.Db + "\x00" + parser.Fingerprint(q.Stmt)
+	c.mu.Lock()
+	_, ok := c.parsed[key]
+	c.parsed[key] = struct{}{}
+	c.mu.Unlock()
+	if ok {
+		return
+	}
+
+	a, err := parser.AnalyzeQuery(q.QueryId, q.Stmt, q.Db)
+	if err != nil {
+		logrus.Debugf("skip collecting tables of sql can not be parsed at query_id: %s, err: %v", q.QueryId, err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, t := range a.Tables {
+		if !strings.Contains(t, ".") {
+			logrus.Debugf("skip table '%s' without database at query_id: %s", t, q.QueryId)
+			continue
+		}
+		c.tables[t] = struct{}{}
+	}
+}
+
+// Tables returns the collected tables in order.
+func (c *QueryTableCollector) Tables() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tables := lo.Keys(c.tables)
+	slices.Sort(tables)
+	return tables
+}
+
+// SplitQueryTable splits the referenced table to database and table name,
+// ok is false if the table is not in the catalog or has no database.
+func SplitQueryTable(name, catalog string) (db, table string, ok bool) {
+	parts := strings.Split(name, ".")
+	switch len(parts) {
+	case 2:
+		return parts[0], parts[1], true
+	case 3:
+		ctl := lo.CoalesceOrEmpty(catalog, "internal")
+		if !strings.EqualFold(parts[0], ctl) {
+			return "", "", false
+		}
+		return parts[1], parts[2], true
+	}
+	return "", "", false
+}
+
+// ShowViewBaseTables returns the tables referenced by the view definition, qualified by the database of view.
+func ShowViewBaseTables(ctx context.Context, conn *sqlx.DB, db, view string) ([]string, error) {
+	stmt, _, err := showCreateTable(ctx, conn, db, view)
+	if err != nil {
+		return nil, err
+	}
+	a, err := parser.AnalyzeQuery(db+"."+view, stmt, db)
+	if err != nil {
+		return nil, err
+	}
+	return a.Tables, nil
+}
+
+// FindSchema finds the table in schemas by name, the case-insensitive match is used if there is no exact one.
+func FindSchema(schemas []*Schema, name string) (*Schema, bool) {
+	if s, ok := lo.Find(schemas, func(s *Schema) bool { return s.Name == name }); ok {
+		return s, true
+	}
+	return lo.Find(schemas, func(s *Schema) bool { return strings.EqualFold(s.Name, name) })
+}
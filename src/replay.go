@@ -3,6 +3,7 @@ package src
 import (
 	"bufio"
 	"bytes"
+	"cmp"
 	"context"
 	"database/sql"
 	"errors"
@@ -11,6 +12,7 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -20,6 +22,8 @@ import (
 	"github.com/jmoiron/sqlx"
 	"github.com/sirupsen/logrus"
 	"github.com/zeebo/blake3"
+
+	"github.com/Thearas/dodo/src/parser"
 )
 
 const (
@@ -28,17 +32,42 @@ const (
 	replayTsFormat           = "2006-01-02 15:04:05.000"
 	ReplayResultFileExt      = ".result"
 	ReplayCustomClientPrefix = "client"
+
+	// replayMaxPreparedStmts is the max count of prepared statements cached by one client.
+	replayMaxPreparedStmts = 256
 )
 
 type ReplayResult struct {
 	Ts      string `json:"ts,omitempty"`
 	QueryId string `json:"queryId"`
 
+	// Client is the client of the result file, only set when reading results.
+	Client string `json:"-"`
+
 	ReturnRows     int    `json:"returnRows"`
 	ReturnRowsHash string `json:"returnRowsHash,omitempty"`
 	DurationMs     int64  `json:"durationMs"`
 	Err            string `json:"err,omitempty"`
 	Stmt           string `json:"stmt,omitempty"`
+
+	// Skipped is the reason why the sql is not executed, like the unsafe statements in '--write-mode=sandbox'.
+	// The skipped sqls are neither errors nor compared by diff and report.
+	Skipped string `json:"skipped,omitempty"`
+
+	// LagMs is the delay between the scheduled and actual start time, only for open-loop replay.
+	LagMs int64 `json:"lagMs,omitempty"`
+
+	// PlanDigest is the digest of the normalized plan if '--capture-plan',
+	// Plan is the normalized plan text, only recorded at the first time of each digest of a client.
+	PlanDigest string `json:"planDigest,omitempty"`
+	Plan       string `json:"plan,omitempty"`
+
+	// Profile is the path of query profile relative to the result dir, only for the sqls slower than '--profile-threshold'.
+	Profile string `json:"profile,omitempty"`
+
+	// Shadow is the result of the shadow target, ShadowDiff is the difference between them.
+	Shadow     *ReplayResult `json:"shadow,omitempty"`
+	ShadowDiff string        `json:"shadowDiff,omitempty"`
 }
 
 func (re *ReplayResult) String() string {
@@ -53,15 +82,56 @@ type ReplayClient struct {
 	cluster   string
 
 	client          string
-	sqls            []*ReplaySql
+	sqls            *ClientSqls
 	speed           float32
 	maxHashRows     int
+	maxSaveRows     int
 	maxConnIdleTime time.Duration
 	minTs           int64
 
-	db         *sqlx.DB
-	connect    *sqlx.Conn
-	resultFile *os.File
+	db            *sqlx.DB
+	connect       *sqlx.Conn
+	resultFile    *os.File
+	resultCreated bool
+	rowsWriter    *clientFileWriter
+	// appendFile never truncates the result files, for resuming replay
+	appendFile bool
+
+	// resumeAfter is the last executed query id of previous replay
+	resumeAfter string
+	monitor     *replayMonitor
+
+	// timeWarp shifts the time literals before executing
+	timeWarp *ReplayTimeWarp
+	// sandbox rewrites the write statements before executing
+	sandbox *ReplaySandbox
+	// plans captures the plans of the sqls, nil if not capturing
+	plans *planCapturer
+	// profiler fetches the profiles of slow sqls, nil if not profiling
+	profiler *replayProfiler
+
+	// users maps the original users to replay credentials, nil if not mapping,
+	// user is the original user of the connection, workloadGroup is its workload group
+	users         *ReplayUserMap
+	user          string
+	workloadGroup string
+	// limiter limits the concurrent sqls per user and db, nil if unlimited
+	limiter *replayLimiter
+
+	// shadow executes the same sqls on the shadow target
+	shadow             *ReplayClient
+	shadowLatencyRatio float64
+
+	// session statements (like 'SET xxx') executed by this client,
+	// they will be re-executed when the connection is re-established.
+	sessionStmts []string
+	// session is the current session of the connection, sessionStates are the session statements
+	// of other sessions sharing the connection, only used by open-loop replay.
+	session       string
+	sessionStates map[string][]string
+
+	// stmts are the prepared statements of the connection, by template
+	stmts map[string]*sql.Stmt
 
 	hash *blake3.Hasher
 }
@@ -95,6 +165,26 @@ func (c *ReplayClient) conn(ctx context.Context, currdb string, reconnect ...boo
 		if err != nil {
 			return nil, err
 		}
+
+		// restore session state
+		for _, stmt := range c.sessionStmts {
+			if _, err := c.connect.ExecContext(ctx, stmt); err != nil {
+				logrus.Errorf("client %s restoring session failed, stmt: %s, err: %v", c.client, stmt, err)
+				return nil, err
+			}
+		}
+		if c.workloadGroup != "" {
+			if _, err := c.connect.ExecContext(ctx, fmt.Sprintf("SET workload_group = '%s'", c.workloadGroup)); err != nil {
+				logrus.Errorf("client %s setting workload group %s failed, err: %v", c.client, c.workloadGroup, err)
+				return nil, err
+			}
+		}
+		if c.profiler != nil {
+			if _, err := c.connect.ExecContext(ctx, "SET enable_profile = true"); err != nil {
+				logrus.Errorf("client %s enabling profile failed, err: %v", c.client, err)
+				return nil, err
+			}
+		}
 	}
 
 	// switch db
@@ -114,14 +204,25 @@ func (c *ReplayClient) conn(ctx context.Context, currdb string, reconnect ...boo
 	return c.connect, nil
 }
 
-func (c *ReplayClient) query(ctx context.Context, currdb, stmt string, args ...any) (*sql.Rows, int64, error) {
-	conn, err := c.conn(ctx, currdb)
+func (c *ReplayClient) query(ctx context.Context, s *ReplaySql) (*sql.Rows, int64, error) {
+	conn, err := c.conn(ctx, s.Db)
 	if err != nil {
 		return nil, 0, err
 	}
 
+	if s.Prepared {
+		// the prepare is not counted in duration, like the clients that cache prepared statements
+		stmt, err := c.prepare(ctx, conn, s.Stmt)
+		if err != nil {
+			return nil, 0, err
+		}
+		startedAt := time.Now()
+		r, err := stmt.QueryContext(ctx, preparedParamValues(s.Params)...)
+		return r, time.Since(startedAt).Milliseconds(), err
+	}
+
 	startedAt := time.Now()
-	r, err := conn.QueryContext(ctx, stmt, args...)
+	r, err := conn.QueryContext(ctx, s.Stmt)
 	duration := time.Since(startedAt).Milliseconds()
 
 	if err != nil {
@@ -130,30 +231,137 @@ func (c *ReplayClient) query(ctx context.Context, currdb, stmt string, args ...a
 	return r, duration, nil
 }
 
-func (c *ReplayClient) queryWithReconnect(ctx context.Context, currdb, stmt string, args ...any) (*sql.Rows, int64, error) {
-	r, duration, err := c.query(ctx, currdb, stmt, args...)
+// prepare returns the prepared statement of template, which is cached until the connection closed.
+func (c *ReplayClient) prepare(ctx context.Context, conn *sqlx.Conn, template string) (*sql.Stmt, error) {
+	if stmt, ok := c.stmts[template]; ok {
+		return stmt, nil
+	}
+	if len(c.stmts) >= replayMaxPreparedStmts {
+		c.closeStmts()
+	}
+
+	stmt, err := conn.PrepareContext(ctx, strings.TrimSuffix(strings.TrimSpace(template), ";"))
+	if err != nil {
+		return nil, err
+	}
+	if c.stmts == nil {
+		c.stmts = map[string]*sql.Stmt{}
+	}
+	c.stmts[template] = stmt
+	return stmt, nil
+}
+
+func (c *ReplayClient) closeStmts() {
+	for _, stmt := range c.stmts {
+		_ = stmt.Close()
+	}
+	clear(c.stmts)
+}
+
+func (c *ReplayClient) queryWithReconnect(ctx context.Context, s *ReplaySql) (*sql.Rows, int64, error) {
+	r, duration, err := c.query(ctx, s)
 	if errors.Is(err, sql.ErrConnDone) || errors.Is(err, net.ErrClosed) || errors.Is(err, mysql.ErrInvalidConn) {
 		// reconnect
 		c.Close(false)
-		_, err = c.conn(ctx, currdb, true)
+		_, err = c.conn(ctx, s.Db, true)
 		if err != nil {
 			return nil, 0, err
 		}
 		logrus.Debugln("client", c.client, "reconnect")
-		r, duration, err = c.query(ctx, currdb, stmt, args...)
+		r, duration, err = c.query(ctx, s)
 	}
 	return r, duration, err
 }
 
+// recordSessionStmt records the session statement after it is executed successfully,
+// only the last assignment of each variable is kept.
+func (c *ReplayClient) recordSessionStmt(stmt string) {
+	if !sessionStmtRe.MatchString(stmt) {
+		return
+	}
+
+	// 'USE xxx' changes the current db, which will be switched by the db of next sql
+	if strings.EqualFold(strings.TrimSpace(stmt)[:3], "USE") {
+		c.dbcfg.DBName = ""
+		return
+	}
+	// keep the order of assignments, the reassigned variable is moved to the end as the latest
+	for _, assign := range splitSessionStmt(stmt) {
+		v := sessionStmtVar(assign)
+		c.sessionStmts = append(slices.DeleteFunc(c.sessionStmts, func(s string) bool { return sessionStmtVar(s) == v }), assign)
+	}
+}
+
+// splitSessionStmt splits the SET statement into one statement per assignment,
+// it is kept as a whole if not a list of assignments, like 'SET NAMES utf8'.
+func splitSessionStmt(stmt string) []string {
+	assigns := splitSQLParams(sessionStmtBody(stmt))
+	if len(assigns) < 2 {
+		return []string{stmt}
+	}
+
+	stmts := make([]string, 0, len(assigns))
+	modifier := ""
+	for _, assign := range assigns {
+		m := sessionVarAssignRe.FindStringSubmatch(assign)
+		if m == nil {
+			return []string{stmt}
+		}
+		// the scope modifier also applies to the following assignments without modifier
+		if m[1] != "" {
+			modifier = m[1]
+		} else if m[2] == "" && modifier != "" {
+			assign = modifier + " " + assign
+		}
+		stmts = append(stmts, "SET "+assign)
+	}
+	return stmts
+}
+
+// sessionStmtVar returns the variable assigned by the SET statement of one assignment, like 'session a', 'global a' or '@a',
+// or the first word if not an assignment, like 'names' of 'SET NAMES utf8'.
+func sessionStmtVar(stmt string) string {
+	body := sessionStmtBody(stmt)
+	m := sessionVarAssignRe.FindStringSubmatch(body)
+	if m == nil {
+		word, _, _ := strings.Cut(body, " ")
+		return strings.ToLower(word)
+	}
+
+	name := strings.ToLower(m[4])
+	if m[2] == "@" {
+		return "@" + name
+	}
+	scope := m[3]
+	if scope == "" {
+		scope = m[1]
+	}
+	if scope = strings.ToLower(scope); scope != "global" {
+		scope = "session"
+	}
+	return scope + " " + name
+}
+
+// sessionStmtBody returns the statement without the leading 'SET' and the trailing ';'.
+func sessionStmtBody(stmt string) string {
+	stmt = strings.TrimSuffix(strings.TrimSpace(stmt), ";")
+	return strings.TrimSpace(stmt[min(len(stmt), 3):])
+}
+
 func (c *ReplayClient) writeResult(b []byte) (err error) {
 	if c.resultFile == nil {
-		// result file
+		// result file, truncate at the first open, append when reopen
+		flag := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		if !c.resultCreated && !c.appendFile {
+			flag |= os.O_TRUNC
+		}
 		resultFilePath := filepath.Join(c.resultDir, fmt.Sprintf("%s%s", c.client, ReplayResultFileExt))
-		c.resultFile, err = os.OpenFile(resultFilePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		c.resultFile, err = os.OpenFile(resultFilePath, flag, 0600)
 		if err != nil {
 			logrus.Errorf("open replay result file %s failed, err: %v", resultFilePath, err)
 			return err
 		}
+		c.resultCreated = true
 	}
 	if _, err := c.resultFile.Write(append(b, '\n')); err != nil {
 		logrus.Errorln("client", c.client, "failed to write result:", err)
@@ -162,8 +370,27 @@ func (c *ReplayClient) writeResult(b []byte) (err error) {
 	return nil
 }
 
+func (c *ReplayClient) writeRows(rows *ReplayRows) error {
+	b, err := json.Marshal(rows)
+	if err != nil {
+		logrus.Errorln("failed to marshal rows:", err)
+		return nil
+	}
+
+	if c.rowsWriter == nil {
+		c.rowsWriter = newClientFileWriter(c.resultDir, ReplayRowsFileExt)
+		c.rowsWriter.appendOnly = c.appendFile
+	}
+	if err := c.rowsWriter.write(c.client, b); err != nil {
+		logrus.Errorln("client", c.client, "failed to write rows:", err)
+		return err
+	}
+	return nil
+}
+
 //nolint:revive
 func (c *ReplayClient) Close(closefile bool) {
+	c.closeStmts()
 	if c.connect != nil {
 		logrus.Traceln("client", c.client, "close idle conn")
 		c.connect.Close()
@@ -173,6 +400,9 @@ func (c *ReplayClient) Close(closefile bool) {
 		c.db.Close()
 		c.db = nil
 	}
+	if c.shadow != nil {
+		c.shadow.Close(false)
+	}
 	if closefile {
 		c.closeResultFile()
 	}
@@ -184,13 +414,18 @@ func (c *ReplayClient) closeResultFile() {
 		_ = c.resultFile.Close()
 		c.resultFile = nil
 	}
+	if c.rowsWriter != nil {
+		if err := c.rowsWriter.Close(); err != nil {
+			logrus.Errorln("client", c.client, "failed to close rows file:", err)
+		}
+	}
 }
 
-func (c *ReplayClient) appendHash(r *sql.Rows) error {
+func scanRawRow(r *sql.Rows) ([]any, error) {
 	// ignore r.started, since we needn't use reflect for anything.
 	columns, err := r.Columns()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	values := make([]any, len(columns))
 	for i := range values {
@@ -198,14 +433,17 @@ func (c *ReplayClient) appendHash(r *sql.Rows) error {
 	}
 
 	if err := r.Scan(values...); err != nil {
-		return err
+		return nil, err
 	}
+	return values, nil
+}
+
+func (c *ReplayClient) appendHash(values []any) {
 	for _, v := range values {
 		c.hash.Write(*v.(*sql.RawBytes))
 		c.hash.Write([]byte{'\t'}) // append a tab between columns
 	}
 	c.hash.Write([]byte{'\n'}) // append a newline between rows
-	return nil
 }
 
 func (c *ReplayClient) consumeHash() string {
@@ -214,15 +452,110 @@ func (c *ReplayClient) consumeHash() string {
 	return h
 }
 
+// execute runs the sql and returns the replay result, and the return rows if '--max-save-rows' > 0.
+func (c *ReplayClient) execute(ctx context.Context, s *ReplaySql) (*ReplayResult, *ReplayRows) {
+	if c.timeWarp != nil {
+		s = c.timeWarp.warp(s)
+	}
+	if c.sandbox != nil {
+		rewritten, skip := c.sandbox.rewrite(s)
+		if skip != "" {
+			return &ReplayResult{Ts: time.Now().Format(replayTsFormat), QueryId: s.QueryId, Skipped: skip}, nil
+		}
+		s = rewritten
+	}
+	c.switchUser(s.User)
+	logrus.Traceln("client", c.client, "executing query_id:", s.QueryId, "sql:", s.Stmt)
+
+	var (
+		rowCount  int
+		rows      *ReplayRows
+		plan      *capturedPlan
+		startedAt = time.Now()
+	)
+	if c.plans != nil {
+		plan = c.capturePlan(ctx, s)
+	}
+	r, durationMs, err := c.queryWithReconnect(ctx, s)
+	if err != nil {
+		logrus.Debugf("client %s executed sql failed at query_id: %s, err: %v", c.client, s.QueryId, err)
+	} else {
+		c.recordSessionStmt(s.Stmt)
+		if c.maxSaveRows > 0 {
+			rows = &ReplayRows{QueryId: s.QueryId}
+			rows.Columns, _ = r.Columns()
+		}
+		for r.Next() {
+			rowCount++
+			hashRow, saveRow := rowCount < c.maxHashRows, rowCount <= c.maxSaveRows
+			if !hashRow && !saveRow {
+				continue
+			}
+
+			values, err := scanRawRow(r)
+			if err != nil {
+				logrus.Errorf("scan sql return rows failed, query_id: %s, err: %v", s.QueryId, err)
+				break
+			}
+			if hashRow {
+				c.appendHash(values)
+			}
+			if saveRow {
+				rows.append(values)
+			}
+		}
+		if rows != nil {
+			rows.Truncated = rowCount > c.maxSaveRows
+			if !parser.HasOrderBy(s.Stmt) {
+				// the order of rows is not determined
+				rows.sort()
+			}
+		}
+	}
+	if r != nil {
+		_ = r.Close()
+	}
+
+	logrus.Traceln("query_id:", s.QueryId, ", row count:", rowCount, ", duration:", durationMs, "ms")
+
+	result := &ReplayResult{
+		Ts:         startedAt.Format(replayTsFormat),
+		QueryId:    s.QueryId,
+		ReturnRows: rowCount,
+		DurationMs: durationMs,
+	}
+	if err != nil {
+		result.Err = err.Error()
+	}
+	if c.maxHashRows > 0 && rowCount > 0 {
+		result.ReturnRowsHash = c.consumeHash()
+	}
+	if plan != nil && err == nil {
+		c.recordPlan(plan, result)
+	}
+	if c.profiler != nil {
+		c.collectProfile(ctx, s, result)
+	}
+	return result, rows
+}
+
 func (c *ReplayClient) replay(ctx context.Context) error {
-	logrus.Debugf("replay %d sqls for client %s", len(c.sqls), c.client)
+	logrus.Debugf("replay sqls for client %s", c.client)
+
+	r, skipped, err := openClientSqls(c.sqls, c.resumeAfter, nil)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	c.monitor.skip(skipped)
 
 	var (
 		prevTs         = c.minTs
 		prevDurationMs int64
+		seq            int
 	)
 
-	for _, s := range c.sqls {
+	for s := r.Next(); s != nil && ctx.Err() == nil; s = r.Next() {
 		// 1. Wait
 		sleepDuration := time.Duration(float32(s.Ts-prevTs-prevDurationMs)/c.speed) * time.Millisecond
 		if sleepDuration > 2*time.Millisecond {
@@ -234,49 +567,24 @@ func (c *ReplayClient) replay(ctx context.Context) error {
 				// close conn if idle time is too long
 				c.Close(false)
 			}
-			time.Sleep(sleepDuration)
+			if !sleepContext(ctx, sleepDuration) {
+				break
+			}
 		}
 		prevTs = s.Ts
 		prevDurationMs = s.DurationMs
 
-		logrus.Traceln("client", c.client, "executing query_id:", s.QueryId, "sql:", s.Stmt)
-
 		// 2. Execute query
-		var (
-			rowCount  int
-			startedAt = time.Now()
-		)
-		r, durationMs, err := c.queryWithReconnect(ctx, s.Db, s.Stmt)
-		if err != nil {
-			logrus.Debugf("client %s executed sql failed at query_id: %s, err: %v", c.client, s.QueryId, err)
-		} else {
-			for r.Next() {
-				rowCount++
-				if rowCount < c.maxHashRows {
-					if err = c.appendHash(r); err != nil {
-						logrus.Errorf("scan sql return rows failed, query_id: %s, err: %v", s.QueryId, err)
-						break
-					}
-				}
-			}
+		result, rows := c.executeWithShadow(ctx, s)
+		if ctx.Err() != nil {
+			// interrupted, the sql will be replayed again when resuming
+			break
 		}
-		if r != nil {
-			_ = r.Close()
-		}
-
-		logrus.Traceln("query_id:", s.QueryId, ", row count:", rowCount, ", duration:", durationMs, "ms")
 
-		result := ReplayResult{
-			Ts:         startedAt.Format(replayTsFormat),
-			QueryId:    s.QueryId,
-			ReturnRows: rowCount,
-			DurationMs: durationMs,
-		}
-		if err != nil {
-			result.Err = err.Error()
-		}
-		if c.maxHashRows > 0 && rowCount > 0 {
-			result.ReturnRowsHash = c.consumeHash()
+		if rows != nil {
+			if err := c.writeRows(rows); err != nil {
+				return err
+			}
 		}
 
 		b, err := json.Marshal(result)
@@ -288,6 +596,8 @@ func (c *ReplayClient) replay(ctx context.Context) error {
 		if err := c.writeResult(b); err != nil {
 			return err
 		}
+		c.monitor.done(c.client, seq, s, result)
+		seq++
 	}
 
 	logrus.Debugf("client %s replay done", c.client)
@@ -295,31 +605,71 @@ func (c *ReplayClient) replay(ctx context.Context) error {
 	return nil
 }
 
-func ReplaySqls(
-	ctx context.Context,
-	host string, port uint16, user, password, catalog, cluster string,
-	resultDir string, clientSqls []ClientSqls, speed float32, maxHashRows int, maxConnIdleTime time.Duration,
-	minTs int64, parallel int,
-) error {
-	if len(clientSqls) == 0 {
-		return errors.New("no sqls to replay")
-	}
-	if parallel != len(clientSqls) {
-		logrus.Warnf("Parallel %d is not equal to client count %d", parallel, len(clientSqls))
-		if !Confirm("Set parallel to client count") {
-			return errors.New("parallel must be equal to client count")
-		}
-		parallel = len(clientSqls)
-	}
+// ReplayOpts is the options of replaying sqls.
+type ReplayOpts struct {
+	Host     string
+	Port     uint16
+	User     string
+	Password string
+	Catalog  string
+	Cluster  string
+
+	ResultDir       string
+	Speed           float32
+	MaxHashRows     int
+	MaxSaveRows     int
+	MaxConnIdleTime time.Duration
+	Parallel        int
+
+	// OpenLoop fires each sql at its scheduled time, no matter how long the previous sql took.
+	OpenLoop bool
+	// QPS is the target qps of open-loop replay, <= 0 means following the original timestamps.
+	QPS float64
+	// QPSRamp is the duration to ramp up qps linearly from 0 to QPS.
+	QPSRamp time.Duration
+	// PoolSize is the max connections of open-loop replay.
+	PoolSize int
+
+	// Shadow is the shadow target, every sql is sent to both targets at the same moment.
+	Shadow *ReplayShadow
+	// Sandbox rewrites the write statements before replaying, nil means replaying them as they are.
+	Sandbox *ReplaySandbox
+	// TimeWarp shifts the date and datetime literals before replaying, nil means not shifting.
+	TimeWarp *ReplayTimeWarp
+	// CapturePlan captures the plan of each distinct statement fingerprint, 'explain' or 'shape', empty means not capturing.
+	CapturePlan string
+	// ProfileThreshold enables profile and saves the profiles of sqls slower than it, <= 0 means never.
+	ProfileThreshold time.Duration
+	// HTTPPort is the FE HTTP port to fetch profiles.
+	HTTPPort uint16
+
+	// UserMap maps the original users to replay credentials and workload groups, nil means replaying all sqls by User.
+	UserMap *ReplayUserMap
+	// MaxConcurrencyPerUser and MaxConcurrencyPerDB limit the concurrent sqls of each original user and db, <= 0 means unlimited.
+	MaxConcurrencyPerUser int
+	MaxConcurrencyPerDB   int
+
+	// ProgressInterval is the interval of logging replay progress, <= 0 means never.
+	ProgressInterval time.Duration
+	// MetricsAddr is the address to serve Prometheus '/metrics', empty means not serving.
+	MetricsAddr string
+	// Resume continues the replay from the checkpoint in ResultDir.
+	Resume bool
+
+	resume   *ReplayCheckpoint
+	monitor  *replayMonitor
+	profiler *replayProfiler
+	limiter  *replayLimiter
+	// plans and shadowPlans capture the plans of each target, shared by all clients
+	plans, shadowPlans *planCapturer
+}
 
-	logrus.Infof("Replay with %d client, parallel %d, started at %v, speed %f",
-		len(clientSqls),
-		parallel,
-		time.UnixMilli(minTs).UTC().Format("2006-01-02 15:04:05"),
-		speed,
-	)
+func (o *ReplayOpts) dbConfig() *mysql.Config {
+	return newReplayDBConfig(o.Host, o.Port, o.User, o.Password)
+}
 
-	dbcfg := &mysql.Config{
+func newReplayDBConfig(host string, port uint16, user, password string) *mysql.Config {
+	return &mysql.Config{
 		User:                 user,
 		Passwd:               password,
 		Addr:                 net.JoinHostPort(host, strconv.Itoa(int(port))),
@@ -327,10 +677,82 @@ func ReplaySqls(
 		DBName:               "",
 		AllowNativePasswords: true,
 		Timeout:              5 * time.Second,
-		InterpolateParams:    true,
+		InterpolateParams:    false, // replay prepared statements by server-side prepare
 		ReadTimeout:          600 * time.Second,
 		WriteTimeout:         600 * time.Second,
 	}
+}
+
+func (o *ReplayOpts) newClient(dbcfg *mysql.Config, client string, sqls *ClientSqls, minTs int64) *ReplayClient {
+	var (
+		shadow             *ReplayClient
+		shadowLatencyRatio float64
+	)
+	if o.Shadow != nil {
+		shadowLatencyRatio = o.Shadow.LatencyRatio
+		shadow = &ReplayClient{
+			dbcfg:       o.Shadow.dbConfig(),
+			catalog:     o.Shadow.Catalog,
+			cluster:     o.Shadow.Cluster,
+			client:      client + "(shadow)",
+			maxHashRows: o.MaxHashRows,
+			maxSaveRows: o.MaxSaveRows,
+			timeWarp:    o.TimeWarp,
+			sandbox:     o.Sandbox,
+			plans:       o.shadowPlans,
+
+			hash: blake3.New(),
+		}
+	}
+
+	var resumeAfter string
+	if o.resume != nil {
+		resumeAfter = o.resume.Clients[client]
+	}
+
+	return &ReplayClient{
+		resultDir:       o.ResultDir,
+		dbcfg:           dbcfg.Clone(),
+		catalog:         o.Catalog,
+		cluster:         o.Cluster,
+		client:          client,
+		sqls:            sqls,
+		speed:           o.Speed,
+		maxHashRows:     o.MaxHashRows,
+		maxSaveRows:     o.MaxSaveRows,
+		maxConnIdleTime: o.MaxConnIdleTime,
+		minTs:           minTs,
+		timeWarp:        o.TimeWarp,
+		sandbox:         o.Sandbox,
+		plans:           o.plans,
+		profiler:        o.profiler,
+		users:           o.UserMap,
+		limiter:         o.limiter,
+		shadow:          shadow,
+
+		shadowLatencyRatio: shadowLatencyRatio,
+
+		appendFile:  o.resume != nil,
+		resumeAfter: resumeAfter,
+		monitor:     o.monitor,
+
+		hash: blake3.New(),
+	}
+}
+
+func ReplaySqls(ctx context.Context, opts ReplayOpts, clientSqls []ClientSqls, minTs int64, count int) error {
+	if len(clientSqls) == 0 {
+		return errors.New("no sqls to replay")
+	}
+	if !opts.OpenLoop && opts.Parallel != len(clientSqls) {
+		logrus.Warnf("Parallel %d is not equal to client count %d", opts.Parallel, len(clientSqls))
+		if !Confirm("Set parallel to client count") {
+			return errors.New("parallel must be equal to client count")
+		}
+		opts.Parallel = len(clientSqls)
+	}
+
+	dbcfg := opts.dbConfig()
 
 	// test connection
 	db, err := sqlx.ConnectContext(ctx, "mysql", dbcfg.FormatDSN())
@@ -338,25 +760,96 @@ func ReplaySqls(
 		return err
 	}
 	db.Close()
+	if opts.Shadow != nil {
+		db, err := sqlx.ConnectContext(ctx, "mysql", opts.Shadow.dbConfig().FormatDSN())
+		if err != nil {
+			return fmt.Errorf("connect shadow target failed: %w", err)
+		}
+		db.Close()
+	}
+
+	startTs := minTs
+	if opts.Resume {
+		opts.resume, err = ReadReplayCheckpoint(opts.ResultDir)
+		if err != nil {
+			return fmt.Errorf("read replay checkpoint failed: %w", err)
+		}
+		if startTs, err = resumeStartTs(clientSqls, opts.resume); err != nil {
+			return err
+		}
+		logrus.Infof("Resume replay of %d client(s) from %v", len(opts.resume.Clients), time.UnixMilli(startTs).UTC().Format("2006-01-02 15:04:05"))
+	}
+	opts.monitor = newReplayMonitor(count, minTs, opts.resume)
+
+	monitorCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go opts.monitor.runProgress(monitorCtx, opts.ProgressInterval)
+	if opts.MetricsAddr != "" {
+		if err := opts.monitor.serveMetrics(monitorCtx, opts.MetricsAddr); err != nil {
+			return fmt.Errorf("serve metrics failed: %w", err)
+		}
+	}
+
+	if opts.ProfileThreshold > 0 {
+		if opts.profiler, err = newReplayProfiler(&opts); err != nil {
+			return err
+		}
+	}
+	if opts.UserMap != nil {
+		opts.UserMap.complete(opts.User, opts.Password)
+	}
+	opts.limiter = newReplayLimiter(opts.MaxConcurrencyPerUser, opts.MaxConcurrencyPerDB, opts.UserMap)
+	if opts.CapturePlan != "" {
+		opts.plans = newPlanCapturer(opts.CapturePlan)
+		if opts.Shadow != nil {
+			opts.shadowPlans = newPlanCapturer(opts.CapturePlan)
+		}
+	}
+
+	if opts.OpenLoop {
+		err = replayOpenLoop(ctx, &opts, dbcfg, clientSqls, startTs)
+	} else {
+		err = replayClosedLoop(ctx, &opts, dbcfg, clientSqls, startTs)
+	}
+	if opts.profiler != nil {
+		opts.profiler.wait()
+	}
+	return opts.finish(ctx, err)
+}
+
+// resumeStartTs returns the timestamp of the first sql to resume, the replay clock is rebased on it,
+// so that the resumed sqls keep their original intervals instead of bursting.
+func resumeStartTs(clientSqls []ClientSqls, resume *ReplayCheckpoint) (int64, error) {
+	startTs := int64(math.MaxInt64)
+	for i := range clientSqls {
+		r, _, err := openClientSqls(&clientSqls[i], resume.Clients[clientSqls[i].Client], nil)
+		if err != nil {
+			return 0, err
+		}
+		if s := r.Next(); s != nil {
+			startTs = min(startTs, s.Ts)
+		}
+		r.Close()
+	}
+	if startTs == math.MaxInt64 {
+		// all sqls have been executed
+		return resume.Ts, nil
+	}
+	return startTs, nil
+}
+
+func replayClosedLoop(ctx context.Context, opts *ReplayOpts, dbcfg *mysql.Config, clientSqls []ClientSqls, minTs int64) error {
+	logrus.Infof("Replay with %d client, parallel %d, started at %v, speed %f",
+		len(clientSqls),
+		opts.Parallel,
+		time.UnixMilli(minTs).UTC().Format("2006-01-02 15:04:05"),
+		opts.Speed,
+	)
 
-	g := ParallelGroup(parallel)
+	g := ParallelGroup(opts.Parallel)
 	for _, clientsql := range clientSqls {
-		client, sqls := clientsql.Client, clientsql.Sqls
 		g.Go(func() error {
-			cli := ReplayClient{
-				resultDir:       resultDir,
-				dbcfg:           dbcfg.Clone(),
-				catalog:         catalog,
-				cluster:         cluster,
-				client:          client,
-				sqls:            sqls,
-				speed:           speed,
-				maxHashRows:     maxHashRows,
-				maxConnIdleTime: maxConnIdleTime,
-				minTs:           minTs,
-
-				hash: blake3.New(),
-			}
+			cli := opts.newClient(dbcfg, clientsql.Client, &clientsql, minTs)
 			defer cli.Close(true)
 
 			return cli.replay(ctx)
@@ -366,9 +859,37 @@ func ReplaySqls(
 	return g.Wait()
 }
 
-type ClientSqls struct {
-	Client string
-	Sqls   []*ReplaySql
+// finish writes the checkpoint if replay is interrupted, otherwise removes the stale one.
+func (o *ReplayOpts) finish(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		logrus.Warnln("Replay interrupted:", o.monitor.progress())
+		if err := o.monitor.writeCheckpoint(o.ResultDir); err != nil {
+			return fmt.Errorf("write replay checkpoint failed: %w", err)
+		}
+		logrus.Warnf("Replay checkpoint is saved to %s, continue with '--resume'", filepath.Join(o.ResultDir, ReplayCheckpointFile))
+		return errors.New("replay interrupted")
+	}
+	if err != nil {
+		return err
+	}
+
+	logrus.Infoln("Replay done:", o.monitor.progress())
+	if err := os.Remove(filepath.Join(o.ResultDir, ReplayCheckpointFile)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// sleepContext sleeps for d, returns false if ctx is done before that.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
 }
 
 func clientNameFormat(clientCount int) string {
@@ -395,105 +916,205 @@ func getClientBySqlIdx(
 	return fmt.Sprintf(format, (sqlIdx%clientCount)+1)
 }
 
+// sessionIdx returns the index of the session, assigned by the order of first appearance.
+func sessionIdx(session2idx map[string]int, session string) int {
+	idx, ok := session2idx[session]
+	if !ok {
+		idx = len(session2idx)
+		session2idx[session] = idx
+	}
+	return idx
+}
+
 func DecodeReplaySqls(
 	s *bufio.Scanner,
 	dbs, users map[string]struct{},
 	from, to int64, // ms
 	clientCount int,
 ) (map[string][]*ReplaySql, int64, int, error) {
+	c := NewReplaySqlCollector(dbs, users, from, to, clientCount)
+	if err := c.Collect(s); err != nil {
+		return nil, 0, 0, err
+	}
+	client2sqls, minTs, count := c.Close()
+	return client2sqls, minTs, count, nil
+}
+
+// ReplaySqlCollector collects replay sqls into memory grouped by client,
+// sqls from multiple dump files are merged into one timeline.
+type ReplaySqlCollector struct {
+	assigner    *replaySqlAssigner
+	client2sqls map[string][]*ReplaySql
+}
+
+func NewReplaySqlCollector(dbs, users map[string]struct{}, from, to int64, clientCount int) *ReplaySqlCollector {
+	return &ReplaySqlCollector{
+		assigner:    newReplaySqlAssigner(dbs, users, from, to, clientCount),
+		client2sqls: make(map[string][]*ReplaySql, 1024),
+	}
+}
+
+// Collect collects the replay sqls from dump file, can be called multiple times with different dump files.
+func (c *ReplaySqlCollector) Collect(s *bufio.Scanner) error {
+	d, err := newReplaySqlDecoder(s)
+	if err != nil || d == nil {
+		return err
+	}
+
+	for sql := d.next(); sql != nil; sql = d.next() {
+		client, ok := c.assigner.assign(sql)
+		if !ok {
+			continue
+		}
+		c.client2sqls[client] = append(c.client2sqls[client], sql)
+	}
+	return s.Err()
+}
+
+// Close returns the sqls of each client in time order, the minimal timestamp and the sql count.
+func (c *ReplaySqlCollector) Close() (map[string][]*ReplaySql, int64, int) {
+	// rebuild the execution order of each client
+	for _, sqls := range c.client2sqls {
+		slices.SortStableFunc(sqls, func(a, b *ReplaySql) int { return cmp.Compare(a.Ts, b.Ts) })
+	}
+	return c.client2sqls, c.assigner.minTs, c.assigner.count
+}
+
+// replaySqlDecoder decodes replay sqls from dump file one by one.
+type replaySqlDecoder struct {
+	s    *bufio.Scanner
+	line []byte
+	eof  bool
+}
+
+// newReplaySqlDecoder returns nil if the dump file is empty.
+func newReplaySqlDecoder(s *bufio.Scanner) (*replaySqlDecoder, error) {
 	if !s.Scan() {
 		logrus.Warningln("Failed to scan reply sql file, maybe empty?")
-		return nil, 0, 0, nil
+		return nil, s.Err()
 	}
 
-	var (
-		clientNameFmt = clientNameFormat(clientCount)
-		line          = s.Bytes()
-		eof           = false
-		count         int
-	)
-
 	// check the replay file is valid by first line prefix
+	line := s.Bytes()
 	if !bytes.HasPrefix(line, []byte(ReplaySqlPrefix)) {
-		return nil, 0, 0, errors.New("invalid sql replay file")
+		return nil, errors.New("invalid sql replay file")
 	}
+	return &replaySqlDecoder{s: s, line: line}, nil
+}
 
-	client2sqls := make(map[string][]*ReplaySql, 1024)
-	minTs := int64(math.MaxInt64)
-	for i := 0; !eof; i++ {
-		oneSql := bytes.Clone(line)
+// next returns the next replay sql, or nil if there is no more.
+func (d *replaySqlDecoder) next() *ReplaySql {
+	for !d.eof {
+		oneSql := bytes.Clone(d.line)
 
 		// one log may have multiple lines
 		// a line not starts with `replaySqlPrefix` is considered belonging to the previous line
 		for {
-			if !s.Scan() {
-				eof = true
+			if !d.s.Scan() {
+				d.eof = true
 				break
 			}
-			line = s.Bytes()
+			d.line = d.s.Bytes()
 
-			if bytes.HasPrefix(line, []byte(ReplaySqlPrefix)) {
+			if bytes.HasPrefix(d.line, []byte(ReplaySqlPrefix)) {
 				break
 			}
 
 			// append to previous line
 			oneSql = append(oneSql, '\n')
-			oneSql = append(oneSql, line...)
+			oneSql = append(oneSql, d.line...)
 		}
 
-		// parse one sql
-
-		// decode meta
-		// include '{' and '}'
-		metaStart := len(ReplaySqlPrefix) - 1
-		metaEnd := bytes.Index(oneSql, []byte(ReplaySqlSuffix))
-		if metaEnd < 0 || oneSql[metaEnd-1] != '}' {
-			logrus.Warningln("Failed to extract replay sql meta at:", string(oneSql))
-			continue
-		}
-		meta, err := decodeReplaySqlMeta(oneSql[metaStart:metaEnd])
-		if err != nil {
-			logrus.Warningln("Failed to parse replay sql meta, err: ", err, ", query:", meta.QueryId)
-			continue
+		if sql := decodeReplaySql(oneSql); sql != nil {
+			return sql
 		}
+	}
+	return nil
+}
 
-		// decode stmt
-		stmt := string(bytes.TrimSpace(oneSql[metaEnd+len(ReplaySqlSuffix):]))
-		if stmt == "" {
-			logrus.Warningln("empty replay sql stmt, query_id:", meta.QueryId)
-			continue
-		}
+func decodeReplaySql(oneSql []byte) *ReplaySql {
+	// decode meta
+	// include '{' and '}'
+	metaStart := len(ReplaySqlPrefix) - 1
+	metaEnd := bytes.Index(oneSql, []byte(ReplaySqlSuffix))
+	if metaEnd < 0 || oneSql[metaEnd-1] != '}' {
+		logrus.Warningln("Failed to extract replay sql meta at:", string(oneSql))
+		return nil
+	}
+	meta, err := decodeReplaySqlMeta(oneSql[metaStart:metaEnd])
+	if err != nil {
+		logrus.Warningln("Failed to parse replay sql meta, err: ", err, ", query:", meta.QueryId)
+		return nil
+	}
 
-		// filter
-		if _, ok := dbs[meta.Db]; len(dbs) > 0 && !ok {
-			continue
-		}
-		if _, ok := users[meta.User]; len(users) > 0 && !ok {
-			continue
-		}
-		if !meta.matchTime(from, to) {
-			continue
-		}
+	// decode stmt
+	stmt := string(bytes.TrimSpace(oneSql[metaEnd+len(ReplaySqlSuffix):]))
+	if stmt == "" {
+		logrus.Warningln("empty replay sql stmt, query_id:", meta.QueryId)
+		return nil
+	}
 
-		// logs may out of order
-		ts, err := meta.Timestamp()
-		if err != nil {
-			continue
-		}
-		if ts < minTs {
-			minTs = meta.Ts
-		}
+	return &ReplaySql{ReplaySqlMeta: meta, Stmt: stmt}
+}
 
-		// add to result
-		client := getClientBySqlIdx(clientNameFmt, clientCount, meta.Client, i)
-		client2sqls[client] = append(client2sqls[client], &ReplaySql{
-			ReplaySqlMeta: meta,
-			Stmt:          stmt,
-		})
-		count++
+// replaySqlAssigner filters replay sqls and assigns them to clients.
+type replaySqlAssigner struct {
+	dbs, users    map[string]struct{}
+	from, to      int64
+	clientCount   int
+	clientNameFmt string
+	session2idx   map[string]int
+
+	i     int
+	minTs int64
+	count int
+}
+
+func newReplaySqlAssigner(dbs, users map[string]struct{}, from, to int64, clientCount int) *replaySqlAssigner {
+	return &replaySqlAssigner{
+		dbs:           dbs,
+		users:         users,
+		from:          from,
+		to:            to,
+		clientCount:   clientCount,
+		clientNameFmt: clientNameFormat(clientCount),
+		session2idx:   make(map[string]int, 1024),
+		minTs:         int64(math.MaxInt64),
+	}
+}
+
+// assign returns the client of the sql, false if the sql is filtered out.
+func (a *replaySqlAssigner) assign(sql *ReplaySql) (string, bool) {
+	i := a.i
+	a.i++
+
+	// filter
+	meta := &sql.ReplaySqlMeta
+	if _, ok := a.dbs[meta.Db]; len(a.dbs) > 0 && !ok {
+		return "", false
+	}
+	if _, ok := a.users[meta.User]; len(a.users) > 0 && !ok {
+		return "", false
+	}
+	if !meta.matchTime(a.from, a.to) {
+		return "", false
 	}
 
-	return client2sqls, minTs, count, nil
+	// logs may out of order
+	ts, err := meta.Timestamp()
+	if err != nil {
+		return "", false
+	}
+	if ts < a.minTs {
+		a.minTs = ts
+	}
+	a.count++
+
+	// sqls in the same session always go to the same client
+	if meta.Session != "" {
+		return getClientBySqlIdx(a.clientNameFmt, a.clientCount, meta.Session, sessionIdx(a.session2idx, meta.Session)), true
+	}
+	return getClientBySqlIdx(a.clientNameFmt, a.clientCount, meta.Client, i), true
 }
 
 type ReplaySql struct {
@@ -511,15 +1132,20 @@ func (s *ReplaySql) ToReplayResult() *ReplayResult {
 	}
 }
 
-func EncodeReplaySql(ts, client, user, db, queryId, stmt string, durationMs int64) string {
-	b, err := json.Marshal(ReplaySqlMeta{
+func EncodeReplaySql(ts, client, session, user, db, queryId, stmt string, durationMs int64) string {
+	return encodeReplaySql(ReplaySqlMeta{
 		Ts_:        ts,
 		Client:     client,
+		Session:    session,
 		User:       user,
 		Db:         db,
 		QueryId:    queryId,
 		DurationMs: durationMs,
-	})
+	}, stmt)
+}
+
+func encodeReplaySql(meta ReplaySqlMeta, stmt string) string {
+	b, err := json.Marshal(meta)
 	if err != nil {
 		panic(err)
 	}
@@ -534,15 +1160,24 @@ func EncodeReplaySql(ts, client, user, db, queryId, stmt string, durationMs int6
 
 // ReplaySqlMeta will be prepend to every sql as a comment.
 //
-// e.g.	"/*dodo{"ts": "2024-09-20 00:00:00", "client": "127.0.0.1:32345", "user": "root", "db": "test", "queryId": "1"}*/ <the sql>"
+// e.g.	"/*dodo{"ts": "2024-09-20 00:00:00", "client": "127.0.0.1:32345", "session": "127.0.0.1:32345@10.0.0.1", "user": "root", "db": "test", "queryId": "1"}*/ <the sql>"
+//
+// The sql of prepared statement is its template, like:
+//
+//	"/*dodo{..., "prepared": true, "params": ["1", "'a'"]}*/ SELECT * FROM t WHERE id = ? AND name = ?"
 type ReplaySqlMeta struct {
 	Ts_        string `json:"ts"`
 	Ts         int64  `json:"-"`
 	Client     string `json:"client"`
+	Session    string `json:"session,omitempty"` // the connection which executed the sql, sqls are replayed per session if exists
 	User       string `json:"user"`
 	Db         string `json:"db"`
 	QueryId    string `json:"queryId"`
 	DurationMs int64  `json:"durationMs,omitempty"`
+	Fe         string `json:"fe,omitempty"` // the FE which the sql was sent to
+
+	Prepared bool     `json:"prepared,omitempty"` // the sql is executed by server-side prepared statement
+	Params   []string `json:"params,omitempty"`   // the sql literals bound to prepared statement
 }
 
 func (m *ReplaySqlMeta) matchTime(fromMs, toMs int64) bool {
@@ -566,7 +1201,7 @@ func (m *ReplaySqlMeta) matchTime(fromMs, toMs int64) bool {
 
 func (m *ReplaySqlMeta) Timestamp() (ms int64, err error) {
 	if m.Ts != 0 {
-		return
+		return m.Ts, nil
 	}
 
 	ts, err := time.Parse(replayTsFormat, m.Ts_)
@@ -2,8 +2,16 @@ package src
 
 import (
 	"bufio"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -88,3 +96,593 @@ func TestDecodeReplaySqls(t *testing.T) {
 		})
 	}
 }
+
+func TestDecodeReplaySqls_session(t *testing.T) {
+	disableLog()
+
+	replaySqls := `/*dodo{"ts":"2024-08-06 23:44:11.003","client":"10.0.0.2:51970","session":"10.0.0.2:51970@10.0.0.1","user":"root","db":"mydb","queryId":"a2"}*/ SELECT @a;
+/*dodo{"ts":"2024-08-06 23:44:11.001","client":"10.0.0.2:51970","session":"10.0.0.2:51970@10.0.0.1","user":"root","db":"mydb","queryId":"a1"}*/ SET @a = 1;
+/*dodo{"ts":"2024-08-06 23:44:11.002","client":"10.0.0.2:51970","session":"10.0.0.2:51970@10.0.0.9","user":"root","db":"mydb","queryId":"b1"}*/ SELECT 1;
+/*dodo{"ts":"2024-08-06 23:44:11.004","client":"10.0.0.3:51970","user":"root","db":"mydb","queryId":"c1"}*/ SELECT 2;`
+
+	got, _, count, err := DecodeReplaySqls(bufio.NewScanner(strings.NewReader(replaySqls)), nil, nil, 0, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, count)
+	assert.Len(t, got, 3)
+	// sqls in the same session are ordered by ts
+	assert.Equal(t, []string{"a1", "a2"}, lo.Map(got["10.0.0.2:51970@10.0.0.1"], func(s *ReplaySql, _ int) string { return s.QueryId }))
+	assert.Len(t, got["10.0.0.2:51970@10.0.0.9"], 1)
+	assert.Len(t, got["10.0.0.3:51970"], 1)
+
+	// sqls in the same session always go to the same custom client
+	got, _, _, err = DecodeReplaySqls(bufio.NewScanner(strings.NewReader(replaySqls)), nil, nil, 0, 0, 2)
+	assert.NoError(t, err)
+	assert.Len(t, got["client1"], 2)
+	assert.Equal(t, "a1", got["client1"][0].QueryId)
+}
+
+func TestOpenLoopSchedule(t *testing.T) {
+	sql := func(ts int64) *ReplaySql { return &ReplaySql{ReplaySqlMeta: ReplaySqlMeta{Ts: ts}} }
+
+	// follow original timestamps
+	s := &openLoopSchedule{minTs: 1000, speed: 2}
+	assert.Equal(t, time.Duration(0), s.at(0, sql(1000)))
+	assert.Equal(t, 500*time.Millisecond, s.at(1, sql(2000)))
+
+	// fixed qps, timestamps are ignored
+	s = &openLoopSchedule{minTs: 1000, speed: 1, qps: 10}
+	assert.Equal(t, time.Duration(0), s.at(0, sql(5000)))
+	assert.Equal(t, time.Second, s.at(10, sql(1000)))
+
+	// ramp 0 -> 10 qps in 10s fires 50 sqls, then 10 qps
+	s = &openLoopSchedule{minTs: 1000, speed: 1, qps: 10, ramp: 10 * time.Second}
+	assert.Equal(t, time.Duration(0), s.at(0, sql(1000)))
+	assert.InDelta(t, math.Sqrt(2*10*10/10.), s.at(10, sql(1000)).Seconds(), 1e-6)
+	assert.InDelta(t, 10., s.at(50, sql(1000)).Seconds(), 1e-6)
+	assert.InDelta(t, 11., s.at(60, sql(1000)).Seconds(), 1e-6)
+}
+
+func TestOpenLoopMerger(t *testing.T) {
+	sql := func(ts int64) *ReplaySql {
+		return &ReplaySql{ReplaySqlMeta: ReplaySqlMeta{Ts: ts, QueryId: fmt.Sprint(ts)}}
+	}
+	clientSqls := []ClientSqls{
+		{Client: "a", Sqls: []*ReplaySql{sql(1), sql(3)}},
+		{Client: "b", Sqls: []*ReplaySql{sql(2), sql(3)}},
+		{Client: "c"},
+	}
+	merge := func(resume *ReplayCheckpoint) ([]string, int) {
+		m, err := newOpenLoopMerger(clientSqls, resume)
+		assert.NoError(t, err)
+		defer m.Close()
+
+		got := []string{}
+		for task := m.next(); task != nil; task = m.next() {
+			got = append(got, fmt.Sprintf("%s%d#%d", task.client, task.sql.Ts, task.seq))
+		}
+		return got, m.skipped
+	}
+
+	got, skipped := merge(nil)
+	assert.Equal(t, []string{"a1#0", "b2#0", "a3#1", "b3#1"}, got)
+	assert.Equal(t, 0, skipped)
+
+	// resume after the executed sqls, unknown query id replays from the beginning
+	got, skipped = merge(&ReplayCheckpoint{Clients: map[string]string{"a": "1", "b": "404"}})
+	assert.Equal(t, []string{"b2#0", "a3#0", "b3#1"}, got)
+	assert.Equal(t, 1, skipped)
+
+	// the clock is rebased on the first resumed sql
+	startTs, err := resumeStartTs(clientSqls, &ReplayCheckpoint{Ts: 3, Clients: map[string]string{"a": "3"}})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, startTs)
+	startTs, err = resumeStartTs(clientSqls, &ReplayCheckpoint{Ts: 3, Clients: map[string]string{"a": "3", "b": "3"}})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 3, startTs)
+}
+
+func TestReplayMonitor(t *testing.T) {
+	sql := func(ts int64, id string) *ReplaySql {
+		return &ReplaySql{ReplaySqlMeta: ReplaySqlMeta{Ts: ts, QueryId: id, User: "root", Db: "db1"}}
+	}
+	m := newReplayMonitor(10, 1000, &ReplayCheckpoint{Ts: 1500, Clients: map[string]string{"b": "x"}})
+	m.skip(3)
+
+	// sqls of a client finish out of order, checkpoint only advances to the continuous prefix
+	m.done("a", 1, sql(3000, "a2"), &ReplayResult{DurationMs: 200})
+	assert.Equal(t, map[string]string{"b": "x"}, m.checkpoint.Clients)
+	m.done("a", 0, sql(2000, "a1"), &ReplayResult{DurationMs: 20, Err: "boom"})
+	m.done("a", 3, sql(5000, "a4"), &ReplayResult{DurationMs: 2000})
+	assert.Equal(t, map[string]string{"a": "a2", "b": "x"}, m.checkpoint.Clients)
+	assert.Equal(t, int64(3000), m.checkpoint.Ts)
+	assert.Equal(t, int64(6), m.executed.Load())
+	assert.Contains(t, m.progress(), "6/10 (60.0%)")
+
+	dir := t.TempDir()
+	assert.NoError(t, m.writeCheckpoint(dir))
+	cp, err := ReadReplayCheckpoint(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, m.checkpoint, cp)
+
+	// skipped sqls are neither errors nor latency
+	m.done("a", 2, sql(4000, "a3"), &ReplayResult{Skipped: "skipped by --write-mode=sandbox"})
+	assert.Contains(t, m.progress(), "1 error(s), 1 skipped")
+
+	var sb strings.Builder
+	assert.NoError(t, m.writeMetrics(&sb))
+	metrics := sb.String()
+	assert.Contains(t, metrics, `dodo_replay_errors_total{user="root",db="db1"} 1`)
+	assert.Contains(t, metrics, "dodo_replay_skipped_queries_total 1")
+	assert.Contains(t, metrics, `dodo_replay_query_duration_seconds_bucket{user="root",db="db1",le="0.025"} 1`)
+	assert.Contains(t, metrics, `dodo_replay_query_duration_seconds_bucket{user="root",db="db1",le="0.25"} 2`)
+	assert.Contains(t, metrics, `dodo_replay_query_duration_seconds_bucket{user="root",db="db1",le="+Inf"} 3`)
+	assert.Contains(t, metrics, `dodo_replay_query_duration_seconds_sum{user="root",db="db1"} 2.22`)
+}
+
+func TestReplaySqlSplitter(t *testing.T) {
+	replaySqls := `/*dodo{"ts":"2024-08-06 00:00:02.000","client":"c1","user":"u","db":"d","queryId":"2"}*/ select 2;
+/*dodo{"ts":"2024-08-06 00:00:01.000","client":"c1","user":"u","db":"d","queryId":"1"}*/ select
+1;
+/*dodo{"ts":"2024-08-06 00:00:03.000","client":"c2","user":"u","db":"d","queryId":"3"}*/ select 3;
+/*dodo{"ts":"2024-08-06 00:00:04.000","client":"c2","user":"u2","db":"d","queryId":"4"}*/ select 4;`
+
+	dir := t.TempDir()
+	sp := NewReplaySqlSplitter(dir, nil, map[string]struct{}{"u": {}}, 0, 0, 0)
+	assert.NoError(t, sp.Split(bufio.NewScanner(strings.NewReader(replaySqls))))
+	clientSqls, minTs, count, err := sp.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+	assert.Equal(t, time.Date(2024, 8, 6, 0, 0, 1, 0, time.UTC).UnixMilli(), minTs)
+	assert.Equal(t, []string{"c1", "c2"}, lo.Map(clientSqls, func(cs ClientSqls, _ int) string { return cs.Client }))
+
+	// read lazily in time order
+	r, err := clientSqls[0].Open()
+	assert.NoError(t, err)
+	defer r.Close()
+	sqls := r.ReadAll()
+	assert.Equal(t, []string{"1", "2"}, lo.Map(sqls, func(s *ReplaySql, _ int) string { return s.QueryId }))
+	assert.Equal(t, "select\n1;", sqls[0].Stmt)
+	assert.Equal(t, "d", sqls[0].Db)
+
+	// look up the original sqls client by client
+	originals := NewOriginalSqls(clientSqls)
+	assert.Equal(t, "select 2;", originals.Get("c1", "2").Stmt)
+	assert.Equal(t, "select 3;", originals.Get("c2", "3").Stmt)
+	assert.Nil(t, originals.Get("c2", "1"))
+	assert.Nil(t, originals.Get("c3", "3"))
+}
+
+func TestClientReaderPool(t *testing.T) {
+	// multi-line sqls, the readers are reopened at the pending line
+	var b strings.Builder
+	for i := range 10 {
+		fmt.Fprintf(&b, `/*dodo{"ts":"%s","client":"c1","user":"u","db":"d","queryId":"%d"}*/ select`+"\r\n%d;\n",
+			time.UnixMilli(int64(i)).UTC().Format(replayTsFormat), i, i)
+	}
+	dir := t.TempDir()
+	clientSqls := make([]ClientSqls, 3)
+	for i := range clientSqls {
+		clientSqls[i].File = filepath.Join(dir, fmt.Sprintf("c%d.sql", i))
+		assert.NoError(t, os.WriteFile(clientSqls[i].File, []byte(b.String()), 0600))
+	}
+
+	pool := newClientReaderPool(2)
+	readers := lo.Map(clientSqls, func(cs ClientSqls, _ int) *ReplaySqlReader {
+		r, _, err := openClientSqls(&cs, "3", pool)
+		assert.NoError(t, err)
+		return r
+	})
+	got := make([][]string, len(readers))
+	for range 6 {
+		for i, r := range readers {
+			if s := r.Next(); s != nil {
+				got[i] = append(got[i], s.Stmt)
+			}
+			assert.LessOrEqual(t, len(pool.open), 2)
+		}
+	}
+	want := lo.Map(lo.Range(10)[4:], func(i, _ int) string { return fmt.Sprintf("select\n%d;", i) })
+	assert.Equal(t, [][]string{want, want, want}, got)
+
+	// closed at the end
+	assert.Empty(t, pool.open)
+	assert.Nil(t, readers[0].Next())
+}
+
+func TestReplaySqlSplitter_multiFiles(t *testing.T) {
+	disableLog()
+
+	// sqls of the same client are interleaved across dump files, far beyond a reorder window
+	var file1, file2 strings.Builder
+	for i := range 3000 {
+		line := fmt.Sprintf(`/*dodo{"ts":"%s","client":"c1","user":"u","db":"d","queryId":"%d"}*/ select %d;`+"\n",
+			time.UnixMilli(int64(i)).UTC().Format(replayTsFormat), i, i)
+		if i%2 == 0 {
+			file1.WriteString(line)
+		} else {
+			file2.WriteString(line)
+		}
+	}
+
+	dir := t.TempDir()
+	sp := NewReplaySqlSplitter(dir, nil, nil, 0, 0, 0)
+	assert.NoError(t, sp.Split(bufio.NewScanner(strings.NewReader(file1.String()))))
+	assert.NoError(t, sp.Split(bufio.NewScanner(strings.NewReader(file2.String()))))
+	clientSqls, _, count, err := sp.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, 3000, count)
+
+	want := lo.Map(lo.Range(3000), func(i, _ int) string { return strconv.Itoa(i) })
+	readIds := func(cs ClientSqls) []string {
+		r, err := cs.Open()
+		assert.NoError(t, err)
+		defer r.Close()
+		return lo.Map(r.ReadAll(), func(s *ReplaySql, _ int) string { return s.QueryId })
+	}
+	assert.Equal(t, want, readIds(clientSqls[0]))
+
+	// sorted in chunks and merged
+	path := filepath.Join(dir, "unsorted.sql")
+	assert.NoError(t, os.WriteFile(path, []byte(file1.String()+file2.String()), 0600))
+	assert.NoError(t, sortReplaySqlFile(path, 500))
+	assert.Equal(t, want, readIds(ClientSqls{File: path}))
+	assert.NoFileExists(t, path+".0")
+}
+
+func TestReplaySqlSplitter_outOfOrder(t *testing.T) {
+	disableLog()
+
+	// the first sql is logged after 2000 later sqls
+	var b strings.Builder
+	for _, i := range append(lo.Range(2001)[1:], 0) {
+		fmt.Fprintf(&b, `/*dodo{"ts":"%s","client":"c1","user":"u","db":"d","queryId":"%d"}*/ select %d;`+"\n",
+			time.UnixMilli(int64(i)).UTC().Format(replayTsFormat), i, i)
+	}
+
+	c := NewReplaySqlCollector(nil, nil, 0, 0, 0)
+	assert.NoError(t, c.Collect(bufio.NewScanner(strings.NewReader(b.String()))))
+	client2sqls, _, _ := c.Close()
+
+	sp := NewReplaySqlSplitter(t.TempDir(), nil, nil, 0, 0, 0)
+	assert.NoError(t, sp.Split(bufio.NewScanner(strings.NewReader(b.String()))))
+	clientSqls, _, _, err := sp.Close()
+	assert.NoError(t, err)
+	r, err := clientSqls[0].Open()
+	assert.NoError(t, err)
+	defer r.Close()
+
+	// streaming replays the same order as in memory
+	ids := func(sqls []*ReplaySql) []string {
+		return lo.Map(sqls, func(s *ReplaySql, _ int) string { return s.QueryId })
+	}
+	assert.Equal(t, ids(client2sqls["c1"]), ids(r.ReadAll()))
+	assert.Equal(t, "0", client2sqls["c1"][0].QueryId)
+}
+
+func TestReplaySqlCollector(t *testing.T) {
+	disableLog()
+
+	// a day of rotated audit logs, the session continues in the next file
+	file1 := `/*dodo{"ts":"2024-08-06 10:00:02.000","client":"c1","session":"c1@fe1","user":"u","db":"d","queryId":"2"}*/ select 2;
+/*dodo{"ts":"2024-08-06 10:00:03.000","client":"c2","session":"c2@fe1","user":"u","db":"d","queryId":"3"}*/ select 3;`
+	file2 := `/*dodo{"ts":"2024-08-06 10:00:01.000","client":"c1","session":"c1@fe1","user":"u","db":"d","queryId":"1"}*/ select 1;
+/*dodo{"ts":"2024-08-06 10:00:04.000","client":"c1","session":"c1@fe1","user":"u","db":"d","queryId":"4"}*/ select 4;`
+
+	c := NewReplaySqlCollector(nil, nil, 0, 0, 2)
+	assert.NoError(t, c.Collect(bufio.NewScanner(strings.NewReader(file1))))
+	assert.NoError(t, c.Collect(bufio.NewScanner(strings.NewReader(file2))))
+	client2sqls, minTs, count := c.Close()
+
+	assert.Equal(t, 4, count)
+	assert.Equal(t, time.Date(2024, 8, 6, 10, 0, 1, 0, time.UTC).UnixMilli(), minTs)
+	ids := lo.MapValues(client2sqls, func(sqls []*ReplaySql, _ string) []string {
+		return lo.Map(sqls, func(s *ReplaySql, _ int) string { return s.QueryId })
+	})
+	assert.Equal(t, map[string][]string{"client1": {"1", "2", "4"}, "client2": {"3"}}, ids)
+}
+
+func TestShadowDiff(t *testing.T) {
+	r := func(rows int, hash string, ms int64, err string) *ReplayResult {
+		return &ReplayResult{ReturnRows: rows, ReturnRowsHash: hash, DurationMs: ms, Err: err}
+	}
+	str := func(s string) *string { return &s }
+
+	assert.Empty(t, shadowDiff(r(1, "h", 10, ""), r(1, "h", 15, ""), nil, nil, 2))
+	assert.Equal(t, `err: "" vs "boom"; rows count: 1 vs 0`, shadowDiff(r(1, "h", 10, ""), r(0, "", 10, "boom"), nil, nil, 0))
+	assert.Equal(t, "rows hash not match", shadowDiff(r(1, "h1", 10, ""), r(1, "h2", 10, ""), nil, nil, 0))
+	assert.Equal(t, "latency: 9ms vs 29ms (x3.00)", shadowDiff(r(1, "h", 9, ""), r(1, "h", 29, ""), nil, nil, 2))
+
+	// saved rows take precedence over hash
+	rows1 := &ReplayRows{Rows: [][]*string{{str("1.0000001")}}}
+	rows2 := &ReplayRows{Rows: [][]*string{{str("1.0000002")}}}
+	assert.Empty(t, shadowDiff(r(1, "h1", 10, ""), r(1, "h2", 10, ""), rows1, rows2, 0))
+	rows2.Rows[0][0] = str("2")
+	assert.Equal(t, "rows not match: 1 mismatched, 0 missing, 0 extra", shadowDiff(r(1, "h1", 10, ""), r(1, "h2", 10, ""), rows1, rows2, 0))
+
+	// truncated unordered rows fall back to hash
+	rows1.Sorted, rows1.Truncated = true, true
+	assert.Empty(t, shadowDiff(r(1, "h", 10, ""), r(1, "h", 10, ""), rows1, rows2, 0))
+	assert.Equal(t, "rows hash not match", shadowDiff(r(1, "h1", 10, ""), r(1, "h2", 10, ""), rows1, rows2, 0))
+}
+
+func TestPreparedParamValues(t *testing.T) {
+	params := splitSQLParams(`1, -2.5, 'a, b', "it\'s", NULL, true, NOW()`)
+	assert.Equal(t, []string{"1", "-2.5", "'a, b'", `"it\'s"`, "NULL", "true", "NOW()"}, params)
+	assert.Equal(t, []any{int64(1), -2.5, "a, b", "it's", nil, true, "NOW()"}, preparedParamValues(params))
+}
+
+func TestPreparedStmtsSessions(t *testing.T) {
+	p := newPreparedStmts()
+	p.resolve("s0", "PREPARE p FROM 'SELECT ?'")
+	for i := range preparedMaxSessions {
+		p.resolve(fmt.Sprint("s", i+1), "SET @a = 1")
+		if i == 0 {
+			// s0 is used recently
+			_, params, _, _ := p.resolve("s0", "EXECUTE p USING 1")
+			assert.Equal(t, []string{"1"}, params)
+		}
+	}
+
+	// the least recently used session is dropped
+	assert.Equal(t, preparedMaxSessions, p.lru.Len())
+	assert.NotContains(t, p.sessions, "s1")
+	_, _, prepared, _ := p.resolve("s0", "EXECUTE p USING 1")
+	assert.True(t, prepared)
+
+	// dropped at the end of session
+	p.end("s0")
+	_, _, prepared, emit := p.resolve("s0", "EXECUTE p USING 1")
+	assert.False(t, prepared || emit)
+	assert.Len(t, p.sessions, preparedMaxSessions-1)
+}
+
+func TestReplaySandbox(t *testing.T) {
+	s := &ReplaySql{ReplaySqlMeta: ReplaySqlMeta{QueryId: "1"}, Stmt: "insert into db1.t values (1)"}
+
+	sandbox := &ReplaySandbox{Mode: ReplayWriteSandbox, DB: "sandbox", TableSuffix: "_shadow"}
+	got, skip := sandbox.rewrite(s)
+	assert.Empty(t, skip)
+	assert.Equal(t, "insert into `sandbox`.`t_shadow` values (1)", got.Stmt)
+	assert.Equal(t, "insert into db1.t values (1)", s.Stmt)
+
+	explain := &ReplaySandbox{Mode: ReplayWriteExplain}
+	got, _ = explain.rewrite(s)
+	assert.Equal(t, "EXPLAIN insert into db1.t values (1)", got.Stmt)
+	_, skip = explain.rewrite(&ReplaySql{Stmt: "truncate table t"})
+	assert.Contains(t, skip, "can not be explained")
+
+	query := &ReplaySql{Stmt: "select * from t"}
+	got, _ = sandbox.rewrite(query)
+	assert.Same(t, query, got)
+
+	// never reach the production tables
+	for _, stmt := range []string{"drop table db1.t", "create table t2 as select * from t", "set global a = 1"} {
+		got, skip = sandbox.rewrite(&ReplaySql{Stmt: stmt})
+		assert.Nil(t, got)
+		assert.Contains(t, skip, "skipped by --write-mode=sandbox: not a query")
+	}
+}
+
+func TestNormalizePlan(t *testing.T) {
+	plan1 := normalizePlan("PhysicalResultSink\n--PhysicalTopN[12] cardinality=1,000\n\n----PhysicalOlapScan[t1] \n")
+	plan2 := normalizePlan("PhysicalResultSink\n--PhysicalTopN[7] cardinality=20\n----PhysicalOlapScan[t1]")
+	assert.Equal(t, "PhysicalResultSink\n--PhysicalTopN[?] cardinality=?,?\n----PhysicalOlapScan[t1]", plan1)
+	assert.Equal(t, "PhysicalResultSink\n--PhysicalTopN[?] cardinality=?\n----PhysicalOlapScan[t1]", plan2)
+
+	d := DiffPlans(plan1, plan2, "a", "b")
+	assert.Contains(t, d, "--- a\n+++ b\n")
+	assert.Contains(t, d, "\n---PhysicalTopN[?] cardinality=?,?\n+--PhysicalTopN[?] cardinality=?\n")
+}
+
+func TestPlanCapturer(t *testing.T) {
+	plans := newPlanCapturer(ReplayPlanShape)
+	c1, c2 := &ReplayClient{client: "c1", plans: plans}, &ReplayClient{client: "c2", plans: plans}
+
+	// captured once for all clients
+	p := &capturedPlan{done: make(chan struct{}), digest: "d1", plan: "PhysicalResultSink"}
+	plans.plans["select ?"] = p
+	assert.Same(t, p, c2.capturePlan(context.Background(), &ReplaySql{Stmt: "select 2"}))
+	close(p.done)
+
+	// the plan text is recorded once in the result file of each client
+	planOf := func(c *ReplayClient) string {
+		result := &ReplayResult{}
+		c.recordPlan(p, result)
+		assert.Equal(t, "d1", result.PlanDigest)
+		return result.Plan
+	}
+	assert.Equal(t, "PhysicalResultSink", planOf(c1))
+	assert.Empty(t, planOf(c1))
+	assert.Equal(t, "PhysicalResultSink", planOf(c2))
+	assert.Nil(t, c1.capturePlan(context.Background(), &ReplaySql{Stmt: "set a = 1"}))
+}
+
+func TestReplayProfiler(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		user, password, _ := r.BasicAuth()
+		assert.Equal(t, "staging_alice", user)
+		assert.Equal(t, "pw", password)
+		assert.Equal(t, "/api/profile/text", r.URL.Path)
+		if requests == 1 {
+			// not reported yet
+			_, _ = w.Write([]byte(`{"msg":"query id q-1 not found.","code":1}`))
+			return
+		}
+		_, _ = w.Write([]byte("Summary:\n  - Profile ID: " + r.URL.Query().Get("query_id")))
+	}))
+	defer server.Close()
+
+	p, err := newReplayProfiler(&ReplayOpts{User: "root", ResultDir: t.TempDir()})
+	assert.NoError(t, err)
+	p.baseURL = server.URL
+	// fetched with the credential of the mapped user
+	p.fetch("1", "q-1", "staging_alice", "pw")
+	p.wait()
+
+	b, err := os.ReadFile(filepath.Join(filepath.Dir(p.dir), ReplayProfileFile("1")))
+	assert.NoError(t, err)
+	assert.Equal(t, "Summary:\n  - Profile ID: q-1", string(b))
+	assert.Equal(t, 2, requests)
+}
+
+func TestReplayUserMap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(`
+users:
+  alice: {user: staging_alice, password: pw, workload_group: wg_a, max_concurrency: 1}
+  bob: {workload_group: wg_b}
+dbs:
+  db1: {max_concurrency: 2}
+`), 0600))
+	m, err := ReadReplayUserMap(path)
+	assert.NoError(t, err)
+	m.complete("root", "rootpw")
+
+	c := &ReplayClient{dbcfg: newReplayDBConfig("127.0.0.1", 9030, "root", "rootpw"), users: m}
+	c.switchUser("alice")
+	assert.Equal(t, "staging_alice", c.dbcfg.User)
+	assert.Equal(t, "pw", c.dbcfg.Passwd)
+	assert.Equal(t, "wg_a", c.workloadGroup)
+	c.switchUser("bob")
+	assert.Equal(t, "root", c.dbcfg.User)
+	assert.Equal(t, "wg_b", c.workloadGroup)
+	c.switchUser("carol")
+	assert.Equal(t, "root", c.dbcfg.User)
+	assert.Empty(t, c.workloadGroup)
+
+	// alice is limited to 1, db1 is limited to 2
+	l := newReplayLimiter(0, 0, m)
+	assert.NotNil(t, l)
+	release, err := l.acquire(context.Background(), "alice", "db2")
+	assert.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = l.acquire(ctx, "alice", "db2")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	release()
+	release, err = l.acquire(context.Background(), "alice", "db2")
+	assert.NoError(t, err)
+	release()
+
+	r1, err := l.acquire(context.Background(), "bob", "db1")
+	assert.NoError(t, err)
+	r2, err := l.acquire(context.Background(), "carol", "db1")
+	assert.NoError(t, err)
+	_, err = l.acquire(ctx, "dave", "db1")
+	assert.Error(t, err)
+	r1()
+	r2()
+
+	assert.Nil(t, newReplayLimiter(0, 0, nil))
+}
+
+func TestReplayTimeWarp(t *testing.T) {
+	_, err := ParseReplayTimeWarp("1x")
+	assert.Error(t, err)
+	w, err := ParseReplayTimeWarp("-2d")
+	assert.NoError(t, err)
+	assert.Equal(t, -48*time.Hour, w.Offset)
+
+	s := &ReplaySql{
+		ReplaySqlMeta: ReplaySqlMeta{QueryId: "1", Prepared: true, Params: []string{"'2024-09-20 10:00:00'", "1"}},
+		Stmt:          "select * from t where dt = '2024-09-20' and ts > ? and a = ?",
+	}
+	got := w.warp(s)
+	assert.Equal(t, "select * from t where dt = '2024-09-18' and ts > ? and a = ?", got.Stmt)
+	assert.Equal(t, []string{"'2024-09-18 10:00:00'", "1"}, got.Params)
+	assert.Equal(t, "'2024-09-20 10:00:00'", s.Params[0])
+
+	query := &ReplaySql{Stmt: "select * from t where a = '1'"}
+	assert.Same(t, query, w.warp(query))
+
+	// relative to the original time, which is 10 days ago
+	now := time.Now()
+	_, zoneOffset := now.Zone()
+	ts := now.UTC().Add(time.Duration(zoneOffset)*time.Second - 240*time.Hour).Format(replayTsFormat)
+	w, err = ParseReplayTimeWarp(ReplayTimeWarpNow)
+	assert.NoError(t, err)
+	got = w.warp(&ReplaySql{ReplaySqlMeta: ReplaySqlMeta{Ts_: ts}, Stmt: "select * from t where dt = '2024-09-20'"})
+	assert.Equal(t, "select * from t where dt = '2024-09-30'", got.Stmt)
+}
+
+func TestReplayClientRecordSessionStmt(t *testing.T) {
+	c := &ReplayClient{}
+	for _, stmt := range []string{"SET @a = 1", "SELECT 1", "SET @a = 2", "SET @a = 1"} {
+		c.recordSessionStmt(stmt)
+	}
+	// only the latest assignment of each variable is restored on reconnect
+	assert.Equal(t, []string{"SET @a = 1"}, c.sessionStmts)
+
+	c = &ReplayClient{}
+	for _, stmt := range []string{
+		"SET @a = 1, b = 'x, y'",
+		"SET GLOBAL b = 1, @@session.c = 1, d = 1",
+		"SET NAMES utf8",
+		"set @@b = 2;",
+		"SET @A := 2",
+		"SET SESSION d = 2",
+		"SET NAMES gbk",
+	} {
+		c.recordSessionStmt(stmt)
+	}
+	assert.Equal(t, []string{
+		"SET GLOBAL b = 1",
+		"SET @@session.c = 1",
+		"SET GLOBAL d = 1",
+		"set @@b = 2;",
+		"SET @A := 2",
+		"SET SESSION d = 2",
+		"SET NAMES gbk",
+	}, c.sessionStmts)
+}
+
+func TestOpenLoopPool(t *testing.T) {
+	q := newOpenLoopQueue()
+	for i := range 3 {
+		q.push(&openLoopTask{seq: i})
+	}
+	q.close()
+	var seqs []int
+	for task, ok := q.pop(); ok; task, ok = q.pop() {
+		seqs = append(seqs, task.seq)
+	}
+	assert.Equal(t, []int{0, 1, 2}, seqs)
+
+	// a session is pinned to the same worker even if its sqls are of different users and dbs
+	pool := newOpenLoopPool(4)
+	tasks := []*openLoopTask{
+		{client: "s1", seq: 0, sql: &ReplaySql{ReplaySqlMeta: ReplaySqlMeta{User: "u1", Db: "db1"}, Stmt: "SET @a = 1"}},
+		{client: "s2", seq: 0, sql: &ReplaySql{ReplaySqlMeta: ReplaySqlMeta{User: "u1", Db: "db1"}, Stmt: "SELECT 1"}},
+		{client: "s1", seq: 1, sql: &ReplaySql{ReplaySqlMeta: ReplaySqlMeta{User: "u1", Db: "db2"}, Stmt: "USE db2"}},
+		{client: "s1", seq: 2, sql: &ReplaySql{ReplaySqlMeta: ReplaySqlMeta{User: "u1", Db: "db2"}, Stmt: "SELECT @a"}},
+		{client: "s1", seq: 3, sql: &ReplaySql{ReplaySqlMeta: ReplaySqlMeta{User: "u2", Db: "db1"}, Stmt: "SELECT 2"}},
+	}
+	workers := map[string]int{}
+	for _, task := range tasks {
+		w := pool.dispatch(task)
+		if prev, ok := workers[task.client]; ok {
+			assert.Equal(t, prev, w, "session %s seq %d", task.client, task.seq)
+		}
+		workers[task.client] = w
+	}
+	pool.close()
+	seqs = nil
+	for task, ok := pool[workers["s1"]].pop(); ok; task, ok = pool[workers["s1"]].pop() {
+		if task.client == "s1" {
+			seqs = append(seqs, task.seq)
+		}
+	}
+	assert.Equal(t, []int{0, 1, 2, 3}, seqs)
+	assert.Equal(t, 0, openLoopWorker("s1", 1))
+
+	// session state is swapped when sessions share a connection
+	c := &ReplayClient{}
+	c.switchSession("s1")
+	c.recordSessionStmt("SET @a = 1")
+	c.switchSession("s2")
+	assert.Empty(t, c.sessionStmts)
+	c.switchSession("s1")
+	assert.Equal(t, []string{"SET @a = 1"}, c.sessionStmts)
+}
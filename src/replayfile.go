@@ -0,0 +1,532 @@
+package src
+
+import (
+	"bufio"
+	"cmp"
+	"compress/gzip"
+	"container/heap"
+	"fmt"
+	"io"
+	"iter"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/goccy/go-json"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	ReplaySplitFileExt = ".sql"
+
+	clientFileMaxOpen    = 256
+	clientFileBufferSize = 32 * 1024
+	replaySortChunkSize  = 100000
+)
+
+// clientFileWriter writes to one file per client, at most clientFileMaxOpen files are opened at the same time.
+type clientFileWriter struct {
+	dir, ext string
+
+	files   map[string]*clientFile
+	created map[string]struct{}
+
+	// appendOnly never truncates the files, for resuming replay
+	appendOnly bool
+}
+
+type clientFile struct {
+	f  *os.File
+	gz *gzip.Writer
+	w  *bufio.Writer
+}
+
+func newClientFileWriter(dir, ext string) *clientFileWriter {
+	return &clientFileWriter{
+		dir:     dir,
+		ext:     ext,
+		files:   map[string]*clientFile{},
+		created: map[string]struct{}{},
+	}
+}
+
+func (w *clientFileWriter) path(client string) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%s%s", client, w.ext))
+}
+
+// write writes a line to the client file, the file is truncated at the first write.
+func (w *clientFileWriter) write(client string, b []byte) error {
+	cf, ok := w.files[client]
+	if !ok {
+		if len(w.files) >= clientFileMaxOpen {
+			// prevent open too many files
+			if err := w.Close(); err != nil {
+				return err
+			}
+		}
+
+		flag := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		if _, ok := w.created[client]; !ok && !w.appendOnly {
+			flag |= os.O_TRUNC
+		}
+		path := w.path(client)
+		f, err := os.OpenFile(path, flag, 0600)
+		if err != nil {
+			logrus.Errorf("open file %s failed, err: %v", path, err)
+			return err
+		}
+		cf = &clientFile{f: f}
+		if strings.HasSuffix(w.ext, ".gz") {
+			// reopened file is appended as a new gzip member
+			cf.gz = gzip.NewWriter(f)
+			cf.w = bufio.NewWriterSize(cf.gz, clientFileBufferSize)
+		} else {
+			cf.w = bufio.NewWriterSize(f, clientFileBufferSize)
+		}
+		w.files[client] = cf
+		w.created[client] = struct{}{}
+	}
+
+	if _, err := cf.w.Write(b); err != nil {
+		return err
+	}
+	return cf.w.WriteByte('\n')
+}
+
+func (w *clientFileWriter) Close() (err error) {
+	for client, cf := range w.files {
+		if err_ := cf.w.Flush(); err_ != nil {
+			err = err_
+		}
+		if cf.gz != nil {
+			if err_ := cf.gz.Close(); err_ != nil {
+				err = err_
+			}
+		}
+		_ = cf.f.Sync()
+		_ = cf.f.Close()
+		delete(w.files, client)
+	}
+	return err
+}
+
+// ReplaySqlSplitter splits replay sqls into one file per client,
+// so that each client can read its sqls lazily and the memory is bounded by the client count.
+type ReplaySqlSplitter struct {
+	assigner *replaySqlAssigner
+	writer   *clientFileWriter
+	clients  []string
+}
+
+func NewReplaySqlSplitter(dir string, dbs, users map[string]struct{}, from, to int64, clientCount int) *ReplaySqlSplitter {
+	return &ReplaySqlSplitter{
+		assigner: newReplaySqlAssigner(dbs, users, from, to, clientCount),
+		writer:   newClientFileWriter(dir, ReplaySplitFileExt),
+	}
+}
+
+// Split splits the replay sqls from dump file, can be called multiple times with different dump files.
+func (sp *ReplaySqlSplitter) Split(s *bufio.Scanner) error {
+	d, err := newReplaySqlDecoder(s)
+	if err != nil || d == nil {
+		return err
+	}
+
+	for sql := d.next(); sql != nil; sql = d.next() {
+		client, ok := sp.assigner.assign(sql)
+		if !ok {
+			continue
+		}
+		if _, ok := sp.writer.created[client]; !ok {
+			sp.clients = append(sp.clients, client)
+		}
+
+		b, err := marshalReplaySqlLine(sql)
+		if err != nil {
+			return err
+		}
+		if err := sp.writer.write(client, b); err != nil {
+			return err
+		}
+	}
+	return s.Err()
+}
+
+// Close sorts the split files by time and returns the split clients sqls, the minimal timestamp and the sql count.
+func (sp *ReplaySqlSplitter) Close() ([]ClientSqls, int64, int, error) {
+	if err := sp.writer.Close(); err != nil {
+		return nil, 0, 0, err
+	}
+
+	clientSqls := make([]ClientSqls, 0, len(sp.clients))
+	for _, client := range sp.clients {
+		// rebuild the execution order of each client, sqls from multiple dump files are merged into one timeline
+		path := sp.writer.path(client)
+		if err := sortReplaySqlFile(path, replaySortChunkSize); err != nil {
+			logrus.Errorf("sort split file %s failed, err: %v", path, err)
+			return nil, 0, 0, err
+		}
+		clientSqls = append(clientSqls, ClientSqls{Client: client, File: path})
+	}
+	return clientSqls, sp.assigner.minTs, sp.assigner.count, nil
+}
+
+// marshalReplaySqlLine marshals the sql to a line of split file, the statement is kept as it is.
+func marshalReplaySqlLine(sql *ReplaySql) ([]byte, error) {
+	meta, err := json.Marshal(sql.ReplaySqlMeta)
+	if err != nil {
+		return nil, err
+	}
+	return fmt.Appendf(nil, "%s%s%s %s", ReplaySqlPrefix[:len(ReplaySqlPrefix)-1], meta, ReplaySqlSuffix, sql.Stmt), nil
+}
+
+// sortReplaySqlFile sorts the sqls in file by time stably, the same as ReplaySqlCollector.Close.
+// Sqls are sorted in chunks of chunkSize, then the chunks are merged, so the memory is bounded.
+func sortReplaySqlFile(path string, chunkSize int) error {
+	if sorted, err := isReplaySqlFileSorted(path); err != nil || sorted {
+		return err
+	}
+
+	var (
+		chunks []string
+		sqls   = make([]*ReplaySql, 0, chunkSize)
+	)
+	defer func() {
+		for _, chunk := range chunks {
+			_ = os.Remove(chunk)
+		}
+	}()
+	flush := func() error {
+		chunk := fmt.Sprintf("%s.%d", path, len(chunks))
+		chunks = append(chunks, chunk)
+		slices.SortStableFunc(sqls, func(a, b *ReplaySql) int { return cmp.Compare(a.Ts, b.Ts) })
+		err := writeReplaySqlFile(chunk, slices.Values(sqls))
+		sqls = sqls[:0]
+		return err
+	}
+
+	r, err := (&ClientSqls{File: path}).Open()
+	if err != nil {
+		return err
+	}
+	for s := r.Next(); s != nil; s = r.Next() {
+		sqls = append(sqls, s)
+		if len(sqls) >= chunkSize {
+			if err := flush(); err != nil {
+				r.Close()
+				return err
+			}
+		}
+	}
+	r.Close()
+	if len(sqls) > 0 {
+		if err := flush(); err != nil {
+			return err
+		}
+	}
+
+	// merge the sorted chunks, sqls with the same time keep the order of chunks
+	readers := make([]*ReplaySqlReader, 0, len(chunks))
+	defer func() {
+		for _, r := range readers {
+			r.Close()
+		}
+	}()
+	heads := openLoopHeap{}
+	pool := newClientReaderPool(clientFileMaxOpen)
+	for i, chunk := range chunks {
+		r, err := (&ClientSqls{File: chunk}).open(pool)
+		if err != nil {
+			return err
+		}
+		readers = append(readers, r)
+		if s := r.Next(); s != nil {
+			heads = append(heads, openLoopHead{idx: i, sql: s})
+		}
+	}
+	heap.Init(&heads)
+
+	return writeReplaySqlFile(path, func(yield func(*ReplaySql) bool) {
+		for len(heads) > 0 {
+			head := heads[0]
+			if s := readers[head.idx].Next(); s != nil {
+				heads[0].sql = s
+				heap.Fix(&heads, 0)
+			} else {
+				heap.Pop(&heads)
+			}
+			if !yield(head.sql) {
+				return
+			}
+		}
+	})
+}
+
+func isReplaySqlFileSorted(path string) (bool, error) {
+	r, err := (&ClientSqls{File: path}).Open()
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+
+	var prevTs int64
+	for s := r.Next(); s != nil; s = r.Next() {
+		if s.Ts < prevTs {
+			return false, nil
+		}
+		prevTs = s.Ts
+	}
+	return true, nil
+}
+
+func writeReplaySqlFile(path string, sqls iter.Seq[*ReplaySql]) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriterSize(f, clientFileBufferSize)
+	for s := range sqls {
+		b, err := marshalReplaySqlLine(s)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(append(b, '\n')); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+type ClientSqls struct {
+	Client string
+	Sqls   []*ReplaySql
+
+	// File is the file split by ReplaySqlSplitter, sqls are read from it lazily if set.
+	File string
+}
+
+// Open returns a reader of the client sqls in time order.
+func (cs *ClientSqls) Open() (*ReplaySqlReader, error) {
+	return cs.open(nil)
+}
+
+// open is like Open, the file is counted in pool if set.
+func (cs *ClientSqls) open(pool *clientReaderPool) (*ReplaySqlReader, error) {
+	r := &ReplaySqlReader{sqls: cs.Sqls}
+	if cs.File == "" {
+		return r, nil
+	}
+
+	r.file, r.pool = cs.File, pool
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// OriginalSqls looks up the original dump sqls by client and query id,
+// the sqls of a client are read lazily, only one client is kept in memory at a time.
+type OriginalSqls struct {
+	clients map[string]*ClientSqls
+
+	client  string
+	id2sqls map[string]*ReplaySql
+}
+
+func NewOriginalSqls(clientSqls []ClientSqls) *OriginalSqls {
+	o := &OriginalSqls{clients: make(map[string]*ClientSqls, len(clientSqls))}
+	for i := range clientSqls {
+		o.clients[clientSqls[i].Client] = &clientSqls[i]
+	}
+	return o
+}
+
+// Get returns the original sql or nil if not found, call it in the order of clients to read each client only once.
+func (o *OriginalSqls) Get(client, queryId string) *ReplaySql {
+	if o == nil {
+		return nil
+	}
+	if o.id2sqls == nil || client != o.client {
+		o.client, o.id2sqls = client, map[string]*ReplaySql{}
+		if cs, ok := o.clients[client]; ok {
+			r, err := cs.Open()
+			if err != nil {
+				logrus.Errorf("read original sqls of client %s failed, err: %v", client, err)
+				return nil
+			}
+			for s := r.Next(); s != nil; s = r.Next() {
+				o.id2sqls[s.QueryId] = s
+			}
+			r.Close()
+		}
+	}
+	return o.id2sqls[queryId]
+}
+
+// ReplaySqlReader reads sqls of a client in time order.
+//
+// When reading from file lazily, the file must be sorted by time, like the files split by ReplaySqlSplitter.
+type ReplaySqlReader struct {
+	sqls []*ReplaySql
+
+	// file is empty if there is no more sqls in it
+	file string
+	f    *os.File
+	d    *replaySqlDecoder
+	pool *clientReaderPool
+
+	// offset is where to reopen the file, read and lastLine are the bytes scanned and the length of the last line
+	offset, read int64
+	lastLine     int
+}
+
+// open opens the file at the offset, the decoder begins with the line at the offset.
+func (r *ReplaySqlReader) open() error {
+	f, err := os.Open(r.file)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(r.offset, io.SeekStart); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	r.read, r.lastLine = r.offset, 0
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 0, clientFileBufferSize), 10*1024*1024)
+	s.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		if advance > 0 {
+			r.read += int64(advance)
+			r.lastLine = advance
+		}
+		return advance, token, err
+	})
+	d, err := newReplaySqlDecoder(s)
+	if err != nil || d == nil {
+		_ = f.Close()
+		r.file = ""
+		return err
+	}
+
+	r.f, r.d = f, d
+	if r.pool != nil {
+		r.pool.acquire(r)
+	}
+	return nil
+}
+
+// suspend closes the file, it will be reopened at the pending line of the decoder on next read.
+func (r *ReplaySqlReader) suspend() {
+	if r.f == nil {
+		return
+	}
+	r.offset = r.read - int64(r.lastLine)
+	_ = r.f.Close()
+	r.f, r.d = nil, nil
+}
+
+// Next returns the next sql, or nil if there is no more.
+func (r *ReplaySqlReader) Next() *ReplaySql {
+	for r.file != "" {
+		if r.f == nil {
+			if err := r.open(); err != nil {
+				logrus.Errorf("reopen file %s failed, err: %v", r.file, err)
+				r.Close()
+				break
+			}
+			if r.file == "" {
+				break
+			}
+		}
+
+		s := r.d.next()
+		if r.d.eof {
+			// close as early as possible
+			r.Close()
+		}
+		if s == nil {
+			break
+		}
+		if _, err := s.Timestamp(); err != nil {
+			continue
+		}
+		return s
+	}
+
+	if len(r.sqls) == 0 {
+		return nil
+	}
+	s := r.sqls[0]
+	r.sqls = r.sqls[1:]
+	return s
+}
+
+func (r *ReplaySqlReader) Close() {
+	r.suspend()
+	r.file = ""
+	if r.pool != nil {
+		r.pool.release(r)
+	}
+}
+
+// clientReaderPool limits the files opened by client readers to max, like clientFileWriter,
+// all of them are closed when the limit is reached, and reopened at where they stopped on next read.
+type clientReaderPool struct {
+	max  int
+	open map[*ReplaySqlReader]struct{}
+}
+
+func newClientReaderPool(max int) *clientReaderPool {
+	return &clientReaderPool{max: max, open: map[*ReplaySqlReader]struct{}{}}
+}
+
+func (p *clientReaderPool) acquire(r *ReplaySqlReader) {
+	if len(p.open) >= p.max {
+		// prevent open too many files
+		for o := range p.open {
+			o.suspend()
+		}
+		clear(p.open)
+	}
+	p.open[r] = struct{}{}
+}
+
+func (p *clientReaderPool) release(r *ReplaySqlReader) {
+	delete(p.open, r)
+}
+
+// ReadAll reads all the remaining sqls.
+func (r *ReplaySqlReader) ReadAll() []*ReplaySql {
+	sqls := []*ReplaySql{}
+	for s := r.Next(); s != nil; s = r.Next() {
+		sqls = append(sqls, s)
+	}
+	return sqls
+}
+
+// openClientSqls opens the client sqls, skips the executed ones until resumeAfter (inclusive) if set.
+// Returns the count of skipped sqls.
+func openClientSqls(cs *ClientSqls, resumeAfter string, pool *clientReaderPool) (*ReplaySqlReader, int, error) {
+	r, err := cs.open(pool)
+	if err != nil || resumeAfter == "" {
+		return r, 0, err
+	}
+
+	skipped := 0
+	for s := r.Next(); s != nil; s = r.Next() {
+		skipped++
+		if s.QueryId == resumeAfter {
+			return r, skipped, nil
+		}
+	}
+
+	// not found, replay from the beginning
+	logrus.Warnf("resume query id %s not found in client %s, replay from the beginning", resumeAfter, cs.Client)
+	r.Close()
+	r, err = cs.open(pool)
+	return r, 0, err
+}
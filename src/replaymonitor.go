@@ -0,0 +1,298 @@
+package src
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/sirupsen/logrus"
+)
+
+const ReplayCheckpointFile = "replay.checkpoint"
+
+// replayLatencyBuckets are the upper bounds (in seconds) of replay latency histogram.
+var replayLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// ReplayCheckpoint records the replay progress, so that an interrupted replay can be resumed.
+type ReplayCheckpoint struct {
+	// Ts is the latest original time of executed sqls.
+	Ts int64 `json:"ts"`
+	// Clients is the last executed query id of each client, all sqls before it are executed too.
+	Clients map[string]string `json:"clients"`
+}
+
+// ReadReplayCheckpoint reads the checkpoint in the replay result dir.
+func ReadReplayCheckpoint(dir string) (*ReplayCheckpoint, error) {
+	b, err := os.ReadFile(filepath.Join(dir, ReplayCheckpointFile))
+	if err != nil {
+		return nil, err
+	}
+	cp := &ReplayCheckpoint{}
+	if err := json.Unmarshal(b, cp); err != nil {
+		return nil, fmt.Errorf("invalid replay checkpoint: %w", err)
+	}
+	if cp.Clients == nil {
+		cp.Clients = map[string]string{}
+	}
+	return cp, nil
+}
+
+func (cp *ReplayCheckpoint) write(dir string) error {
+	b, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, ReplayCheckpointFile), b, 0600)
+}
+
+// clientCheckpoint tracks the executed sqls of a client, sqls may finish out of order in open-loop replay.
+type clientCheckpoint struct {
+	next int
+	done map[int]*ReplaySql
+}
+
+// replaySeries is the metrics of a user/db.
+type replaySeries struct {
+	user, db   string
+	count      uint64
+	errors     uint64
+	sumSeconds float64
+	buckets    []uint64
+}
+
+// replayMonitor collects the replay progress, metrics and checkpoint.
+type replayMonitor struct {
+	total    int
+	executed atomic.Int64
+	errors   atomic.Int64
+	skipped  atomic.Int64
+	start    time.Time
+	minTs    int64
+
+	mu         sync.Mutex
+	series     map[string]*replaySeries
+	clients    map[string]*clientCheckpoint
+	checkpoint *ReplayCheckpoint
+}
+
+func newReplayMonitor(total int, minTs int64, resume *ReplayCheckpoint) *replayMonitor {
+	m := &replayMonitor{
+		total:      total,
+		start:      time.Now(),
+		minTs:      minTs,
+		series:     map[string]*replaySeries{},
+		clients:    map[string]*clientCheckpoint{},
+		checkpoint: &ReplayCheckpoint{Ts: minTs, Clients: map[string]string{}},
+	}
+	if resume != nil {
+		m.checkpoint.Ts = resume.Ts
+		for client, queryId := range resume.Clients {
+			m.checkpoint.Clients[client] = queryId
+		}
+	}
+	return m
+}
+
+// skip counts the sqls skipped by resuming as executed.
+func (m *replayMonitor) skip(n int) {
+	m.executed.Add(int64(n))
+}
+
+// done records the seq-th executed sql of the client (counting from 0 after resuming).
+func (m *replayMonitor) done(client string, seq int, s *ReplaySql, r *ReplayResult) {
+	m.executed.Add(1)
+	if r.Err != "" {
+		m.errors.Add(1)
+	}
+	if r.Skipped != "" {
+		m.skipped.Add(1)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// metrics, the skipped sqls have no latency
+	if r.Skipped == "" {
+		key := s.User + "@" + s.Db
+		ss, ok := m.series[key]
+		if !ok {
+			ss = &replaySeries{user: s.User, db: s.Db, buckets: make([]uint64, len(replayLatencyBuckets))}
+			m.series[key] = ss
+		}
+		seconds := float64(r.DurationMs) / 1000
+		ss.count++
+		ss.sumSeconds += seconds
+		if r.Err != "" {
+			ss.errors++
+		}
+		for i, le := range replayLatencyBuckets {
+			if seconds <= le {
+				ss.buckets[i]++
+			}
+		}
+	}
+
+	// checkpoint, only advance when all previous sqls of the client are done
+	cc, ok := m.clients[client]
+	if !ok {
+		cc = &clientCheckpoint{done: map[int]*ReplaySql{}}
+		m.clients[client] = cc
+	}
+	cc.done[seq] = s
+	for {
+		s, ok := cc.done[cc.next]
+		if !ok {
+			break
+		}
+		delete(cc.done, cc.next)
+		cc.next++
+		m.checkpoint.Clients[client] = s.QueryId
+		m.checkpoint.Ts = max(m.checkpoint.Ts, s.Ts)
+	}
+}
+
+func (m *replayMonitor) writeCheckpoint(dir string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.checkpoint.write(dir)
+}
+
+func (m *replayMonitor) progress() string {
+	var (
+		executed = m.executed.Load()
+		elapsed  = time.Since(m.start)
+		percent  float64
+	)
+	if m.total > 0 {
+		percent = float64(executed) * 100 / float64(m.total)
+	}
+
+	m.mu.Lock()
+	ts := m.checkpoint.Ts
+	m.mu.Unlock()
+
+	return fmt.Sprintf("%d/%d (%.1f%%), %.1f qps, %d error(s), %d skipped, replay time %s (+%v), elapsed %v",
+		executed,
+		m.total,
+		percent,
+		float64(executed)/max(elapsed.Seconds(), 1e-3),
+		m.errors.Load(),
+		m.skipped.Load(),
+		time.UnixMilli(ts).UTC().Format("2006-01-02 15:04:05"),
+		time.Duration(ts-m.minTs)*time.Millisecond,
+		elapsed.Round(time.Second),
+	)
+}
+
+// runProgress logs the replay progress every interval until ctx is done.
+func (m *replayMonitor) runProgress(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			logrus.Infoln("Replay progress:", m.progress())
+		}
+	}
+}
+
+// writeMetrics writes metrics in Prometheus text format.
+func (m *replayMonitor) writeMetrics(w io.Writer) error {
+	m.mu.Lock()
+	series := make([]*replaySeries, 0, len(m.series))
+	for _, ss := range m.series {
+		s := *ss
+		s.buckets = slices.Clone(ss.buckets)
+		series = append(series, &s)
+	}
+	m.mu.Unlock()
+	slices.SortFunc(series, func(a, b *replaySeries) int {
+		return strings.Compare(a.user+"@"+a.db, b.user+"@"+b.db)
+	})
+
+	var sb strings.Builder
+	sb.WriteString("# HELP dodo_replay_queries Total count of sqls to replay.\n")
+	sb.WriteString("# TYPE dodo_replay_queries gauge\n")
+	fmt.Fprintf(&sb, "dodo_replay_queries %d\n", m.total)
+	sb.WriteString("# HELP dodo_replay_executed_queries_total Count of executed sqls, including the skipped ones by resuming.\n")
+	sb.WriteString("# TYPE dodo_replay_executed_queries_total counter\n")
+	fmt.Fprintf(&sb, "dodo_replay_executed_queries_total %d\n", m.executed.Load())
+
+	sb.WriteString("# HELP dodo_replay_skipped_queries_total Count of sqls not executed, like the unsafe ones in '--write-mode=sandbox'.\n")
+	sb.WriteString("# TYPE dodo_replay_skipped_queries_total counter\n")
+	fmt.Fprintf(&sb, "dodo_replay_skipped_queries_total %d\n", m.skipped.Load())
+
+	sb.WriteString("# HELP dodo_replay_errors_total Count of failed sqls.\n")
+	sb.WriteString("# TYPE dodo_replay_errors_total counter\n")
+	for _, ss := range series {
+		fmt.Fprintf(&sb, "dodo_replay_errors_total{%s} %d\n", ss.labels(), ss.errors)
+	}
+
+	sb.WriteString("# HELP dodo_replay_query_duration_seconds Latency of replayed sqls.\n")
+	sb.WriteString("# TYPE dodo_replay_query_duration_seconds histogram\n")
+	for _, ss := range series {
+		labels := ss.labels()
+		for i, le := range replayLatencyBuckets {
+			fmt.Fprintf(&sb, "dodo_replay_query_duration_seconds_bucket{%s,le=\"%g\"} %d\n", labels, le, ss.buckets[i])
+		}
+		fmt.Fprintf(&sb, "dodo_replay_query_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, ss.count)
+		fmt.Fprintf(&sb, "dodo_replay_query_duration_seconds_sum{%s} %g\n", labels, ss.sumSeconds)
+		fmt.Fprintf(&sb, "dodo_replay_query_duration_seconds_count{%s} %d\n", labels, ss.count)
+	}
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func (ss *replaySeries) labels() string {
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace
+	return fmt.Sprintf(`user="%s",db="%s"`, escape(ss.user), escape(ss.db))
+}
+
+// serveMetrics serves '/metrics' on addr until ctx is done.
+func (m *replayMonitor) serveMetrics(ctx context.Context, addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := m.writeMetrics(w); err != nil {
+			logrus.Debugln("write metrics failed:", err)
+		}
+	})
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+
+	errc := make(chan error, 1)
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			errc <- err
+		}
+		close(errc)
+	}()
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+
+	// fail fast if the addr is unavailable
+	select {
+	case err := <-errc:
+		return err
+	case <-time.After(100 * time.Millisecond):
+	}
+	logrus.Infof("Serving replay metrics at http://%s/metrics", addr)
+	return nil
+}
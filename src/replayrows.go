@@ -0,0 +1,209 @@
+package src
+
+import (
+	"bufio"
+	"cmp"
+	"compress/gzip"
+	"database/sql"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/goccy/go-json"
+	"github.com/sirupsen/logrus"
+)
+
+const ReplayRowsFileExt = ".rows.gz"
+
+// ReplayRows is the return rows of a replayed sql, persisted in '<client>.rows.gz' as json lines.
+type ReplayRows struct {
+	QueryId string      `json:"queryId"`
+	Columns []string    `json:"columns"`
+	Rows    [][]*string `json:"rows"`
+
+	// Sorted means the rows are sorted since the sql has no 'ORDER BY', the order of rows is not determined.
+	Sorted bool `json:"sorted,omitempty"`
+	// Truncated means only the first '--max-save-rows' rows are saved.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+func (rs *ReplayRows) append(values []any) {
+	row := make([]*string, len(values))
+	for i, v := range values {
+		if b := *v.(*sql.RawBytes); b != nil {
+			s := string(b)
+			row[i] = &s
+		}
+	}
+	rs.Rows = append(rs.Rows, row)
+}
+
+// Partial reports whether the saved rows are an arbitrary subset of the result,
+// i.e. truncated rows of a sql without 'ORDER BY', they can not be diffed with others.
+func (rs *ReplayRows) Partial() bool {
+	return rs.Sorted && rs.Truncated
+}
+
+func (rs *ReplayRows) sort() {
+	slices.SortStableFunc(rs.Rows, compareRow)
+	rs.Sorted = true
+}
+
+// compareRow compares two rows lexicographically, NULL is the smallest.
+func compareRow(a, b []*string) int {
+	for i := range min(len(a), len(b)) {
+		if c := compareValue(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(len(a), len(b))
+}
+
+func compareValue(a, b *string) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+	return strings.Compare(*a, *b)
+}
+
+// valueEqual reports whether two values are equal, numbers are equal if the relative difference is within tolerance.
+func valueEqual(a, b *string, tolerance float64) bool {
+	if compareValue(a, b) == 0 {
+		return true
+	}
+	if a == nil || b == nil || tolerance <= 0 {
+		return false
+	}
+
+	fa, err := strconv.ParseFloat(*a, 64)
+	if err != nil {
+		return false
+	}
+	fb, err := strconv.ParseFloat(*b, 64)
+	if err != nil {
+		return false
+	}
+	return math.Abs(fa-fb) <= tolerance*max(1, math.Abs(fa), math.Abs(fb))
+}
+
+// diffColumns returns the indexes of columns which are not equal.
+func diffColumns(a, b []*string, tolerance float64) []int {
+	cols := []int{}
+	for i := range max(len(a), len(b)) {
+		if i >= len(a) || i >= len(b) || !valueEqual(a[i], b[i], tolerance) {
+			cols = append(cols, i)
+		}
+	}
+	return cols
+}
+
+// RowMismatch is a pair of rows at the same position but with different columns.
+type RowMismatch struct {
+	Idx        int
+	Row1, Row2 []*string
+	Cols       []int
+}
+
+// RowsDiff is the difference between two replay rows.
+type RowsDiff struct {
+	Columns    []string
+	Mismatches []RowMismatch
+	// Missing are the rows only in the first replay, Extra are the rows only in the second one.
+	Missing, Extra [][]*string
+}
+
+func (d *RowsDiff) Empty() bool {
+	return len(d.Mismatches) == 0 && len(d.Missing) == 0 && len(d.Extra) == 0
+}
+
+// DiffReplayRows compares two replay rows, numbers are compared with the relative tolerance.
+//
+// Rows are compared one by one if their order is determined, otherwise they are compared as sorted sets.
+// Partial rows should not be diffed, compare the hashes instead.
+func DiffReplayRows(rs1, rs2 *ReplayRows, tolerance float64, ignoreOrder bool) *RowsDiff {
+	d := &RowsDiff{Columns: rs1.Columns}
+	rows1, rows2 := rs1.Rows, rs2.Rows
+
+	// the saved rows may be truncated, only compare the common part
+	if rs1.Truncated || rs2.Truncated {
+		n := min(len(rows1), len(rows2))
+		rows1, rows2 = rows1[:n], rows2[:n]
+	}
+
+	if !ignoreOrder && !rs1.Sorted && !rs2.Sorted {
+		for i := range min(len(rows1), len(rows2)) {
+			if cols := diffColumns(rows1[i], rows2[i], tolerance); len(cols) > 0 {
+				d.Mismatches = append(d.Mismatches, RowMismatch{Idx: i, Row1: rows1[i], Row2: rows2[i], Cols: cols})
+			}
+		}
+		if len(rows1) > len(rows2) {
+			d.Missing = rows1[len(rows2):]
+		} else if len(rows2) > len(rows1) {
+			d.Extra = rows2[len(rows1):]
+		}
+		return d
+	}
+
+	// compare as sorted sets
+	rows1, rows2 = slices.Clone(rows1), slices.Clone(rows2)
+	slices.SortStableFunc(rows1, compareRow)
+	slices.SortStableFunc(rows2, compareRow)
+
+	i, j := 0, 0
+	for i < len(rows1) && j < len(rows2) {
+		if len(diffColumns(rows1[i], rows2[j], tolerance)) == 0 {
+			i++
+			j++
+		} else if compareRow(rows1[i], rows2[j]) < 0 {
+			d.Missing = append(d.Missing, rows1[i])
+			i++
+		} else {
+			d.Extra = append(d.Extra, rows2[j])
+			j++
+		}
+	}
+	d.Missing = append(d.Missing, rows1[i:]...)
+	d.Extra = append(d.Extra, rows2[j:]...)
+	return d
+}
+
+// ReadReplayRows reads the replay rows file, keyed by query id. Returns nil if the file does not exist.
+func ReadReplayRows(path string) (map[string]*ReplayRows, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if errors.Is(err, io.EOF) {
+		return map[string]*ReplayRows{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	id2rows := map[string]*ReplayRows{}
+	scan := bufio.NewScanner(gz)
+	scan.Buffer(make([]byte, 0, 10*1024*1024), 100*1024*1024)
+	for scan.Scan() {
+		rows := &ReplayRows{}
+		if err := json.Unmarshal(scan.Bytes(), rows); err != nil {
+			logrus.Errorf("unmarshal replay rows in %s failed, err: %v", path, err)
+			continue
+		}
+		id2rows[rows.QueryId] = rows
+	}
+	return id2rows, scan.Err()
+}
@@ -0,0 +1,77 @@
+package src
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffReplayRows(t *testing.T) {
+	row := func(values ...string) []*string {
+		return lo.Map(values, func(v string, _ int) *string {
+			if v == "NULL" {
+				return nil
+			}
+			return &v
+		})
+	}
+
+	// ordered, compared one by one
+	rs1 := &ReplayRows{Columns: []string{"a", "b"}, Rows: [][]*string{row("x", "1.0000001"), row("y", "2"), row("z", "3")}}
+	rs2 := &ReplayRows{Columns: []string{"a", "b"}, Rows: [][]*string{row("x", "1.0000002"), row("y", "NULL")}}
+	d := DiffReplayRows(rs1, rs2, 1e-6, false)
+	assert.Equal(t, []RowMismatch{{Idx: 1, Row1: row("y", "2"), Row2: row("y", "NULL"), Cols: []int{1}}}, d.Mismatches)
+	assert.Equal(t, [][]*string{row("z", "3")}, d.Missing)
+	assert.Empty(t, d.Extra)
+
+	// no tolerance
+	d = DiffReplayRows(rs1, rs2, 0, false)
+	assert.Len(t, d.Mismatches, 2)
+
+	// truncated, only compare the common part
+	rs2.Truncated = true
+	d = DiffReplayRows(rs1, rs2, 1e-6, false)
+	assert.Empty(t, d.Missing)
+
+	// unordered, compared as sets
+	rs1 = &ReplayRows{Rows: [][]*string{row("b"), row("a"), row("c")}, Sorted: true}
+	rs2 = &ReplayRows{Rows: [][]*string{row("c"), row("d"), row("a")}}
+	d = DiffReplayRows(rs1, rs2, 1e-6, false)
+	assert.Empty(t, d.Mismatches)
+	assert.Equal(t, [][]*string{row("b")}, d.Missing)
+	assert.Equal(t, [][]*string{row("d")}, d.Extra)
+
+	// ignore order
+	rs1.Sorted = false
+	rs2.Rows = [][]*string{row("c"), row("b"), row("a")}
+	assert.True(t, DiffReplayRows(rs1, rs2, 0, true).Empty())
+	assert.False(t, DiffReplayRows(rs1, rs2, 0, false).Empty())
+
+	// truncated unordered rows are arbitrary subsets
+	assert.False(t, rs2.Partial())
+	rs2.Sorted, rs2.Truncated = true, true
+	assert.True(t, rs2.Partial())
+}
+
+func TestReadReplayRows(t *testing.T) {
+	dir := t.TempDir()
+	w := newClientFileWriter(dir, ReplayRowsFileExt)
+	assert.NoError(t, w.write("c1", []byte(`{"queryId":"1","columns":["a"],"rows":[["x"],[null]],"sorted":true}`)))
+	assert.NoError(t, w.Close())
+	// reopen and append as a new gzip member
+	assert.NoError(t, w.write("c1", []byte(`{"queryId":"2","columns":["a"],"rows":[]}`)))
+	assert.NoError(t, w.Close())
+
+	id2rows, err := ReadReplayRows(filepath.Join(dir, "c1"+ReplayRowsFileExt))
+	assert.NoError(t, err)
+	assert.Len(t, id2rows, 2)
+	assert.True(t, id2rows["1"].Sorted)
+	assert.Nil(t, id2rows["1"].Rows[1][0])
+	assert.Equal(t, "x", *id2rows["1"].Rows[0][0])
+
+	id2rows, err = ReadReplayRows(filepath.Join(dir, "not-exist"+ReplayRowsFileExt))
+	assert.NoError(t, err)
+	assert.Nil(t, id2rows)
+}
@@ -0,0 +1,241 @@
+package src
+
+import (
+	"bufio"
+	"cmp"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/goccy/go-json"
+	"github.com/sirupsen/logrus"
+	"github.com/zeebo/blake3"
+
+	"github.com/Thearas/dodo/src/parser"
+)
+
+const ReportTotalFingerprint = "(total)"
+
+// ReportLatency is the latency percentiles of a group of sqls.
+type ReportLatency struct {
+	P50Ms int64 `json:"p50Ms"`
+	P90Ms int64 `json:"p90Ms"`
+	P99Ms int64 `json:"p99Ms"`
+	MaxMs int64 `json:"maxMs"`
+}
+
+func newReportLatency(durations []int64) ReportLatency {
+	if len(durations) == 0 {
+		return ReportLatency{}
+	}
+	slices.Sort(durations)
+	return ReportLatency{
+		P50Ms: percentile(durations, 0.5),
+		P90Ms: percentile(durations, 0.9),
+		P99Ms: percentile(durations, 0.99),
+		MaxMs: durations[len(durations)-1],
+	}
+}
+
+// percentile returns the nearest-rank percentile of sorted values.
+func percentile(sorted []int64, p float64) int64 {
+	idx := int(math.Ceil(p*float64(len(sorted)))) - 1
+	return sorted[max(idx, 0)]
+}
+
+// ReportItem is the replay statistics of a sql fingerprint.
+type ReportItem struct {
+	Id          string `json:"id"`
+	Fingerprint string `json:"fingerprint"`
+
+	Count   int     `json:"count"`
+	Errors  int     `json:"errors"`
+	ErrRate float64 `json:"errRate"`
+	ReportLatency
+
+	// Base is the latency of the baseline (another replay or the original dump sqls).
+	Base *ReportLatency `json:"base,omitempty"`
+	// ErrMismatches is the count of sqls whose error differs from the baseline replay.
+	ErrMismatches int `json:"errMismatches"`
+	// RowsMismatches is the count of sqls whose return rows (or rows hash) differ from the baseline replay.
+	RowsMismatches int `json:"rowsMismatches"`
+
+	durations, baseDurations []int64
+}
+
+func (item *ReportItem) add(r, base *ReplayResult, compareRows bool) {
+	item.Count++
+	item.durations = append(item.durations, r.DurationMs)
+	if r.Err != "" {
+		item.Errors++
+	}
+	if base == nil {
+		return
+	}
+
+	item.baseDurations = append(item.baseDurations, base.DurationMs)
+	if !compareRows {
+		return
+	}
+	if r.Err != base.Err {
+		item.ErrMismatches++
+	}
+	if r.ReturnRows != base.ReturnRows || r.ReturnRowsHash != base.ReturnRowsHash {
+		item.RowsMismatches++
+	}
+}
+
+func (item *ReportItem) complete() {
+	item.ErrRate = float64(item.Errors) / float64(max(item.Count, 1))
+	item.ReportLatency = newReportLatency(item.durations)
+	if len(item.baseDurations) > 0 {
+		base := newReportLatency(item.baseDurations)
+		item.Base = &base
+	}
+	item.durations, item.baseDurations = nil, nil
+}
+
+// ReplayReport is the aggregated replay statistics grouped by sql fingerprint.
+type ReplayReport struct {
+	Total *ReportItem   `json:"total"`
+	Items []*ReportItem `json:"fingerprints"`
+}
+
+// NewReplayReport aggregates replay results by the fingerprint of sqls.
+//
+// The baseline is another replay results if baseResults is not nil, otherwise the original dump sqls,
+// error and return rows are only compared with another replay.
+func NewReplayReport(originals *OriginalSqls, results, baseResults map[string]*ReplayResult) *ReplayReport {
+	var (
+		h        = blake3.New()
+		fp2item  = map[string]*ReportItem{}
+		total    = &ReportItem{Id: "-", Fingerprint: ReportTotalFingerprint}
+		unknowns int
+	)
+
+	// read the original sqls client by client
+	ids := slices.SortedFunc(maps.Keys(results), func(a, b string) int {
+		return cmp.Or(cmp.Compare(results[a].Client, results[b].Client), cmp.Compare(a, b))
+	})
+	for _, id := range ids {
+		r := results[id]
+		if r.Skipped != "" || (baseResults != nil && baseResults[id] != nil && baseResults[id].Skipped != "") {
+			// not executed, nothing to compare
+			continue
+		}
+		stmt := r.Stmt
+		s := originals.Get(r.Client, id)
+		if s != nil {
+			stmt = s.Stmt
+		}
+		if stmt == "" {
+			unknowns++
+			continue
+		}
+
+		var base *ReplayResult
+		if baseResults != nil {
+			base = baseResults[id]
+		} else if s != nil {
+			base = s.ToReplayResult()
+		}
+
+		fp := parser.Fingerprint(stmt)
+		item, ok := fp2item[fp]
+		if !ok {
+			item = &ReportItem{Id: anonymizeHashStr(h, fp), Fingerprint: fp}
+			fp2item[fp] = item
+		}
+		item.add(r, base, baseResults != nil)
+		total.add(r, base, baseResults != nil)
+	}
+	if unknowns > 0 {
+		logrus.Warnf("%d replay result(s) not found in original dump sqls, skipping", unknowns)
+	}
+
+	items := make([]*ReportItem, 0, len(fp2item))
+	for _, item := range fp2item {
+		item.complete()
+		items = append(items, item)
+	}
+	total.complete()
+	SortReportItems(items, "p99")
+
+	return &ReplayReport{Total: total, Items: items}
+}
+
+// SortReportItems sorts report items in descending order by the field.
+func SortReportItems(items []*ReportItem, by string) {
+	key := func(item *ReportItem) float64 {
+		switch by {
+		case "count":
+			return float64(item.Count)
+		case "p50":
+			return float64(item.P50Ms)
+		case "p90":
+			return float64(item.P90Ms)
+		case "max":
+			return float64(item.MaxMs)
+		case "err-rate":
+			return item.ErrRate
+		case "rows-mismatch":
+			return float64(item.RowsMismatches)
+		default:
+			return float64(item.P99Ms)
+		}
+	}
+	slices.SortStableFunc(items, func(a, b *ReportItem) int {
+		if c := cmp.Compare(key(b), key(a)); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Fingerprint, b.Fingerprint)
+	})
+}
+
+// ReadReplayResults reads all replay results ('*.result') in the dir, keyed by query id.
+func ReadReplayResults(dir string) (map[string]*ReplayResult, error) {
+	results := map[string]*ReplayResult{}
+	err := walkReplayResults(dir, func(client string, r *ReplayResult) {
+		r.Client = client
+		results[r.QueryId] = r
+	})
+	return results, err
+}
+
+// walkReplayResults calls fn with each replay result in the dir, along with the client it belongs to.
+func walkReplayResults(dir string, fn func(client string, r *ReplayResult)) error {
+	return filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ReplayResultFileExt) {
+			return nil
+		}
+		client := strings.TrimSuffix(filepath.Base(path), ReplayResultFileExt)
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		scan := bufio.NewScanner(f)
+		scan.Buffer(make([]byte, 0, 10*1024*1024), 10*1024*1024)
+		for scan.Scan() {
+			b := scan.Bytes()
+			if len(b) == 0 {
+				continue
+			}
+			r := &ReplayResult{}
+			if err := json.Unmarshal(b, r); err != nil {
+				logrus.Errorf("unmarshal %s failed, err: %v", scan.Text(), err)
+				continue
+			}
+			fn(client, r)
+		}
+		return scan.Err()
+	})
+}
@@ -0,0 +1,59 @@
+package src
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewReplayReport(t *testing.T) {
+	sql := func(id, stmt string, durationMs int64) *ReplaySql {
+		return &ReplaySql{ReplaySqlMeta: ReplaySqlMeta{QueryId: id, DurationMs: durationMs}, Stmt: stmt}
+	}
+	originals := NewOriginalSqls([]ClientSqls{
+		{Client: "c1", Sqls: []*ReplaySql{sql("1", "select * from t where a = 1", 10), sql("2", "select * from t where a = 2", 20)}},
+		{Client: "c2", Sqls: []*ReplaySql{sql("3", "select * from t where a = 3", 30), sql("4", "select count(*) from t", 100)}},
+		{Client: "c3", Sqls: []*ReplaySql{sql("6", "drop table t", 10)}},
+	})
+	results := map[string]*ReplayResult{
+		"1": {QueryId: "1", Client: "c1", DurationMs: 15, ReturnRows: 1},
+		"2": {QueryId: "2", Client: "c1", DurationMs: 25, ReturnRows: 1},
+		"3": {QueryId: "3", Client: "c2", DurationMs: 35, Err: "timeout"},
+		"4": {QueryId: "4", Client: "c2", DurationMs: 50, ReturnRows: 1, ReturnRowsHash: "x"},
+		"5": {QueryId: "5", Client: "c1", DurationMs: 50},
+		"6": {QueryId: "6", Client: "c3", Skipped: "skipped by --write-mode=sandbox"},
+	}
+
+	// compare with original dump sqls
+	r := NewReplayReport(originals, results, nil)
+	assert.Equal(t, 4, r.Total.Count)
+	assert.Len(t, r.Items, 2)
+
+	item := r.Items[0]
+	assert.Equal(t, "select count(*) from t", item.Fingerprint)
+	assert.Equal(t, ReportLatency{P50Ms: 50, P90Ms: 50, P99Ms: 50, MaxMs: 50}, item.ReportLatency)
+	assert.Equal(t, &ReportLatency{P50Ms: 100, P90Ms: 100, P99Ms: 100, MaxMs: 100}, item.Base)
+
+	item = r.Items[1]
+	assert.Equal(t, "select * from t where a = ?", item.Fingerprint)
+	assert.Equal(t, 3, item.Count)
+	assert.Equal(t, 1, item.Errors)
+	assert.InDelta(t, 1./3, item.ErrRate, 1e-9)
+	assert.Equal(t, ReportLatency{P50Ms: 25, P90Ms: 35, P99Ms: 35, MaxMs: 35}, item.ReportLatency)
+	assert.Equal(t, 0, item.RowsMismatches)
+
+	// compare with another replay
+	baseResults := map[string]*ReplayResult{
+		"1": {QueryId: "1", DurationMs: 10, ReturnRows: 1},
+		"2": {QueryId: "2", DurationMs: 10, ReturnRows: 2},
+		"3": {QueryId: "3", DurationMs: 10},
+		"4": {QueryId: "4", DurationMs: 10, ReturnRows: 1, ReturnRowsHash: "y"},
+	}
+	r = NewReplayReport(originals, results, baseResults)
+	SortReportItems(r.Items, "count")
+	assert.Equal(t, "select * from t where a = ?", r.Items[0].Fingerprint)
+	assert.Equal(t, 1, r.Items[0].RowsMismatches)
+	assert.Equal(t, 1, r.Items[0].ErrMismatches)
+	assert.Equal(t, 1, r.Items[1].RowsMismatches)
+	assert.Equal(t, 2, r.Total.RowsMismatches)
+}
@@ -0,0 +1,144 @@
+package src
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/parquet-go/parquet-go"
+
+	"github.com/Thearas/dodo/src/parser"
+)
+
+const (
+	ResultExportParquet = "parquet"
+	ResultExportCSV     = "csv"
+)
+
+// ReplayResultColumns is the column names of ReplayResultRecord, in the order of exported csv.
+var ReplayResultColumns = []string{
+	"run", "client", "ts", "query_id", "fingerprint", "user", "db",
+	"duration_ms", "return_rows", "return_rows_hash", "err",
+}
+
+// loadFileFieldReplacer removes the row and column separators in the fields of stream load file.
+var loadFileFieldReplacer = strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ", string(ColumnSeparator), " ")
+
+// ReplayResultRecord is a flattened replay result, one row of the exported table.
+type ReplayResultRecord struct {
+	Run            string `parquet:"run" json:"run"`
+	Client         string `parquet:"client" json:"client"`
+	Ts             string `parquet:"ts" json:"ts"`
+	QueryId        string `parquet:"query_id" json:"queryId"`
+	Fingerprint    string `parquet:"fingerprint" json:"fingerprint"`
+	User           string `parquet:"user" json:"user"`
+	Db             string `parquet:"db" json:"db"`
+	DurationMs     int64  `parquet:"duration_ms" json:"durationMs"`
+	ReturnRows     int64  `parquet:"return_rows" json:"returnRows"`
+	ReturnRowsHash string `parquet:"return_rows_hash" json:"returnRowsHash"`
+	Err            string `parquet:"err" json:"err"`
+}
+
+func (r *ReplayResultRecord) values() []string {
+	return []string{
+		r.Run, r.Client, r.Ts, r.QueryId, r.Fingerprint, r.User, r.Db,
+		strconv.FormatInt(r.DurationMs, 10), strconv.FormatInt(r.ReturnRows, 10), r.ReturnRowsHash, r.Err,
+	}
+}
+
+// ReadReplayResultRecords reads the replay results in the dir as records of the run,
+// the fingerprint, user and db are filled from the original sql of the same query id (if any).
+func ReadReplayResultRecords(dir, run string, originals *OriginalSqls) ([]ReplayResultRecord, error) {
+	records := []ReplayResultRecord{}
+	fingerprints := map[string]string{}
+	err := walkReplayResults(dir, func(client string, r *ReplayResult) {
+		if r.Skipped != "" {
+			// not executed
+			return
+		}
+		record := ReplayResultRecord{
+			Run:            run,
+			Client:         client,
+			Ts:             r.Ts,
+			QueryId:        r.QueryId,
+			DurationMs:     r.DurationMs,
+			ReturnRows:     int64(r.ReturnRows),
+			ReturnRowsHash: r.ReturnRowsHash,
+			Err:            r.Err,
+		}
+
+		stmt := r.Stmt
+		if s := originals.Get(client, r.QueryId); s != nil {
+			stmt = s.Stmt
+			record.User, record.Db = s.User, s.Db
+		}
+		if stmt != "" {
+			fp, ok := fingerprints[stmt]
+			if !ok {
+				fp = parser.Fingerprint(stmt)
+				fingerprints[stmt] = fp
+			}
+			record.Fingerprint = fp
+		}
+
+		records = append(records, record)
+	})
+	return records, err
+}
+
+// WriteReplayResultRecords writes the records in format parquet or csv (with header).
+func WriteReplayResultRecords(w io.Writer, format string, records []ReplayResultRecord) error {
+	switch format {
+	case ResultExportParquet:
+		pw := parquet.NewGenericWriter[ReplayResultRecord](w, parquet.Compression(&parquet.Zstd))
+		if _, err := pw.Write(records); err != nil {
+			return err
+		}
+		return pw.Close()
+	case ResultExportCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(ReplayResultColumns); err != nil {
+			return err
+		}
+		for i := range records {
+			if err := cw.Write(records[i].values()); err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	default:
+		return fmt.Errorf("unknown replay result export format: %s", format)
+	}
+}
+
+// WriteReplayResultLoadFile writes the records to a data file which can be loaded by StreamLoad.
+func WriteReplayResultLoadFile(path string, records []ReplayResultRecord) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	if _, err := fmt.Fprintf(w, "%s%s\n", GenDataFileFirstLinePrefix, strings.Join(ReplayResultColumns, ",")); err != nil {
+		return err
+	}
+	for i := range records {
+		values := records[i].values()
+		for j, v := range values {
+			values[j] = loadFileFieldReplacer.Replace(v)
+		}
+		if _, err := w.WriteString(strings.Join(values, string(ColumnSeparator)) + "\n"); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,61 @@
+package src
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplayResultRecords(t *testing.T) {
+	dir := t.TempDir()
+	results := []*ReplayResult{
+		{Ts: "2025-01-01 00:00:00.000", QueryId: "1", DurationMs: 15, ReturnRows: 1, ReturnRowsHash: "x"},
+		{Ts: "2025-01-01 00:00:01.000", QueryId: "2", DurationMs: 25, Err: "line1\nline2"},
+	}
+	lines := make([]string, 0, len(results))
+	for _, r := range results {
+		lines = append(lines, r.String())
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "c1"+ReplayResultFileExt), []byte(strings.Join(lines, "\n")+"\n"), 0600))
+
+	originals := NewOriginalSqls([]ClientSqls{{Client: "c1", Sqls: []*ReplaySql{
+		{ReplaySqlMeta: ReplaySqlMeta{QueryId: "1", User: "root", Db: "db1"}, Stmt: "select * from t where a = 1"},
+	}}})
+	records, err := ReadReplayResultRecords(dir, "run1", originals)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, ReplayResultRecord{
+		Run: "run1", Client: "c1", Ts: "2025-01-01 00:00:00.000", QueryId: "1",
+		Fingerprint: "select * from t where a = ?", User: "root", Db: "db1",
+		DurationMs: 15, ReturnRows: 1, ReturnRowsHash: "x",
+	}, records[0])
+	assert.Empty(t, records[1].Fingerprint)
+
+	// parquet
+	buf := &bytes.Buffer{}
+	require.NoError(t, WriteReplayResultRecords(buf, ResultExportParquet, records))
+	rows, err := parquet.Read[ReplayResultRecord](bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+	assert.Equal(t, records, rows)
+
+	// csv
+	buf.Reset()
+	require.NoError(t, WriteReplayResultRecords(buf, ResultExportCSV, records))
+	assert.True(t, strings.HasPrefix(buf.String(), strings.Join(ReplayResultColumns, ",")+"\n"))
+
+	// stream load file, the row separators in fields are replaced
+	file := filepath.Join(dir, "load.csv")
+	require.NoError(t, WriteReplayResultLoadFile(file, records))
+	b, err := os.ReadFile(file)
+	require.NoError(t, err)
+	loadLines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	require.Len(t, loadLines, 3)
+	assert.Equal(t, GenDataFileFirstLinePrefix+strings.Join(ReplayResultColumns, ","), loadLines[0])
+	assert.True(t, strings.HasSuffix(loadLines[2], string(ColumnSeparator)+"line1 line2"))
+}
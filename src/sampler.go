@@ -0,0 +1,327 @@
+package src
+
+import (
+	"bufio"
+	"cmp"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"sync"
+
+	"github.com/samber/lo"
+	"github.com/zeebo/blake3"
+	"gopkg.in/yaml.v3"
+
+	"github.com/Thearas/dodo/src/parser"
+)
+
+// DumpFingerprintsFile is the workload summary by sql fingerprint, placed next to the dumped sql dir.
+const DumpFingerprintsFile = "fingerprints.yaml"
+
+// QuerySampleOpts is the options of sampling dumped queries by fingerprint.
+type QuerySampleOpts struct {
+	// MaxPerFingerprint keeps at most N queries of each fingerprint, the first scanned ones, <= 0 means unlimited.
+	MaxPerFingerprint int
+	// TopSlowestPerFingerprint keeps the K slowest queries of each fingerprint, <= 0 means not.
+	TopSlowestPerFingerprint int
+	// Percent keeps a random percent of queries, every query has the same chance so the time distribution is preserved,
+	// <= 0 or >= 100 means all.
+	Percent float64
+}
+
+// FingerprintSummary is the statistics of the dumped queries of a fingerprint.
+type FingerprintSummary struct {
+	Id            string   `yaml:"id"`
+	Fingerprint   string   `yaml:"fingerprint"`
+	Count         int      `yaml:"count"`
+	Sampled       int      `yaml:"sampled"`
+	AvgDurationMs int64    `yaml:"avg_duration_ms"`
+	MaxDurationMs int64    `yaml:"max_duration_ms"`
+	Users         []string `yaml:"users"`
+	Dbs           []string `yaml:"dbs"`
+
+	sumDurationMs int64
+	users, dbs    map[string]struct{}
+	slowest       sampledSqlHeap
+}
+
+func (f *FingerprintSummary) add(s *ReplaySql) {
+	f.Count++
+	f.sumDurationMs += s.DurationMs
+	f.MaxDurationMs = max(f.MaxDurationMs, s.DurationMs)
+	f.users[s.User] = struct{}{}
+	f.dbs[s.Db] = struct{}{}
+}
+
+// sampledSql is a query buffered to be written after all queries are scanned.
+type sampledSql struct {
+	writer     int
+	seq        int
+	durationMs int64
+	sql        string
+}
+
+// sampledSqlHeap is a min heap by duration, so that the fastest one is popped when it is full.
+type sampledSqlHeap []*sampledSql
+
+func (h sampledSqlHeap) Len() int           { return len(h) }
+func (h sampledSqlHeap) Less(i, j int) bool { return h[i].durationMs < h[j].durationMs }
+func (h sampledSqlHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *sampledSqlHeap) Push(x any)        { *h = append(*h, x.(*sampledSql)) }
+func (h *sampledSqlHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// QuerySampler samples the dumped queries by fingerprint, and summarizes the workload of each fingerprint.
+// Session statements (like 'SET' and 'USE') are always kept.
+type QuerySampler struct {
+	opts    QuerySampleOpts
+	writers []SqlWriter
+
+	mu           sync.Mutex
+	fingerprints map[string]*FingerprintSummary
+	seqs         []int
+	// spills are the session statements of each writer spilled to disk until the slowest queries are flushed,
+	// to keep their interleaving
+	spills []*sampledSqlSpill
+}
+
+// sampledSqlSpill is a temp file of the session statements of a writer, in the order of seq.
+type sampledSqlSpill struct {
+	f *os.File
+	w *bufio.Writer
+}
+
+func (sp *sampledSqlSpill) write(seq int, sql string) error {
+	b := binary.AppendUvarint(nil, uint64(seq))
+	b = binary.AppendUvarint(b, uint64(len(sql)))
+	if _, err := sp.w.Write(b); err != nil {
+		return err
+	}
+	_, err := sp.w.WriteString(sql)
+	return err
+}
+
+// readAll calls fn with each spilled statement in order.
+func (sp *sampledSqlSpill) readAll(fn func(seq int, sql string) error) error {
+	if err := sp.w.Flush(); err != nil {
+		return err
+	}
+	if _, err := sp.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReader(sp.f)
+	for {
+		seq, err := binary.ReadUvarint(r)
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return err
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return err
+		}
+		if err := fn(int(seq), string(b)); err != nil {
+			return err
+		}
+	}
+}
+
+func (sp *sampledSqlSpill) remove() {
+	_ = sp.f.Close()
+	_ = os.Remove(sp.f.Name())
+}
+
+// NewQuerySampler returns the sampler and the writers to write queries through it.
+func NewQuerySampler(opts QuerySampleOpts, writers []SqlWriter) (*QuerySampler, []SqlWriter) {
+	s := &QuerySampler{
+		opts:         opts,
+		writers:      writers,
+		fingerprints: map[string]*FingerprintSummary{},
+		seqs:         make([]int, len(writers)),
+		spills:       make([]*sampledSqlSpill, len(writers)),
+	}
+	sampled := make([]SqlWriter, len(writers))
+	for i, w := range writers {
+		sampled[i] = &sampledSqlWriter{sampler: s, idx: i, w: w}
+	}
+	return s, sampled
+}
+
+type sampledSqlWriter struct {
+	sampler *QuerySampler
+	idx     int
+	w       SqlWriter
+}
+
+func (w *sampledSqlWriter) WriteSql(s string) error {
+	return w.sampler.write(w.idx, s)
+}
+
+func (w *sampledSqlWriter) Close() error {
+	return w.w.Close()
+}
+
+func (s *QuerySampler) write(idx int, sql string) error {
+	q := decodeReplaySql([]byte(sql))
+	if q == nil || sessionStmtRe.MatchString(q.Stmt) {
+		if s.opts.TopSlowestPerFingerprint <= 0 {
+			return s.writers[idx].WriteSql(sql)
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.spills[idx] == nil {
+			f, err := os.CreateTemp("", "dodo-sample-")
+			if err != nil {
+				return err
+			}
+			s.spills[idx] = &sampledSqlSpill{f: f, w: bufio.NewWriter(f)}
+		}
+		seq := s.seqs[idx]
+		s.seqs[idx]++
+		return s.spills[idx].write(seq, sql)
+	}
+	fp := parser.Fingerprint(q.Stmt)
+
+	s.mu.Lock()
+	f, ok := s.fingerprints[fp]
+	if !ok {
+		f = &FingerprintSummary{Fingerprint: fp, users: map[string]struct{}{}, dbs: map[string]struct{}{}}
+		s.fingerprints[fp] = f
+	}
+	f.add(q)
+	seq := s.seqs[idx]
+	s.seqs[idx]++
+
+	keep := s.sampled(q)
+	switch {
+	case !keep:
+	case s.opts.TopSlowestPerFingerprint > 0:
+		heap.Push(&f.slowest, &sampledSql{writer: idx, seq: seq, durationMs: q.DurationMs, sql: sql})
+		if f.slowest.Len() > s.opts.TopSlowestPerFingerprint {
+			heap.Pop(&f.slowest)
+		}
+		keep = false
+	case s.opts.MaxPerFingerprint > 0 && f.Sampled >= s.opts.MaxPerFingerprint:
+		keep = false
+	}
+	if keep {
+		f.Sampled++
+	}
+	s.mu.Unlock()
+
+	if !keep {
+		return nil
+	}
+	return s.writers[idx].WriteSql(sql)
+}
+
+// sampled returns whether the query is in the random percent, the query id is hashed so that the result is stable.
+func (s *QuerySampler) sampled(q *ReplaySql) bool {
+	if s.opts.Percent <= 0 || s.opts.Percent >= 100 {
+		return true
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(lo.CoalesceOrEmpty(q.QueryId, q.Ts_+q.Stmt)))
+	return float64(h.Sum64()%10000) < s.opts.Percent*100
+}
+
+// Flush writes the buffered queries (the slowest ones of each fingerprint) and session statements in their original order,
+// it must be called after all queries are written and before the writers are closed.
+func (s *QuerySampler) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	buffered := []*sampledSql{}
+	for _, f := range s.fingerprints {
+		f.Sampled += f.slowest.Len()
+		buffered = append(buffered, f.slowest...)
+		f.slowest = nil
+	}
+	slices.SortFunc(buffered, func(a, b *sampledSql) int {
+		return cmp.Or(cmp.Compare(a.writer, b.writer), cmp.Compare(a.seq, b.seq))
+	})
+
+	spills := s.spills
+	s.spills = make([]*sampledSqlSpill, len(s.writers))
+	defer func() {
+		for _, sp := range spills {
+			if sp != nil {
+				sp.remove()
+			}
+		}
+	}()
+	for idx, w := range s.writers {
+		// merge the slowest queries and the spilled session statements of the writer by seq
+		n, _ := slices.BinarySearchFunc(buffered, idx+1, func(q *sampledSql, idx int) int { return cmp.Compare(q.writer, idx) })
+		queries := buffered[:n]
+		buffered = buffered[n:]
+		writeUntil := func(seq int) error {
+			for ; len(queries) > 0 && queries[0].seq < seq; queries = queries[1:] {
+				if err := w.WriteSql(queries[0].sql); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		if sp := spills[idx]; sp != nil {
+			err := sp.readAll(func(seq int, sql string) error {
+				if err := writeUntil(seq); err != nil {
+					return err
+				}
+				return w.WriteSql(sql)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if err := writeUntil(math.MaxInt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Summary returns the statistics of all fingerprints, in descending order by count.
+func (s *QuerySampler) Summary() []*FingerprintSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h := blake3.New()
+	summary := lo.Values(s.fingerprints)
+	for _, f := range summary {
+		f.Id = anonymizeHashStr(h, f.Fingerprint)
+		f.AvgDurationMs = f.sumDurationMs / int64(f.Count)
+		f.Users = lo.Keys(f.users)
+		f.Dbs = lo.Keys(f.dbs)
+		slices.Sort(f.Users)
+		slices.Sort(f.Dbs)
+	}
+	slices.SortFunc(summary, func(a, b *FingerprintSummary) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), cmp.Compare(a.Fingerprint, b.Fingerprint))
+	})
+	return summary
+}
+
+// WriteFingerprintSummary writes the fingerprint summary to the yaml file.
+func WriteFingerprintSummary(path string, summary []*FingerprintSummary) error {
+	b, err := yaml.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0600)
+}
@@ -0,0 +1,71 @@
+package src
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Thearas/dodo/src/parser"
+)
+
+const (
+	// ReplayWriteDirect replays write statements as they are.
+	ReplayWriteDirect = "direct"
+	// ReplayWriteSandbox redirects the target tables of write statements to the sandbox.
+	ReplayWriteSandbox = "sandbox"
+	// ReplayWriteExplain sends 'EXPLAIN <stmt>' in place of write statements.
+	ReplayWriteExplain = "explain"
+)
+
+// ReplaySandbox protects the tables written by replay, only the target tables of INSERT, UPDATE, DELETE and TRUNCATE are affected,
+// the other statements except queries and session statements are skipped.
+type ReplaySandbox struct {
+	Mode string
+	// DB is the database that the written tables are redirected to, like 'db.t' -> 'sandbox.t'.
+	DB string
+	// TableSuffix is appended to the written table names, like 't' -> 't_shadow'.
+	TableSuffix string
+}
+
+// rewrite returns the sql to execute in place of the write statement,
+// or the reason to skip it if the statement can not be executed safely.
+func (b *ReplaySandbox) rewrite(s *ReplaySql) (*ReplaySql, string) {
+	var rename func(parts []string) []string
+	if b.Mode == ReplayWriteSandbox {
+		rename = b.rename
+	}
+
+	stmt, kind, err := parser.RewriteWriteStmt(s.QueryId, s.Stmt, rename)
+	if err != nil {
+		logrus.Debugf("skip sql can not be rewritten at query_id: %s, err: %v", s.QueryId, err)
+		return nil, fmt.Sprintf("skipped by --write-mode=%s: %v", b.Mode, err)
+	}
+	if kind == "" {
+		return s, ""
+	}
+
+	if b.Mode == ReplayWriteExplain {
+		if kind == parser.WriteStmtTruncate {
+			return nil, fmt.Sprintf("skipped by --write-mode=%s: %s can not be explained", b.Mode, kind)
+		}
+		stmt = "EXPLAIN " + stmt
+	}
+	logrus.Traceln("rewrite write statement at query_id:", s.QueryId, "to:", stmt)
+
+	rewritten := *s
+	rewritten.Stmt = stmt
+	return &rewritten, ""
+}
+
+// rename redirects the table to the sandbox database, and appends the suffix to its name.
+func (b *ReplaySandbox) rename(parts []string) []string {
+	if b.DB != "" {
+		if len(parts) == 1 {
+			parts = append([]string{b.DB}, parts...)
+		} else {
+			parts[len(parts)-2] = b.DB
+		}
+	}
+	parts[len(parts)-1] += b.TableSuffix
+	return parts
+}
@@ -0,0 +1,489 @@
+package src
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/jmoiron/sqlx"
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// computed columns of 'SHOW WORKLOAD GROUPS', not properties
+	workloadGroupIgnoredItems = []string{"id", "name", "running_query_num", "waiting_query_num", "compute_group"}
+	// computed items of 'SHOW RESOURCES', not properties
+	resourceIgnoredItems = []string{"id", "version", "reference"}
+	// the properties masked by Doris when showing resources and catalogs, like '"password" = "*XXX"'
+	maskedPropertyRe = regexp.MustCompile(`"([^"]+)"\s*=\s*"(\*XXX|\*{3,})"`)
+	// the tag locations in 'resource_tags' property of user, like '{"location" : "group_a"}, {"location" : "group_b"}'
+	tagLocationRe = regexp.MustCompile(`"location"\s*:\s*"([^"]+)"`)
+)
+
+const (
+	// ResourceTagDefault is the tag location of backends and users without resource tag.
+	ResourceTagDefault = "default"
+	// resource tag schemas, one for backends and one for users
+	resourceTagBackends = "backends"
+	resourceTagUsers    = "users"
+)
+
+// ShowCreateGlobalSchemas returns the schemas not in any database: resource tags, resources, workload groups, catalogs and global functions.
+// The ones failed to show are skipped with warning, they may be not supported by the Doris version or not privileged.
+func ShowCreateGlobalSchemas(ctx context.Context, conn *sqlx.DB) []*Schema {
+	shows := []struct {
+		t    SchemaType
+		show func() ([]*Schema, error)
+	}{
+		{SchemaTypeResourceTag, func() ([]*Schema, error) { return ShowCreateResourceTags(ctx, conn) }},
+		{SchemaTypeResource, func() ([]*Schema, error) { return ShowCreateResources(ctx, conn) }},
+		{SchemaTypeWorkloadGroup, func() ([]*Schema, error) { return ShowCreateWorkloadGroups(ctx, conn) }},
+		{SchemaTypeCatalog, func() ([]*Schema, error) { return ShowCreateCatalogs(ctx, conn) }},
+		{SchemaTypeFunction, func() ([]*Schema, error) { return ShowCreateFunctions(ctx, conn, "") }},
+	}
+
+	schemas := []*Schema{}
+	for _, s := range shows {
+		schemas_, err := s.show()
+		if err != nil {
+			logrus.Warnf("skip dumping global %s(s), err: %v", s.t.Lower(), err)
+			continue
+		}
+		schemas = append(schemas, schemas_...)
+	}
+	return schemas
+}
+
+// ShowCreateDBSchemas returns the schemas in db depended by tables or queries: functions, row policies and rollups of tables.
+// The ones failed to show are skipped with warning, like ShowCreateGlobalSchemas.
+func ShowCreateDBSchemas(ctx context.Context, conn *sqlx.DB, db string, tables []*Schema) []*Schema {
+	schemas, err := ShowCreateFunctions(ctx, conn, db)
+	if err != nil {
+		logrus.Warnf("skip dumping functions of db '%s', err: %v", db, err)
+		schemas = []*Schema{}
+	}
+
+	tableNames := lo.Map(tables, func(s *Schema, _ int) string { return s.Name })
+	policies, err := ShowCreateRowPolicies(ctx, conn, db, tableNames...)
+	if err != nil {
+		logrus.Warnf("skip dumping row policies of db '%s', err: %v", db, err)
+	}
+	schemas = append(schemas, policies...)
+
+	for _, t := range tables {
+		if t.Type != SchemaTypeTable {
+			continue
+		}
+		rollup, err := ShowCreateRollups(ctx, conn, db, t.Name)
+		if err != nil {
+			logrus.Warnf("skip dumping rollups of table '%s', err: %v", t, err)
+			continue
+		}
+		if rollup != nil {
+			schemas = append(schemas, rollup)
+		}
+	}
+	return schemas
+}
+
+// ShowCreateFunctions returns the UDFs in db, the global ones if db is empty.
+// The overloaded functions are in the same schema.
+func ShowCreateFunctions(ctx context.Context, conn *sqlx.DB, db string) ([]*Schema, error) {
+	show, showCreate := "SHOW GLOBAL FULL FUNCTIONS", func(sig string) string { return "SHOW CREATE GLOBAL FUNCTION " + sig }
+	if db != "" {
+		show = fmt.Sprintf("SHOW FULL FUNCTIONS FROM `%s`", db)
+		showCreate = func(sig string) string { return fmt.Sprintf("SHOW CREATE FUNCTION %s FROM `%s`", sig, db) }
+	}
+	rows, err := showRows(ctx, conn, show)
+	if err != nil {
+		return nil, err
+	}
+
+	schemas := []*Schema{}
+	for _, row := range rows {
+		// signature is like 'my_add(INT, INT)'
+		sig := row["Signature"]
+		name, _, _ := strings.Cut(sig, "(")
+
+		r, err := conn.QueryxContext(ctx, InternalSqlComment+showCreate(sig))
+		if err != nil {
+			return nil, err
+		}
+		stmt, err := getStmtfromShowCreate(r)
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+		schemas = addSchemaStmt(schemas, &Schema{Name: name, Type: SchemaTypeFunction, DB: db}, stmt)
+	}
+	return schemas, nil
+}
+
+// ShowCreateRowPolicies returns the row policies on tables of db, all tables if not specified.
+// The policies of the same name are in the same schema.
+func ShowCreateRowPolicies(ctx context.Context, conn *sqlx.DB, db string, tables ...string) ([]*Schema, error) {
+	rows, err := showRows(ctx, conn, "SHOW ROW POLICY")
+	if err != nil {
+		return nil, err
+	}
+	return rowPoliciesFromRows(rows, db, tables), nil
+}
+
+func rowPoliciesFromRows(rows []map[string]string, db string, tables []string) []*Schema {
+	schemas := []*Schema{}
+	for _, row := range rows {
+		// the db of old versions has cluster prefix, like 'default_cluster:db'
+		dbname := row["DbName"]
+		if _, name, found := strings.Cut(dbname, ":"); found {
+			dbname = name
+		}
+		if dbname != db || (len(tables) > 0 && !slices.Contains(tables, row["TableName"])) {
+			continue
+		}
+		schemas = addSchemaStmt(schemas, &Schema{Name: row["PolicyName"], Type: SchemaTypeRowPolicy, DB: db}, row["OriginStmt"])
+	}
+	return schemas
+}
+
+// ShowCreateRollups returns the rollups and sync materialized views of table in one schema, nil if there is none.
+func ShowCreateRollups(ctx context.Context, conn *sqlx.DB, db, table string) (*Schema, error) {
+	rows, err := showRows(ctx, conn, fmt.Sprintf("DESC `%s`.`%s` ALL", db, table))
+	if err != nil {
+		return nil, err
+	}
+
+	var rollups, stmts []string
+	for _, idx := range rollupIndexesFromRows(table, rows) {
+		// sync materialized view has its create statement, rollup does not
+		mv, err := showRows(ctx, conn, fmt.Sprintf("SHOW CREATE MATERIALIZED VIEW `%s` ON `%s`.`%s`", idx.name, db, table))
+		if err == nil && len(mv) > 0 && mv[0]["CreateStmt"] != "" {
+			stmts = append(stmts, mv[0]["CreateStmt"])
+			continue
+		}
+		if idx.hasDefineExpr {
+			logrus.Warnf("skip dumping sync materialized view '%s' of table '%s.%s', can not show its create statement, err: %v", idx.name, db, table, err)
+			continue
+		}
+		rollups = append(rollups, idx.String())
+	}
+	if len(rollups) > 0 {
+		stmts = append([]string{fmt.Sprintf("ALTER TABLE `%s` ADD ROLLUP %s", table, strings.Join(rollups, ", "))}, stmts...)
+	}
+
+	var schemas []*Schema
+	for _, stmt := range stmts {
+		schemas = addSchemaStmt(schemas, &Schema{Name: table, Type: SchemaTypeRollup, DB: db}, stmt)
+	}
+	if len(schemas) == 0 {
+		return nil, nil
+	}
+	return schemas[0], nil
+}
+
+type rollupIndex struct {
+	name          string
+	keysType      string
+	columns       []string
+	keys          []string
+	hasDefineExpr bool
+}
+
+// String returns the rollup clause of 'ALTER TABLE ADD ROLLUP'.
+func (r *rollupIndex) String() string {
+	quote := func(cols []string) string {
+		return strings.Join(lo.Map(cols, func(c string, _ int) string { return "`" + c + "`" }), ", ")
+	}
+	clause := fmt.Sprintf("`%s` (%s)", r.name, quote(r.columns))
+	if r.keysType == "DUP_KEYS" && len(r.keys) > 0 {
+		clause += fmt.Sprintf(" DUPLICATE KEY (%s)", quote(r.keys))
+	}
+	return clause
+}
+
+// rollupIndexesFromRows returns the indexes except the base one from rows of 'DESC table ALL',
+// only the first column row of each index has the index name.
+func rollupIndexesFromRows(table string, rows []map[string]string) []*rollupIndex {
+	var (
+		indexes []*rollupIndex
+		idx     *rollupIndex
+	)
+	for _, row := range rows {
+		if name := row["IndexName"]; name != "" {
+			idx = nil
+			if name != table {
+				idx = &rollupIndex{name: name, keysType: row["IndexKeysType"]}
+				indexes = append(indexes, idx)
+			}
+		}
+		if idx == nil {
+			continue
+		}
+		idx.columns = append(idx.columns, row["Field"])
+		if strings.EqualFold(row["Key"], "true") {
+			idx.keys = append(idx.keys, row["Field"])
+		}
+		if row["DefineExpr"] != "" {
+			idx.hasDefineExpr = true
+		}
+	}
+	return indexes
+}
+
+// ShowCreateWorkloadGroups returns the workload groups except the built-in 'normal' one.
+func ShowCreateWorkloadGroups(ctx context.Context, conn *sqlx.DB) ([]*Schema, error) {
+	rows, err := showRows(ctx, conn, "SHOW WORKLOAD GROUPS")
+	if err != nil {
+		return nil, err
+	}
+	return workloadGroupsFromRows(rows), nil
+}
+
+func workloadGroupsFromRows(rows []map[string]string) []*Schema {
+	names, props := []string{}, map[string]map[string]string{}
+	for _, row := range rows {
+		name := row["Name"]
+		// the built-in group exists in every cluster
+		if name == "normal" {
+			continue
+		}
+		if _, ok := props[name]; !ok {
+			names = append(names, name)
+			props[name] = map[string]string{}
+		}
+
+		// old versions show one property per row
+		if item, ok := row["Item"]; ok {
+			props[name][item] = row["Value"]
+			continue
+		}
+		for k, v := range row {
+			if v != "" && !slices.Contains(workloadGroupIgnoredItems, strings.ToLower(k)) {
+				props[name][k] = v
+			}
+		}
+	}
+
+	return lo.Map(names, func(name string, _ int) *Schema {
+		stmt := fmt.Sprintf("CREATE WORKLOAD GROUP `%s` %s", name, propertiesClause(props[name]))
+		return &Schema{Name: name, Type: SchemaTypeWorkloadGroup, CreateStmt: stmt}
+	})
+}
+
+// ShowCreateResourceTags returns the non-default resource tags as the statements setting them:
+// 'backends' tags the backends by 'ALTER SYSTEM MODIFY BACKEND', 'users' sets the 'resource_tags.location' of users.
+func ShowCreateResourceTags(ctx context.Context, conn *sqlx.DB) ([]*Schema, error) {
+	backends, err := showRows(ctx, conn, "SHOW BACKENDS")
+	if err != nil {
+		return nil, err
+	}
+	schemas := backendTagsFromRows(backends)
+
+	grants, err := showRows(ctx, conn, "SHOW ALL GRANTS")
+	if err != nil {
+		logrus.Warnf("skip dumping resource tags of users, err: %v", err)
+		return schemas, nil
+	}
+	users, props := []string{}, map[string][]map[string]string{}
+	for _, g := range grants {
+		user, _, _ := strings.Cut(strings.TrimPrefix(g["UserIdentity"], "'"), "'@")
+		if _, ok := props[user]; ok || user == "" {
+			continue
+		}
+		rows, err := showRows(ctx, conn, fmt.Sprintf("SHOW PROPERTY FOR '%s' LIKE 'resource_tags%%'", strings.ReplaceAll(user, "'", "\\'")))
+		if err != nil {
+			logrus.Warnf("skip dumping resource tags of user '%s', err: %v", user, err)
+			continue
+		}
+		users, props[user] = append(users, user), rows
+	}
+	return append(schemas, userTagsFromRows(users, props)...), nil
+}
+
+func backendTagsFromRows(rows []map[string]string) []*Schema {
+	stmts := []string{}
+	for _, row := range rows {
+		location, err := backendTagLocation(row)
+		if err != nil {
+			logrus.Warnf("skip the tag of backend %s, err: %v", row["Host"], err)
+			continue
+		}
+		if location == ResourceTagDefault {
+			continue
+		}
+		stmts = append(stmts, backendTagStmt(backendAddr(row), location))
+	}
+	if len(stmts) == 0 {
+		return nil
+	}
+	return []*Schema{{Name: resourceTagBackends, Type: SchemaTypeResourceTag, CreateStmt: strings.Join(stmts, ";\n")}}
+}
+
+// backendTagLocation returns the tag location of the row of 'SHOW BACKENDS', like '{"location" : "default"}'.
+func backendTagLocation(row map[string]string) (string, error) {
+	tag := map[string]any{}
+	if row["Tag"] != "" {
+		if err := json.Unmarshal([]byte(row["Tag"]), &tag); err != nil {
+			return "", err
+		}
+	}
+	if location, _ := tag["location"].(string); location != "" {
+		return location, nil
+	}
+	return ResourceTagDefault, nil
+}
+
+func backendAddr(row map[string]string) string {
+	return net.JoinHostPort(row["Host"], row["HeartbeatPort"])
+}
+
+func userTagsFromRows(users []string, props map[string][]map[string]string) []*Schema {
+	stmts := []string{}
+	for _, user := range users {
+		for _, row := range props[user] {
+			if key := row["Key"]; key != "resource_tags" && key != "resource_tags.location" {
+				continue
+			}
+			locations := resourceTagLocations(row["Value"])
+			if len(locations) == 0 || (len(locations) == 1 && locations[0] == ResourceTagDefault) {
+				continue
+			}
+			stmts = append(stmts, fmt.Sprintf(`SET PROPERTY FOR '%s' 'resource_tags.location' = '%s'`, user, strings.Join(locations, ", ")))
+		}
+	}
+	if len(stmts) == 0 {
+		return nil
+	}
+	return []*Schema{{Name: resourceTagUsers, Type: SchemaTypeResourceTag, CreateStmt: strings.Join(stmts, ";\n")}}
+}
+
+func backendTagStmt(addr, location string) string {
+	return fmt.Sprintf(`ALTER SYSTEM MODIFY BACKEND "%s" SET ("tag.location" = "%s")`, addr, location)
+}
+
+// resourceTagLocations returns the locations of 'resource_tags' property, which is shown as tags or plain locations in Doris versions.
+func resourceTagLocations(value string) []string {
+	if ms := tagLocationRe.FindAllStringSubmatch(value, -1); len(ms) > 0 {
+		return lo.Map(ms, func(m []string, _ int) string { return m[1] })
+	}
+	return lo.Compact(lo.Map(strings.Split(value, ","), func(s string, _ int) string { return strings.TrimSpace(s) }))
+}
+
+// ShowCreateResources returns the resources, like the ones used by catalogs and storage policies.
+func ShowCreateResources(ctx context.Context, conn *sqlx.DB) ([]*Schema, error) {
+	rows, err := showRows(ctx, conn, "SHOW RESOURCES")
+	if err != nil {
+		return nil, err
+	}
+	schemas := resourcesFromRows(rows)
+	lo.ForEach(schemas, func(s *Schema, _ int) { warnMaskedProperties(s) })
+	return schemas, nil
+}
+
+func resourcesFromRows(rows []map[string]string) []*Schema {
+	names, props := []string{}, map[string]map[string]string{}
+	for _, row := range rows {
+		name := row["Name"]
+		if _, ok := props[name]; !ok {
+			names = append(names, name)
+			props[name] = map[string]string{"type": row["ResourceType"]}
+		}
+		if item := row["Item"]; !slices.Contains(resourceIgnoredItems, item) {
+			props[name][item] = row["Value"]
+		}
+	}
+
+	return lo.Map(names, func(name string, _ int) *Schema {
+		stmt := fmt.Sprintf("CREATE RESOURCE `%s` %s", name, propertiesClause(props[name]))
+		return &Schema{Name: name, Type: SchemaTypeResource, CreateStmt: stmt}
+	})
+}
+
+// ShowCreateCatalogs returns the catalogs except the internal one.
+func ShowCreateCatalogs(ctx context.Context, conn *sqlx.DB) ([]*Schema, error) {
+	catalogs, err := ShowCatalogs(ctx, conn, "")
+	if err != nil {
+		return nil, err
+	}
+
+	schemas := []*Schema{}
+	for _, catalog := range catalogs {
+		if catalog == "internal" {
+			continue
+		}
+		r, err := conn.QueryxContext(ctx, fmt.Sprintf(InternalSqlComment+"SHOW CREATE CATALOG `%s`", catalog))
+		if err != nil {
+			return nil, err
+		}
+		stmt, err := getStmtfromShowCreate(r)
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+		s := &Schema{Name: catalog, Type: SchemaTypeCatalog, CreateStmt: stmt}
+		warnMaskedProperties(s)
+		schemas = append(schemas, s)
+	}
+	return schemas, nil
+}
+
+// maskedProperties returns the keys of properties whose secret values are masked in the create statement.
+func maskedProperties(stmt string) []string {
+	return lo.Map(maskedPropertyRe.FindAllStringSubmatch(stmt, -1), func(m []string, _ int) string { return m[1] })
+}
+
+// warnMaskedProperties warns the masked secrets of schema, which can not be dumped and must be filled in before creating.
+func warnMaskedProperties(s *Schema) {
+	if keys := maskedProperties(s.CreateStmt); len(keys) > 0 {
+		logrus.Warnf("%s '%s' has masked properties %v, please fill in the real values in the dumped file before creating", s.Type.Lower(), s.Name, keys)
+	}
+}
+
+// waitRollupJobs waits until the rollup and sync materialized view jobs in db are done,
+// as the next one can not be created on the same table until then.
+func waitRollupJobs(ctx context.Context, conn *sqlx.DB, db string) error {
+	for {
+		rows, err := showRows(ctx, conn, fmt.Sprintf("SHOW ALTER TABLE MATERIALIZED VIEW FROM `%s`", db))
+		if err != nil {
+			return err
+		}
+		if !lo.ContainsBy(rows, func(r map[string]string) bool { return r["State"] != "FINISHED" && r["State"] != "CANCELLED" }) {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// addSchemaStmt adds the statement to the schema of the same name and type, the schema s is added if not exists.
+func addSchemaStmt(schemas []*Schema, s *Schema, stmt string) []*Schema {
+	stmt = strings.TrimSuffix(strings.TrimSpace(stmt), ";")
+	if stmt == "" {
+		return schemas
+	}
+	if exist, ok := lo.Find(schemas, func(e *Schema) bool { return e.Name == s.Name && e.Type == s.Type }); ok {
+		exist.CreateStmt += ";\n" + stmt
+		return schemas
+	}
+	s.CreateStmt = stmt
+	return append(schemas, s)
+}
+
+// propertiesClause returns the 'PROPERTIES (...)' clause in order of keys.
+func propertiesClause(props map[string]string) string {
+	keys := lo.Keys(props)
+	slices.Sort(keys)
+	items := lo.Map(keys, func(k string, _ int) string {
+		return fmt.Sprintf(`  "%s" = "%s"`, k, strings.ReplaceAll(props[k], `"`, `\"`))
+	})
+	return "PROPERTIES (\n" + strings.Join(items, ",\n") + "\n)"
+}
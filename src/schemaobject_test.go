@@ -0,0 +1,167 @@
+package src
+
+import (
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Thearas/dodo/src/parser"
+)
+
+func TestWorkloadGroupsFromRows(t *testing.T) {
+	want := "CREATE WORKLOAD GROUP `g1` PROPERTIES (\n  \"cpu_share\" = \"10\",\n  \"memory_limit\" = \"30%\"\n)"
+
+	// one group per row
+	schemas := workloadGroupsFromRows([]map[string]string{
+		{"Id": "1", "Name": "normal", "cpu_share": "1024"},
+		{"Id": "2", "Name": "g1", "cpu_share": "10", "memory_limit": "30%", "running_query_num": "1", "tag": ""},
+	})
+	require.Len(t, schemas, 1)
+	assert.Equal(t, &Schema{Name: "g1", Type: SchemaTypeWorkloadGroup, CreateStmt: want}, schemas[0])
+
+	// one property per row in old versions
+	schemas = workloadGroupsFromRows([]map[string]string{
+		{"Id": "2", "Name": "g1", "Item": "cpu_share", "Value": "10"},
+		{"Id": "2", "Name": "g1", "Item": "memory_limit", "Value": "30%"},
+	})
+	require.Len(t, schemas, 1)
+	assert.Equal(t, want, schemas[0].CreateStmt)
+}
+
+func TestResourcesFromRows(t *testing.T) {
+	schemas := resourcesFromRows([]map[string]string{
+		{"Name": "jdbc1", "ResourceType": "jdbc", "Item": "user", "Value": "root"},
+		{"Name": "jdbc1", "ResourceType": "jdbc", "Item": "jdbc_url", "Value": "jdbc:mysql://127.0.0.1:3306/db"},
+		{"Name": "s3", "ResourceType": "s3", "Item": "id", "Value": "10001"},
+		{"Name": "s3", "ResourceType": "s3", "Item": "s3.endpoint", "Value": "s3.amazonaws.com"},
+	})
+	require.Len(t, schemas, 2)
+	assert.Equal(t, "CREATE RESOURCE `jdbc1` PROPERTIES (\n  \"jdbc_url\" = \"jdbc:mysql://127.0.0.1:3306/db\",\n  \"type\" = \"jdbc\",\n  \"user\" = \"root\"\n)", schemas[0].CreateStmt)
+	assert.Equal(t, "CREATE RESOURCE `s3` PROPERTIES (\n  \"s3.endpoint\" = \"s3.amazonaws.com\",\n  \"type\" = \"s3\"\n)", schemas[1].CreateStmt)
+}
+
+func TestResourceTagsFromRows(t *testing.T) {
+	schemas := backendTagsFromRows([]map[string]string{
+		{"Host": "10.0.0.1", "HeartbeatPort": "9050", "Tag": `{"location" : "default"}`},
+		{"Host": "10.0.0.2", "HeartbeatPort": "9050", "Tag": `{"compute_group_name" : "g", "location" : "group_a"}`},
+	})
+	require.Len(t, schemas, 1)
+	assert.Equal(t, &Schema{Name: "backends", Type: SchemaTypeResourceTag, CreateStmt: `ALTER SYSTEM MODIFY BACKEND "10.0.0.2:9050" SET ("tag.location" = "group_a")`}, schemas[0])
+
+	schemas = userTagsFromRows([]string{"u1", "u2", "u3"}, map[string][]map[string]string{
+		"u1": {{"Key": "resource_tags", "Value": `{"location" : "group_a"}, {"location" : "group_b"}`}},
+		"u2": {{"Key": "resource_tags.location", "Value": "group_c"}},
+		"u3": {{"Key": "resource_tags", "Value": ""}},
+	})
+	require.Len(t, schemas, 1)
+	assert.Equal(t, "SET PROPERTY FOR 'u1' 'resource_tags.location' = 'group_a, group_b';\nSET PROPERTY FOR 'u2' 'resource_tags.location' = 'group_c'", schemas[0].CreateStmt)
+}
+
+func TestMapBackendTags(t *testing.T) {
+	rows := []map[string]string{
+		{"Host": "10.0.1.1", "HeartbeatPort": "9050", "Tag": `{"location" : "default"}`},
+		{"Host": "10.0.1.2", "HeartbeatPort": "9050", "Tag": `{"location" : "default"}`},
+		{"Host": "10.0.1.3", "HeartbeatPort": "9050", "Tag": `{"location" : "default"}`},
+		{"Host": "10.0.1.4", "HeartbeatPort": "9050", "Tag": `{"location" : "group_x"}`},
+	}
+	mapped := mapBackendTags([]lo.Tuple2[string, string]{
+		lo.T2("10.0.0.1:9050", "group_a"),
+		lo.T2("10.0.1.3:9050", "group_b"), // the same address is kept
+		lo.T2("10.0.0.2:9050", "group_a"), // the last backend in default location is kept
+		lo.T2("10.0.0.3:9050", "group_a"),
+	}, rows)
+	assert.Equal(t, []lo.Tuple2[string, string]{
+		lo.T2("10.0.1.1:9050", "group_a"),
+		lo.T2("10.0.1.3:9050", "group_b"),
+	}, mapped)
+}
+
+func TestMaskedProperties(t *testing.T) {
+	schemas := resourcesFromRows([]map[string]string{
+		{"Name": "jdbc1", "ResourceType": "jdbc", "Item": "user", "Value": "root"},
+		{"Name": "jdbc1", "ResourceType": "jdbc", "Item": "password", "Value": "******"},
+	})
+	require.Len(t, schemas, 1)
+	assert.Equal(t, []string{"password"}, maskedProperties(schemas[0].CreateStmt))
+
+	catalog := "CREATE CATALOG `hive` PROPERTIES (\n\"type\" = \"hms\",\n\"s3.access_key\" = \"ak\",\n\"s3.secret_key\" = \"*XXX\"\n);"
+	assert.Equal(t, []string{"s3.secret_key"}, maskedProperties(catalog))
+	assert.Empty(t, maskedProperties("CREATE CATALOG `es` PROPERTIES (\"type\" = \"es\", \"password\" = \"*pw*\")"))
+}
+
+func TestRowPoliciesFromRows(t *testing.T) {
+	rows := []map[string]string{
+		{"PolicyName": "p1", "DbName": "default_cluster:db1", "TableName": "t1", "OriginStmt": "CREATE ROW POLICY p1 ON db1.t1 AS RESTRICTIVE TO u1 USING (a = 1);"},
+		{"PolicyName": "p1", "DbName": "db1", "TableName": "t1", "OriginStmt": "CREATE ROW POLICY p1 ON db1.t1 AS RESTRICTIVE TO u2 USING (a = 2)"},
+		{"PolicyName": "p2", "DbName": "db1", "TableName": "t2", "OriginStmt": "CREATE ROW POLICY p2 ON db1.t2 AS PERMISSIVE TO u1 USING (b = 1)"},
+		{"PolicyName": "p3", "DbName": "db2", "TableName": "t1", "OriginStmt": "CREATE ROW POLICY p3 ON db2.t1 AS PERMISSIVE TO u1 USING (b = 1)"},
+	}
+
+	schemas := rowPoliciesFromRows(rows, "db1", nil)
+	require.Len(t, schemas, 2)
+	assert.Equal(t, "db1.p1", schemas[0].String())
+	assert.Equal(t, "CREATE ROW POLICY p1 ON db1.t1 AS RESTRICTIVE TO u1 USING (a = 1);\nCREATE ROW POLICY p1 ON db1.t1 AS RESTRICTIVE TO u2 USING (a = 2)", schemas[0].CreateStmt)
+	assert.Equal(t, "db1.p2", schemas[1].String())
+
+	schemas = rowPoliciesFromRows(rows, "db1", []string{"t2"})
+	require.Len(t, schemas, 1)
+	assert.Equal(t, "p2", schemas[0].Name)
+}
+
+func TestRollupIndexesFromRows(t *testing.T) {
+	rows := []map[string]string{
+		{"IndexName": "t", "IndexKeysType": "DUP_KEYS", "Field": "a", "Key": "true"},
+		{"Field": "b", "Key": "false"},
+		{"Field": "c", "Key": "false"},
+		{"IndexName": "r1", "IndexKeysType": "DUP_KEYS", "Field": "b", "Key": "true"},
+		{"Field": "a", "Key": "false"},
+		{"IndexName": "mv1", "IndexKeysType": "AGG_KEYS", "Field": "mv_a", "Key": "true", "DefineExpr": "`a`"},
+		{"Field": "mva_SUM__`c`", "Key": "false", "DefineExpr": "`c`"},
+	}
+
+	indexes := rollupIndexesFromRows("t", rows)
+	require.Len(t, indexes, 2)
+	assert.Equal(t, "`r1` (`b`, `a`) DUPLICATE KEY (`b`)", indexes[0].String())
+	assert.False(t, indexes[0].hasDefineExpr)
+	assert.Equal(t, "mv1", indexes[1].name)
+	assert.True(t, indexes[1].hasDefineExpr)
+}
+
+func TestCreatedSchema(t *testing.T) {
+	tests := []struct {
+		sql      string
+		wantName string
+		wantType SchemaType
+	}{
+		{"CREATE TABLE `t` (a int) DISTRIBUTED BY HASH(a) BUCKETS 1", "t", SchemaTypeTable},
+		{"CREATE VIEW v AS SELECT 1", "v", SchemaTypeView},
+		{"CREATE MATERIALIZED VIEW mtmv BUILD IMMEDIATE REFRESH AUTO ON MANUAL DISTRIBUTED BY RANDOM BUCKETS 1 AS SELECT a FROM t", "mtmv", SchemaTypeMaterializedView},
+		{"CREATE MATERIALIZED VIEW mv1 AS SELECT a, sum(c) FROM t GROUP BY a", "mv1", SchemaTypeRollup},
+		{"ALTER TABLE `t` ADD ROLLUP `r1` (`b`, `a`), `r2` (`c`)", "t", SchemaTypeRollup},
+		{`CREATE FUNCTION my_add(INT, INT) RETURNS INT PROPERTIES ("symbol" = "add", "type" = "JAVA_UDF", "file" = "file:///udf.jar")`, "my_add", SchemaTypeFunction},
+		{"CREATE ALIAS FUNCTION id_masking(INT) WITH PARAMETER(id) AS CONCAT(LEFT(id, 3), '****')", "id_masking", SchemaTypeFunction},
+		{"CREATE ROW POLICY p1 ON db1.t1 AS RESTRICTIVE TO u1 USING (a = 1)", "p1", SchemaTypeRowPolicy},
+		{`CREATE WORKLOAD GROUP g1 PROPERTIES ("cpu_share" = "10")`, "g1", SchemaTypeWorkloadGroup},
+		{`CREATE RESOURCE "jdbc1" PROPERTIES ("type" = "jdbc")`, "jdbc1", SchemaTypeResource},
+		{`CREATE CATALOG hive PROPERTIES ("type" = "hms")`, "hive", SchemaTypeCatalog},
+		{`ALTER SYSTEM MODIFY BACKEND "10.0.0.1:9050" SET ("tag.location" = "group_a")`, "10.0.0.1:9050", SchemaTypeResourceTag},
+		{`SET PROPERTY FOR 'u1' 'resource_tags.location' = 'group_a'`, "u1", SchemaTypeResourceTag},
+		{`SET PROPERTY FOR 'u1' 'max_user_connections' = '100'`, "", ""},
+		{"SELECT 1", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sql, func(t *testing.T) {
+			stmts, err := parser.NewParser("test", tt.sql).Parse()
+			require.NoError(t, err)
+			s, ok := stmts.Statement(0).(*parser.StatementBaseAliasContext)
+			require.True(t, ok)
+
+			name, schemaType, ok := createdSchema(s.StatementBase())
+			assert.Equal(t, tt.wantType != "", ok)
+			assert.Equal(t, tt.wantName, name)
+			assert.Equal(t, tt.wantType, schemaType)
+		})
+	}
+}
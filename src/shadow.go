@@ -0,0 +1,95 @@
+package src
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/sirupsen/logrus"
+)
+
+const shadowFloatTolerance = 1e-6
+
+// ReplayShadow is the shadow target of replay, every sql is also sent to it at the same moment.
+type ReplayShadow struct {
+	Host     string
+	Port     uint16
+	User     string
+	Password string
+	Catalog  string
+	Cluster  string
+
+	// LatencyRatio reports the latency diff if the duration ratio of shadow and primary exceeds it, <= 0 means never.
+	LatencyRatio float64
+}
+
+func (o *ReplayShadow) dbConfig() *mysql.Config {
+	return newReplayDBConfig(o.Host, o.Port, o.User, o.Password)
+}
+
+// executeWithShadow executes the sql on both the primary and the shadow target at the same moment,
+// the shadow result is recorded in the primary one side by side.
+// The sql waits for the concurrency limit of its user and db first.
+func (c *ReplayClient) executeWithShadow(ctx context.Context, s *ReplaySql) (*ReplayResult, *ReplayRows) {
+	release, err := c.limiter.acquire(ctx, s.User, s.Db)
+	if err != nil {
+		return &ReplayResult{Ts: time.Now().Format(replayTsFormat), QueryId: s.QueryId, Err: err.Error()}, nil
+	}
+	defer release()
+
+	if c.shadow == nil {
+		return c.execute(ctx, s)
+	}
+
+	var (
+		shadowResult *ReplayResult
+		shadowRows   *ReplayRows
+		wg           sync.WaitGroup
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		shadowResult, shadowRows = c.shadow.execute(ctx, s)
+	}()
+	result, rows := c.execute(ctx, s)
+	wg.Wait()
+
+	result.Shadow = shadowResult
+	result.ShadowDiff = shadowDiff(result, shadowResult, rows, shadowRows, c.shadowLatencyRatio)
+	if result.ShadowDiff != "" {
+		logrus.Warnf("client %s shadow diff at query_id: %s, %s", c.client, s.QueryId, result.ShadowDiff)
+	}
+	return result, rows
+}
+
+// shadowDiff returns the difference of errors, row counts, hashes (or saved rows), plans and latency.
+func shadowDiff(r1, r2 *ReplayResult, rows1, rows2 *ReplayRows, latencyRatio float64) string {
+	diffs := []string{}
+	if r1.Err != r2.Err {
+		diffs = append(diffs, fmt.Sprintf("err: %q vs %q", r1.Err, r2.Err))
+	}
+	if r1.ReturnRows != r2.ReturnRows {
+		diffs = append(diffs, fmt.Sprintf("rows count: %d vs %d", r1.ReturnRows, r2.ReturnRows))
+	} else if rows1 != nil && rows2 != nil && !rows1.Partial() && !rows2.Partial() {
+		if rd := DiffReplayRows(rows1, rows2, shadowFloatTolerance, false); !rd.Empty() {
+			diffs = append(diffs, fmt.Sprintf("rows not match: %d mismatched, %d missing, %d extra", len(rd.Mismatches), len(rd.Missing), len(rd.Extra)))
+		}
+	} else if r1.ReturnRowsHash != r2.ReturnRowsHash {
+		diffs = append(diffs, "rows hash not match")
+	}
+	if r1.PlanDigest != "" && r2.PlanDigest != "" && r1.PlanDigest != r2.PlanDigest {
+		diffs = append(diffs, fmt.Sprintf("plan: %s vs %s", r1.PlanDigest, r2.PlanDigest))
+	}
+
+	if latencyRatio > 0 {
+		// plus 1ms to avoid dividing by zero
+		ratio := float64(r2.DurationMs+1) / float64(r1.DurationMs+1)
+		if ratio >= latencyRatio || ratio <= 1/latencyRatio {
+			diffs = append(diffs, fmt.Sprintf("latency: %dms vs %dms (x%.2f)", r1.DurationMs, r2.DurationMs, ratio))
+		}
+	}
+	return strings.Join(diffs, "; ")
+}
@@ -0,0 +1,180 @@
+package src
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/zeebo/blake3"
+)
+
+const (
+	AuditLogFormatSQL      = "sql"
+	AuditLogFormatSQLLines = "sql-lines"
+)
+
+// sqlLinesFormat is the plain sql file with one statement per line,
+// it is detected only when no statement is terminated by ';', which is regarded as sqlFileFormat.
+var sqlLinesFormat = &AuditLogFormat{
+	Name: AuditLogFormatSQLLines,
+	Detect: func(lines []string) bool {
+		terminated := false
+		sp := &sqlStmtSplitter{}
+		for _, line := range lines {
+			sp.feed(line, func() { terminated = true })
+			if terminated {
+				return false
+			}
+			sp.stmt.WriteByte('\n')
+		}
+		return len(lines) > 0
+	},
+	IsRecordStart: func([]byte) bool { return true },
+	NewScanner: func(opts AuditLogScanOpts, source string) AuditLogScanner {
+		return newSQLFileScanner(opts, source, true)
+	},
+}
+
+// sqlFileFormat is the plain sql file with statements separated by ';', it is the fallback of format detection.
+var sqlFileFormat = &AuditLogFormat{
+	Name:          AuditLogFormatSQL,
+	Detect:        func([]string) bool { return true },
+	IsRecordStart: func([]byte) bool { return true },
+	NewScanner: func(opts AuditLogScanOpts, source string) AuditLogScanner {
+		return newSQLFileScanner(opts, source, false)
+	},
+}
+
+// SQLFileScanner scans plain sql files.
+//
+// Sql files have no meta, statements of a file are regarded as executed sequentially by one client named by the file,
+// one millisecond apart from the time the scan starts.
+type SQLFileScanner struct {
+	SimpleAuditLogScanner
+
+	source  string
+	perLine bool
+	start   time.Time
+	seq     int
+	db      string
+
+	sqlStmtSplitter
+}
+
+// auditLogSourceName returns the source name of the audit log, which is the file name followed by the hash of its full path,
+// so that the files of the same name in different directories are different sources.
+func auditLogSourceName(path string) string {
+	return fmt.Sprintf("%s-%s", filepath.Base(path), anonymizeHashStr(blake3.New(), filepath.Clean(path))[:8])
+}
+
+func newSQLFileScanner(opts AuditLogScanOpts, source string, perLine bool) *SQLFileScanner {
+	// sql files have no time and duration
+	opts.From, opts.To, opts.QueryMinDurationMs = "", "", 0
+
+	return &SQLFileScanner{
+		SimpleAuditLogScanner: *NewSimpleAuditLogScanner(opts),
+		source:                source,
+		perLine:               perLine,
+	}
+}
+
+func (s *SQLFileScanner) Init() {
+	s.start = time.Now().Truncate(time.Millisecond)
+}
+
+// ScanOne reads a line of statements, statements are terminated by ';' or also by the line end in sql-lines.
+func (s *SQLFileScanner) ScanOne(oneLog []byte) error {
+	s.feed(string(oneLog), s.Flush)
+	if s.perLine {
+		s.Flush()
+	} else {
+		s.stmt.WriteByte('\n')
+	}
+	return nil
+}
+
+// sqlStmtSplitter splits statements by ';', the ones in quotes and comments are ignored.
+type sqlStmtSplitter struct {
+	// the statement being read, with the state of quote and comment
+	stmt         strings.Builder
+	quote        byte
+	blockComment bool
+}
+
+// feed reads a line into the statement being read, flush is called at the end of each statement.
+func (sp *sqlStmtSplitter) feed(line string, flush func()) {
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case sp.blockComment:
+			if c == '*' && i+1 < len(line) && line[i+1] == '/' {
+				sp.blockComment = false
+				sp.stmt.WriteByte(c)
+				i++
+				c = line[i]
+			}
+		case sp.quote != 0:
+			if c == '\\' && i+1 < len(line) {
+				sp.stmt.WriteByte(c)
+				i++
+				c = line[i]
+			} else if c == sp.quote {
+				sp.quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			sp.quote = c
+		case c == '/' && i+1 < len(line) && line[i+1] == '*':
+			sp.blockComment = true
+		case c == '-' && strings.HasPrefix(line[i:], "--"):
+			// single line comment
+			sp.stmt.WriteString(line[i:])
+			return
+		case c == ';':
+			sp.stmt.WriteByte(c)
+			flush()
+			continue
+		}
+		sp.stmt.WriteByte(c)
+	}
+}
+
+func (sp *sqlStmtSplitter) reset() {
+	sp.stmt.Reset()
+	sp.quote, sp.blockComment = 0, false
+}
+
+// Flush adds the statement being read.
+func (s *SQLFileScanner) Flush() {
+	stmt := trimSQLComments(s.stmt.String())
+	s.reset()
+	if stmt == "" || stmt == ";" {
+		return
+	}
+
+	if m := mysqlUseStmtRe.FindStringSubmatch(stmt); m != nil {
+		s.db = m[1]
+	}
+
+	ts := s.start.Add(time.Duration(s.seq) * time.Millisecond)
+	s.seq++
+	s.addRecord(&auditLogRecord{
+		Time:    ts.UTC().Format(replayTsFormat),
+		Client:  s.source,
+		Db:      s.db,
+		QueryId: fmt.Sprintf("%s-%d", s.source, s.seq),
+		Stmt:    stmt,
+		IsQuery: isQueryStmtRe.MatchString(stmt),
+	}, false, false)
+}
+
+// trimSQLComments trims spaces and the leading single line comments of the statement.
+func trimSQLComments(stmt string) string {
+	for {
+		stmt = strings.TrimSpace(stmt)
+		if !strings.HasPrefix(stmt, "--") {
+			return stmt
+		}
+		_, stmt, _ = strings.Cut(stmt, "\n")
+	}
+}
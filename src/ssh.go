@@ -1,7 +1,11 @@
 package src
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"net/url"
 	"os"
 	"path"
@@ -35,6 +39,31 @@ func sshClientConfig(remoteUrl, privKey string) (cfg *ssh.ClientConfig, host, us
 	return &clientConfig, host, user, urlParsed.Path, nil
 }
 
+// sshDial connects to the remote server of url, falls back to private key authentication if the password one fails.
+func sshDial(remoteUrl, privKey string) (*ssh.Client, string, error) {
+	clientConfig, host, user, remotePath, err := sshClientConfig(remoteUrl, privKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	client, err := ssh.Dial("tcp", host, clientConfig)
+	if err == nil {
+		return client, remotePath, nil
+	}
+	logrus.Debugln("couldn't establish ssh to the remote server, try using private key authentication", err)
+
+	cfg, err_ := auth.PrivateKey(user, privKey, ssh.InsecureIgnoreHostKey())
+	if err_ != nil {
+		return nil, "", err
+	}
+	client, err_ = ssh.Dial("tcp", host, &cfg)
+	if err_ != nil {
+		logrus.Debugln("couldn't establish ssh to the remote server again with private key", err_)
+		return nil, "", err
+	}
+	return client, remotePath, nil
+}
+
 func SshLs(_ context.Context, privKey, remoteUrl string) ([]string, error) {
 	clientConfig, host, _, remotePath, err := sshClientConfig(remoteUrl, privKey)
 	if err != nil {
@@ -114,3 +143,116 @@ func ScpFromRemote(ctx context.Context, privKey, remoteUrl, localPath string) er
 
 	return nil
 }
+
+// SshGlob returns the urls of remote files matching the glob pattern in remoteUrl.
+func SshGlob(_ context.Context, privKey, remoteUrl string) ([]string, error) {
+	u, err := url.Parse(remoteUrl)
+	if err != nil {
+		return nil, err
+	}
+	client, pattern, err := sshDial(remoteUrl, privKey)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	// the pattern is not quoted, so that it is expanded by the remote shell
+	out, err := session.Output("ls -1d -- " + strings.ReplaceAll(pattern, " ", `\ `))
+	if err != nil {
+		return nil, fmt.Errorf("no remote file matches %s: %v", pattern, err)
+	}
+
+	urls := []string{}
+	for _, p := range strings.Split(string(out), "\n") {
+		if p = strings.TrimSpace(p); p != "" {
+			u.Path = p
+			urls = append(urls, u.String())
+		}
+	}
+	return urls, nil
+}
+
+// SshCat reads a file on the remote server as a stream, without downloading it to local.
+// The remote 'cat' is stopped when ctx is done.
+//
+//	privKey is the path to the private key to use for authentication.
+//	remoteUrl is the address of file on the remote server, format user@host:port/path.
+func SshCat(ctx context.Context, privKey, remoteUrl string) (io.ReadCloser, error) {
+	client, remotePath, err := sshDial(remoteUrl, privKey)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		client.Close()
+		return nil, err
+	}
+	r := &sshFileReader{Reader: stdout, ctx: ctx, path: remotePath, client: client, session: session}
+	session.Stderr = &r.stderr
+	if err := session.Start("cat -- " + shellQuote(remotePath)); err != nil {
+		session.Close()
+		client.Close()
+		return nil, err
+	}
+	r.stop = context.AfterFunc(ctx, func() {
+		session.Close()
+		client.Close()
+	})
+	return r, nil
+}
+
+// sshFileReader reads the stdout of remote 'cat', the error of command is returned at the end of file.
+type sshFileReader struct {
+	io.Reader
+	ctx     context.Context
+	stop    func() bool
+	path    string
+	client  *ssh.Client
+	session *ssh.Session
+	stderr  bytes.Buffer
+	waitErr error
+	waited  bool
+}
+
+func (r *sshFileReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if !errors.Is(err, io.EOF) {
+		return n, err
+	}
+	if !r.waited {
+		r.waited = true
+		if cerr := r.ctx.Err(); cerr != nil {
+			// the session is closed by canceling, the stdout ends early
+			r.waitErr = fmt.Errorf("read remote file %s canceled: %w", r.path, cerr)
+		} else if werr := r.session.Wait(); werr != nil {
+			r.waitErr = fmt.Errorf("read remote file %s failed: %v, %s", r.path, werr, strings.TrimSpace(r.stderr.String()))
+		}
+	}
+	if r.waitErr != nil {
+		return n, r.waitErr
+	}
+	return n, err
+}
+
+func (r *sshFileReader) Close() error {
+	r.stop()
+	r.session.Close()
+	return r.client.Close()
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
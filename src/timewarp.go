@@ -0,0 +1,107 @@
+package src
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Thearas/dodo/src/parser"
+)
+
+// ReplayTimeWarpNow shifts the time literals of each sql by the duration between the replay time and its original time.
+const ReplayTimeWarpNow = "now"
+
+// ReplayTimeWarp shifts the date and datetime literals of sqls, so that the replayed sqls hit the same relative data windows.
+type ReplayTimeWarp struct {
+	// Offset is the fixed offset of all sqls, date literals are shifted by the whole days of it.
+	Offset time.Duration
+	// Relative shifts the literals of each sql by the duration between the replay time and its original time, Offset is ignored.
+	Relative bool
+}
+
+// ParseReplayTimeWarp parses the time warp like 'now', '720h' or '-90d'.
+func ParseReplayTimeWarp(s string) (*ReplayTimeWarp, error) {
+	if s == ReplayTimeWarpNow {
+		return &ReplayTimeWarp{Relative: true}, nil
+	}
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time warp '%s': %w", s, err)
+		}
+		return &ReplayTimeWarp{Offset: time.Duration(n) * 24 * time.Hour}, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time warp '%s', should be '%s' or an offset like '720h', '-90d'", s, ReplayTimeWarpNow)
+	}
+	return &ReplayTimeWarp{Offset: d}, nil
+}
+
+// warpFunc returns the function to shift the time literals of the sql.
+func (w *ReplayTimeWarp) warpFunc(s *ReplaySql) func(t time.Time, dateOnly bool) time.Time {
+	offset, days := w.Offset, int(w.Offset/(24*time.Hour))
+	if w.Relative {
+		ts, err := s.Timestamp()
+		if err != nil {
+			return nil
+		}
+		// the original time is the wall clock of FE, compare it with the wall clock of now
+		now := time.Now()
+		_, zoneOffset := now.Zone()
+		wallNow := now.UTC().Add(time.Duration(zoneOffset) * time.Second)
+		original := time.UnixMilli(ts).UTC()
+
+		offset = wallNow.Sub(original)
+		days = int(wallNow.Truncate(24*time.Hour).Sub(original.Truncate(24*time.Hour)) / (24 * time.Hour))
+	}
+	if offset == 0 {
+		return nil
+	}
+
+	return func(t time.Time, dateOnly bool) time.Time {
+		if dateOnly {
+			return t.AddDate(0, 0, days)
+		}
+		return t.Add(offset)
+	}
+}
+
+// warp returns the sql with shifted time literals, or the original one if nothing changed.
+func (w *ReplayTimeWarp) warp(s *ReplaySql) *ReplaySql {
+	warp := w.warpFunc(s)
+	if warp == nil {
+		return s
+	}
+
+	stmt, err := parser.WarpTimeLiterals(s.QueryId, s.Stmt, warp)
+	if err != nil {
+		logrus.Debugf("skip time warp of sql can not be parsed at query_id: %s, err: %v", s.QueryId, err)
+		return s
+	}
+
+	var params []string
+	for i, p := range s.Params {
+		if warped, ok := parser.WarpTimeLiteral(p, warp); ok {
+			if params == nil {
+				params = slices.Clone(s.Params)
+			}
+			params[i] = warped
+		}
+	}
+	if stmt == s.Stmt && params == nil {
+		return s
+	}
+	logrus.Traceln("time warp at query_id:", s.QueryId, "to:", stmt, params)
+
+	warped := *s
+	warped.Stmt = stmt
+	if params != nil {
+		warped.Params = params
+	}
+	return &warped
+}
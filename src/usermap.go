@@ -0,0 +1,183 @@
+package src
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// ReplayUser is the replay credential and settings of an original user.
+type ReplayUser struct {
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	// WorkloadGroup is set to session variable 'workload_group' after connected, empty means not setting.
+	WorkloadGroup string `yaml:"workload_group"`
+	// MaxConcurrency is the max concurrent sqls of the user, overrides '--max-concurrency-per-user'.
+	MaxConcurrency int `yaml:"max_concurrency"`
+}
+
+// ReplayDB is the replay settings of an original database.
+type ReplayDB struct {
+	// MaxConcurrency is the max concurrent sqls of the database, overrides '--max-concurrency-per-db'.
+	MaxConcurrency int `yaml:"max_concurrency"`
+}
+
+// ReplayUserMap maps the original users to replay credentials, like:
+//
+//	users:
+//	  alice: {user: staging_alice, password: xxx, workload_group: wg_a, max_concurrency: 4}
+//	  bob: {workload_group: wg_b}
+//	dbs:
+//	  db1: {max_concurrency: 8}
+//
+// The users without mapped credentials are replayed by the default credential ('--user' and '--password').
+type ReplayUserMap struct {
+	Users map[string]*ReplayUser `yaml:"users"`
+	DBs   map[string]*ReplayDB   `yaml:"dbs"`
+
+	fallback *ReplayUser
+}
+
+// ReadReplayUserMap reads the user map from the yaml file.
+func ReadReplayUserMap(path string) (*ReplayUserMap, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := &ReplayUserMap{}
+	if err := yaml.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("invalid replay user map '%s': %w", path, err)
+	}
+	for name, u := range m.Users {
+		if u == nil {
+			return nil, fmt.Errorf("invalid replay user map '%s': user '%s' is empty", path, name)
+		}
+	}
+	return m, nil
+}
+
+// complete fills the users without mapped credentials with the default credential.
+func (m *ReplayUserMap) complete(user, password string) {
+	for _, u := range m.Users {
+		if u.User == "" {
+			u.User, u.Password = user, password
+		}
+	}
+	m.fallback = &ReplayUser{User: user, Password: password}
+}
+
+// lookup returns the replay user of the original user.
+func (m *ReplayUserMap) lookup(user string) *ReplayUser {
+	if u, ok := m.Users[user]; ok {
+		return u
+	}
+	return m.fallback
+}
+
+// switchUser switches the connection to the credential of the original user, reconnects if it is changed.
+func (c *ReplayClient) switchUser(user string) {
+	if c.users == nil || (c.connect != nil && user == c.user) {
+		return
+	}
+	c.user = user
+
+	u := c.users.lookup(user)
+	if u.User == c.dbcfg.User && u.Password == c.dbcfg.Passwd && u.WorkloadGroup == c.workloadGroup {
+		return
+	}
+	if c.connect != nil {
+		logrus.Traceln("client", c.client, "switching to user", u.User, "for original user", user)
+		c.Close(false)
+	}
+	c.dbcfg.User, c.dbcfg.Passwd, c.workloadGroup = u.User, u.Password, u.WorkloadGroup
+}
+
+// replayLimiter limits the concurrent sqls per original user and database.
+type replayLimiter struct {
+	perUser, perDB int
+	users          *ReplayUserMap
+
+	mu   sync.Mutex
+	sems map[string]chan struct{}
+}
+
+func newReplayLimiter(perUser, perDB int, users *ReplayUserMap) *replayLimiter {
+	if perUser <= 0 && perDB <= 0 && !users.hasConcurrency() {
+		return nil
+	}
+	return &replayLimiter{perUser: perUser, perDB: perDB, users: users, sems: map[string]chan struct{}{}}
+}
+
+func (m *ReplayUserMap) hasConcurrency() bool {
+	if m == nil {
+		return false
+	}
+	for _, u := range m.Users {
+		if u.MaxConcurrency > 0 {
+			return true
+		}
+	}
+	for _, d := range m.DBs {
+		if d != nil && d.MaxConcurrency > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// acquire waits until both the user and db of sql are under the limit,
+// the user is always acquired before the db, so that there is no deadlock.
+func (l *replayLimiter) acquire(ctx context.Context, user, db string) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	userLimit, dbLimit := l.perUser, l.perDB
+	if l.users != nil {
+		if u, ok := l.users.Users[user]; ok && u.MaxConcurrency > 0 {
+			userLimit = u.MaxConcurrency
+		}
+		if d, ok := l.users.DBs[db]; ok && d != nil && d.MaxConcurrency > 0 {
+			dbLimit = d.MaxConcurrency
+		}
+	}
+
+	acquired := make([]chan struct{}, 0, 2)
+	release = func() {
+		for _, sem := range acquired {
+			<-sem
+		}
+	}
+	for _, key := range []struct {
+		name  string
+		limit int
+	}{{"user:" + user, userLimit}, {"db:" + db, dbLimit}} {
+		if key.limit <= 0 {
+			continue
+		}
+		sem := l.sem(key.name, key.limit)
+		select {
+		case <-ctx.Done():
+			release()
+			return nil, ctx.Err()
+		case sem <- struct{}{}:
+			acquired = append(acquired, sem)
+		}
+	}
+	return release, nil
+}
+
+func (l *replayLimiter) sem(key string, limit int) chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	sem, ok := l.sems[key]
+	if !ok {
+		sem = make(chan struct{}, limit)
+		l.sems[key] = sem
+	}
+	return sem
+}